@@ -15,31 +15,55 @@
 package ip
 
 import (
+	"bytes"
 	"math/big"
 	"net"
 )
 
 // NextIP returns IP incremented by 1
 func NextIP(ip net.IP) net.IP {
-	i := ipToInt(ip)
-	return intToIP(i.Add(i, big.NewInt(1)))
+	i := ToInt(ip)
+	return FromInt(i.Add(i, big.NewInt(1)), ip.To4() != nil)
 }
 
 // PrevIP returns IP decremented by 1
 func PrevIP(ip net.IP) net.IP {
-	i := ipToInt(ip)
-	return intToIP(i.Sub(i, big.NewInt(1)))
+	i := ToInt(ip)
+	return FromInt(i.Sub(i, big.NewInt(1)), ip.To4() != nil)
 }
 
-func ipToInt(ip net.IP) *big.Int {
+// Cmp compares two IPs numerically, returning -1, 0 or +1 like
+// bytes.Compare. IPv4 addresses compare in their 16-byte form.
+func Cmp(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// ToInt returns the IP as an unsigned integer
+func ToInt(ip net.IP) *big.Int {
 	if v := ip.To4(); v != nil {
 		return big.NewInt(0).SetBytes(v)
 	}
 	return big.NewInt(0).SetBytes(ip.To16())
 }
 
-func intToIP(i *big.Int) net.IP {
-	return net.IP(i.Bytes())
+// FromInt converts i back to an IP of the given family, restoring
+// the leading zero bytes dropped by big.Int and wrapping any value
+// outside the address width
+func FromInt(i *big.Int, v4 bool) net.IP {
+	length := net.IPv6len
+	if v4 {
+		length = net.IPv4len
+	}
+	if i.Sign() < 0 {
+		i = new(big.Int).Add(i, new(big.Int).Lsh(big.NewInt(1), uint(8*length)))
+	}
+	b := i.Bytes()
+	if len(b) > length {
+		b = b[len(b)-length:]
+	}
+	ip := make(net.IP, length)
+	copy(ip[length-len(b):], b)
+	return ip
 }
 
 // Network masks off the host portion of the IP
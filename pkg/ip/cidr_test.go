@@ -0,0 +1,82 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"math/big"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CIDR helpers", func() {
+	Describe("NextIP", func() {
+		It("increments addresses with leading zero bytes", func() {
+			Expect(NextIP(net.ParseIP("0.0.0.1")).String()).To(Equal("0.0.0.2"))
+			Expect(NextIP(net.ParseIP("::1")).String()).To(Equal("::2"))
+		})
+
+		It("carries across byte boundaries", func() {
+			Expect(NextIP(net.ParseIP("10.0.0.255")).String()).To(Equal("10.0.1.0"))
+			Expect(NextIP(net.ParseIP("fd00::ff")).String()).To(Equal("fd00::100"))
+		})
+
+		It("wraps at the top of the address space", func() {
+			Expect(NextIP(net.ParseIP("255.255.255.255")).String()).To(Equal("0.0.0.0"))
+			Expect(NextIP(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")).String()).To(Equal("::"))
+		})
+
+		It("keeps IPv4 addresses 4 bytes long", func() {
+			// net.ParseIP returns the 16-byte form
+			Expect(NextIP(net.ParseIP("10.0.0.1"))).To(HaveLen(net.IPv4len))
+			Expect(NextIP(net.ParseIP("255.255.255.255"))).To(HaveLen(net.IPv4len))
+			Expect(NextIP(net.ParseIP("::1"))).To(HaveLen(net.IPv6len))
+		})
+	})
+
+	Describe("PrevIP", func() {
+		It("decrements addresses with leading zero bytes", func() {
+			Expect(PrevIP(net.ParseIP("0.0.0.2")).String()).To(Equal("0.0.0.1"))
+			Expect(PrevIP(net.ParseIP("::1")).String()).To(Equal("::"))
+		})
+
+		It("wraps at the bottom of the address space", func() {
+			Expect(PrevIP(net.ParseIP("0.0.0.0")).String()).To(Equal("255.255.255.255"))
+			Expect(PrevIP(net.ParseIP("::")).String()).To(Equal("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+		})
+	})
+
+	Describe("Cmp", func() {
+		It("orders addresses numerically", func() {
+			Expect(Cmp(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.10"))).To(Equal(-1))
+			Expect(Cmp(net.ParseIP("10.0.1.0"), net.ParseIP("10.0.0.255"))).To(Equal(1))
+			Expect(Cmp(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.1"))).To(Equal(0))
+		})
+	})
+
+	Describe("ToInt and FromInt", func() {
+		It("round-trip addresses of both families", func() {
+			for _, s := range []string{"0.0.0.0", "10.0.0.1", "::", "::1", "fd00::1:0"} {
+				addr := net.ParseIP(s)
+				Expect(FromInt(ToInt(addr), addr.To4() != nil).String()).To(Equal(s))
+			}
+		})
+
+		It("converts IPv4 addresses to 32-bit values", func() {
+			Expect(ToInt(net.ParseIP("0.0.1.1"))).To(Equal(big.NewInt(257)))
+		})
+	})
+})
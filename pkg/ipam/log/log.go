@@ -0,0 +1,141 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package log is a small leveled logger for IPAM plugins. Every entry is
+// written as a single line of JSON so that allocation problems can be
+// traced by container ID, IP or network in the plugin's stderr.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// DefaultLevel keeps plugins quiet unless something went wrong, since
+// runtimes often capture plugin stderr
+const DefaultLevel = LevelWarn
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel parses a level name, returning DefaultLevel for ""
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return DefaultLevel, nil
+	}
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes entries at or above its level to w, tagged with its
+// fields
+type Logger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  Level
+	fields map[string]string
+}
+
+// New creates a Logger writing to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+// NewStderr creates a Logger writing to stderr, where CNI expects plugin
+// diagnostics
+func NewStderr(level Level) *Logger {
+	return New(os.Stderr, level)
+}
+
+// With returns a Logger that adds the given field, such as
+// "containerID", "ip" or "network", to every entry
+func (l *Logger) With(key, value string) *Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{mu: l.mu, w: l.w, level: l.level, fields: fields}
+}
+
+// Enabled reports whether entries at level are written, so that callers
+// can skip gathering fields that would only be logged at that level
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	entry := make(map[string]string, len(l.fields)+2)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["level"] = level.String()
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
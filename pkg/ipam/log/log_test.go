@@ -0,0 +1,98 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var buf *bytes.Buffer
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+	})
+
+	entries := func() []map[string]string {
+		var out []map[string]string
+		dec := json.NewDecoder(buf)
+		for dec.More() {
+			var e map[string]string
+			Expect(dec.Decode(&e)).To(Succeed())
+			out = append(out, e)
+		}
+		return out
+	}
+
+	It("writes one JSON line per entry with its fields", func() {
+		l := New(buf, LevelDebug).With("network", "net1").With("containerID", "ID")
+		l.Infof("reserved %s", "10.0.0.2")
+
+		Expect(buf.String()).To(HaveSuffix("}\n"))
+		Expect(bytes.Count(buf.Bytes(), []byte("\n"))).To(Equal(1))
+		Expect(entries()).To(Equal([]map[string]string{{
+			"level":       "info",
+			"msg":         "reserved 10.0.0.2",
+			"network":     "net1",
+			"containerID": "ID",
+		}}))
+	})
+
+	It("drops entries below its level", func() {
+		l := New(buf, LevelWarn)
+		l.Debugf("debug")
+		l.Infof("info")
+		l.Warnf("warn")
+		l.Errorf("error")
+
+		var msgs []string
+		for _, e := range entries() {
+			msgs = append(msgs, e["msg"])
+		}
+		Expect(msgs).To(Equal([]string{"warn", "error"}))
+	})
+
+	It("reports which levels are enabled", func() {
+		l := New(buf, LevelInfo)
+		Expect(l.Enabled(LevelDebug)).To(BeFalse())
+		Expect(l.Enabled(LevelInfo)).To(BeTrue())
+		Expect(l.Enabled(LevelError)).To(BeTrue())
+	})
+
+	It("does not share fields between derived loggers", func() {
+		base := New(buf, LevelDebug)
+		base.With("ip", "10.0.0.2")
+		base.Infof("plain")
+
+		Expect(entries()[0]).ToNot(HaveKey("ip"))
+	})
+
+	It("parses level names", func() {
+		l, err := ParseLevel("debug")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l).To(Equal(LevelDebug))
+
+		l, err = ParseLevel("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l).To(Equal(DefaultLevel))
+
+		_, err = ParseLevel("loud")
+		Expect(err).To(MatchError(`unknown log level "loud"`))
+	})
+})
@@ -0,0 +1,57 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics renders IPAM pool utilization in the Prometheus text
+// exposition format, for exporters that poll the IPAM stores of a host.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Pool is the utilization of the address pool of one network
+type Pool struct {
+	Network string
+	Total   int
+	Used    int
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write renders the pools as two gauges, cni_ipam_addresses_total and
+// cni_ipam_addresses_used, labelled by network name
+func Write(w io.Writer, pools []Pool) error {
+	gauges := []struct {
+		name  string
+		help  string
+		value func(Pool) int
+	}{
+		{"cni_ipam_addresses_total", "Number of allocatable addresses in the pool.", func(p Pool) int { return p.Total }},
+		{"cni_ipam_addresses_used", "Number of reserved addresses in the pool.", func(p Pool) int { return p.Used }},
+	}
+
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name); err != nil {
+			return err
+		}
+		for _, p := range pools {
+			if _, err := fmt.Fprintf(w, "%s{network=\"%s\"} %d\n", g.name, labelEscaper.Replace(p.Network), g.value(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
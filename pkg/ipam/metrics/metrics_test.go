@@ -0,0 +1,48 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write", func() {
+	It("renders each pool in the text exposition format", func() {
+		var buf bytes.Buffer
+		err := Write(&buf, []Pool{
+			{Network: "a", Total: 253, Used: 10},
+			{Network: "b", Total: 5, Used: 5},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.String()).To(Equal(`# HELP cni_ipam_addresses_total Number of allocatable addresses in the pool.
+# TYPE cni_ipam_addresses_total gauge
+cni_ipam_addresses_total{network="a"} 253
+cni_ipam_addresses_total{network="b"} 5
+# HELP cni_ipam_addresses_used Number of reserved addresses in the pool.
+# TYPE cni_ipam_addresses_used gauge
+cni_ipam_addresses_used{network="a"} 10
+cni_ipam_addresses_used{network="b"} 5
+`))
+	})
+
+	It("escapes network names in labels", func() {
+		var buf bytes.Buffer
+		Expect(Write(&buf, []Pool{{Network: "a\"b\\c\nd", Total: 1}})).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(`cni_ipam_addresses_total{network="a\"b\\c\nd"} 1`))
+	})
+})
@@ -23,6 +23,7 @@ import (
 	"os"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 // CmdArgs captures all the arguments passed in to the plugin
@@ -39,8 +40,16 @@ type CmdArgs struct {
 type reqForCmdEntry map[string]bool
 
 // PluginMain is the "main" for a plugin. It accepts
-// two callback functions for add and del commands.
-func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
+// callback functions for add, check and del commands.
+// cmdCheck may be nil for plugins that do not implement CHECK.
+// The VERSION command reports version.Legacy.
+func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error) {
+	PluginMainWithVersions(cmdAdd, cmdCheck, cmdDel, version.Legacy)
+}
+
+// PluginMainWithVersions is PluginMain for plugins that advertise the
+// spec versions in versionInfo on the VERSION command.
+func PluginMainWithVersions(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) {
 	var cmd, contID, netns, ifName, args, path string
 
 	vars := []struct {
@@ -52,48 +61,54 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 			"CNI_COMMAND",
 			&cmd,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 		{
 			"CNI_CONTAINERID",
 			&contID,
 			reqForCmdEntry{
-				"ADD": false,
-				"DEL": false,
+				"ADD":   false,
+				"CHECK": false,
+				"DEL":   false,
 			},
 		},
 		{
 			"CNI_NETNS",
 			&netns,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": false,
+				"ADD":   true,
+				"CHECK": true,
+				"DEL":   false,
 			},
 		},
 		{
 			"CNI_IFNAME",
 			&ifName,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 		{
 			"CNI_ARGS",
 			&args,
 			reqForCmdEntry{
-				"ADD": false,
-				"DEL": false,
+				"ADD":   false,
+				"CHECK": false,
+				"DEL":   false,
 			},
 		},
 		{
 			"CNI_PATH",
 			&path,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 	}
@@ -111,6 +126,14 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 		dieMsg("required env variables missing")
 	}
 
+	// VERSION takes no arguments, so don't wait for stdin
+	if cmd == "VERSION" {
+		if err := versionInfo.Encode(os.Stdout); err != nil {
+			dieMsg("error writing version info: %v", err)
+		}
+		return
+	}
+
 	stdinData, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		dieMsg("error reading from stdin: %v", err)
@@ -129,6 +152,12 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 	case "ADD":
 		err = cmdAdd(cmdArgs)
 
+	case "CHECK":
+		if cmdCheck == nil {
+			dieMsg("plugin does not support CNI_COMMAND: %v", cmd)
+		}
+		err = cmdCheck(cmdArgs)
+
 	case "DEL":
 		err = cmdDel(cmdArgs)
 
@@ -141,7 +170,7 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 			// don't wrap Error in Error
 			dieErr(e)
 		}
-		dieMsg(err.Error())
+		dieMsg("%s", err.Error())
 	}
 }
 
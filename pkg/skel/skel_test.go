@@ -49,35 +49,41 @@ var _ = Describe("Skel", func() {
 		It("should not fail with ADD and noop callback", func() {
 			err := os.Setenv("CNI_COMMAND", "ADD")
 			Expect(err).NotTo(HaveOccurred())
-			PluginMain(fNoop, nil)
+			PluginMain(fNoop, nil, nil)
 		})
 
 		// TODO: figure out howto mock printing and os.Exit()
 		// It("should fail with ADD and error callback", func() {
 		// 	err := os.Setenv("CNI_COMMAND", "ADD")
 		// 	Expect(err).NotTo(HaveOccurred())
-		// 	PluginMain(fErr, nil)
+		// 	PluginMain(fErr, nil, nil)
 		// })
 
 		It("should not fail with DEL and noop callback", func() {
 			err := os.Setenv("CNI_COMMAND", "DEL")
 			Expect(err).NotTo(HaveOccurred())
-			PluginMain(nil, fNoop)
+			PluginMain(nil, nil, fNoop)
 		})
 
 		// TODO: figure out howto mock printing and os.Exit()
 		// It("should fail with DEL and error callback", func() {
 		// 	err := os.Setenv("CNI_COMMAND", "DEL")
 		// 	Expect(err).NotTo(HaveOccurred())
-		// 	PluginMain(fErr, nil)
+		// 	PluginMain(fErr, nil, nil)
 		// })
 
+		It("should not fail with CHECK and noop callback", func() {
+			err := os.Setenv("CNI_COMMAND", "CHECK")
+			Expect(err).NotTo(HaveOccurred())
+			PluginMain(nil, fNoop, nil)
+		})
+
 		It("should not fail with DEL and no NETNS and noop callback", func() {
 			err := os.Setenv("CNI_COMMAND", "DEL")
 			Expect(err).NotTo(HaveOccurred())
 			err = os.Unsetenv("CNI_NETNS")
 			Expect(err).NotTo(HaveOccurred())
-			PluginMain(nil, fNoop)
+			PluginMain(nil, nil, fNoop)
 		})
 
 	})
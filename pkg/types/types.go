@@ -105,9 +105,17 @@ type DNS struct {
 	Options     []string `json:"options,omitempty"`
 }
 
+func (d *DNS) empty() bool {
+	return len(d.Nameservers) == 0 && d.Domain == "" && len(d.Search) == 0 && len(d.Options) == 0
+}
+
 type Route struct {
 	Dst net.IPNet
 	GW  net.IP
+	// MTU and Metric are optional hints for the route, left out of the
+	// JSON form if zero
+	MTU    int
+	Metric int
 }
 
 type Error struct {
@@ -135,8 +143,29 @@ type ipConfig struct {
 }
 
 type route struct {
-	Dst IPNet  `json:"dst"`
-	GW  net.IP `json:"gw,omitempty"`
+	Dst    IPNet  `json:"dst"`
+	GW     net.IP `json:"gw,omitempty"`
+	MTU    int    `json:"mtu,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+// result holds DNS by pointer so that an empty DNS block is omitted
+type result struct {
+	IP4 *IPConfig `json:"ip4,omitempty"`
+	IP6 *IPConfig `json:"ip6,omitempty"`
+	DNS *DNS      `json:"dns,omitempty"`
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	res := result{
+		IP4: r.IP4,
+		IP6: r.IP6,
+	}
+	if !r.DNS.empty() {
+		res.DNS = &r.DNS
+	}
+
+	return json.Marshal(res)
 }
 
 func (c *IPConfig) MarshalJSON() ([]byte, error) {
@@ -169,13 +198,17 @@ func (r *Route) UnmarshalJSON(data []byte) error {
 
 	r.Dst = net.IPNet(rt.Dst)
 	r.GW = rt.GW
+	r.MTU = rt.MTU
+	r.Metric = rt.Metric
 	return nil
 }
 
 func (r *Route) MarshalJSON() ([]byte, error) {
 	rt := route{
-		Dst: IPNet(r.Dst),
-		GW:  r.GW,
+		Dst:    IPNet(r.Dst),
+		GW:     r.GW,
+		MTU:    r.MTU,
+		Metric: r.Metric,
 	}
 
 	return json.Marshal(rt)
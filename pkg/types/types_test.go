@@ -0,0 +1,126 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	"encoding/json"
+	"net"
+
+	. "github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Result MarshalJSON", func() {
+	ipConfig := &IPConfig{
+		IP: net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+	}
+
+	It("omits an empty DNS block", func() {
+		data, err := json.Marshal(&Result{IP4: ipConfig})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"ip4":{"ip":"10.0.0.2/24"}}`))
+	})
+
+	It("includes the configured DNS fields", func() {
+		data, err := json.Marshal(Result{
+			IP4: ipConfig,
+			DNS: DNS{
+				Nameservers: []string{"10.0.0.53"},
+				Domain:      "example.com",
+				Search:      []string{"example.com"},
+				Options:     []string{"ndots:2"},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"ip4":{"ip":"10.0.0.2/24"},"dns":{"nameservers":["10.0.0.53"],"domain":"example.com","search":["example.com"],"options":["ndots:2"]}}`))
+	})
+
+	It("round-trips through UnmarshalJSON", func() {
+		in := Result{IP4: ipConfig, DNS: DNS{Nameservers: []string{"10.0.0.53"}}}
+		data, err := json.Marshal(in)
+		Expect(err).ToNot(HaveOccurred())
+
+		var out Result
+		Expect(json.Unmarshal(data, &out)).To(Succeed())
+		Expect(out.IP4.IP.String()).To(Equal("10.0.0.2/24"))
+		Expect(out.DNS).To(Equal(in.DNS))
+	})
+})
+
+var _ = Describe("Route JSON", func() {
+	It("round-trips the MTU and metric hints", func() {
+		var r Route
+		Expect(json.Unmarshal([]byte(`{"dst":"0.0.0.0/0","gw":"10.0.0.1","mtu":1450,"metric":100}`), &r)).To(Succeed())
+		Expect(r.Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(r.MTU).To(Equal(1450))
+		Expect(r.Metric).To(Equal(100))
+
+		data, err := json.Marshal(&r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"dst":"0.0.0.0/0","gw":"10.0.0.1","mtu":1450,"metric":100}`))
+	})
+
+	It("leaves out hints that are not set", func() {
+		var r Route
+		Expect(json.Unmarshal([]byte(`{"dst":"10.1.0.0/16"}`), &r)).To(Succeed())
+		data, err := json.Marshal(&r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"dst":"10.1.0.0/16"}`))
+	})
+})
+
+var _ = Describe("Result MarshalVersion", func() {
+	r := &Result{
+		IP4: &IPConfig{
+			IP:      net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+			Gateway: net.ParseIP("10.0.0.1"),
+			Routes:  []Route{{Dst: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}}},
+		},
+		IP6: &IPConfig{
+			IP: net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		},
+	}
+
+	It("keeps the ip4 and ip6 layout for the older versions", func() {
+		for _, v := range []string{"", "0.1.0", "0.2.0"} {
+			data, err := r.MarshalVersion(v)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(MatchJSON(`{
+				"ip4": {"ip": "10.0.0.2/24", "gateway": "10.0.0.1", "routes": [{"dst": "0.0.0.0/0"}]},
+				"ip6": {"ip": "fd00::2/64"}
+			}`))
+		}
+	})
+
+	It("lists the addresses under ips for 0.3.0", func() {
+		data, err := r.MarshalVersion("0.3.0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(MatchJSON(`{
+			"cniVersion": "0.3.0",
+			"ips": [
+				{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"},
+				{"version": "6", "address": "fd00::2/64"}
+			],
+			"routes": [{"dst": "0.0.0.0/0"}]
+		}`))
+	})
+
+	It("rejects an unsupported version", func() {
+		_, err := r.MarshalVersion("0.4.0")
+		Expect(err).To(MatchError(`unsupported CNI version "0.4.0", supported versions are [0.1.0 0.2.0 0.3.0]`))
+	})
+})
@@ -0,0 +1,102 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// ResultVersions are the spec versions a Result can be printed in,
+// oldest first. 0.1.0 and 0.2.0 share the ip4/ip6 layout; 0.3.0 lists
+// the addresses under "ips" and hoists the routes to the top level.
+var ResultVersions = []string{"0.1.0", "0.2.0", "0.3.0"}
+
+// CheckVersion returns an error unless a Result can be printed in spec
+// version v. An empty version stands for the original spec.
+func CheckVersion(v string) error {
+	if v == "" {
+		return nil
+	}
+	for _, supported := range ResultVersions {
+		if v == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported CNI version %q, supported versions are %v", v, ResultVersions)
+}
+
+// PrintVersion prints r in the result format of spec version v
+func (r *Result) PrintVersion(v string) error {
+	res, err := r.convert(v)
+	if err != nil {
+		return err
+	}
+	return prettyPrint(res)
+}
+
+// MarshalVersion returns the JSON of r in the result format of spec
+// version v
+func (r *Result) MarshalVersion(v string) ([]byte, error) {
+	res, err := r.convert(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+func (r *Result) convert(v string) (interface{}, error) {
+	if err := CheckVersion(v); err != nil {
+		return nil, err
+	}
+	if v != "0.3.0" {
+		return r, nil
+	}
+
+	res := &result030{CNIVersion: v}
+	for _, c := range []struct {
+		version string
+		ipc     *IPConfig
+	}{{"4", r.IP4}, {"6", r.IP6}} {
+		if c.ipc == nil {
+			continue
+		}
+		res.IPs = append(res.IPs, ipConfig030{
+			Version: c.version,
+			Address: IPNet(c.ipc.IP),
+			Gateway: c.ipc.Gateway,
+		})
+		res.Routes = append(res.Routes, c.ipc.Routes...)
+	}
+	if !r.DNS.empty() {
+		res.DNS = &r.DNS
+	}
+	return res, nil
+}
+
+// result030 is the result format of spec version 0.3.0
+type result030 struct {
+	CNIVersion string        `json:"cniVersion"`
+	IPs        []ipConfig030 `json:"ips,omitempty"`
+	Routes     []Route       `json:"routes,omitempty"`
+	DNS        *DNS          `json:"dns,omitempty"`
+}
+
+type ipConfig030 struct {
+	Version string `json:"version"`
+	Address IPNet  `json:"address"`
+	Gateway net.IP `json:"gateway,omitempty"`
+}
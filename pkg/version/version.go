@@ -0,0 +1,63 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version describes the versions of the CNI spec that a plugin
+// supports, as reported by the VERSION command.
+package version
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Current is the version of the spec that types.Result is written in
+const Current = "0.2.0"
+
+// PluginInfo reports the spec versions supported by a plugin
+type PluginInfo interface {
+	// SupportedVersions returns the spec versions, oldest first
+	SupportedVersions() []string
+	// Encode writes the VERSION command output to w
+	Encode(w io.Writer) error
+}
+
+type pluginInfo struct {
+	CNIVersion string   `json:"cniVersion"`
+	Supported  []string `json:"supportedVersions"`
+}
+
+func (p *pluginInfo) SupportedVersions() []string {
+	return p.Supported
+}
+
+func (p *pluginInfo) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(p)
+}
+
+// PluginSupports returns a PluginInfo for the given spec versions
+func PluginSupports(supportedVersions ...string) PluginInfo {
+	return &pluginInfo{
+		CNIVersion: Current,
+		Supported:  supportedVersions,
+	}
+}
+
+// Legacy is what plugins that don't advertise their versions support:
+// the original spec, whose result only holds ip4 and ip6
+var Legacy = PluginSupports("0.1.0")
+
+// All is every spec version whose results types.Result can express
+var All = PluginSupports(types.ResultVersions...)
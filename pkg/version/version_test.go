@@ -0,0 +1,40 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version_test
+
+import (
+	"bytes"
+
+	"github.com/containernetworking/cni/pkg/version"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version", func() {
+	It("encodes the current and supported versions", func() {
+		var buf bytes.Buffer
+		Expect(version.PluginSupports("0.1.0", "0.2.0").Encode(&buf)).To(Succeed())
+		Expect(buf.String()).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"supportedVersions": ["0.1.0", "0.2.0"]
+		}`))
+	})
+
+	It("lists supported versions oldest first", func() {
+		Expect(version.All.SupportedVersions()).To(Equal([]string{"0.1.0", "0.2.0", "0.3.0"}))
+		Expect(version.All.SupportedVersions()).To(ContainElement(version.Current))
+	})
+})
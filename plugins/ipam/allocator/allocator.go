@@ -14,9 +14,14 @@
 
 package allocator
 
-import "github.com/containernetworking/cni/pkg/types"
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
 
 type Allocator interface {
 	Get(id string) (*types.IPConfig, error)
 	Release(id string) error
+	ReleaseIP(id string, ip net.IP) error
 }
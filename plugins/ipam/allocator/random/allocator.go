@@ -0,0 +1,294 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package random
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// maxRandomAttempts bounds the number of random picks before falling
+// back to a linear scan of the range
+const maxRandomAttempts = 16
+
+type IPAllocator struct {
+	ranges []sequential.Range
+	conf   *sequential.IPAMConfig
+	store  backend.Store
+	// rand is the entropy source for picks; tests swap in a
+	// deterministic reader
+	rand    io.Reader
+	exclude sequential.ExcludeSet
+}
+
+func NewIPAllocator(conf *sequential.IPAMConfig, store backend.Store) (*IPAllocator, error) {
+	ranges, err := sequential.Ranges(conf)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := sequential.Exclusions(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckGatewayFamily(conf); err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckReservations(conf, store); err != nil {
+		return nil, err
+	}
+	return &IPAllocator{ranges, conf, store, rand.Reader, exclude}, nil
+}
+
+// Returns newly allocated IP along with its config
+func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
+	res, err := a.get(id)
+	sequential.DropGatewayRoutes(res, a.conf.Logger())
+	return res, err
+}
+
+func (a *IPAllocator) get(id string) (*types.IPConfig, error) {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	gw := a.conf.GatewayIP()
+
+	var requestedIP net.IP
+	if a.conf.Args != nil {
+		requestedIP = a.conf.Args.IP
+	}
+	// a MAC mapping forces the IP unless one was requested explicitly
+	mapped := false
+	if requestedIP == nil {
+		requestedIP = a.conf.MappedIP()
+		mapped = requestedIP != nil
+	}
+
+	held, err := sequential.ReclaimGrace(a.conf, a.store, a.ranges, id, requestedIP)
+	if err != nil {
+		return nil, err
+	}
+	if requestedIP == nil {
+		if held == nil {
+			if held, err = sequential.Reclaim(a.conf, a.store, a.ranges, id); err != nil {
+				return nil, err
+			}
+		}
+		if held != nil {
+			return a.ipConfig(held, gw), nil
+		}
+	}
+
+	if err := sequential.CheckContainerLimit(a.conf, a.store, id, requestedIP, 1); err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckUtilization(a.conf, a.store, a.ranges, a.exclude, id, requestedIP); err != nil {
+		return nil, err
+	}
+
+	if requestedIP != nil {
+		isGateway, err := sequential.CheckRequestedGateway(a.conf, gw, requestedIP)
+		if err != nil {
+			return nil, err
+		}
+
+		subnet := (*net.IPNet)(&a.conf.Subnet)
+		if err := sequential.CheckFamily(requestedIP, subnet); err != nil {
+			return nil, err
+		}
+		if !subnet.Contains(requestedIP) {
+			return nil, fmt.Errorf("%s not in network: %s", requestedIP, subnet)
+		}
+		if a.exclude.Contains(requestedIP) {
+			return nil, fmt.Errorf("requested IP address %q is excluded in network: %s", requestedIP, a.conf.Name)
+		}
+		// the gateway usually lies outside of the ranges
+		if !mapped && !isGateway {
+			if err := sequential.CheckRequestedRange(a.conf, a.ranges, requestedIP); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := sequential.CheckRequestedApproval(a.conf, id, requestedIP); err != nil {
+			return nil, err
+		}
+
+		reserved, owner, err := a.store.Reserve(id, requestedIP)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return a.ipConfig(requestedIP, gw), nil
+		}
+		return nil, sequential.NewConflictError(a.conf, requestedIP, owner, mapped)
+	}
+
+	preferred, err := sequential.ReservePreferred(a.conf, a.store, a.ranges, a.exclude, id, gw)
+	if err != nil {
+		return nil, err
+	}
+	if preferred != nil {
+		return a.ipConfig(preferred, gw), nil
+	}
+
+	res, err := a.pick(id, gw)
+	if err != nil || res != nil {
+		return res, err
+	}
+
+	// reclaim abandoned leases before giving up
+	if a.conf.LeaseTTL > 0 {
+		before := time.Now().Add(-time.Duration(a.conf.LeaseTTL))
+		freed, err := a.store.ReleaseExpired(before)
+		if err != nil {
+			return nil, err
+		}
+		if len(freed) > 0 {
+			res, err := a.pick(id, gw)
+			if err != nil || res != nil {
+				return res, err
+			}
+		}
+	}
+	return nil, sequential.NewAllocationError(sequential.ErrPoolExhausted, "no IP addresses available in network: %s", a.conf.Name)
+}
+
+// pick reserves a random free IP, returning a nil config if every IP
+// is taken
+func (a *IPAllocator) pick(id string, gw net.IP) (*types.IPConfig, error) {
+	held, err := sequential.HeldIPs(a.store, id)
+	if err != nil {
+		return nil, err
+	}
+	// don't allocate gateway IP, excluded IPs or IPs the container
+	// already holds
+	skip := func(cur net.IP) bool {
+		return (gw != nil && cur.Equal(gw)) || a.exclude.Contains(cur) || held[cur.String()]
+	}
+
+	size := a.size()
+	for i := 0; size.Sign() > 0 && i < maxRandomAttempts; i++ {
+		off, err := rand.Int(a.rand, size)
+		if err != nil {
+			return nil, err
+		}
+		cur := a.ipAtOffset(off)
+		if skip(cur) {
+			continue
+		}
+
+		reserved, err := a.reserve(id, cur)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return a.ipConfig(cur, gw), nil
+		}
+	}
+
+	// the range is nearly full; fall back to a linear scan so the
+	// remaining addresses are found deterministically
+	for _, r := range a.ranges {
+		for cur := r.Start; ip.Cmp(cur, r.End) < 0; cur = ip.NextIP(cur) {
+			if skip(cur) {
+				continue
+			}
+
+			reserved, err := a.reserve(id, cur)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				return a.ipConfig(cur, gw), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// reserve reserves cur once the validation hook approved it
+func (a *IPAllocator) reserve(id string, cur net.IP) (bool, error) {
+	approved, err := sequential.ApproveIP(a.conf, id, cur)
+	if err != nil || !approved {
+		return false, err
+	}
+	reserved, _, err := a.store.Reserve(id, cur)
+	return reserved, err
+}
+
+// Releases all IPs allocated for the container with given ID
+func (a *IPAllocator) Release(id string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return sequential.ReleaseByID(a.conf, a.store, id)
+}
+
+// ReleaseIP releases a single IP held by the container with given ID,
+// leaving its other reservations in place
+func (a *IPAllocator) ReleaseIP(id string, ip net.IP) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return a.store.ReleaseByIP(id, ip)
+}
+
+func (a *IPAllocator) ipConfig(addr, gw net.IP) *types.IPConfig {
+	return &types.IPConfig{
+		IP:      net.IPNet{IP: addr, Mask: a.conf.Subnet.Mask},
+		Gateway: a.conf.RangeGateway(addr, gw),
+		Routes:  a.conf.SubnetRoutes(),
+	}
+}
+
+// size returns the total number of addresses across all ranges
+func (a *IPAllocator) size() *big.Int {
+	total := new(big.Int)
+	for _, r := range a.ranges {
+		total.Add(total, rangeSize(r))
+	}
+	return total
+}
+
+// rangeSize returns the number of addresses in r, treating a range
+// whose start is not below its end as empty
+func rangeSize(r sequential.Range) *big.Int {
+	n := new(big.Int).Sub(ip.ToInt(r.End), ip.ToInt(r.Start))
+	if n.Sign() < 0 {
+		n.SetInt64(0)
+	}
+	return n
+}
+
+// ipAtOffset maps an offset into the concatenation of all ranges back
+// to an address
+func (a *IPAllocator) ipAtOffset(off *big.Int) net.IP {
+	for _, r := range a.ranges {
+		n := rangeSize(r)
+		if off.Cmp(n) < 0 {
+			return ip.FromInt(off.Add(off, ip.ToInt(r.Start)), r.Start.To4() != nil)
+		}
+		off.Sub(off, n)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package random
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	fakestore "github.com/containernetworking/cni/plugins/ipam/store/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// a single seeded source stands in for crypto/rand, keeping the tests
+// deterministic while still varying picks across allocators
+var testRand = rand.New(rand.NewSource(1))
+
+func newAllocator(subnet string, ipmap map[string]string) *IPAllocator {
+	n, err := types.ParseCIDR(subnet)
+	Expect(err).ToNot(HaveOccurred())
+	conf := &sequential.IPAMConfig{
+		Name:   "test",
+		Type:   "host-local",
+		Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+	}
+	alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(ipmap, nil))
+	Expect(err).ToNot(HaveOccurred())
+	alloc.rand = testRand
+	return alloc
+}
+
+var _ = Describe("random ip allocator", func() {
+	It("spreads allocations roughly uniformly across the range", func() {
+		counts := map[string]int{}
+		// 10.0.0.2 - 10.0.0.14; .0 is skipped, .1 is the gateway
+		// and .15 is the exclusive end of the range
+		const trials = 13000
+		for i := 0; i < trials; i++ {
+			alloc := newAllocator("10.0.0.0/28", map[string]string{})
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			counts[res.IP.IP.String()]++
+		}
+
+		Expect(counts).To(HaveLen(13))
+		Expect(counts).ToNot(HaveKey("10.0.0.1"))
+		for addr, n := range counts {
+			Expect(n).To(BeNumerically("~", trials/13, 300), addr)
+		}
+	})
+
+	It("drops the default route without a gateway if none is resolved", func() {
+		alloc := newAllocator("10.0.0.0/29", map[string]string{})
+		alloc.conf.GatewayMode = sequential.GatewayModeNone
+		// keep the warning out of the test output
+		alloc.conf.LogLevel = "error"
+		for _, dst := range []string{"0.0.0.0/0", "10.1.0.0/16"} {
+			n, err := types.ParseCIDR(dst)
+			Expect(err).ToNot(HaveOccurred())
+			alloc.conf.Routes = append(alloc.conf.Routes, types.Route{Dst: *n})
+		}
+
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Gateway).To(BeNil())
+		Expect(res.Routes).To(HaveLen(1))
+		Expect(res.Routes[0].Dst.String()).To(Equal("10.1.0.0/16"))
+	})
+
+	It("skips the gateway and reserved addresses", func() {
+		ipmap := map[string]string{}
+		alloc := newAllocator("10.0.0.0/29", ipmap)
+		seen := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			addr := res.IP.IP.String()
+			Expect(addr).ToNot(Equal("10.0.0.1"))
+			Expect(seen).ToNot(HaveKey(addr))
+			Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+			seen[addr] = true
+		}
+		Expect(ipmap).To(HaveLen(5))
+	})
+
+	It("finds the last remaining address", func() {
+		alloc := newAllocator("10.0.0.0/29", map[string]string{
+			"10.0.0.2": "id",
+			"10.0.0.3": "id",
+			"10.0.0.4": "id",
+			"10.0.0.6": "id",
+		})
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+	})
+
+	It("returns the same error as the sequential allocator when exhausted", func() {
+		alloc := newAllocator("10.0.0.0/29", map[string]string{
+			"10.0.0.2": "id",
+			"10.0.0.3": "id",
+			"10.0.0.4": "id",
+			"10.0.0.5": "id",
+			"10.0.0.6": "id",
+		})
+		_, err := alloc.Get("ID")
+		Expect(err).To(MatchError("no IP addresses available in network: test"))
+		Expect(errors.Is(err, sequential.ErrPoolExhausted)).To(BeTrue())
+	})
+
+	It("does not allocate outside an empty range", func() {
+		// a /127 leaves nothing between the skipped network address
+		// and the end of the range
+		alloc := newAllocator("fd00::/127", map[string]string{})
+		_, err := alloc.Get("ID")
+		Expect(err).To(MatchError("no IP addresses available in network: test"))
+	})
+
+	It("never picks excluded addresses", func() {
+		for i := 0; i < 20; i++ {
+			alloc := newAllocator("10.0.0.0/29", map[string]string{})
+			// .2 and .3 are excluded
+			alloc.exclude = sequential.ExcludeSet{{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(31, 32)}}
+			seen := map[string]bool{}
+			for j := 0; j < 3; j++ {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				seen[res.IP.IP.String()] = true
+			}
+			Expect(seen).To(Equal(map[string]bool{"10.0.0.4": true, "10.0.0.5": true, "10.0.0.6": true}))
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		}
+	})
+
+	It("honours a requested IP", func() {
+		alloc := newAllocator("10.0.0.0/29", map[string]string{})
+		alloc.conf.Args = &sequential.IPAMArgs{IP: net.ParseIP("10.0.0.4")}
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.0.4"))
+	})
+
+	It("rejects a requested IP of the other address family", func() {
+		alloc := newAllocator("10.0.0.0/29", map[string]string{})
+		alloc.conf.Args = &sequential.IPAMArgs{IP: net.ParseIP("fd00::4")}
+		_, err := alloc.Get("ID")
+		Expect(err).To(MatchError("address family mismatch: fd00::4 is not in the address family of network 10.0.0.0/29"))
+	})
+})
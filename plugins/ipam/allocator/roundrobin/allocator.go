@@ -0,0 +1,288 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package roundrobin hands out addresses in order and never reuses a
+// released address until every address of the ranges has been handed
+// out once.
+package roundrobin
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+type IPAllocator struct {
+	ranges  []sequential.Range
+	conf    *sequential.IPAMConfig
+	store   backend.Store
+	exclude sequential.ExcludeSet
+}
+
+func NewIPAllocator(conf *sequential.IPAMConfig, store backend.Store) (*IPAllocator, error) {
+	ranges, err := sequential.Ranges(conf)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := sequential.Exclusions(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckGatewayFamily(conf); err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckReservations(conf, store); err != nil {
+		return nil, err
+	}
+	return &IPAllocator{ranges, conf, store, exclude}, nil
+}
+
+// Returns newly allocated IP along with its config
+func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
+	res, err := a.get(id)
+	sequential.DropGatewayRoutes(res, a.conf.Logger())
+	return res, err
+}
+
+func (a *IPAllocator) get(id string) (*types.IPConfig, error) {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	gw := a.conf.GatewayIP()
+
+	var requestedIP net.IP
+	if a.conf.Args != nil {
+		requestedIP = a.conf.Args.IP
+	}
+	// a MAC mapping forces the IP unless one was requested explicitly
+	mapped := false
+	if requestedIP == nil {
+		requestedIP = a.conf.MappedIP()
+		mapped = requestedIP != nil
+	}
+
+	held, err := sequential.ReclaimGrace(a.conf, a.store, a.ranges, id, requestedIP)
+	if err != nil {
+		return nil, err
+	}
+	if requestedIP == nil {
+		if held == nil {
+			if held, err = sequential.Reclaim(a.conf, a.store, a.ranges, id); err != nil {
+				return nil, err
+			}
+		}
+		if held != nil {
+			return a.ipConfig(held, gw), nil
+		}
+	}
+
+	if err := sequential.CheckContainerLimit(a.conf, a.store, id, requestedIP, 1); err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckUtilization(a.conf, a.store, a.ranges, a.exclude, id, requestedIP); err != nil {
+		return nil, err
+	}
+
+	if requestedIP != nil {
+		isGateway, err := sequential.CheckRequestedGateway(a.conf, gw, requestedIP)
+		if err != nil {
+			return nil, err
+		}
+
+		subnet := (*net.IPNet)(&a.conf.Subnet)
+		if err := sequential.CheckFamily(requestedIP, subnet); err != nil {
+			return nil, err
+		}
+		if !subnet.Contains(requestedIP) {
+			return nil, fmt.Errorf("%s not in network: %s", requestedIP, subnet)
+		}
+		if a.exclude.Contains(requestedIP) {
+			return nil, fmt.Errorf("requested IP address %q is excluded in network: %s", requestedIP, a.conf.Name)
+		}
+		// the gateway usually lies outside of the ranges
+		if !mapped && !isGateway {
+			if err := sequential.CheckRequestedRange(a.conf, a.ranges, requestedIP); err != nil {
+				return nil, err
+			}
+		}
+
+		// requested IPs leave the high-water mark alone
+		if err := sequential.CheckRequestedApproval(a.conf, id, requestedIP); err != nil {
+			return nil, err
+		}
+
+		reserved, owner, err := a.store.Reserve(id, requestedIP)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return a.ipConfig(requestedIP, gw), nil
+		}
+		return nil, sequential.NewConflictError(a.conf, requestedIP, owner, mapped)
+	}
+
+	// like requested IPs, preferred ones leave the high-water mark alone
+	preferred, err := sequential.ReservePreferred(a.conf, a.store, a.ranges, a.exclude, id, gw)
+	if err != nil {
+		return nil, err
+	}
+	if preferred != nil {
+		return a.ipConfig(preferred, gw), nil
+	}
+
+	mark, err := a.store.HighWaterMark(a.ranges[0].Start.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// hand out addresses past the high-water mark first
+	from := a.first()
+	if mark != nil && a.contains(mark) {
+		from = a.next(mark)
+	}
+	res, err := a.scan(id, gw, from, nil)
+	if err != nil || res != nil {
+		return res, err
+	}
+
+	// every address has been used once; wrap around to reclaim the
+	// released ones
+	res, err = a.scan(id, gw, a.first(), from)
+	if err != nil || res != nil {
+		return res, err
+	}
+
+	// reclaim abandoned leases before giving up
+	if a.conf.LeaseTTL > 0 {
+		before := time.Now().Add(-time.Duration(a.conf.LeaseTTL))
+		freed, err := a.store.ReleaseExpired(before)
+		if err != nil {
+			return nil, err
+		}
+		if len(freed) > 0 {
+			res, err := a.scan(id, gw, a.first(), nil)
+			if err != nil || res != nil {
+				return res, err
+			}
+		}
+	}
+	return nil, sequential.NewAllocationError(sequential.ErrPoolExhausted, "no IP addresses available in network: %s", a.conf.Name)
+}
+
+// scan reserves the first free IP from from up to, but not including,
+// to, or up to the end of the last range if to is nil. The reserved IP
+// becomes the new high-water mark.
+func (a *IPAllocator) scan(id string, gw, from, to net.IP) (*types.IPConfig, error) {
+	held, err := sequential.HeldIPs(a.store, id)
+	if err != nil {
+		return nil, err
+	}
+	for cur := from; cur != nil && (to == nil || !cur.Equal(to)); cur = a.next(cur) {
+		// don't allocate gateway IP, excluded IPs or IPs the container
+		// already holds
+		if (gw != nil && cur.Equal(gw)) || a.exclude.Contains(cur) || held[cur.String()] {
+			continue
+		}
+		approved, err := sequential.ApproveIP(a.conf, id, cur)
+		if err != nil {
+			return nil, err
+		}
+		if !approved {
+			continue
+		}
+
+		reserved, _, err := a.store.Reserve(id, cur)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			if err := a.store.SetHighWaterMark(cur); err != nil {
+				a.store.Release(cur)
+				return nil, err
+			}
+			return a.ipConfig(cur, gw), nil
+		}
+	}
+	return nil, nil
+}
+
+// Releases all IPs allocated for the container with given ID
+func (a *IPAllocator) Release(id string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return sequential.ReleaseByID(a.conf, a.store, id)
+}
+
+// ReleaseIP releases a single IP held by the container with given ID,
+// leaving its other reservations in place
+func (a *IPAllocator) ReleaseIP(id string, ip net.IP) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return a.store.ReleaseByIP(id, ip)
+}
+
+func (a *IPAllocator) ipConfig(addr, gw net.IP) *types.IPConfig {
+	return &types.IPConfig{
+		IP:      net.IPNet{IP: addr, Mask: a.conf.Subnet.Mask},
+		Gateway: a.conf.RangeGateway(addr, gw),
+		Routes:  a.conf.SubnetRoutes(),
+	}
+}
+
+// first returns the first address of the ranges, or nil if they are
+// all empty
+func (a *IPAllocator) first() net.IP {
+	for _, r := range a.ranges {
+		if !r.Empty() {
+			return r.Start
+		}
+	}
+	return nil
+}
+
+// next returns the address after addr in range order, moving on to the
+// next non-empty range at the end of one, or nil after the last range
+func (a *IPAllocator) next(addr net.IP) net.IP {
+	for i, r := range a.ranges {
+		if !r.Contains(addr) {
+			continue
+		}
+		if n := ip.NextIP(addr); r.Contains(n) {
+			return n
+		}
+		for _, o := range a.ranges[i+1:] {
+			if !o.Empty() {
+				return o.Start
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func (a *IPAllocator) contains(addr net.IP) bool {
+	for _, r := range a.ranges {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
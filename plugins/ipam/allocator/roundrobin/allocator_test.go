@@ -0,0 +1,112 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package roundrobin
+
+import (
+	"errors"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	fakestore "github.com/containernetworking/cni/plugins/ipam/store/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func newAllocator(subnet string, ranges []sequential.IPRange) *IPAllocator {
+	n, err := types.ParseCIDR(subnet)
+	Expect(err).ToNot(HaveOccurred())
+	conf := &sequential.IPAMConfig{
+		Name:   "test",
+		Type:   "host-local",
+		Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+		Ranges: ranges,
+	}
+	alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+	Expect(err).ToNot(HaveOccurred())
+	return alloc
+}
+
+func expectNext(alloc *IPAllocator, expected ...string) {
+	for _, e := range expected {
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal(e))
+	}
+}
+
+var _ = Describe("round robin ip allocator", func() {
+	It("hands out addresses in order, skipping the gateway", func() {
+		alloc := newAllocator("10.0.0.0/29", nil)
+		expectNext(alloc, "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	})
+
+	It("does not reuse a released address until the range wraps", func() {
+		// .2 - .6 are allocatable
+		alloc := newAllocator("10.0.0.0/29", nil)
+		expectNext(alloc, "10.0.0.2", "10.0.0.3", "10.0.0.4")
+
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.3"))).To(Succeed())
+		expectNext(alloc, "10.0.0.5", "10.0.0.6")
+
+		// only now is the released address handed out again
+		expectNext(alloc, "10.0.0.3")
+		_, err := alloc.Get("ID")
+		Expect(err).To(MatchError("no IP addresses available in network: test"))
+		Expect(errors.Is(err, sequential.ErrPoolExhausted)).To(BeTrue())
+	})
+
+	It("continues past the reclaimed address after wrapping", func() {
+		alloc := newAllocator("10.0.0.0/29", nil)
+		expectNext(alloc, "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6")
+
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.3"))).To(Succeed())
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.5"))).To(Succeed())
+		expectNext(alloc, "10.0.0.3")
+
+		// .2 is released behind the new mark and must wait for the
+		// next wrap
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+		expectNext(alloc, "10.0.0.5", "10.0.0.2")
+	})
+
+	It("leaves the high-water mark alone for requested IPs", func() {
+		alloc := newAllocator("10.0.0.0/29", nil)
+		expectNext(alloc, "10.0.0.2")
+
+		alloc.conf.Args = &sequential.IPAMArgs{IP: net.ParseIP("10.0.0.5")}
+		expectNext(alloc, "10.0.0.5")
+		alloc.conf.Args = nil
+
+		expectNext(alloc, "10.0.0.3", "10.0.0.4", "10.0.0.6")
+	})
+
+	It("moves through multiple ranges in order", func() {
+		alloc := newAllocator("10.0.0.0/24", []sequential.IPRange{
+			{RangeStart: net.ParseIP("10.0.0.100"), RangeEnd: net.ParseIP("10.0.0.101")},
+			{RangeStart: net.ParseIP("10.0.0.10"), RangeEnd: net.ParseIP("10.0.0.11")},
+		})
+		expectNext(alloc, "10.0.0.100", "10.0.0.101", "10.0.0.10")
+
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.100"))).To(Succeed())
+		expectNext(alloc, "10.0.0.11", "10.0.0.100")
+	})
+
+	It("returns an error when the subnet has no usable addresses", func() {
+		alloc := newAllocator("fd00::/127", nil)
+		_, err := alloc.Get("ID")
+		Expect(err).To(MatchError("no IP addresses available in network: test"))
+	})
+})
@@ -15,123 +15,782 @@
 package sequential
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math/big"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam/log"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/plugins/ipam/store"
 )
 
 type IPAllocator struct {
-	start net.IP
-	end   net.IP
-	conf  *IPAMConfig
-	store backend.Store
+	ranges  []Range
+	conf    *IPAMConfig
+	store   backend.Store
+	exclude ExcludeSet
+	log     *log.Logger
+	// deadline is when the allocation in progress times out, zero
+	// without an allocationTimeout
+	deadline time.Time
+}
+
+// Range is a window of allocatable addresses; End is exclusive
+type Range struct {
+	Start net.IP
+	End   net.IP
+}
+
+// Contains reports whether addr lies within the range
+func (r Range) Contains(addr net.IP) bool {
+	return ip.Cmp(addr, r.Start) >= 0 && ip.Cmp(addr, r.End) < 0
+}
+
+// Empty reports whether the range holds no addresses, as happens for
+// the default range of a /31 or /32 subnet
+func (r Range) Empty() bool {
+	return ip.Cmp(r.Start, r.End) >= 0
+}
+
+// size returns the number of addresses in the range
+func (r Range) size() *big.Int {
+	if r.Empty() {
+		return new(big.Int)
+	}
+	return new(big.Int).Sub(ip.ToInt(r.End), ip.ToInt(r.Start))
 }
 
 func NewIPAllocator(conf *IPAMConfig, store backend.Store) (*IPAllocator, error) {
-	var (
-		start net.IP
-		end   net.IP
-		err   error
-	)
-	start, end, err = networkRange((*net.IPNet)(&conf.Subnet))
+	ranges, err := Ranges(conf)
 	if err != nil {
 		return nil, err
 	}
+	exclude, err := Exclusions(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGatewayMode(conf); err != nil {
+		return nil, err
+	}
+	if err := CheckGatewayFamily(conf); err != nil {
+		return nil, err
+	}
+	// the check covers all subnets of a weighted network at once
+	if !conf.inSubnets {
+		if err := CheckReservations(conf, store); err != nil {
+			return nil, err
+		}
+	}
+	level, err := log.ParseLevel(conf.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.NewStderr(level).With("network", conf.Name)
+	return &IPAllocator{ranges: ranges, conf: conf, store: store, exclude: exclude, log: logger}, nil
+}
+
+// NewIPAllocatorForSubnet returns an allocator for the whole of subnet
+// with default options, for embedders that work out the subnet at run
+// time rather than from a network configuration. The subnet doubles as
+// the network name in errors.
+func NewIPAllocatorForSubnet(subnet *net.IPNet, store backend.Store) (*IPAllocator, error) {
+	if subnet == nil || subnet.IP == nil || subnet.Mask == nil {
+		return nil, fmt.Errorf("missing subnet")
+	}
+	conf := &IPAMConfig{
+		Name:   subnet.String(),
+		Subnet: types.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask},
+	}
+	return NewIPAllocator(conf, store)
+}
+
+// Ranges returns the windows that addresses are allocated from for the
+// given configuration, in the order they are scanned. If a pool is
+// requested through the POOL argument, only the ranges of that name are
+// returned, and a subnet requested through the SUBNET argument clips
+// them to its addresses.
+func Ranges(conf *IPAMConfig) ([]Range, error) {
+	ranges, err := poolRanges(conf)
+	if err != nil {
+		return nil, err
+	}
+	n, err := searchSubnet(conf)
+	if err != nil || n == nil {
+		return ranges, err
+	}
+	return narrowRanges(conf, ranges, n)
+}
+
+// poolRanges returns the ranges of the requested pool, or every range
+// if no pool was requested
+func poolRanges(conf *IPAMConfig) ([]Range, error) {
+	ranges, err := allRanges(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Args == nil || conf.Args.POOL == "" {
+		return ranges, nil
+	}
 
-	// skip the .0 address
-	start = ip.NextIP(start)
+	var pool []Range
+	for i, cr := range conf.Ranges {
+		if cr.Name == string(conf.Args.POOL) {
+			pool = append(pool, ranges[i])
+		}
+	}
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("unknown pool %q in network: %s", conf.Args.POOL, conf.Name)
+	}
+	return pool, nil
+}
 
-	if conf.RangeStart != nil {
-		if err := validateRangeIP(conf.RangeStart, (*net.IPNet)(&conf.Subnet)); err != nil {
+// allRanges returns every window of the configuration, regardless of
+// the requested pool
+func allRanges(conf *IPAMConfig) ([]Range, error) {
+	if conf.RangeSizeFromGateway > 0 {
+		start, end, err := gatewayBounds(conf)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newRange(conf, start, end)
+		if err != nil {
 			return nil, err
 		}
-		start = conf.RangeStart
+		return []Range{r}, nil
 	}
-	if conf.RangeEnd != nil {
-		if err := validateRangeIP(conf.RangeEnd, (*net.IPNet)(&conf.Subnet)); err != nil {
+	if len(conf.Ranges) == 0 && conf.RangeCIDR.IP != nil {
+		start, end, err := cidrBounds(conf)
+		if err != nil {
 			return nil, err
 		}
+		r, err := newRange(conf, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return []Range{r}, nil
+	}
+	if len(conf.Ranges) == 0 {
+		r, err := newRange(conf, conf.RangeStart, conf.RangeEnd)
+		if err != nil {
+			return nil, err
+		}
+		return []Range{r}, nil
+	}
+
+	var ranges []Range
+	for i, cr := range conf.Ranges {
+		r, err := newRange(conf, cr.RangeStart, cr.RangeEnd)
+		if err != nil {
+			return nil, fmt.Errorf("range %d: %v", i, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// cidrBounds returns the first and last allocatable address of the
+// rangeCIDR, leaving out the network and broadcast addresses of the
+// subnet should the rangeCIDR include them, unless the network address
+// is not to be skipped
+func cidrBounds(conf *IPAMConfig) (net.IP, net.IP, error) {
+	subnet := (*net.IPNet)(&conf.Subnet)
+	cidr := &net.IPNet{IP: conf.RangeCIDR.IP.Mask(conf.RangeCIDR.Mask), Mask: conf.RangeCIDR.Mask}
+	if subnet.IP == nil || !subnetContains(conf.Subnet, cidr) {
+		return nil, nil, fmt.Errorf("rangeCIDR %s is not within subnet %s", cidr, subnet)
+	}
+
+	start, end, err := networkRange(cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !pointToPoint(subnet) {
+		first, last, err := networkRange(&net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask})
+		if err != nil {
+			return nil, nil, err
+		}
+		if start.Equal(first) && conf.SkipsNetworkAddress() {
+			start = ip.NextIP(start)
+		}
+		if end.Equal(last) {
+			end = ip.PrevIP(end)
+		}
+	}
+	return start, end, nil
+}
+
+// gatewayBounds returns the first and last address of the range given
+// as rangeSizeFromGateway addresses starting rangeStartOffsetFromGateway
+// addresses after the gateway, which must lie within the subnet
+func gatewayBounds(conf *IPAMConfig) (net.IP, net.IP, error) {
+	subnet := (*net.IPNet)(&conf.Subnet)
+	gw := conf.GatewayIP()
+	if gw == nil {
+		return nil, nil, fmt.Errorf("%q requires a gateway in network: %s", "rangeSizeFromGateway", subnet)
+	}
+
+	netStart, netEnd, err := networkRange(subnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	// add in big.Int so that a range past the top of the address space
+	// cannot wrap around into the subnet
+	first := new(big.Int).Add(ip.ToInt(gw), big.NewInt(int64(conf.RangeOffsetFromGateway)))
+	last := new(big.Int).Add(first, big.NewInt(int64(conf.RangeSizeFromGateway-1)))
+	if first.Cmp(ip.ToInt(netStart)) < 0 || last.Cmp(ip.ToInt(netEnd)) > 0 {
+		return nil, nil, fmt.Errorf("range of %d addresses at offset %d from gateway %s runs past network: %s", conf.RangeSizeFromGateway, conf.RangeOffsetFromGateway, gw, subnet)
+	}
+	v4 := gw.To4() != nil
+	return ip.FromInt(first, v4), ip.FromInt(last, v4), nil
+}
+
+// newRange builds a Range out of the optional inclusive rangeStart and
+// rangeEnd, defaulting to the whole subnet
+func newRange(conf *IPAMConfig, rangeStart, rangeEnd net.IP) (Range, error) {
+	start, end, err := networkRange((*net.IPNet)(&conf.Subnet))
+	if err != nil {
+		return Range{}, err
+	}
+
+	broadcast := end
+	if pointToPoint((*net.IPNet)(&conf.Subnet)) {
+		// every address of a /31 (RFC 3021) or /32 is usable
+		end = exclusiveEnd(end)
+	} else if conf.SkipsNetworkAddress() {
+		// skip the .0 address
+		start = ip.NextIP(start)
+	}
+
+	if conf.ReserveLow > 0 {
+		// keep the lowest addresses free for static assignment
+		start = ip.FromInt(new(big.Int).Add(ip.ToInt(start), big.NewInt(int64(conf.ReserveLow))), start.To4() != nil)
+		if ip.Cmp(start, end) >= 0 {
+			return Range{}, fmt.Errorf("reserveLow %d leaves no addresses in network: %s", conf.ReserveLow, (*net.IPNet)(&conf.Subnet))
+		}
+	}
+
+	if rangeStart != nil {
+		if err := validateRangeIP(rangeStart, (*net.IPNet)(&conf.Subnet)); err != nil {
+			return Range{}, err
+		}
+		start = rangeStart
+	}
+	if rangeEnd != nil {
+		if err := validateRangeIP(rangeEnd, (*net.IPNet)(&conf.Subnet)); err != nil {
+			return Range{}, err
+		}
 		// RangeEnd is inclusive
-		end = ip.NextIP(conf.RangeEnd)
+		end = exclusiveEnd(rangeEnd)
+		if start.To4() != nil && !pointToPoint((*net.IPNet)(&conf.Subnet)) {
+			// never hand out the broadcast address of an IPv4 subnet,
+			// even if rangeEnd reaches it
+			if ip.Cmp(end, broadcast) > 0 {
+				end = broadcast
+			}
+		}
 	}
-	return &IPAllocator{start, end, conf, store}, nil
+
+	r := Range{start, end}
+	if (rangeStart != nil || rangeEnd != nil) && r.Empty() {
+		return Range{}, fmt.Errorf("rangeStart %s is after rangeEnd %s", start, ip.PrevIP(end))
+	}
+	return r, nil
 }
 
 func validateRangeIP(ip net.IP, ipnet *net.IPNet) error {
+	if err := CheckFamily(ip, ipnet); err != nil {
+		return err
+	}
 	if !ipnet.Contains(ip) {
 		return fmt.Errorf("%s not in network: %s", ip, ipnet)
 	}
 	return nil
 }
 
+// CheckFamily returns an error if ip is not of the address family of
+// ipnet, which Contains alone reports as an IP outside of the network
+func CheckFamily(ip net.IP, ipnet *net.IPNet) error {
+	if (ip.To4() != nil) != (ipnet.IP.To4() != nil) {
+		return fmt.Errorf("address family mismatch: %s is not in the address family of network %s", ip, ipnet)
+	}
+	return nil
+}
+
+// CheckGatewayFamily returns an error if the configured gateway is not
+// of the address family of the subnet
+func CheckGatewayFamily(conf *IPAMConfig) error {
+	if conf.Gateway == nil {
+		return nil
+	}
+	if err := CheckFamily(conf.Gateway, (*net.IPNet)(&conf.Subnet)); err != nil {
+		return fmt.Errorf("gateway: %v", err)
+	}
+	return nil
+}
+
 // Returns newly allocated IP along with its config
 func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
+	a.startDeadline()
+	res, err := a.get(id)
+	DropGatewayRoutes(res, a.log)
+	return res, err
+}
+
+func (a *IPAllocator) get(id string) (*types.IPConfig, error) {
 	a.store.Lock()
 	defer a.store.Unlock()
 
-	gw := a.conf.Gateway
-	if gw == nil {
-		gw = ip.NextIP(a.conf.Subnet.IP)
+	// waiting for the lock counts against the timeout
+	if err := a.checkDeadline(); err != nil {
+		return nil, err
 	}
 
+	if a.conf.ConfirmTTL > 0 {
+		if err := ReclaimPending(a.conf, a.store); err != nil {
+			return nil, err
+		}
+		// the reservation is tentative until confirmed
+		id = backend.PendingID(id)
+	}
+
+	gw := a.conf.GatewayIP()
+
 	var requestedIP net.IP
 	if a.conf.Args != nil {
 		requestedIP = a.conf.Args.IP
 	}
+	// a MAC mapping forces the IP unless one was requested explicitly
+	mapped := false
+	if requestedIP == nil {
+		requestedIP = a.conf.MappedIP()
+		mapped = requestedIP != nil
+	}
+
+	held, err := ReclaimGrace(a.conf, a.store, a.ranges, id, requestedIP)
+	if err != nil {
+		return nil, err
+	}
+	if requestedIP == nil {
+		if held == nil {
+			if held, err = Reclaim(a.conf, a.store, a.ranges, id); err != nil {
+				return nil, err
+			}
+		}
+		if held != nil {
+			a.log.With("containerID", id).With("ip", held.String()).Debugf("reclaimed held IP")
+			return &types.IPConfig{
+				IP:      net.IPNet{IP: held, Mask: a.conf.Subnet.Mask},
+				Gateway: a.conf.RangeGateway(held, gw),
+				Routes:  a.conf.SubnetRoutes(),
+			}, nil
+		}
+	}
+
+	if err := CheckContainerLimit(a.conf, a.store, id, requestedIP, 1); err != nil {
+		return nil, err
+	}
+	if err := CheckUtilization(a.conf, a.store, a.ranges, a.exclude, id, requestedIP); err != nil {
+		return nil, err
+	}
 
 	if requestedIP != nil {
-		if gw != nil && gw.Equal(a.conf.Args.IP) {
-			return nil, fmt.Errorf("requested IP must differ gateway IP")
+		isGateway, err := CheckRequestedGateway(a.conf, gw, requestedIP)
+		if err != nil {
+			return nil, err
 		}
 
 		subnet := net.IPNet{
 			IP:   a.conf.Subnet.IP,
 			Mask: a.conf.Subnet.Mask,
 		}
-		err := validateRangeIP(requestedIP, &subnet)
+		err = validateRangeIP(requestedIP, &subnet)
 		if err != nil {
 			return nil, err
 		}
+		if a.exclude.Contains(requestedIP) {
+			return nil, fmt.Errorf("requested IP address %q is excluded in network: %s", requestedIP, a.conf.Name)
+		}
+		// the gateway usually lies outside of the ranges
+		if !mapped && !isGateway {
+			if err := CheckRequestedRange(a.conf, a.ranges, requestedIP); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := CheckRequestedApproval(a.conf, id, requestedIP); err != nil {
+			return nil, err
+		}
 
-		reserved, err := a.store.Reserve(id, requestedIP)
+		reserved, owner, err := a.store.Reserve(id, requestedIP)
 		if err != nil {
 			return nil, err
 		}
 
+		ipConf := &types.IPConfig{
+			IP:      net.IPNet{IP: requestedIP, Mask: a.conf.Subnet.Mask},
+			Gateway: a.conf.RangeGateway(requestedIP, gw),
+			Routes:  a.conf.SubnetRoutes(),
+		}
 		if reserved {
+			a.log.With("containerID", id).With("ip", requestedIP.String()).Debugf("reserved requested IP")
+			return ipConf, nil
+		}
+		return nil, NewConflictError(a.conf, requestedIP, owner, mapped)
+	}
+
+	preferred, err := ReservePreferred(a.conf, a.store, a.ranges, a.exclude, id, gw)
+	if err != nil {
+		return nil, err
+	}
+	if preferred != nil {
+		a.log.With("containerID", id).With("ip", preferred.String()).Debugf("reserved preferred IP")
+		return &types.IPConfig{
+			IP:      net.IPNet{IP: preferred, Mask: a.conf.Subnet.Mask},
+			Gateway: a.conf.RangeGateway(preferred, gw),
+			Routes:  a.conf.SubnetRoutes(),
+		}, nil
+	}
+
+	if mirrored := a.conf.MirroredIP(); mirrored != nil {
+		reserved, err := ReservePreferredIP(a.conf, a.store, a.ranges, a.exclude, id, gw, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		if reserved != nil {
+			a.log.With("containerID", id).With("ip", reserved.String()).Debugf("reserved mirrored IP")
 			return &types.IPConfig{
-				IP:      net.IPNet{IP: requestedIP, Mask: a.conf.Subnet.Mask},
-				Gateway: gw,
-				Routes:  a.conf.Routes,
+				IP:      net.IPNet{IP: reserved, Mask: a.conf.Subnet.Mask},
+				Gateway: a.conf.RangeGateway(reserved, gw),
+				Routes:  a.conf.SubnetRoutes(),
 			}, nil
 		}
-		return nil, fmt.Errorf("requested IP address %q is not available in network: %s", requestedIP, a.conf.Name)
+		a.log.With("containerID", id).With("ip", mirrored.String()).Debugf("mirrored IP not available")
 	}
 
-	startIP, endIP := a.getSearchRange()
-	for cur := startIP; !cur.Equal(endIP); cur = a.nextIP(cur) {
-		// don't allocate gateway IP
-		if gw != nil && cur.Equal(gw) {
+	if a.conf.StickyMode {
+		sticky, err := ReservePreferredIP(a.conf, a.store, a.ranges, a.exclude, id, gw, a.hashedIP(id))
+		if err != nil {
+			return nil, err
+		}
+		if sticky != nil {
+			a.log.With("containerID", id).With("ip", sticky.String()).Debugf("reserved sticky IP")
+			return &types.IPConfig{
+				IP:      net.IPNet{IP: sticky, Mask: a.conf.Subnet.Mask},
+				Gateway: a.conf.RangeGateway(sticky, gw),
+				Routes:  a.conf.SubnetRoutes(),
+			}, nil
+		}
+	}
+
+	if a.conf.ReuseMode == ReuseModeLIFO {
+		res, err := a.reuseFreed(id, gw)
+		if err != nil || res != nil {
+			return res, err
+		}
+	}
+
+	res, err := a.scan(id, gw)
+	if err != nil || res != nil {
+		return res, err
+	}
+
+	// reclaim abandoned leases before giving up
+	if a.conf.LeaseTTL > 0 {
+		before := time.Now().Add(-time.Duration(a.conf.LeaseTTL))
+		freed, err := a.store.ReleaseExpired(before)
+		if err != nil {
+			return nil, err
+		}
+		if len(freed) > 0 {
+			a.log.Infof("reclaimed %d expired reservations", len(freed))
+			res, err := a.scan(id, gw)
+			if err != nil || res != nil {
+				return res, err
+			}
+		}
+	}
+	return nil, NewAllocationError(ErrPoolExhausted, "no IP addresses available in network: %s", a.conf.Name)
+}
+
+// GetBlock reserves count consecutive IPs within one range for the
+// container with given ID and returns their configs in order. The block
+// is reserved as a whole; if no run of count free IPs exists, nothing
+// is reserved.
+func (a *IPAllocator) GetBlock(id string, count int) ([]*types.IPConfig, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("invalid block size %d", count)
+	}
+
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	if err := CheckContainerLimit(a.conf, a.store, id, nil, count); err != nil {
+		return nil, err
+	}
+
+	gw := a.conf.GatewayIP()
+	held, err := HeldIPs(a.store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range a.ranges {
+		for start := r.Start; r.Contains(start); start = ip.NextIP(start) {
+			block := a.block(r, start, count, gw, held)
+			if block == nil {
+				continue
+			}
+			reserved, err := backend.ReserveBlock(a.store, id, block)
+			if err != nil {
+				return nil, err
+			}
+			if !reserved {
+				continue
+			}
+
+			confs := make([]*types.IPConfig, 0, count)
+			for _, addr := range block {
+				c := &types.IPConfig{
+					IP:      net.IPNet{IP: addr, Mask: a.conf.Subnet.Mask},
+					Gateway: a.conf.RangeGateway(addr, gw),
+					Routes:  a.conf.SubnetRoutes(),
+				}
+				DropGatewayRoutes(c, a.log)
+				confs = append(confs, c)
+			}
+			return confs, nil
+		}
+	}
+	return nil, NewAllocationError(ErrPoolExhausted, "no block of %d consecutive IP addresses available in network: %s", count, a.conf.Name)
+}
+
+// block returns the count consecutive IPs of r beginning at start, or
+// nil if they run past the end of r or include the gateway, an excluded
+// IP or one already held by the container
+func (a *IPAllocator) block(r Range, start net.IP, count int, gw net.IP, held map[string]bool) []net.IP {
+	block := make([]net.IP, 0, count)
+	for cur := start; len(block) < count; cur = ip.NextIP(cur) {
+		if !r.Contains(cur) || cur.Equal(gw) || a.exclude.Contains(cur) || held[cur.String()] {
+			return nil
+		}
+		block = append(block, cur)
+	}
+	return block
+}
+
+// ReservePreferred reserves the first free IP of those passed as
+// PREFERRED_IP and PREFERRED_IPS for the container with given ID and
+// returns it. It returns nil, leaving the allocation to the usual scan,
+// if no IP was passed or none of them is available. The caller must
+// hold the store lock.
+func ReservePreferred(conf *IPAMConfig, store backend.Store, ranges []Range, exclude ExcludeSet, id string, gw net.IP) (net.IP, error) {
+	for _, preferred := range conf.PreferredIPs() {
+		reserved, err := ReservePreferredIP(conf, store, ranges, exclude, id, gw, preferred)
+		if err != nil || reserved != nil {
+			return reserved, err
+		}
+	}
+	return nil, nil
+}
+
+// ReservePreferredIP reserves preferred for the container with given ID
+// and returns it. It returns nil if preferred lies outside ranges, is
+// the gateway or is excluded, if the validation hook rejects it or if
+// another container holds it. The caller must hold the store lock.
+func ReservePreferredIP(conf *IPAMConfig, store backend.Store, ranges []Range, exclude ExcludeSet, id string, gw, preferred net.IP) (net.IP, error) {
+	if preferred == nil {
+		return nil, nil
+	}
+	if preferred.To4() != nil {
+		preferred = preferred.To4()
+	}
+	if (gw != nil && gw.Equal(preferred)) || exclude.Contains(preferred) {
+		return nil, nil
+	}
+	for _, r := range ranges {
+		if !r.Contains(preferred) {
 			continue
 		}
+		approved, err := ApproveIP(conf, id, preferred)
+		if err != nil || !approved {
+			return nil, err
+		}
+		reserved, _, err := store.Reserve(id, preferred)
+		if err != nil || !reserved {
+			return nil, err
+		}
+		return preferred, nil
+	}
+	return nil, nil
+}
 
-		reserved, err := a.store.Reserve(id, cur)
+// CheckRequestedGateway reports whether the requested IP is the gateway
+// IP, returning an error unless the configuration allows allocating it.
+// The gateway is never handed out by a scan either way.
+func CheckRequestedGateway(conf *IPAMConfig, gw, requested net.IP) (bool, error) {
+	if gw == nil || !gw.Equal(requested) {
+		return false, nil
+	}
+	if !conf.AllowGatewayAllocation {
+		return false, fmt.Errorf("requested IP must differ gateway IP")
+	}
+	return true, nil
+}
+
+// CheckRequestedRange returns an error if the IP requested through the
+// IP argument lies outside of ranges, unless the configuration allows
+// out-of-range requests. Addresses mapped to a MAC are not subject to
+// the check.
+func CheckRequestedRange(conf *IPAMConfig, ranges []Range, requested net.IP) error {
+	if conf.AllowOutOfRangeRequest {
+		return nil
+	}
+	for _, r := range ranges {
+		if r.Contains(requested) {
+			return nil
+		}
+	}
+	return fmt.Errorf("requested IP address %q is outside of the allocation range in network: %s", requested, conf.Name)
+}
+
+// HeldIPs returns the IPs reserved by the container with given ID.
+// Reserve succeeds again for these, so scans for a fresh IP skip them.
+func HeldIPs(store backend.Store, id string) (map[string]bool, error) {
+	ips, err := store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		held[ip.String()] = true
+	}
+	return held, nil
+}
+
+// scan walks the ranges once, reserving the first free IP. It returns
+// a nil config if every IP is taken. Stores that index their
+// reservations spare the scan a Reserve call on each taken IP; as the
+// index may miss IPs released since it was built, it is refreshed and
+// the ranges walked again before the scan gives up.
+func (a *IPAllocator) scan(id string, gw net.IP) (*types.IPConfig, error) {
+	if a.empty() {
+		return nil, nil
+	}
+
+	index, ok := a.store.(backend.Index)
+	if !ok {
+		held, err := HeldIPs(a.store, id)
 		if err != nil {
 			return nil, err
 		}
-		if reserved {
-			return &types.IPConfig{
-				IP:      net.IPNet{IP: cur, Mask: a.conf.Subnet.Mask},
-				Gateway: gw,
-				Routes:  a.conf.Routes,
-			}, nil
+		return a.walk(id, gw, func(cur net.IP) (bool, error) {
+			return held[cur.String()], nil
+		})
+	}
+
+	// an IP the container already holds is reserved in the index, so
+	// there is no need to look them up
+	res, err := a.walk(id, gw, index.IsReserved)
+	if err != nil || res != nil {
+		return res, err
+	}
+	if err := index.RefreshIndex(); err != nil {
+		return nil, err
+	}
+	return a.walk(id, gw, index.IsReserved)
+}
+
+// walk visits the ranges from the search start in the allocation
+// direction, reserving the first IP that is neither the gateway, nor
+// excluded, nor to be skipped
+func (a *IPAllocator) walk(id string, gw net.IP, skip func(net.IP) (bool, error)) (*types.IPConfig, error) {
+	startIP, endIP := a.getSearchRange()
+	for cur := startIP; ; {
+		if err := a.checkDeadline(); err != nil {
+			return nil, err
+		}
+		if (gw == nil || !cur.Equal(gw)) && !a.exclude.Contains(cur) {
+			skipped, err := skip(cur)
+			if err != nil {
+				return nil, err
+			}
+			if !skipped {
+				res, err := a.reserveScanned(id, cur, gw)
+				if err != nil || res != nil {
+					return res, err
+				}
+			}
+		}
+		if cur.Equal(endIP) {
+			break
+		}
+		// stop once back at the start, should endIP never be reached
+		if cur = a.step(cur); cur.Equal(startIP) {
+			break
 		}
 	}
-	return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+	return nil, nil
+}
+
+// reserveScanned tries to reserve cur as found by the scan, returning a
+// nil config if it is taken or rejected
+func (a *IPAllocator) reserveScanned(id string, cur, gw net.IP) (*types.IPConfig, error) {
+	reserved, err := a.reserveApproved(id, cur)
+	if err != nil || !reserved {
+		return nil, err
+	}
+	if err := a.rollBackLate(id, cur); err != nil {
+		return nil, err
+	}
+	a.log.With("containerID", id).With("ip", cur.String()).Debugf("reserved IP")
+	if err := a.store.SetLastReservedIP(a.rangeID(), cur); err != nil {
+		a.log.Warnf("error recording last reserved ip: %v", err)
+	}
+	return &types.IPConfig{
+		IP:      net.IPNet{IP: cur, Mask: a.conf.Subnet.Mask},
+		Gateway: a.conf.RangeGateway(cur, gw),
+		Routes:  a.conf.SubnetRoutes(),
+	}, nil
+}
+
+// reserveApproved reserves cur for the container with given ID once the
+// validation hook approved it; a rejected IP is passed over like a
+// taken one
+func (a *IPAllocator) reserveApproved(id string, cur net.IP) (bool, error) {
+	approved, err := ApproveIP(a.conf, id, cur)
+	if err != nil {
+		return false, err
+	}
+	if !approved {
+		a.log.With("containerID", id).With("ip", cur.String()).Debugf("validation hook rejected IP")
+		return false, nil
+	}
+	reserved, _, err := a.store.Reserve(id, cur)
+	return reserved, err
+}
+
+// Reservations returns every (container ID, IP) pair held in the store
+// of the network, including reservations outside the configured ranges
+func (a *IPAllocator) Reservations() ([]backend.Reservation, error) {
+	return a.store.List()
+}
+
+// IsReserved reports whether addr is reserved and, if so, the ID of the
+// container holding it. It does not take the store lock, so it never
+// holds up allocations.
+func (a *IPAllocator) IsReserved(addr net.IP) (bool, string, error) {
+	subnet := (*net.IPNet)(&a.conf.Subnet)
+	if !subnet.Contains(addr) {
+		return false, "", fmt.Errorf("%s not in network: %s", addr, subnet)
+	}
+	owner, err := backend.Owner(a.store, addr)
+	if err != nil {
+		return false, "", err
+	}
+	return owner != "", owner, nil
 }
 
 // Releases all IPs allocated for the container with given ID
@@ -139,7 +798,123 @@ func (a *IPAllocator) Release(id string) error {
 	a.store.Lock()
 	defer a.store.Unlock()
 
-	return a.store.ReleaseByID(id)
+	return ReleaseByID(a.conf, a.store, id)
+}
+
+// ReleaseMany releases all IPs of each of the containers with given
+// IDs under a single store lock. A failure for one ID does not stop the
+// others from being released; the failures are returned together.
+func (a *IPAllocator) ReleaseMany(ids []string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	var errs []error
+	for _, id := range ids {
+		if err := ReleaseByID(a.conf, a.store, id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReleaseIP releases a single IP held by the container with given ID,
+// leaving its other reservations in place. An IP still pending
+// confirmation is released as well.
+func (a *IPAllocator) ReleaseIP(id string, ip net.IP) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	owner := id
+	if a.conf.ConfirmTTL > 0 {
+		held, err := backend.Owner(a.store, ip)
+		if err != nil {
+			return err
+		}
+		if held == backend.PendingID(id) {
+			owner = held
+		}
+	}
+	if err := a.store.ReleaseByIP(owner, ip); err != nil {
+		return err
+	}
+	if a.conf.ReuseMode == ReuseModeLIFO {
+		return a.store.PushFreed(ip)
+	}
+	return nil
+}
+
+// Check verifies that the container with given ID still holds a
+// reservation within the allocator's ranges. Reservations of the other
+// address family are ignored. If expected is not nil it must be one of
+// the reserved IPs.
+func (a *IPAllocator) Check(id string, expected net.IP) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	all, err := a.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if a.conf.ConfirmTTL > 0 {
+		pending, err := a.store.GetByID(backend.PendingID(id))
+		if err != nil {
+			return err
+		}
+		all = append(all, pending...)
+	}
+	v4 := a.ranges[0].Start.To4() != nil
+	var ips []net.IP
+	for _, reserved := range all {
+		if (reserved.To4() != nil) == v4 {
+			ips = append(ips, reserved)
+		}
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IP addresses reserved for container %s in network: %s", id, a.conf.Name)
+	}
+
+	found := expected == nil
+	for _, reserved := range ips {
+		if a.rangeIndex(reserved) < 0 && !(a.conf.AllowGatewayAllocation && reserved.Equal(a.conf.GatewayIP())) {
+			return fmt.Errorf("reserved IP %s for container %s is outside the configured range of network: %s", reserved, id, a.conf.Name)
+		}
+		if expected != nil && reserved.Equal(expected) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("expected IP %s is not reserved for container %s in network: %s", expected, id, a.conf.Name)
+	}
+	return nil
+}
+
+// Stats returns the Usage of the ranges, logging a store error. It
+// reads the store without locking it so it can be polled from outside
+// the plugin.
+func (a *IPAllocator) Stats() (total, used int) {
+	total, used, err := Usage(a.conf, a.store, a.ranges, a.exclude)
+	if err != nil {
+		a.log.Warnf("error listing reservations: %v", err)
+	}
+	return total, used
+}
+
+// exclusiveEnd returns the exclusive end of a range whose last address
+// is last. The address after the top of the address space would wrap
+// around to zero, so a range reaching the top ends just below it.
+func exclusiveEnd(last net.IP) net.IP {
+	end := ip.NextIP(last)
+	if ip.Cmp(end, last) < 0 {
+		return last
+	}
+	return end
+}
+
+// pointToPoint reports whether ipnet is an IPv4 /31 or /32, which have
+// neither a network nor a broadcast address
+func pointToPoint(ipnet *net.IPNet) bool {
+	ones, bits := ipnet.Mask.Size()
+	return bits == 32 && ones >= 31
 }
 
 func networkRange(ipnet *net.IPNet) (net.IP, net.IP, error) {
@@ -165,38 +940,95 @@ func networkRange(ipnet *net.IPNet) (net.IP, net.IP, error) {
 	return ipnet.IP, end, nil
 }
 
-// nextIP returns the next ip of curIP within ipallocator's subnet
+// empty reports whether none of the ranges hold any addresses
+func (a *IPAllocator) empty() bool {
+	for _, r := range a.ranges {
+		if !r.Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// nextIP returns the next ip of curIP within ipallocator's ranges,
+// wrapping from the end of one range to the start of the next
 func (a *IPAllocator) nextIP(curIP net.IP) net.IP {
-	if curIP.Equal(a.end) {
-		return a.start
+	i := a.rangeIndex(curIP)
+	if i < 0 {
+		return a.ranges[0].Start
+	}
+	next := ip.NextIP(curIP)
+	// NextIP wraps around at the top of the address space
+	if next.Equal(a.ranges[i].End) || ip.Cmp(next, curIP) <= 0 {
+		return a.ranges[(i+1)%len(a.ranges)].Start
 	}
-	return ip.NextIP(curIP)
+	return next
 }
 
-// getSearchRange returns the start and end ip based on the last reserved ip
+// rangeIndex returns the index of the range containing addr, or -1
+func (a *IPAllocator) rangeIndex(addr net.IP) int {
+	for i, r := range a.ranges {
+		if r.Contains(addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// getSearchRange returns the first and last ip to try based on the last
+// reserved ip and the allocation direction; the search covers every
+// range exactly once
 func (a *IPAllocator) getSearchRange() (net.IP, net.IP) {
-	var startIP net.IP
-	var endIP net.IP
-	startFromLastReservedIP := false
-	lastReservedIP, err := a.store.LastReservedIP()
+	lastReservedIP, err := a.store.LastReservedIP(a.rangeID(), a.ranges[0].Start.To4() == nil)
 	if err != nil {
-		log.Printf("Error retriving last reserved ip: %v", err)
-	} else if lastReservedIP != nil {
-		subnet := net.IPNet{
-			IP:   a.conf.Subnet.IP,
-			Mask: a.conf.Subnet.Mask,
-		}
-		err := validateRangeIP(lastReservedIP, &subnet)
-		if err == nil {
-			startFromLastReservedIP = true
+		a.log.Warnf("error retrieving last reserved ip: %v", err)
+	} else if lastReservedIP != nil && a.rangeIndex(lastReservedIP) >= 0 {
+		return a.step(lastReservedIP), lastReservedIP
+	}
+	start := a.jitteredStart()
+	if a.descending() {
+		// walk down from the ip below the start, so that the top of
+		// the ranges comes first
+		return a.prevIP(start), start
+	}
+	return start, a.prevIP(start)
+}
+
+// prevIP returns the previous ip of curIP within ipallocator's ranges,
+// wrapping from the start of one range to the end of the one before;
+// curIP must lie within the ranges
+func (a *IPAllocator) prevIP(curIP net.IP) net.IP {
+	for i, r := range a.ranges {
+		if curIP.Equal(r.Start) {
+			prev := a.ranges[(i+len(a.ranges)-1)%len(a.ranges)]
+			return ip.PrevIP(prev.End)
 		}
 	}
-	if startFromLastReservedIP {
-		startIP = a.nextIP(lastReservedIP)
-		endIP = lastReservedIP
-	} else {
-		startIP = a.start
-		endIP = a.end
+	return ip.PrevIP(curIP)
+}
+
+// CheckLastReserved returns an error if the last reserved IP the scan
+// resumes after cannot be read from the store or lies outside of the
+// subnet. No IP recorded yet is not an error.
+func (a *IPAllocator) CheckLastReserved() error {
+	subnet := (*net.IPNet)(&a.conf.Subnet)
+	last, err := a.store.LastReservedIP(a.rangeID(), subnet.IP.To4() == nil)
+	if err != nil {
+		return fmt.Errorf("failed to read the last reserved IP of network %s: %v", a.conf.Name, err)
+	}
+	if last != nil && !subnet.Contains(last) {
+		return fmt.Errorf("last reserved IP %s is not in network: %s", last, subnet)
+	}
+	return nil
+}
+
+// rangeID identifies the ranges of the allocator in the store, so
+// allocators sharing a store over different ranges keep separate last
+// reserved ips
+func (a *IPAllocator) rangeID() string {
+	ids := make([]string, len(a.ranges))
+	for i, r := range a.ranges {
+		ids[i] = fmt.Sprintf("%s-%s", r.Start, ip.PrevIP(r.End))
 	}
-	return startIP, endIP
+	return strings.Join(ids, ",")
 }
@@ -15,15 +15,80 @@
 package sequential
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ipam/log"
 	"github.com/containernetworking/cni/pkg/types"
-	fakestore "github.com/containernetworking/cni/plugins/ipam/host-local/backend/testing"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+	fakestore "github.com/containernetworking/cni/plugins/ipam/store/testing"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"net"
 )
 
+// failingReleaseStore fails to release the container with the given ID
+type failingReleaseStore struct {
+	*fakestore.FakeStore
+	failID string
+}
+
+func (s *failingReleaseStore) ReleaseByID(id string) error {
+	if id == s.failID {
+		return errors.New("store unavailable")
+	}
+	return s.FakeStore.ReleaseByID(id)
+}
+
+// slowStore takes delay for every reservation attempt
+type slowStore struct {
+	*fakestore.FakeStore
+	delay time.Duration
+}
+
+func (s *slowStore) Reserve(id string, ip net.IP) (bool, string, error) {
+	time.Sleep(s.delay)
+	return s.FakeStore.Reserve(id, ip)
+}
+
+// racingStore has another container reserve every IP as soon as it is
+// released, as a plugin not holding the store lock could
+type racingStore struct {
+	*fakestore.FakeStore
+}
+
+func (s *racingStore) ReleaseByID(id string) error {
+	ips, err := s.FakeStore.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.FakeStore.ReleaseByID(id); err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		s.FakeStore.Reserve("racer", ip)
+	}
+	return nil
+}
+
+func (s *racingStore) ReleaseByIP(id string, ip net.IP) error {
+	if err := s.FakeStore.ReleaseByIP(id, ip); err != nil {
+		return err
+	}
+	s.FakeStore.Reserve("racer", ip)
+	return nil
+}
+
 type AllocatorTestCase struct {
 	subnet       string
+	ranges       []IPRange
 	ipmap        map[string]string
 	expectResult string
 	lastIP       string
@@ -31,17 +96,24 @@ type AllocatorTestCase struct {
 
 func (t AllocatorTestCase) run() (*types.IPConfig, error) {
 	subnet, err := types.ParseCIDR(t.subnet)
+	Expect(err).ToNot(HaveOccurred())
 	conf := IPAMConfig{
 		Name:   "test",
 		Type:   "host-local",
 		Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		Ranges: t.ranges,
 	}
 	store := fakestore.NewFakeStore(t.ipmap, net.ParseIP(t.lastIP))
-	alloc, _ := NewIPAllocator(&conf, store)
+	alloc, err := NewIPAllocator(&conf, store)
+	Expect(err).ToNot(HaveOccurred())
 	res, err := alloc.Get("ID")
 	return res, err
 }
 
+func ipRange(start, end string) IPRange {
+	return IPRange{RangeStart: net.ParseIP(start), RangeEnd: net.ParseIP(end)}
+}
+
 var _ = Describe("host-local ip allocator", func() {
 	Context("when has free ip", func() {
 		It("should allocate ips in round robin", func() {
@@ -65,24 +137,22 @@ var _ = Describe("host-local ip allocator", func() {
 				{
 					subnet:       "10.0.0.0/29",
 					ipmap:        map[string]string{},
-					expectResult: "10.0.0.7",
-					lastIP:       "10.0.0.6",
+					expectResult: "10.0.0.6",
+					lastIP:       "10.0.0.5",
 				},
 				{
 					subnet: "10.0.0.0/29",
 					ipmap: map[string]string{
 						"10.0.0.5": "id",
-						"10.0.0.6": "id",
 					},
-					expectResult: "10.0.0.7",
+					expectResult: "10.0.0.6",
 					lastIP:       "10.0.0.4",
 				},
-				// round robin to the beginning
+				// round robin to the beginning, skipping the broadcast
+				// address
 				{
-					subnet: "10.0.0.0/29",
-					ipmap: map[string]string{
-						"10.0.0.7": "id",
-					},
+					subnet:       "10.0.0.0/29",
+					ipmap:        map[string]string{},
 					expectResult: "10.0.0.2",
 					lastIP:       "10.0.0.6",
 				},
@@ -105,32 +175,2802 @@ var _ = Describe("host-local ip allocator", func() {
 		})
 	})
 
-	Context("when out of ips", func() {
-		It("returns a meaningful error", func() {
+	Context("when rangeEnd reaches the broadcast address", func() {
+		newAllocator := func(subnet, rangeEnd string) *IPAllocator {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart: net.ParseIP("10.0.0.250"),
+				RangeEnd:   net.ParseIP(rangeEnd),
+			}
+			if n.IP.To4() == nil {
+				conf.RangeStart = net.ParseIP("fd00::fffe")
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("never hands out the IPv4 broadcast address", func() {
+			alloc := newAllocator("10.0.0.0/24", "10.0.0.255")
+			var ips []string
+			for i := 0; i < 5; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				ips = append(ips, res.IP.IP.String())
+			}
+			Expect(ips).To(Equal([]string{"10.0.0.250", "10.0.0.251", "10.0.0.252", "10.0.0.253", "10.0.0.254"}))
+			_, err := alloc.Get("ID5")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("rejects a request for the broadcast address", func() {
+			alloc := newAllocator("10.0.0.0/24", "10.0.0.255")
+			alloc.conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.0.255")}
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError(`requested IP address "10.0.0.255" is outside of the allocation range in network: test`))
+		})
+
+		It("hands out the last IPv6 address", func() {
+			alloc := newAllocator("fd00::/112", "fd00::ffff")
+			var ips []string
+			for i := 0; i < 2; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				ips = append(ips, res.IP.IP.String())
+			}
+			Expect(ips).To(Equal([]string{"fd00::fffe", "fd00::ffff"}))
+		})
+	})
+
+	Context("when multiple ranges are configured", func() {
+		ranges := []IPRange{
+			ipRange("10.0.0.10", "10.0.0.12"),
+			ipRange("10.0.0.100", "10.0.0.101"),
+		}
+
+		It("should allocate across ranges in order", func() {
 			testCases := []AllocatorTestCase{
+				// fresh start in the first range
 				{
-					subnet: "10.0.0.0/30",
+					subnet:       "10.0.0.0/24",
+					ranges:       ranges,
+					ipmap:        map[string]string{},
+					expectResult: "10.0.0.10",
+				},
+				// end of the first range moves on to the second
+				{
+					subnet:       "10.0.0.0/24",
+					ranges:       ranges,
+					ipmap:        map[string]string{},
+					expectResult: "10.0.0.100",
+					lastIP:       "10.0.0.12",
+				},
+				// end of the last range wraps to the first
+				{
+					subnet: "10.0.0.0/24",
+					ranges: ranges,
 					ipmap: map[string]string{
-						"10.0.0.2": "id",
-						"10.0.0.3": "id",
+						"10.0.0.10": "id",
 					},
+					expectResult: "10.0.0.11",
+					lastIP:       "10.0.0.101",
 				},
+				// addresses between ranges are never handed out
 				{
-					subnet: "10.0.0.0/29",
+					subnet: "10.0.0.0/24",
+					ranges: ranges,
 					ipmap: map[string]string{
-						"10.0.0.2": "id",
-						"10.0.0.3": "id",
-						"10.0.0.4": "id",
-						"10.0.0.5": "id",
-						"10.0.0.6": "id",
-						"10.0.0.7": "id",
+						"10.0.0.10": "id",
+						"10.0.0.11": "id",
+						"10.0.0.12": "id",
 					},
+					expectResult: "10.0.0.100",
+				},
+				// lastIP between ranges restarts from the first range
+				{
+					subnet:       "10.0.0.0/24",
+					ranges:       ranges,
+					ipmap:        map[string]string{},
+					expectResult: "10.0.0.10",
+					lastIP:       "10.0.0.50",
 				},
 			}
+
 			for _, tc := range testCases {
-				_, err := tc.run()
-				Expect(err).To(MatchError("no IP addresses available in network: test"))
+				res, err := tc.run()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(tc.expectResult))
+			}
+		})
+
+		It("should skip the gateway inside a range", func() {
+			tc := AllocatorTestCase{
+				subnet:       "10.0.0.0/24",
+				ranges:       []IPRange{ipRange("10.0.0.1", "10.0.0.3")},
+				ipmap:        map[string]string{},
+				expectResult: "10.0.0.2",
+			}
+			res, err := tc.run()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal(tc.expectResult))
+		})
+
+		It("returns a meaningful error when all ranges are full", func() {
+			tc := AllocatorTestCase{
+				subnet: "10.0.0.0/24",
+				ranges: ranges,
+				ipmap: map[string]string{
+					"10.0.0.10":  "id",
+					"10.0.0.11":  "id",
+					"10.0.0.12":  "id",
+					"10.0.0.100": "id",
+					"10.0.0.101": "id",
+				},
+				lastIP: "10.0.0.11",
+			}
+			_, err := tc.run()
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+	})
+
+	Context("when the subnet is IPv6", func() {
+		newAllocator := func(subnet string, ranges []IPRange) (*IPAllocator, *fakestore.FakeStore) {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Ranges: ranges,
+			}
+			store := fakestore.NewFakeStore(map[string]string{}, nil)
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc, store
+		}
+
+		It("skips the network address and the gateway", func() {
+			alloc, _ := newAllocator("fd00::/120", nil)
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.String()).To(Equal("fd00::2/120"))
+			Expect(res.Gateway.String()).To(Equal("fd00::1"))
+		})
+
+		It("hands released addresses back out in order", func() {
+			alloc, _ := newAllocator("fd00::/120", []IPRange{ipRange("fd00::2", "fd00::4")})
+			expected := []string{"fd00::2", "fd00::3", "fd00::4"}
+			for _, e := range expected {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(e))
+			}
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+
+			Expect(alloc.Release("ID")).To(Succeed())
+			for _, e := range expected {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(e))
+			}
+		})
+
+		It("increments across byte boundaries", func() {
+			alloc, _ := newAllocator("fd00::/112", []IPRange{ipRange("fd00::fe", "fd00::101")})
+			for _, e := range []string{"fd00::fe", "fd00::ff", "fd00::100", "fd00::101"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(e))
+			}
+		})
+	})
+
+	Context("when checking a reservation", func() {
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				RangeStart: net.ParseIP("10.0.0.10"),
+				RangeEnd:   net.ParseIP("10.0.0.20"),
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("succeeds when the container holds the expected IP", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.12": "ID"})
+			Expect(alloc.Check("ID", net.ParseIP("10.0.0.12"))).To(Succeed())
+			Expect(alloc.Check("ID", nil)).To(Succeed())
+		})
+
+		It("fails when the container has no reservation", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.12": "other"})
+			Expect(alloc.Check("ID", nil)).To(MatchError("no IP addresses reserved for container ID in network: test"))
+		})
+
+		It("fails when the reservation is outside the range", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.30": "ID"})
+			Expect(alloc.Check("ID", nil)).To(MatchError("reserved IP 10.0.0.30 for container ID is outside the configured range of network: test"))
+		})
+
+		It("fails when the reservation does not match the expected IP", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.12": "ID"})
+			Expect(alloc.Check("ID", net.ParseIP("10.0.0.13"))).To(MatchError("expected IP 10.0.0.13 is not reserved for container ID in network: test"))
+		})
+	})
+
+	Context("when releasing a single IP", func() {
+		var (
+			alloc *IPAllocator
+			store *fakestore.FakeStore
+		)
+
+		BeforeEach(func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			}
+			store = fakestore.NewFakeStore(map[string]string{
+				"10.0.0.2": "ID",
+				"10.0.0.3": "ID",
+				"10.0.0.4": "other",
+			}, nil)
+			alloc, err = NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("frees only the matching reservation", func() {
+			Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].String()).To(Equal("10.0.0.3"))
+		})
+
+		It("refuses to free another container's IP", func() {
+			err := alloc.ReleaseIP("ID", net.ParseIP("10.0.0.4"))
+			Expect(err).To(MatchError("10.0.0.4 is not reserved by container ID"))
+			ips, err := store.GetByID("other")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("fails for an IP that is not reserved", func() {
+			err := alloc.ReleaseIP("ID", net.ParseIP("10.0.0.5"))
+			Expect(err).To(MatchError("10.0.0.5 is not reserved"))
+		})
+	})
+
+	Context("when the subnet is resized", func() {
+		newAllocator := func(subnet string, store *fakestore.FakeStore) (*IPAllocator, error) {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+			}
+			return NewIPAllocator(&conf, store)
+		}
+
+		It("keeps the reservations and hands out the new addresses of an expanded subnet", func() {
+			store := fakestore.NewFakeStore(map[string]string{}, nil)
+			alloc, err := newAllocator("10.0.0.0/25", store)
+			Expect(err).ToNot(HaveOccurred())
+			for i := 2; i < 127; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(fmt.Sprintf("10.0.0.%d", i)))
+			}
+			_, err = alloc.Get("full")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+
+			alloc, err = newAllocator("10.0.0.0/24", store)
+			Expect(err).ToNot(HaveOccurred())
+			// the scan resumes after the last address of the old subnet
+			for i := 127; i < 255; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(fmt.Sprintf("10.0.0.%d", i)))
+			}
+			ips, err := store.GetByID("ID2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].String()).To(Equal("10.0.0.2"))
+		})
+
+		It("refuses a store holding reservations outside of a shrunk subnet", func() {
+			store := fakestore.NewFakeStore(map[string]string{"10.0.0.5": "a", "10.0.0.200": "b"}, nil)
+			_, err := newAllocator("10.0.0.0/25", store)
+			Expect(err).To(MatchError("reserved IP 10.0.0.200 is outside of network: test; release it before shrinking the subnet"))
+
+			Expect(store.ReleaseByID("b")).To(Succeed())
+			_, err = newAllocator("10.0.0.0/25", store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("ignores reservations of the other address family", func() {
+			store := fakestore.NewFakeStore(map[string]string{"10.0.0.5": "a", "fd00::5": "a"}, nil)
+			_, err := newAllocator("10.0.0.0/25", store)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = newAllocator("fd00::/120", store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when releasing by label", func() {
+		var (
+			alloc *IPAllocator
+			store *fakestore.FakeStore
+		)
+
+		BeforeEach(func() {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+			}
+			store = fakestore.NewFakeStore(map[string]string{
+				"10.0.0.2":  "a",
+				"10.0.0.3":  "b",
+				"10.0.0.4":  "c",
+				"10.0.0.5":  "d",
+				"10.0.0.6":  "e",
+				"10.0.0.10": backend.PreReservedID,
+			}, nil)
+			for ip, label := range map[string]string{
+				"10.0.0.2":  "team-a/web",
+				"10.0.0.3":  "team-a/db",
+				"10.0.0.4":  "team-b/web",
+				"10.0.0.5":  "team-a",
+				"10.0.0.10": "team-a/reserved",
+			} {
+				store.SetLabel(net.ParseIP(ip), label)
+			}
+			alloc, err = NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		remaining := func() []string {
+			list, err := store.List()
+			Expect(err).ToNot(HaveOccurred())
+			var ips []string
+			for _, r := range list {
+				ips = append(ips, r.IP.String())
+			}
+			return ips
+		}
+
+		It("releases the reservations of a namespace", func() {
+			freed, err := alloc.ReleaseByLabel(LabelKeyNamespace, "team-a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(Equal(2))
+			// a plain label has no namespace, and pre-reserved IPs stay
+			Expect(remaining()).To(ConsistOf("10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.10"))
+		})
+
+		It("releases the reservations of a pod name", func() {
+			freed, err := alloc.ReleaseByLabel(LabelKeyName, "web")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(Equal(2))
+			Expect(remaining()).To(ConsistOf("10.0.0.3", "10.0.0.5", "10.0.0.6", "10.0.0.10"))
+		})
+
+		It("matches the whole label", func() {
+			freed, err := alloc.ReleaseByLabel(LabelKeyLabel, "team-a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(Equal(1))
+			Expect(remaining()).To(ConsistOf("10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.6", "10.0.0.10"))
+		})
+
+		It("frees nothing if no label matches", func() {
+			freed, err := alloc.ReleaseByLabel(LabelKeyNamespace, "team-c")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(BeZero())
+			Expect(remaining()).To(HaveLen(6))
+		})
+
+		It("rejects an unknown key", func() {
+			_, err := alloc.ReleaseByLabel("app", "web")
+			Expect(err).To(MatchError(`unknown label key "app": must be "namespace", "name" or "label"`))
+			Expect(remaining()).To(HaveLen(6))
+		})
+	})
+
+	Context("when releasing many containers", func() {
+		newAllocator := func(store backend.Store) *IPAllocator {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			}
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("releases the existing containers and ignores unknown IDs", func() {
+			ipmap := map[string]string{
+				"10.0.0.2": "a",
+				"10.0.0.3": "a",
+				"10.0.0.4": "b",
+				"10.0.0.5": "c",
+			}
+			alloc := newAllocator(fakestore.NewFakeStore(ipmap, nil))
+			Expect(alloc.ReleaseMany([]string{"a", "missing", "c"})).To(Succeed())
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.4": "b"}))
+		})
+
+		It("releases a container twice and an unknown one without error", func() {
+			for _, mode := range []string{"", ReuseModeLIFO} {
+				ipmap := map[string]string{"10.0.0.2": "a", "10.0.0.3": "b"}
+				alloc := newAllocator(fakestore.NewFakeStore(ipmap, nil))
+				alloc.conf.ReuseMode = mode
+				Expect(alloc.Release("a")).To(Succeed())
+				Expect(alloc.Release("a")).To(Succeed())
+				Expect(alloc.Release("never-seen")).To(Succeed())
+				Expect(ipmap).To(Equal(map[string]string{"10.0.0.3": "b"}))
+			}
+		})
+
+		It("carries on past a failing ID and reports it", func() {
+			ipmap := map[string]string{
+				"10.0.0.2": "a",
+				"10.0.0.3": "b",
+				"10.0.0.4": "c",
+			}
+			store := &failingReleaseStore{fakestore.NewFakeStore(ipmap, nil), "b"}
+			err := newAllocator(store).ReleaseMany([]string{"a", "b", "c"})
+			Expect(err).To(MatchError("failed to release b: store unavailable"))
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.3": "b"}))
+		})
+	})
+
+	Context("when clearing all reservations", func() {
+		It("empties the store and starts the scan over", func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{Name: "test", Subnet: types.IPNet(*subnet)}
+			ipmap := map[string]string{"10.0.0.7": "a", "10.0.0.8": "b"}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, net.ParseIP("10.0.0.8")))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("c")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.9"))
+
+			cleared, err := alloc.ClearAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(3))
+			Expect(ipmap).To(BeEmpty())
+			last, err := alloc.store.LastReservedIP(alloc.rangeID(), false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last).To(BeNil())
+
+			res, err = alloc.Get("d")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+
+		It("refuses a store that cannot be cleared", func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{Name: "test", Subnet: types.IPNet(*subnet)}
+			// embedding the interface hides Clear
+			store := struct{ backend.Store }{fakestore.NewFakeStore(map[string]string{}, nil)}
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = alloc.ClearAll()
+			Expect(err).To(MatchError("the store of network test cannot be cleared"))
+		})
+	})
+
+	Context("when reserving a block", func() {
+		var store *fakestore.FakeStore
+
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				RangeStart: net.ParseIP("10.0.0.2"),
+				RangeEnd:   net.ParseIP("10.0.0.6"),
+			}
+			store = fakestore.NewFakeStore(ipmap, nil)
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		blockIPs := func(confs []*types.IPConfig) []string {
+			var ips []string
+			for _, c := range confs {
+				ips = append(ips, c.IP.IP.String())
+			}
+			return ips
+		}
+
+		It("reserves consecutive IPs under one ID", func() {
+			alloc := newAllocator(map[string]string{})
+			confs, err := alloc.GetBlock("ID", 3)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(blockIPs(confs)).To(Equal([]string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}))
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(3))
+
+			Expect(alloc.Release("ID")).To(Succeed())
+			ips, err = store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("rolls back a block that straddles a reserved IP", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.3": "other"})
+			confs, err := alloc.GetBlock("ID", 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(blockIPs(confs)).To(Equal([]string{"10.0.0.4", "10.0.0.5"}))
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(2))
+		})
+
+		It("reserves nothing when no block fits", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.4": "other"})
+			_, err := alloc.GetBlock("ID", 3)
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+			Expect(err).To(MatchError("no block of 3 consecutive IP addresses available in network: test"))
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("rejects an invalid block size", func() {
+			alloc := newAllocator(map[string]string{})
+			_, err := alloc.GetBlock("ID", 0)
+			Expect(err).To(MatchError("invalid block size 0"))
+		})
+	})
+
+	Context("when leases expire", func() {
+		newAllocator := func(ttl time.Duration) (*IPAllocator, *fakestore.FakeStore) {
+			subnet, err := types.ParseCIDR("10.0.0.0/30")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:     "test",
+				Subnet:   types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				LeaseTTL: Duration(ttl),
+			}
+			store := fakestore.NewFakeStore(map[string]string{"10.0.0.2": "old"}, nil)
+			store.SetReservedAt(net.ParseIP("10.0.0.2"), time.Now().Add(-2*time.Hour))
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc, store
+		}
+
+		It("reclaims reservations older than the TTL when the range is full", func() {
+			alloc, store := newAllocator(time.Hour)
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+
+			ips, err := store.GetByID("old")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("keeps reservations younger than the TTL", func() {
+			alloc, _ := newAllocator(3 * time.Hour)
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("never expires reservations when no TTL is set", func() {
+			alloc, _ := newAllocator(0)
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+	})
+
+	Context("when released IPs have a grace period", func() {
+		newAllocator := func() (*IPAllocator, *fakestore.FakeStore) {
+			subnet, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:               "test",
+				Subnet:             types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				ReleaseGracePeriod: Duration(time.Minute),
+			}
+			store := fakestore.NewFakeStore(map[string]string{}, nil)
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc, store
+		}
+
+		It("lets only the previous owner reclaim the IP within the grace period", func() {
+			alloc, _ := newAllocator()
+			res, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			Expect(alloc.Release("a")).To(Succeed())
+
+			res, err = alloc.Get("b")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.3"))
+
+			res, err = alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+
+		It("reclaims a requested IP held for the container", func() {
+			alloc, store := newAllocator()
+			_, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("a")).To(Succeed())
+
+			alloc.conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.0.2")}
+			res, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+
+			ips, err := store.GetByID(backend.GraceID("a"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("never frees the IP while holding or reclaiming it", func() {
+			alloc, store := newAllocator()
+			alloc.store = &racingStore{store}
+			_, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("a")).To(Succeed())
+			owner, err := store.Owner(net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(owner).To(Equal(backend.GraceID("a")))
+
+			res, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+
+		It("lets any container take the IP once the grace period is over", func() {
+			alloc, store := newAllocator()
+			// fill the range so the scan has to come back to the released IP
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				_, err := alloc.Get(id)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(alloc.Release("a")).To(Succeed())
+
+			_, err := alloc.Get("f")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+
+			store.SetReservedAt(net.ParseIP("10.0.0.2"), time.Now().Add(-2*time.Minute))
+			res, err := alloc.Get("f")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+	})
+
+	Context("when classifying errors", func() {
+		newAllocator := func(ipmap map[string]string, args *IPAMArgs) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/30")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Args:   args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("marks exhaustion with ErrPoolExhausted", func() {
+			_, err := newAllocator(map[string]string{"10.0.0.2": "id"}, nil).Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+			Expect(errors.Is(err, ErrIPNotAvailable)).To(BeFalse())
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("marks a taken requested IP with ErrIPNotAvailable", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.2": "id"}, &IPAMArgs{IP: net.ParseIP("10.0.0.2")})
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrIPNotAvailable)).To(BeTrue())
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeFalse())
+			Expect(err).To(MatchError(`requested IP address "10.0.0.2" is reserved by container id in network: test`))
+		})
+
+		It("names the container holding a requested IP", func() {
+			ipmap := map[string]string{}
+			_, err := newAllocator(ipmap, nil).Get("A")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.2")}).Get("B")
+			var conflict *ErrIPConflict
+			Expect(errors.As(err, &conflict)).To(BeTrue())
+			Expect(conflict.IP.String()).To(Equal("10.0.0.2"))
+			Expect(conflict.OwnerID).To(Equal("A"))
+			Expect(err).To(MatchError(`requested IP address "10.0.0.2" is reserved by container A in network: test`))
+		})
+
+		It("returns the requested IP again when its owner retries", func() {
+			ipmap := map[string]string{}
+			alloc := newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.2")})
+			first, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			second, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(Equal(first))
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "ID"}))
+		})
+
+		It("does not scan onto an IP the container already holds", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.2": "ID"}, nil)
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("matches neither for configuration errors", func() {
+			alloc := newAllocator(map[string]string{}, &IPAMArgs{IP: net.ParseIP("10.0.1.2")})
+			_, err := alloc.Get("ID")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeFalse())
+			Expect(errors.Is(err, ErrIPNotAvailable)).To(BeFalse())
+		})
+	})
+
+	Context("when IPs are excluded", func() {
+		newAllocator := func(exclude ...string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: n.IP, Mask: n.Mask},
+				ExcludeIPs: exclude,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("never hands out excluded addresses", func() {
+			// .2 - .6 are allocatable; .4 and .6 - .7 are excluded
+			alloc := newAllocator("10.0.0.4", "10.0.0.6/31")
+			for _, expected := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.5"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("refuses a requested IP that is excluded", func() {
+			alloc := newAllocator("10.0.0.4")
+			alloc.conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.0.4")}
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError(`requested IP address "10.0.0.4" is excluded in network: test`))
+		})
+
+		It("leaves excluded addresses out of the stats", func() {
+			// .4 is listed twice and .1 is the gateway
+			alloc := newAllocator("10.0.0.4", "10.0.0.4/31", "10.0.0.1")
+			total, used := alloc.Stats()
+			Expect(total).To(Equal(3))
+			Expect(used).To(BeZero())
+		})
+	})
+
+	Context("when the boundaries of nested subnets are excluded", func() {
+		newAllocator := func() *IPAllocator {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/16",
+					"rangeStart": "10.0.1.254",
+					"rangeEnd": "10.0.3.1",
+					"excludeSubnetBoundaries": ["10.0.2.0/24", "10.0.3.0/24"]
+				}
+			}`), "")
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("excludes the network and broadcast address of each", func() {
+			set := newAllocator().exclude
+			var excluded []string
+			for _, n := range set {
+				excluded = append(excluded, n.String())
 			}
+			Expect(excluded).To(Equal([]string{"10.0.2.0/32", "10.0.2.255/32", "10.0.3.0/32", "10.0.3.255/32"}))
+		})
+
+		It("passes over them when scanning", func() {
+			alloc := newAllocator()
+			var got []string
+			for i := 0; i < 4; i++ {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				got = append(got, res.IP.IP.String())
+			}
+			Expect(got).To(Equal([]string{"10.0.1.254", "10.0.1.255", "10.0.2.1", "10.0.2.2"}))
+
+			// the 260 addresses from 10.0.1.254 to 10.0.3.1 less 10.0.2.0,
+			// 10.0.2.255 and 10.0.3.0
+			total, _ := alloc.Stats()
+			Expect(total).To(Equal(257))
+		})
+
+		It("rejects a nested subnet outside of the network", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/16",
+					"excludeSubnetBoundaries": ["10.1.0.0/24"]
+				}
+			}`), "")
+			Expect(err).To(MatchError("excludeSubnetBoundaries entry 10.1.0.0/24 is not in network: 10.0.0.0/16"))
+		})
+	})
+
+	Context("when an IP outside of the range is requested", func() {
+		newAllocator := func(allow bool, ip string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                   "test",
+				Subnet:                 types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart:             net.ParseIP("10.0.0.10"),
+				RangeEnd:               net.ParseIP("10.0.0.20"),
+				AllowOutOfRangeRequest: allow,
+				Args:                   &IPAMArgs{IP: net.ParseIP(ip)},
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("hands out a requested IP within the range", func() {
+			res, err := newAllocator(false, "10.0.0.20").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.20"))
+		})
+
+		It("refuses a requested IP of the subnet outside of the range", func() {
+			_, err := newAllocator(false, "10.0.0.5").Get("ID")
+			Expect(err).To(MatchError(`requested IP address "10.0.0.5" is outside of the allocation range in network: test`))
+		})
+
+		It("hands out a requested IP outside of the range when allowed", func() {
+			res, err := newAllocator(true, "10.0.0.5").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+		})
+	})
+
+	Context("when the gateway IP is requested", func() {
+		newAllocator := func(allow bool, args *IPAMArgs) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                   "test",
+				Subnet:                 types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart:             net.ParseIP("10.0.0.10"),
+				RangeEnd:               net.ParseIP("10.0.0.20"),
+				AllowGatewayAllocation: allow,
+				Args:                   args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("refuses it by default", func() {
+			_, err := newAllocator(false, &IPAMArgs{IP: net.ParseIP("10.0.0.1")}).Get("ID")
+			Expect(err).To(MatchError("requested IP must differ gateway IP"))
+		})
+
+		It("hands it out when allowed, outside of the range as well", func() {
+			alloc := newAllocator(true, &IPAMArgs{IP: net.ParseIP("10.0.0.1")})
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.1"))
+			Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+			Expect(alloc.Check("ID", net.ParseIP("10.0.0.1"))).To(Succeed())
+		})
+
+		It("never hands it out during a scan", func() {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                   "test",
+				Subnet:                 types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart:             net.ParseIP("10.0.0.1"),
+				RangeEnd:               net.ParseIP("10.0.0.2"),
+				AllowGatewayAllocation: true,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			_, err = alloc.Get("ID2")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+	})
+
+	Context("when a utilization limit is set", func() {
+		newAllocator := func(ipmap map[string]string, args *IPAMArgs) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                  "test",
+				Subnet:                types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart:            net.ParseIP("10.0.0.10"),
+				RangeEnd:              net.ParseIP("10.0.0.19"),
+				MaxUtilizationPercent: 80,
+				Args:                  args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("allocates up to the limit and then fails", func() {
+			ipmap := map[string]string{"10.0.0.50": "outside"}
+			alloc := newAllocator(ipmap, nil)
+			for i := 0; i < 8; i++ {
+				_, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, err := alloc.Get("ID8")
+			Expect(errors.Is(err, ErrUtilizationLimit)).To(BeTrue())
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeFalse())
+			Expect(err).To(MatchError("allocating another IP address would exceed 80% utilization of network: test (8 of 10 addresses in use)"))
+			Expect(ipmap).To(HaveLen(9))
+
+			Expect(alloc.Release("ID0")).To(Succeed())
+			_, err = alloc.Get("ID8")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("lets a container retry the request for an IP it holds", func() {
+			ipmap := map[string]string{}
+			for i := 10; i < 18; i++ {
+				ipmap[fmt.Sprintf("10.0.0.%d", i)] = fmt.Sprintf("ID%d", i)
+			}
+			res, err := newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.17")}).Get("ID17")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.17"))
+
+			_, err = newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.18")}).Get("other")
+			Expect(errors.Is(err, ErrUtilizationLimit)).To(BeTrue())
+		})
+	})
+
+	Context("when the IPs per container are limited", func() {
+		newAllocator := func(ipmap map[string]string, args *IPAMArgs) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:               "test",
+				Subnet:             types.IPNet{IP: n.IP, Mask: n.Mask},
+				MaxIPsPerContainer: 2,
+				Args:               args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("refuses another IP beyond the limit until one is released", func() {
+			ipmap := map[string]string{"fd00::2": "ID"}
+			alloc := newAllocator(ipmap, nil)
+			for i := 0; i < 2; i++ {
+				_, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrContainerLimit)).To(BeTrue())
+			Expect(err).To(MatchError("container ID already holds 2 of at most 2 IP addresses in network: test"))
+			Expect(ipmap).To(HaveLen(3))
+
+			// other containers are not affected
+			_, err = alloc.Get("other")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+			_, err = alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("lets a container retry the request for an IP it holds", func() {
+			ipmap := map[string]string{"10.0.0.5": "ID", "10.0.0.6": "ID"}
+			res, err := newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.6")}).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.6"))
+
+			_, err = newAllocator(ipmap, &IPAMArgs{IP: net.ParseIP("10.0.0.7")}).Get("ID")
+			Expect(errors.Is(err, ErrContainerLimit)).To(BeTrue())
+		})
+
+		It("counts the block of GetBlock against the limit", func() {
+			_, err := newAllocator(map[string]string{"10.0.0.50": "ID"}, nil).GetBlock("ID", 2)
+			Expect(errors.Is(err, ErrContainerLimit)).To(BeTrue())
+		})
+	})
+
+	Context("when the scan start is jittered", func() {
+		newAllocator := func(node string, jitter bool) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:        "test",
+				Subnet:      types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart:  net.ParseIP("10.0.0.10"),
+				RangeEnd:    net.ParseIP("10.0.0.13"),
+				StartJitter: jitter,
+				NodeName:    node,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("starts nodes at different offsets", func() {
+			a, err := newAllocator("node-a", true).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			b, err := newAllocator("node-b", true).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.IP.IP.String()).To(Equal("10.0.0.13"))
+			Expect(b.IP.IP.String()).To(Equal("10.0.0.12"))
+		})
+
+		It("starts at the beginning of the range without jitter", func() {
+			res, err := newAllocator("node-a", false).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.10"))
+		})
+
+		It("wraps around to hand out every address", func() {
+			alloc := newAllocator("node-a", true)
+			var ips []string
+			for i := 0; i < 4; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				ips = append(ips, res.IP.IP.String())
+			}
+			Expect(ips).To(Equal([]string{"10.0.0.13", "10.0.0.10", "10.0.0.11", "10.0.0.12"}))
+			_, err := alloc.Get("ID4")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+	})
+
+	Context("when allocations must be confirmed", func() {
+		var (
+			ipmap map[string]string
+			store *fakestore.FakeStore
+			alloc *IPAllocator
+		)
+
+		BeforeEach(func() {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: n.IP, Mask: n.Mask},
+				RangeStart: net.ParseIP("10.0.0.2"),
+				RangeEnd:   net.ParseIP("10.0.0.2"),
+				ConfirmTTL: Duration(time.Minute),
+			}
+			ipmap = map[string]string{}
+			store = fakestore.NewFakeStore(ipmap, nil)
+			alloc, err = NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		expire := func() {
+			store.SetReservedAt(net.ParseIP("10.0.0.2"), time.Now().Add(-2*time.Minute))
+		}
+
+		It("keeps a confirmed IP past the TTL", func() {
+			_, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "__pending__/ID"}))
+			Expect(alloc.Check("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+
+			Expect(alloc.Confirm("ID")).To(Succeed())
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "ID"}))
+			Expect(alloc.Confirm("ID")).To(Succeed())
+
+			expire()
+			_, err = alloc.Get("other")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "ID"}))
+		})
+
+		It("reclaims an IP that was not confirmed within the TTL", func() {
+			_, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+
+			expire()
+			res, err := alloc.Get("other")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "__pending__/other"}))
+
+			Expect(alloc.Confirm("ID")).To(MatchError("no IP addresses pending for container ID in network: test"))
+		})
+
+		It("releases a pending IP", func() {
+			_, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("ID")).To(Succeed())
+			Expect(ipmap).To(BeEmpty())
+		})
+	})
+
+	Context("when IPs are sticky", func() {
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: n.IP, Mask: n.Mask},
+				StickyMode: true,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("prefers the same IP for the same container ID", func() {
+			for i := 0; i < 2; i++ {
+				res, err := newAllocator(map[string]string{}).Get("web-0")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.253"))
+			}
+			res, err := newAllocator(map[string]string{}).Get("web-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.212"))
+		})
+
+		It("gets the IP back after a release", func() {
+			alloc := newAllocator(map[string]string{})
+			_, err := alloc.Get("web-0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("web-0")).To(Succeed())
+
+			res, err := alloc.Get("web-0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.253"))
+		})
+
+		It("falls back to the scan if another container holds the IP", func() {
+			res, err := newAllocator(map[string]string{"10.0.0.253": "other"}).Get("web-0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+	})
+
+	Context("when mirroring the offset of a primary network", func() {
+		newAllocator := func(subnet, offset string, mirror bool, ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:         "secondary",
+				Subnet:       types.IPNet{IP: n.IP, Mask: n.Mask},
+				MirrorOffset: mirror,
+				Args:         &IPAMArgs{MIRROR_OFFSET: types.UnmarshallableString(offset)},
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("takes the same offset as in the primary network", func() {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			primary := IPAMConfig{
+				Name:   "primary",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Args:   &IPAMArgs{IP: net.ParseIP("10.0.0.17")},
+			}
+			alloc, err := NewIPAllocator(&primary, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			// the host part of the address within the /24
+			offset := fmt.Sprint(res.IP.IP.To4()[3])
+
+			res, err = newAllocator("10.1.0.0/24", offset, true, map[string]string{}).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.1.0.17"))
+
+			res, err = newAllocator("fd00::/64", offset, true, map[string]string{}).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("fd00::11"))
+		})
+
+		It("falls back to the scan if the mirrored IP is taken", func() {
+			res, err := newAllocator("10.1.0.0/24", "17", true, map[string]string{"10.1.0.17": "other"}).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.1.0.2"))
+		})
+
+		It("falls back to the scan if the mirrored IP cannot be handed out", func() {
+			// the gateway, the broadcast address and past the subnet
+			for _, offset := range []string{"1", "255", "300"} {
+				res, err := newAllocator("10.1.0.0/24", offset, true, map[string]string{}).Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.1.0.2"), offset)
+			}
+		})
+
+		It("ignores the offset without mirrorOffset", func() {
+			res, err := newAllocator("10.1.0.0/24", "17", false, map[string]string{}).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.1.0.2"))
+		})
+	})
+
+	Context("when a subnet is requested through the args", func() {
+		newAllocator := func(ipmap map[string]string, subnet string) (*IPAllocator, error) {
+			n, err := types.ParseCIDR("10.0.0.0/16")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Args:   &IPAMArgs{SUBNET: types.UnmarshallableString(subnet)},
+			}
+			return NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+		}
+
+		It("allocates only from that subnet", func() {
+			ipmap := map[string]string{}
+			alloc, err := newAllocator(ipmap, "10.0.5.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 256; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.String()).To(Equal(fmt.Sprintf("10.0.5.%d/16", i)))
+				Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+			}
+			_, err = alloc.Get("ID256")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+			Expect(ipmap).To(HaveLen(256))
+		})
+
+		It("rejects a subnet outside of the configured one", func() {
+			_, err := newAllocator(map[string]string{}, "10.1.5.0/24")
+			Expect(err).To(MatchError("requested subnet 10.1.5.0/24 is not within subnet 10.0.0.0/16 of network: test"))
+		})
+	})
+
+	Context("when routes are passed through the args", func() {
+		load := func(args string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"subnet6": "fd00::/120",
+					"routes": [{"dst": "0.0.0.0/0"}]
+				}
+			}`), args)
+		}
+
+		It("hands them out after the configured routes of their family", func() {
+			conf, err := load("ROUTES=10.96.0.0/12,10.0.0.254|172.16.0.0/16|fd10::/64,fd00::1")
+			Expect(err).ToNot(HaveOccurred())
+
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Routes).To(HaveLen(3))
+			Expect(res.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+			Expect(res.Routes[1].Dst.String()).To(Equal("10.96.0.0/12"))
+			Expect(res.Routes[1].GW.String()).To(Equal("10.0.0.254"))
+			Expect(res.Routes[2].Dst.String()).To(Equal("172.16.0.0/16"))
+			Expect(res.Routes[2].GW).To(BeNil())
+			// the configured routes are left alone
+			Expect(conf.Routes).To(HaveLen(1))
+
+			alloc6, err := NewIPAllocator(conf.IPv6Config(), fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err = alloc6.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Routes).To(HaveLen(1))
+			Expect(res.Routes[0].Dst.String()).To(Equal("fd10::/64"))
+			Expect(res.Routes[0].GW.String()).To(Equal("fd00::1"))
+		})
+
+		It("rejects malformed routes", func() {
+			for args, msg := range map[string]string{
+				"ROUTES=10.96.0.0":               `invalid route "10.96.0.0": invalid CIDR address: 10.96.0.0`,
+				"ROUTES=10.96.0.0/12,nowhere":    `invalid route "10.96.0.0/12,nowhere": invalid gateway "nowhere"`,
+				"ROUTES=10.96.0.0/12,10.0.0.1,x": `invalid route "10.96.0.0/12,10.0.0.1,x": must be dst[,gw]`,
+				"ROUTES=10.96.0.0/12,fd00::1":    `invalid route "10.96.0.0/12,fd00::1": gateway is not in the address family of the destination`,
+				"ROUTES=172.16.0.0/16|":          `invalid route "": invalid CIDR address: `,
+			} {
+				_, err := load(args)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(msg), args)
+			}
+		})
+
+		It("rejects routes of a family the network has no subnet of", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24"
+				}
+			}`), "ROUTES=fd10::/64")
+			Expect(err).To(MatchError("route fd10::/64 passed in ROUTES is not in the address family of any subnet of network: test"))
+		})
+	})
+
+	Context("when a validation hook is configured", func() {
+		var hookDir string
+
+		BeforeEach(func() {
+			var err error
+			hookDir, err = ioutil.TempDir("", "host-local-hook")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(hookDir)).To(Succeed())
+		})
+
+		newAllocator := func(script string, args *IPAMArgs) *IPAllocator {
+			hook := filepath.Join(hookDir, "hook")
+			Expect(ioutil.WriteFile(hook, []byte("#!/bin/sh\n"+script+"\n"), 0755)).To(Succeed())
+			n, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                  "test",
+				Subnet:                types.IPNet{IP: n.IP, Mask: n.Mask},
+				ValidationHook:        hook,
+				ValidationHookTimeout: Duration(200 * time.Millisecond),
+				Args:                  args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("reserves IPs the hook approves", func() {
+			calls := filepath.Join(hookDir, "calls")
+			res, err := newAllocator(`echo "$1 $2" >> `+calls, nil).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+
+			contents, err := ioutil.ReadFile(calls)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(contents)).To(Equal("10.0.0.2 ID\n"))
+		})
+
+		It("skips an IP the hook rejects", func() {
+			alloc := newAllocator(`[ "$1" != 10.0.0.3 ]`, nil)
+			var ips []string
+			for i := 0; i < 4; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				ips = append(ips, res.IP.IP.String())
+			}
+			Expect(ips).To(Equal([]string{"10.0.0.2", "10.0.0.4", "10.0.0.5", "10.0.0.6"}))
+			_, err := alloc.Get("ID4")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("fails a request for an IP the hook rejects", func() {
+			_, err := newAllocator("exit 1", &IPAMArgs{IP: net.ParseIP("10.0.0.4")}).Get("ID")
+			Expect(err).To(MatchError(`requested IP address "10.0.0.4" was rejected by the validation hook in network: test`))
+		})
+
+		It("fails the allocation once the hook times out", func() {
+			alloc := newAllocator("sleep 10", nil)
+			start := time.Now()
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError(fmt.Sprintf("validation hook %s timed out after 200ms for 10.0.0.2", alloc.conf.ValidationHook)))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+
+	Context("when allocating in descending order", func() {
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/28")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:                "test",
+				Subnet:              types.IPNet{IP: n.IP, Mask: n.Mask},
+				AllocationDirection: DirectionDescending,
+				ExcludeIPs:          []string{"10.0.0.12"},
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("hands out addresses from the top of the subnet downward", func() {
+			alloc := newAllocator(map[string]string{})
+			var ips []string
+			for i := 0; i < 12; i++ {
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+				ips = append(ips, res.IP.IP.String())
+			}
+			Expect(ips).To(Equal([]string{
+				"10.0.0.14", "10.0.0.13", "10.0.0.11", "10.0.0.10", "10.0.0.9",
+				"10.0.0.8", "10.0.0.7", "10.0.0.6", "10.0.0.5", "10.0.0.4",
+				"10.0.0.3", "10.0.0.2",
+			}))
+			_, err := alloc.Get("ID12")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+		})
+
+		It("wraps to the top after reaching the start of the range", func() {
+			alloc := newAllocator(map[string]string{"10.0.0.13": "other"})
+			Expect(alloc.store.SetLastReservedIP(alloc.rangeID(), net.ParseIP("10.0.0.2"))).To(Succeed())
+
+			// the gateway below 10.0.0.2 is skipped
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.14"))
+			res, err = alloc.Get("ID2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.11"))
+		})
+	})
+
+	Context("when host IPs are reserved", func() {
+		var realInterfaceAddrs func() []net.IP
+
+		BeforeEach(func() {
+			realInterfaceAddrs = interfaceAddrs
+			interfaceAddrs = func() []net.IP {
+				return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("10.0.0.3"), net.ParseIP("fe80::1")}
+			}
+		})
+
+		AfterEach(func() {
+			interfaceAddrs = realInterfaceAddrs
+		})
+
+		newAllocator := func(reserve bool) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:           "test",
+				Subnet:         types.IPNet{IP: n.IP, Mask: n.Mask},
+				ReserveHostIPs: reserve,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("skips host addresses within the subnet", func() {
+			alloc := newAllocator(true)
+			for _, expected := range []string{"10.0.0.2", "10.0.0.4"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+			total, _ := alloc.Stats()
+			Expect(total).To(Equal(4))
+		})
+
+		It("ignores host addresses unless asked to", func() {
+			alloc := newAllocator(false)
+			for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+		})
+	})
+
+	Context("when MACs are mapped to IPs", func() {
+		var store *fakestore.FakeStore
+
+		newAllocator := func(mac string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				MACMappings: map[string]net.IP{
+					"00:11:22:33:44:55": net.ParseIP("10.0.0.5"),
+				},
+				Args: &IPAMArgs{MAC: types.UnmarshallableString(mac)},
+			}
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		BeforeEach(func() {
+			store = fakestore.NewFakeStore(map[string]string{}, nil)
+		})
+
+		It("hands out the mapped IP for a known MAC", func() {
+			res, err := newAllocator("00:11:22:33:44:55").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+		})
+
+		It("matches MACs regardless of notation", func() {
+			res, err := newAllocator("00-11-22-33-44-55").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+		})
+
+		It("scans as usual for an unknown MAC", func() {
+			res, err := newAllocator("00:11:22:33:44:66").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+		})
+
+		It("fails when another container holds the mapped IP", func() {
+			_, _, err := store.Reserve("other", net.ParseIP("10.0.0.5"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = newAllocator("00:11:22:33:44:55").Get("ID")
+			Expect(err).To(MatchError(`IP address "10.0.0.5" mapped to MAC 00:11:22:33:44:55 is reserved by container other in network: test`))
+		})
+
+		It("returns the mapped IP again to the container holding it", func() {
+			alloc := newAllocator("00:11:22:33:44:55")
+			_, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+		})
+	})
+
+	It("logs reservations with the container ID and IP", func() {
+		subnet, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		conf := IPAMConfig{
+			Name:   "test",
+			Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		}
+		alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		Expect(err).ToNot(HaveOccurred())
+		buf := &bytes.Buffer{}
+		alloc.log = log.New(buf, log.LevelDebug).With("network", conf.Name)
+
+		_, err = alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+
+		var entry map[string]string
+		Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+		Expect(entry).To(Equal(map[string]string{
+			"level":       "debug",
+			"msg":         "reserved IP",
+			"network":     "test",
+			"containerID": "ID",
+			"ip":          "10.0.0.2",
+		}))
+	})
+
+	Context("when no gateway is resolved", func() {
+		var (
+			conf   IPAMConfig
+			routes []types.Route
+		)
+
+		BeforeEach(func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			routes = []types.Route{}
+			for _, r := range []struct{ dst, gw string }{
+				{"0.0.0.0/0", ""},
+				{"10.1.0.0/16", ""},
+				{"10.2.0.0/16", "10.0.0.254"},
+				{"0.0.0.0/0", "10.0.0.253"},
+			} {
+				dst, err := types.ParseCIDR(r.dst)
+				Expect(err).ToNot(HaveOccurred())
+				routes = append(routes, types.Route{Dst: *dst, GW: net.ParseIP(r.gw)})
+			}
+			conf = IPAMConfig{
+				Name:        "test",
+				Subnet:      types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				GatewayMode: GatewayModeNone,
+				Routes:      routes,
+			}
+		})
+
+		dsts := func(routes []types.Route) []string {
+			var dsts []string
+			for _, r := range routes {
+				dsts = append(dsts, fmt.Sprintf("%s via %s", r.Dst.String(), r.GW))
+			}
+			return dsts
+		}
+
+		It("drops the default routes that need the gateway and warns", func() {
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			buf := &bytes.Buffer{}
+			alloc.log = log.New(buf, log.LevelWarn).With("network", conf.Name)
+
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway).To(BeNil())
+			Expect(dsts(res.Routes)).To(Equal([]string{
+				"10.1.0.0/16 via <nil>",
+				"10.2.0.0/16 via 10.0.0.254",
+				"0.0.0.0/0 via 10.0.0.253",
+			}))
+			// the configured routes are left alone
+			Expect(conf.Routes).To(HaveLen(4))
+
+			var entry map[string]string
+			Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+			Expect(entry).To(Equal(map[string]string{
+				"level":   "warn",
+				"msg":     "dropping route that needs a gateway, none was resolved",
+				"network": "test",
+				"ip":      "10.0.0.1",
+				"dst":     "0.0.0.0/0",
+			}))
+		})
+
+		It("drops them from every address of a block", func() {
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			alloc.log = log.New(ioutil.Discard, log.LevelWarn)
+
+			confs, err := alloc.GetBlock("ID", 2)
+			Expect(err).ToNot(HaveOccurred())
+			for _, c := range confs {
+				Expect(c.Routes).To(HaveLen(3))
+			}
+		})
+
+		It("keeps them if a range has a gateway of its own", func() {
+			conf.Ranges = []IPRange{{RangeStart: net.ParseIP("10.0.0.10"), RangeEnd: net.ParseIP("10.0.0.20"), Gateway: net.ParseIP("10.0.0.254")}}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway.String()).To(Equal("10.0.0.254"))
+			Expect(res.Routes).To(HaveLen(4))
+		})
+	})
+
+	Context("with an allocationTimeout", func() {
+		var (
+			conf  IPAMConfig
+			ipmap map[string]string
+		)
+
+		BeforeEach(func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf = IPAMConfig{
+				Name:              "test",
+				Subnet:            types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				AllocationTimeout: Duration(50 * time.Millisecond),
+			}
+			// all but the last address are taken
+			ipmap = map[string]string{}
+			for i := 2; i < 254; i++ {
+				ipmap[fmt.Sprintf("10.0.0.%d", i)] = "other"
+			}
+		})
+
+		newAllocator := func(delay time.Duration) *IPAllocator {
+			store := &slowStore{fakestore.NewFakeStore(ipmap, nil), delay}
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		held := func() []string {
+			var ips []string
+			for ip, id := range ipmap {
+				if id == "ID" {
+					ips = append(ips, ip)
+				}
+			}
+			return ips
+		}
+
+		It("gives up on a scan that runs past it", func() {
+			alloc := newAllocator(5 * time.Millisecond)
+			start := time.Now()
+			_, err := alloc.Get("ID")
+			Expect(err).To(MatchError("allocation in network test timed out after 50ms"))
+			Expect(errors.Is(err, ErrAllocationTimeout)).To(BeTrue())
+			// the scan stops at the first attempt past the deadline
+			Expect(time.Since(start)).To(BeNumerically("<", 200*time.Millisecond))
+			Expect(held()).To(BeEmpty())
+		})
+
+		It("rolls back a reservation that completes past it", func() {
+			delete(ipmap, "10.0.0.2")
+			alloc := newAllocator(100 * time.Millisecond)
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrAllocationTimeout)).To(BeTrue())
+			Expect(held()).To(BeEmpty())
+		})
+
+		It("allocates if the scan completes in time", func() {
+			conf.AllocationTimeout = Duration(10 * time.Second)
+			alloc := newAllocator(time.Millisecond)
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.254"))
+			Expect(held()).To(Equal([]string{"10.0.0.254"}))
+		})
+
+		It("restarts for every Get", func() {
+			delete(ipmap, "10.0.0.2")
+			delete(ipmap, "10.0.0.3")
+			alloc := newAllocator(30 * time.Millisecond)
+			for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+		})
+	})
+
+	Context("when selecting the gateway", func() {
+		newAllocator := func(mode, lastIP string) *IPAllocator {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:        "test",
+				Subnet:      types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				GatewayMode: mode,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, net.ParseIP(lastIP)))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("defaults to the first address", func() {
+			for _, mode := range []string{"", "first"} {
+				res, err := newAllocator(mode, "").Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			}
+		})
+
+		It("picks the last address before the broadcast address", func() {
+			alloc := newAllocator("last", "")
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway.String()).To(Equal("10.0.0.254"))
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.1"))
+
+			total, _ := alloc.Stats()
+			Expect(total).To(Equal(253))
+		})
+
+		It("never hands out the last address as the gateway", func() {
+			res, err := newAllocator("last", "10.0.0.253").Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).ToNot(Equal("10.0.0.254"))
+		})
+
+		It("omits the gateway in none mode", func() {
+			alloc := newAllocator("none", "")
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway).To(BeNil())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.1"))
+
+			total, _ := alloc.Stats()
+			Expect(total).To(Equal(254))
+		})
+	})
+
+	It("lists the reservations held in the store", func() {
+		subnet, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		conf := IPAMConfig{
+			Name:   "test",
+			Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		}
+		alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{
+			"10.0.0.2": "id1",
+			"10.0.0.3": "id2",
+		}, nil))
+		Expect(err).ToNot(HaveOccurred())
+
+		list, err := alloc.Reservations()
+		Expect(err).ToNot(HaveOccurred())
+		owners := map[string]string{}
+		for _, r := range list {
+			owners[r.IP.String()] = r.ID
+		}
+		Expect(owners).To(Equal(map[string]string{"10.0.0.2": "id1", "10.0.0.3": "id2"}))
+	})
+
+	Context("when constructed from a subnet alone", func() {
+		It("allocates from the whole subnet with the default gateway", func() {
+			_, subnet, err := net.ParseCIDR("192.0.2.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocatorForSubnet(subnet, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, expected := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.String()).To(Equal(expected + "/29"))
+				Expect(res.Gateway.String()).To(Equal("192.0.2.1"))
+			}
+		})
+
+		It("names the network after the subnet in errors", func() {
+			_, subnet, err := net.ParseCIDR("fd00::/127")
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocatorForSubnet(subnet, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: fd00::/127"))
+		})
+
+		It("requires a subnet", func() {
+			_, err := NewIPAllocatorForSubnet(nil, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).To(MatchError("missing subnet"))
+		})
+	})
+
+	Context("when the range is given as a CIDR", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					`+ipam+`
+				}
+			}`), "")
+		}
+
+		It("allocates only within the rangeCIDR", func() {
+			conf, err := load(`"rangeCIDR": "10.0.0.128/25"`)
+			Expect(err).ToNot(HaveOccurred())
+			ipmap := map[string]string{}
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+
+			// .255 is the broadcast address of the subnet
+			for i := 128; i < 255; i++ {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(fmt.Sprintf("10.0.0.%d", i)))
+			}
+			_, err = alloc.Get("ID")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+			Expect(ipmap).To(HaveLen(127))
+		})
+
+		It("skips the network address and the gateway at the start of the subnet", func() {
+			conf, err := load(`"rangeCIDR": "10.0.0.0/30"`)
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+			_, err = alloc.Get("ID")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects a rangeCIDR that is not within the subnet", func() {
+			_, err := load(`"rangeCIDR": "10.0.0.0/23"`)
+			Expect(err).To(MatchError("rangeCIDR 10.0.0.0/23 is not within subnet 10.0.0.0/24"))
+			_, err = load(`"rangeCIDR": "10.0.1.0/25"`)
+			Expect(err).To(MatchError("rangeCIDR 10.0.1.0/25 is not within subnet 10.0.0.0/24"))
+		})
+
+		It("cannot be combined with rangeStart", func() {
+			_, err := load(`"rangeCIDR": "10.0.0.128/25", "rangeStart": "10.0.0.130"`)
+			Expect(err).To(MatchError(`"rangeCIDR" cannot be combined with "rangeStart" or "rangeEnd"`))
+		})
+	})
+
+	Context("when the range is given relative to the gateway", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					`+ipam+`
+				}
+			}`), "")
+		}
+
+		It("allocates from the addresses after the gateway", func() {
+			conf, err := load(`"rangeStartOffsetFromGateway": 1, "rangeSizeFromGateway": 100`)
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.ranges).To(Equal([]Range{{net.ParseIP("10.0.0.2").To4(), net.ParseIP("10.0.0.102").To4()}}))
+
+			for i := 2; i <= 101; i++ {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(fmt.Sprintf("10.0.0.%d", i)))
+			}
+			_, err = alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("follows a gateway elsewhere in the subnet", func() {
+			conf, err := load(`"gateway": "10.0.0.200", "rangeStartOffsetFromGateway": -10, "rangeSizeFromGateway": 5`)
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.190"))
+		})
+
+		It("rejects a range that runs past the subnet", func() {
+			_, err := load(`"rangeStartOffsetFromGateway": 1, "rangeSizeFromGateway": 255`)
+			Expect(err).To(MatchError("range of 255 addresses at offset 1 from gateway 10.0.0.1 runs past network: 10.0.0.0/24"))
+			_, err = load(`"rangeStartOffsetFromGateway": -2, "rangeSizeFromGateway": 10`)
+			Expect(err).To(MatchError("range of 10 addresses at offset -2 from gateway 10.0.0.1 runs past network: 10.0.0.0/24"))
+		})
+
+		It("requires a positive size and a gateway", func() {
+			_, err := load(`"rangeStartOffsetFromGateway": 1`)
+			Expect(err).To(MatchError(`"rangeSizeFromGateway" must be positive`))
+			_, err = load(`"gatewayMode": "none", "rangeSizeFromGateway": 10`)
+			Expect(err).To(MatchError(`"rangeSizeFromGateway" requires a gateway in network: 10.0.0.0/24`))
+		})
+
+		It("cannot be combined with explicit range fields", func() {
+			for field, value := range map[string]string{
+				"rangeStart": `"10.0.0.10"`,
+				"rangeEnd":   `"10.0.0.20"`,
+				"rangeCIDR":  `"10.0.0.0/25"`,
+				"ranges":     `[{"rangeStart": "10.0.0.10"}]`,
+				"reserveLow": `5`,
+			} {
+				_, err := load(fmt.Sprintf(`"rangeSizeFromGateway": 10, %q: %s`, field, value))
+				Expect(err).To(MatchError(fmt.Sprintf(`"rangeSizeFromGateway" cannot be combined with %q`, field)))
+			}
+		})
+	})
+
+	Context("when low addresses are reserved", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					`+ipam+`
+				}
+			}`), "")
+		}
+
+		It("starts allocating past the reserved addresses", func() {
+			conf, err := load(`"reserveLow": 10`)
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			for _, expected := range []string{"10.0.0.11", "10.0.0.12"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+				Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+			}
+		})
+
+		It("cannot be combined with rangeStart", func() {
+			_, err := load(`"reserveLow": 10, "rangeStart": "10.0.0.20"`)
+			Expect(err).To(MatchError(`"reserveLow" cannot be combined with "rangeStart"`))
+		})
+
+		It("rejects reserving the whole subnet", func() {
+			_, err := load(`"reserveLow": 254`)
+			Expect(err).To(MatchError("reserveLow 254 leaves no addresses in network: 10.0.0.0/24"))
+		})
+	})
+
+	Context("when freed IPs are reused first", func() {
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:      "test",
+				Subnet:    types.IPNet{IP: n.IP, Mask: n.Mask},
+				ReuseMode: ReuseModeLIFO,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("hands out the most recently freed IP", func() {
+			alloc := newAllocator(map[string]string{})
+			for i, id := range []string{"a", "b", "c"} {
+				res, err := alloc.Get(id)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(fmt.Sprintf("10.0.0.%d", i+2)))
+			}
+
+			Expect(alloc.Release("b")).To(Succeed())
+			res, err := alloc.Get("d")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.3"))
+
+			// with nothing freed, the scan carries on
+			res, err = alloc.Get("e")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+		})
+
+		It("reuses the last freed IP first", func() {
+			alloc := newAllocator(map[string]string{})
+			for _, id := range []string{"a", "b", "c"} {
+				_, err := alloc.Get(id)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(alloc.Release("a")).To(Succeed())
+			Expect(alloc.ReleaseIP("c", net.ParseIP("10.0.0.4"))).To(Succeed())
+
+			for _, expected := range []string{"10.0.0.4", "10.0.0.2"} {
+				res, err := alloc.Get("d")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+		})
+
+		It("skips freed IPs that were taken in the meantime", func() {
+			ipmap := map[string]string{}
+			alloc := newAllocator(ipmap)
+			_, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("a")).To(Succeed())
+			ipmap["10.0.0.2"] = "static"
+
+			res, err := alloc.Get("b")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.3"))
+		})
+
+		It("puts back freed IPs outside of the ranges", func() {
+			store := fakestore.NewFakeStore(map[string]string{}, nil)
+			Expect(store.PushFreed(net.ParseIP("10.0.1.7"))).To(Succeed())
+			Expect(store.PushFreed(net.ParseIP("10.0.1.9"))).To(Succeed())
+
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{Name: "test", Subnet: types.IPNet{IP: n.IP, Mask: n.Mask}, ReuseMode: ReuseModeLIFO}
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+
+			for _, expected := range []string{"10.0.1.9", "10.0.1.7"} {
+				ip, err := store.PopFreed(false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ip.String()).To(Equal(expected))
+			}
+		})
+	})
+
+	Context("when an IP is preferred", func() {
+		newAllocator := func(ipmap map[string]string, args *IPAMArgs, ranges []IPRange) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Ranges: ranges,
+				Args:   args,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+		preferred := &IPAMArgs{PREFERRED_IP: net.ParseIP("10.0.0.7")}
+
+		It("hands out the preferred IP when it is free", func() {
+			res, err := newAllocator(map[string]string{}, preferred, nil).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.7"))
+		})
+
+		It("falls back to scanning when the preferred IP is taken", func() {
+			ipmap := map[string]string{"10.0.0.7": "other"}
+			res, err := newAllocator(ipmap, preferred, nil).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			Expect(ipmap["10.0.0.7"]).To(Equal("other"))
+		})
+
+		It("falls back to scanning when the preferred IP is outside the ranges", func() {
+			ranges := []IPRange{{RangeStart: net.ParseIP("10.0.0.100"), RangeEnd: net.ParseIP("10.0.0.110")}}
+			res, err := newAllocator(map[string]string{}, preferred, ranges).Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.100"))
+		})
+
+		Context("as a list", func() {
+			list := &IPAMArgs{PREFERRED_IPS: IPList{net.ParseIP("10.0.0.7"), net.ParseIP("10.0.0.8"), net.ParseIP("10.0.0.9")}}
+
+			It("hands out the first preferred IP when it is free", func() {
+				res, err := newAllocator(map[string]string{}, list, nil).Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.7"))
+			})
+
+			It("hands out the first free preferred IP in order", func() {
+				ipmap := map[string]string{"10.0.0.7": "other", "10.0.0.8": "other"}
+				res, err := newAllocator(ipmap, list, nil).Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.9"))
+			})
+
+			It("falls back to scanning when every preferred IP is taken", func() {
+				ipmap := map[string]string{"10.0.0.7": "other", "10.0.0.8": "other", "10.0.0.9": "other"}
+				res, err := newAllocator(ipmap, list, nil).Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+			})
+
+			It("tries PREFERRED_IP first", func() {
+				args := &IPAMArgs{PREFERRED_IP: net.ParseIP("10.0.0.20"), PREFERRED_IPS: list.PREFERRED_IPS}
+				res, err := newAllocator(map[string]string{}, args, nil).Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.20"))
+			})
+		})
+	})
+
+	Context("when ranges have gateways of their own", func() {
+		newAllocator := func(ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Ranges: []IPRange{
+					{RangeStart: net.ParseIP("10.0.0.10"), RangeEnd: net.ParseIP("10.0.0.11"), Gateway: net.ParseIP("10.0.0.10")},
+					{RangeStart: net.ParseIP("10.0.0.20"), RangeEnd: net.ParseIP("10.0.0.21"), Gateway: net.ParseIP("10.0.0.254")},
+					{RangeStart: net.ParseIP("10.0.0.30"), RangeEnd: net.ParseIP("10.0.0.30")},
+				},
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("returns the gateway of the range each address came from", func() {
+			alloc := newAllocator(map[string]string{})
+			var got [][2]string
+			for _, id := range []string{"ID1", "ID2", "ID3"} {
+				res, err := alloc.Get(id)
+				Expect(err).ToNot(HaveOccurred())
+				got = append(got, [2]string{res.IP.IP.String(), res.Gateway.String()})
+			}
+			Expect(got).To(Equal([][2]string{
+				// the gateway of the first range is never handed out
+				{"10.0.0.11", "10.0.0.10"},
+				{"10.0.0.20", "10.0.0.254"},
+				{"10.0.0.21", "10.0.0.254"},
+			}))
+
+			// a range without a gateway falls back to the subnet's
+			res, err := alloc.Get("ID4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.30"))
+			Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+		})
+
+		It("returns the gateway of the range of a requested IP", func() {
+			alloc := newAllocator(map[string]string{})
+			alloc.conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.0.21")}
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway.String()).To(Equal("10.0.0.254"))
+		})
+	})
+
+	Context("when a pool is requested", func() {
+		ranges := []IPRange{
+			{RangeStart: net.ParseIP("10.0.0.10"), RangeEnd: net.ParseIP("10.0.0.19"), Name: "blue"},
+			{RangeStart: net.ParseIP("10.0.0.20"), RangeEnd: net.ParseIP("10.0.0.29"), Name: "green"},
+		}
+		newConf := func(pool string) *IPAMConfig {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			return &IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Ranges: ranges,
+				Args:   &IPAMArgs{POOL: types.UnmarshallableString(pool)},
+			}
+		}
+
+		It("allocates from the ranges of that name only", func() {
+			alloc, err := NewIPAllocator(newConf("green"), fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.20"))
+		})
+
+		It("rejects an unknown pool", func() {
+			_, err := NewIPAllocator(newConf("red"), fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).To(MatchError(`unknown pool "red" in network: test`))
+		})
+
+		It("resumes each pool after its own last reserved IP", func() {
+			store := fakestore.NewFakeStore(map[string]string{}, nil)
+			get := func(pool, id string) string {
+				alloc, err := NewIPAllocator(newConf(pool), store)
+				Expect(err).ToNot(HaveOccurred())
+				res, err := alloc.Get(id)
+				Expect(err).ToNot(HaveOccurred())
+				return res.IP.IP.String()
+			}
+
+			Expect(get("blue", "ID1")).To(Equal("10.0.0.10"))
+			Expect(get("blue", "ID2")).To(Equal("10.0.0.11"))
+			alloc, err := NewIPAllocator(newConf("blue"), store)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alloc.Release("ID1")).To(Succeed())
+
+			Expect(get("green", "ID3")).To(Equal("10.0.0.20"))
+			// the green reservation does not send blue back to its start
+			Expect(get("blue", "ID4")).To(Equal("10.0.0.12"))
+			Expect(get("green", "ID5")).To(Equal("10.0.0.21"))
+		})
+	})
+
+	Context("when filtering routes", func() {
+		get := func(filter bool) []types.Route {
+			conf, err := LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"filterRoutes": %t,
+					"routes": [
+						{"dst": "0.0.0.0/0"},
+						{"dst": "192.168.0.0/16", "gw": "10.0.0.254", "mtu": 1450, "metric": 10},
+						{"dst": "172.16.0.0/12", "gw": "10.1.0.1"}
+					]
+				}
+			}`, filter)), "")
+			Expect(err).ToNot(HaveOccurred())
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			return res.Routes
+		}
+		dsts := func(routes []types.Route) []string {
+			var out []string
+			for _, r := range routes {
+				out = append(out, r.Dst.String())
+			}
+			return out
+		}
+
+		It("keeps on-link routes and those via a gateway in the subnet", func() {
+			Expect(dsts(get(true))).To(Equal([]string{"0.0.0.0/0", "192.168.0.0/16"}))
+		})
+
+		It("hands out every route by default", func() {
+			Expect(dsts(get(false))).To(Equal([]string{"0.0.0.0/0", "192.168.0.0/16", "172.16.0.0/12"}))
+		})
+
+		It("keeps the MTU and metric hints of a route", func() {
+			routes := get(true)
+			Expect(routes[1].MTU).To(Equal(1450))
+			Expect(routes[1].Metric).To(Equal(10))
+		})
+	})
+
+	Context("when IPs are pre-reserved", func() {
+		var (
+			conf  IPAMConfig
+			ipmap map[string]string
+			store *fakestore.FakeStore
+		)
+
+		BeforeEach(func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf = IPAMConfig{
+				Name:        "test",
+				Subnet:      types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				PreReserved: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.4")},
+			}
+			ipmap = map[string]string{"10.0.0.4": "legacy"}
+			store = fakestore.NewFakeStore(ipmap, nil)
+		})
+
+		It("skips primed addresses", func() {
+			Expect(Prime(&conf, store)).To(Succeed())
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, expected := range []string{"10.0.0.3", "10.0.0.5"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(expected))
+			}
+		})
+
+		It("keeps primed addresses once leases expire", func() {
+			conf.LeaseTTL = Duration(time.Hour)
+			Expect(Prime(&conf, store)).To(Succeed())
+			store.SetReservedAt(net.ParseIP("10.0.0.2"), time.Now().Add(-2*time.Hour))
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 3; i++ {
+				_, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			_, err = alloc.Get("ID3")
+			Expect(err).To(MatchError("no IP addresses available in network: test"))
+			Expect(ipmap).To(HaveKeyWithValue("10.0.0.2", "__reserved__"))
+		})
+
+		It("marks primed addresses in listings and leaves held ones alone", func() {
+			Expect(Prime(&conf, store)).To(Succeed())
+			Expect(Prime(&conf, store)).To(Succeed())
+			Expect(ipmap).To(Equal(map[string]string{"10.0.0.2": "__reserved__", "10.0.0.4": "legacy"}))
+
+			alloc, err := NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			list, err := alloc.Reservations()
+			Expect(err).ToNot(HaveOccurred())
+			for _, r := range list {
+				Expect(r.PreReserved()).To(Equal(r.IP.String() == "10.0.0.2"))
+			}
+		})
+	})
+
+	Context("when looking up a single IP", func() {
+		var alloc *IPAllocator
+
+		BeforeEach(func() {
+			subnet, err := types.ParseCIDR("10.0.0.0/29")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			}
+			store := fakestore.NewFakeStore(map[string]string{"10.0.0.3": "ID"}, nil)
+			alloc, err = NewIPAllocator(&conf, store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the owner of a reserved IP", func() {
+			reserved, owner, err := alloc.IsReserved(net.ParseIP("10.0.0.3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			Expect(owner).To(Equal("ID"))
+		})
+
+		It("reports a free IP", func() {
+			reserved, owner, err := alloc.IsReserved(net.ParseIP("10.0.0.4"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeFalse())
+			Expect(owner).To(BeEmpty())
+		})
+
+		It("rejects an IP outside of the subnet", func() {
+			_, _, err := alloc.IsReserved(net.ParseIP("10.0.1.3"))
+			Expect(err).To(MatchError("10.0.1.3 not in network: 10.0.0.0/29"))
+		})
+	})
+
+	Context("when reporting stats", func() {
+		newAllocator := func(subnet string, ranges []IPRange, ipmap map[string]string) *IPAllocator {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+				Ranges: ranges,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("counts the range without the gateway", func() {
+			// .1 - .6; .1 is the gateway
+			alloc := newAllocator("10.0.0.0/29", nil, map[string]string{
+				"10.0.0.2": "id",
+				"10.0.0.5": "id",
+			})
+			total, used := alloc.Stats()
+			Expect(total).To(Equal(5))
+			Expect(used).To(Equal(2))
+		})
+
+		It("ignores reservations outside the ranges", func() {
+			alloc := newAllocator("10.0.0.0/24", []IPRange{
+				ipRange("10.0.0.10", "10.0.0.19"),
+				ipRange("10.0.0.100", "10.0.0.104"),
+			}, map[string]string{
+				"10.0.0.10":  "id",
+				"10.0.0.50":  "id",
+				"10.0.0.104": "id",
+			})
+			total, used := alloc.Stats()
+			Expect(total).To(Equal(15))
+			Expect(used).To(Equal(2))
+		})
+
+		It("caps the total of huge IPv6 ranges", func() {
+			alloc := newAllocator("fd00::/64", nil, map[string]string{})
+			total, used := alloc.Stats()
+			Expect(total).To(Equal(math.MaxInt))
+			Expect(used).To(BeZero())
+		})
+	})
+
+	Context("when out of ips", func() {
+		It("returns a meaningful error", func() {
+			testCases := []AllocatorTestCase{
+				{
+					subnet: "10.0.0.0/30",
+					ipmap: map[string]string{
+						"10.0.0.2": "id",
+						"10.0.0.3": "id",
+					},
+				},
+				{
+					subnet: "10.0.0.0/29",
+					ipmap: map[string]string{
+						"10.0.0.2": "id",
+						"10.0.0.3": "id",
+						"10.0.0.4": "id",
+						"10.0.0.5": "id",
+						"10.0.0.6": "id",
+						"10.0.0.7": "id",
+					},
+				},
+			}
+			for _, tc := range testCases {
+				_, err := tc.run()
+				Expect(err).To(MatchError("no IP addresses available in network: test"))
+			}
+		})
+
+		It("returns a meaningful error when the subnet has no usable addresses", func() {
+			for _, subnet := range []string{"fd00::/127", "fd00::/128"} {
+				tc := AllocatorTestCase{subnet: subnet, ipmap: map[string]string{}}
+				_, err := tc.run()
+				Expect(err).To(MatchError("no IP addresses available in network: test"), subnet)
+			}
+		})
+	})
+
+	Context("when the gateway is given as an offset", func() {
+		newAllocator := func(offset int) (*IPAllocator, error) {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:          "test",
+				Subnet:        types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				RangeStart:    net.ParseIP("10.0.0.253"),
+				RangeEnd:      net.ParseIP("10.0.0.254"),
+				GatewayOffset: offset,
+			}
+			return NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		}
+
+		It("counts positive offsets from the network address", func() {
+			alloc, err := newAllocator(1)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+		})
+
+		It("counts negative offsets from the broadcast address", func() {
+			alloc, err := newAllocator(-2)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Gateway.String()).To(Equal("10.0.0.254"))
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.253"))
+
+			// .254 is the gateway, so the range is full
+			_, err = alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("rejects offsets outside the subnet", func() {
+			for _, offset := range []int{256, -257, 1 << 32} {
+				_, err := newAllocator(offset)
+				Expect(err).To(MatchError(fmt.Sprintf("gatewayOffset %d is outside of network: 10.0.0.0/24", offset)))
+			}
+		})
+
+		It("rejects the network and broadcast addresses", func() {
+			_, err := newAllocator(-1)
+			Expect(err).To(MatchError("gatewayOffset -1 selects the network or broadcast address of 10.0.0.0/24"))
+		})
+	})
+
+	Context("when the subnet is point-to-point", func() {
+		newAllocator := func(subnet string) *IPAllocator {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+
+		It("hands out both addresses of a /31", func() {
+			alloc := newAllocator("192.0.2.0/31")
+			for _, want := range []string{"192.0.2.0", "192.0.2.1"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.String()).To(Equal(want + "/31"))
+				Expect(res.Gateway).To(BeNil())
+			}
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+
+			total, used := alloc.Stats()
+			Expect(total).To(Equal(2))
+			Expect(used).To(Equal(2))
+		})
+
+		It("hands out the single address of a /32", func() {
+			alloc := newAllocator("192.0.2.5/32")
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.String()).To(Equal("192.0.2.5/32"))
+			Expect(res.Gateway).To(BeNil())
+
+			_, err = alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+	})
+
+	Context("when the network address is not skipped", func() {
+		newAllocator := func(subnet string, skip bool) *IPAllocator {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:               "test",
+				Subnet:             types.IPNet{IP: n.IP, Mask: n.Mask},
+				SkipNetworkAddress: &skip,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+		get := func(alloc *IPAllocator) string {
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			return res.IP.IP.String()
+		}
+
+		It("hands out the network address, but not the gateway", func() {
+			alloc := newAllocator("10.0.0.0/24", false)
+			Expect(get(alloc)).To(Equal("10.0.0.0"))
+			Expect(get(alloc)).To(Equal("10.0.0.2"))
+
+			total, _ := alloc.Stats()
+			Expect(total).To(Equal(254))
+		})
+
+		It("skips the network address when enabled, as by default", func() {
+			Expect(get(newAllocator("10.0.0.0/24", true))).To(Equal("10.0.0.2"))
+		})
+
+		It("hands out the network address of an IPv6 subnet", func() {
+			Expect(get(newAllocator("2001:db8::/64", false))).To(Equal("2001:db8::"))
+		})
+
+		It("keeps every address of a point-to-point subnet either way", func() {
+			for _, skip := range []bool{false, true} {
+				alloc := newAllocator("192.0.2.0/31", skip)
+				Expect(get(alloc)).To(Equal("192.0.2.0"))
+				Expect(get(alloc)).To(Equal("192.0.2.1"))
+				_, err := alloc.Get("ID")
+				Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+
+				Expect(get(newAllocator("192.0.2.5/32", skip))).To(Equal("192.0.2.5"))
+			}
+		})
+
+		It("hands out the network address at the start of a rangeCIDR", func() {
+			n, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			r, err := types.ParseCIDR("10.0.0.0/30")
+			Expect(err).ToNot(HaveOccurred())
+			skip := false
+			conf := IPAMConfig{
+				Name:               "test",
+				Subnet:             types.IPNet(*n),
+				RangeCIDR:          types.IPNet(*r),
+				SkipNetworkAddress: &skip,
+			}
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(get(alloc)).To(Equal("10.0.0.0"))
+		})
+	})
+
+	Context("when the range ends at the top of the address space", func() {
+		newAllocator := func(conf IPAMConfig, ipmap map[string]string, last net.IP) *IPAllocator {
+			conf.Name = "test"
+			alloc, err := NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, last))
+			Expect(err).ToNot(HaveOccurred())
+			return alloc
+		}
+		subnet := func(cidr string) types.IPNet {
+			n, err := types.ParseCIDR(cidr)
+			Expect(err).ToNot(HaveOccurred())
+			return types.IPNet{IP: n.IP, Mask: n.Mask}
+		}
+
+		It("hands out the addresses below the top of the IPv4 space", func() {
+			alloc := newAllocator(IPAMConfig{Subnet: subnet("255.255.255.254/31")}, map[string]string{}, nil)
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.String()).To(Equal("255.255.255.254/31"))
+
+			_, err = alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("ends the scan when resuming after the last address of the range", func() {
+			ipmap := map[string]string{"255.255.255.254": "other"}
+			alloc := newAllocator(IPAMConfig{Subnet: subnet("255.255.255.254/31")}, ipmap, net.ParseIP("255.255.255.254"))
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("accepts a rangeEnd of the last IPv6 address", func() {
+			alloc := newAllocator(IPAMConfig{
+				Subnet:     subnet("ffff:ffff:ffff:ffff::/64"),
+				RangeStart: net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffd"),
+				RangeEnd:   net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+			}, map[string]string{}, nil)
+			for _, want := range []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffd", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe"} {
+				res, err := alloc.Get("ID")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal(want))
+			}
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("wraps the next IP of the top address to the start of the ranges", func() {
+			alloc := newAllocator(IPAMConfig{Subnet: subnet("255.255.255.0/24")}, map[string]string{}, nil)
+			Expect(alloc.nextIP(net.ParseIP("255.255.255.253").To4()).String()).To(Equal("255.255.255.254"))
+			Expect(alloc.nextIP(net.ParseIP("255.255.255.254").To4()).String()).To(Equal("255.255.255.1"))
+			Expect(alloc.nextIP(net.ParseIP("255.255.255.255").To4()).String()).To(Equal("255.255.255.1"))
+		})
+	})
+
+	Context("when validating range bounds", func() {
+		newAllocator := func(start, end string) (*IPAllocator, error) {
+			subnet, err := types.ParseCIDR("10.0.0.0/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := IPAMConfig{
+				Name:       "test",
+				Subnet:     types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				RangeStart: net.ParseIP(start),
+				RangeEnd:   net.ParseIP(end),
+			}
+			return NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		}
+
+		It("allocates from an ordered range", func() {
+			alloc, err := newAllocator("10.0.0.10", "10.0.0.50")
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.10"))
+		})
+
+		It("accepts a single-address range", func() {
+			alloc, err := newAllocator("10.0.0.10", "10.0.0.10")
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.10"))
+
+			_, err = alloc.Get("ID2")
+			Expect(errors.Is(err, ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("rejects a range whose start is after its end", func() {
+			_, err := newAllocator("10.0.0.50", "10.0.0.10")
+			Expect(err).To(MatchError("rangeStart 10.0.0.50 is after rangeEnd 10.0.0.10"))
+		})
+	})
+
+	Context("when the address families are mixed", func() {
+		newConf := func(subnet string) *IPAMConfig {
+			n, err := types.ParseCIDR(subnet)
+			Expect(err).ToNot(HaveOccurred())
+			return &IPAMConfig{
+				Name:   "test",
+				Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+			}
+		}
+
+		It("rejects a rangeStart of the other family", func() {
+			conf := newConf("10.0.0.0/24")
+			conf.RangeStart = net.ParseIP("fd00::10")
+			_, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).To(MatchError("address family mismatch: fd00::10 is not in the address family of network 10.0.0.0/24"))
+		})
+
+		It("rejects a rangeEnd of the other family", func() {
+			conf := newConf("fd00::/120")
+			conf.RangeEnd = net.ParseIP("10.0.0.10")
+			_, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).To(MatchError("address family mismatch: 10.0.0.10 is not in the address family of network fd00::/120"))
+		})
+
+		It("rejects a gateway of the other family", func() {
+			conf := newConf("10.0.0.0/24")
+			conf.Gateway = net.ParseIP("fd00::1")
+			_, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).To(MatchError("gateway: address family mismatch: fd00::1 is not in the address family of network 10.0.0.0/24"))
+		})
+
+		It("rejects a requested IP of the other family", func() {
+			conf := newConf("10.0.0.0/24")
+			conf.Args = &IPAMArgs{IP: net.ParseIP("fd00::2")}
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = alloc.Get("ID")
+			Expect(err).To(MatchError("address family mismatch: fd00::2 is not in the address family of network 10.0.0.0/24"))
 		})
 	})
 })
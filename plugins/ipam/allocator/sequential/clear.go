@@ -0,0 +1,43 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// ClearAll removes every reservation of the network, including those
+// outside the ranges and the pre-reserved IPs, and resets the scans so
+// that the next Get starts over as in a new store. It returns the
+// number of reservations removed. The caller must hold the store lock.
+func ClearAll(conf *IPAMConfig, store backend.Store) (int, error) {
+	c, ok := store.(backend.Clearer)
+	if !ok {
+		return 0, fmt.Errorf("the store of network %s cannot be cleared", conf.Name)
+	}
+	return c.Clear()
+}
+
+// ClearAll removes every reservation of the network under the store
+// lock, see ClearAll. The pre-reserved IPs are reserved again by the
+// next allocator built for the network.
+func (a *IPAllocator) ClearAll() (int, error) {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return ClearAll(a.conf, a.store)
+}
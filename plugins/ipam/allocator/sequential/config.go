@@ -17,21 +17,151 @@ package sequential
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"net"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam/log"
 	"github.com/containernetworking/cni/pkg/types"
 )
 
 // IPAMConfig represents the IP related network configuration.
 type IPAMConfig struct {
-	Name       string
-	Type       string        `json:"type"`
-	RangeStart net.IP        `json:"rangeStart"`
-	RangeEnd   net.IP        `json:"rangeEnd"`
-	Subnet     types.IPNet   `json:"subnet"`
-	Gateway    net.IP        `json:"gateway"`
-	Routes     []types.Route `json:"routes"`
-	Args       *IPAMArgs     `json:"-"`
+	Name                   string
+	Type                   string            `json:"type"`
+	ConfigFile             string            `json:"configFile"`
+	Strategy               string            `json:"strategy"`
+	StartJitter            bool              `json:"startJitter"`
+	StickyMode             bool              `json:"stickyMode"`
+	MirrorOffset           bool              `json:"mirrorOffset"`
+	AllocationDirection    string            `json:"allocationDirection"`
+	ReuseMode              string            `json:"reuseMode"`
+	ReservationKey         string            `json:"reservationKey"`
+	Store                  string            `json:"store"`
+	DataDir                string            `json:"dataDir"`
+	HashFilenames          bool              `json:"hashFilenames"`
+	StoreFormat            string            `json:"storeFormat"`
+	ShardPrefix            int               `json:"shardPrefix"`
+	SyncWrites             *bool             `json:"syncWrites"`
+	RangeStart             net.IP            `json:"rangeStart"`
+	RangeEnd               net.IP            `json:"rangeEnd"`
+	RangeCIDR              types.IPNet       `json:"rangeCIDR"`
+	RangeOffsetFromGateway int               `json:"rangeStartOffsetFromGateway"`
+	RangeSizeFromGateway   int               `json:"rangeSizeFromGateway"`
+	ReserveLow             int               `json:"reserveLow"`
+	SkipNetworkAddress     *bool             `json:"skipNetworkAddress"`
+	MaxUtilizationPercent  int               `json:"maxUtilizationPercent"`
+	MaxIPsPerContainer     int               `json:"maxIPsPerContainer"`
+	AllocationsPerSecond   float64           `json:"allocationsPerSecond"`
+	AllocationBurst        int               `json:"allocationBurst"`
+	Ranges                 []IPRange         `json:"ranges"`
+	AllowOutOfRangeRequest bool              `json:"allowOutOfRangeRequest"`
+	AllowGatewayAllocation bool              `json:"allowGatewayAllocation"`
+	ExcludeIPs             []string          `json:"excludeIPs"`
+	ExcludeBoundaries      []types.IPNet     `json:"excludeSubnetBoundaries"`
+	ReserveHostIPs         bool              `json:"reserveHostIPs"`
+	MACMappings            map[string]net.IP `json:"macMappings"`
+	PreReserved            []net.IP          `json:"preReserved"`
+	Subnet                 types.IPNet       `json:"subnet"`
+	StrictSubnet           bool              `json:"strictSubnet"`
+	Subnets                []WeightedSubnet  `json:"subnets"`
+	SubnetOrder            string            `json:"subnetOrder"`
+	BaseAddress            net.IP            `json:"baseAddress"`
+	PoolCIDR               types.IPNet       `json:"poolCIDR"`
+	NodeSubnetPrefix       int               `json:"nodeSubnetPrefix"`
+	NodeName               string            `json:"nodeName"`
+	HostCount              int               `json:"hostCount"`
+	Gateway                net.IP            `json:"gateway"`
+	GatewayMode            string            `json:"gatewayMode"`
+	GatewayOffset          int               `json:"gatewayOffset"`
+	Routes                 []types.Route     `json:"routes"`
+	FilterRoutes           bool              `json:"filterRoutes"`
+	DNS                    types.DNS         `json:"dns"`
+	DNSFromSubnet          bool              `json:"dnsFromSubnet"`
+	Subnet6                types.IPNet       `json:"subnet6"`
+	Gateway6               net.IP            `json:"gateway6"`
+	Routes6                []types.Route     `json:"routes6"`
+	Delegate               *DelegateConfig   `json:"delegate"`
+	LeaseTTL               Duration          `json:"leaseTTL"`
+	ReleaseGracePeriod     Duration          `json:"releaseGracePeriod"`
+	ConfirmTTL             Duration          `json:"confirmTTL"`
+	LockTimeout            Duration          `json:"lockTimeout"`
+	LockRetryInterval      Duration          `json:"lockRetryInterval"`
+	AllocationTimeout      Duration          `json:"allocationTimeout"`
+	ValidationHook         string            `json:"validationHook"`
+	ValidationHookTimeout  Duration          `json:"validationHookTimeout"`
+	LogLevel               string            `json:"logLevel"`
+	NotifySocket           string            `json:"notifySocket"`
+	ResultFile             string            `json:"resultFile"`
+	DryRun                 bool              `json:"dryRun"`
+	Etcd                   *EtcdConfig       `json:"etcd"`
+	Redis                  *RedisConfig      `json:"redis"`
+	Args                   *IPAMArgs         `json:"-"`
+	PrevResult             *types.Result     `json:"-"`
+	CNIVersion             string            `json:"-"`
+
+	// inSubnets marks the configuration of one of the subnets under
+	// "subnets", whose reservations are checked for the whole network
+	inSubnets bool
+}
+
+// Duration is a time.Duration that unmarshals from strings such as "72h"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// IPRange is an inclusive window of addresses within the subnet
+type IPRange struct {
+	RangeStart net.IP `json:"rangeStart"`
+	RangeEnd   net.IP `json:"rangeEnd"`
+	// Name makes the range part of the pool of that name, which can
+	// be requested through the POOL argument
+	Name string `json:"name"`
+	// Gateway is returned with the addresses of this range instead of
+	// the gateway of the subnet
+	Gateway net.IP `json:"gateway,omitempty"`
+}
+
+// DelegateConfig names a second IPAM plugin that provides the IPv6
+// address of the network
+type DelegateConfig struct {
+	Type string `json:"type"`
+}
+
+// EtcdConfig holds the connection parameters of the etcd store
+type EtcdConfig struct {
+	// Endpoints are base URLs of the etcd v3 JSON gateway, such as
+	// "https://10.0.0.1:2379"; they are tried in order
+	Endpoints []string `json:"endpoints"`
+	// Prefix is prepended to every key, defaulting to "/cni/ipam/"
+	Prefix        string `json:"prefix"`
+	CertFile      string `json:"certFile"`
+	KeyFile       string `json:"keyFile"`
+	TrustedCAFile string `json:"trustedCAFile"`
+}
+
+// RedisConfig holds the connection parameters of the redis store
+type RedisConfig struct {
+	// Address is the host:port of the Redis server
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Prefix is prepended to every key, defaulting to "cni/ipam/"
+	Prefix string `json:"prefix"`
 }
 
 type IPAMArgs struct {
@@ -40,34 +170,721 @@ type IPAMArgs struct {
 	StoreAddr types.UnmarshallableString `json:"store_addr,omitempty"`
 	StorePort types.UnmarshallableString `json:"store_port,omitempty"`
 	StoreNS   types.UnmarshallableString `json:"store_ns,omitempty"`
+	MAC       types.UnmarshallableString `json:"mac,omitempty"`
+	// POOL restricts allocation to the ranges of that name
+	POOL types.UnmarshallableString `json:"pool,omitempty"`
+	// PREFERRED_IP is tried before scanning; unlike IP, allocation
+	// carries on as usual if it is taken
+	PREFERRED_IP net.IP `json:"preferred_ip,omitempty"`
+	// PREFERRED_IPS are tried in order after PREFERRED_IP
+	PREFERRED_IPS IPList `json:"preferred_ips,omitempty"`
+	// LABEL is recorded with the reservation for auditing; it defaults
+	// to the namespace and name of the pod
+	LABEL             types.UnmarshallableString `json:"label,omitempty"`
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"k8s_pod_namespace,omitempty"`
+	K8S_POD_NAME      types.UnmarshallableString `json:"k8s_pod_name,omitempty"`
+	// K8S_POD_UID keys the reservations instead of the container ID
+	// with "reservationKey": "podUID"
+	K8S_POD_UID types.UnmarshallableString `json:"k8s_pod_uid,omitempty"`
+	// SUBNET narrows the scan of this allocation to a subnet of the
+	// configured one
+	SUBNET types.UnmarshallableString `json:"subnet,omitempty"`
+	// ROUTES are handed out on top of the configured routes
+	ROUTES RouteArgs `json:"routes,omitempty"`
+	// MIRROR_OFFSET is the offset of the address a container got in
+	// its primary network, which mirrorOffset tries first
+	MIRROR_OFFSET types.UnmarshallableString `json:"mirror_offset,omitempty"`
 }
 
+// The formats of the reservation files of the disk store, selected by
+// "storeFormat". Files of either format are read whatever the setting.
+const (
+	// StoreFormatLegacy writes the container ID, the reservation time,
+	// the IP and the label on lines of their own
+	StoreFormatLegacy = "legacy"
+	// StoreFormatJSON writes them as a JSON object
+	StoreFormatJSON = "json"
+)
+
 type Net struct {
-	Name string      `json:"name"`
-	IPAM *IPAMConfig `json:"ipam"`
+	CNIVersion string        `json:"cniVersion"`
+	Name       string        `json:"name"`
+	IPAM       *IPAMConfig   `json:"ipam"`
+	PrevResult *types.Result `json:"prevResult,omitempty"`
 }
 
 // NewIPAMConfig creates a NetworkConfig from the given network name.
 func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
-	n := Net{}
+	fileConf, err := loadConfigFile(bytes)
+	if err != nil {
+		return nil, err
+	}
+	n := Net{IPAM: fileConf}
 	if err := json.Unmarshal(bytes, &n); err != nil {
 		return nil, err
 	}
 
+	if n.IPAM == nil {
+		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
+	}
+
 	if args != "" {
 		n.IPAM.Args = &IPAMArgs{}
 		err := types.LoadArgs(args, n.IPAM.Args)
 		if err != nil {
 			return nil, err
 		}
+		if strings.ContainsAny(n.IPAM.Label(), "\r\n") {
+			return nil, fmt.Errorf("label %q must not contain line breaks", n.IPAM.Label())
+		}
 	}
 
-	if n.IPAM == nil {
-		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
+	if n.IPAM.DataDir != "" && !filepath.IsAbs(n.IPAM.DataDir) {
+		return nil, fmt.Errorf("dataDir %q must be an absolute path", n.IPAM.DataDir)
+	}
+
+	if n.IPAM.NotifySocket != "" && !filepath.IsAbs(n.IPAM.NotifySocket) {
+		return nil, fmt.Errorf("notifySocket %q must be an absolute path", n.IPAM.NotifySocket)
+	}
+
+	if n.IPAM.ResultFile != "" && !filepath.IsAbs(n.IPAM.ResultFile) {
+		return nil, fmt.Errorf("resultFile %q must be an absolute path", n.IPAM.ResultFile)
+	}
+
+	if n.IPAM.HashFilenames && n.IPAM.Store != "" && n.IPAM.Store != "disk" {
+		return nil, fmt.Errorf("hashFilenames requires the disk store, got %q", n.IPAM.Store)
+	}
+
+	switch n.IPAM.StoreFormat {
+	case "", StoreFormatLegacy:
+	case StoreFormatJSON:
+		if n.IPAM.Store != "" && n.IPAM.Store != "disk" {
+			return nil, fmt.Errorf("storeFormat %q requires the disk store, got %q", n.IPAM.StoreFormat, n.IPAM.Store)
+		}
+	default:
+		return nil, fmt.Errorf("unknown storeFormat %q", n.IPAM.StoreFormat)
+	}
+
+	if n.IPAM.ShardPrefix != 0 {
+		if n.IPAM.ShardPrefix < 1 || n.IPAM.ShardPrefix > 32 {
+			return nil, fmt.Errorf("shardPrefix %d must be between 1 and 32", n.IPAM.ShardPrefix)
+		}
+		if n.IPAM.Store != "" && n.IPAM.Store != "disk" {
+			return nil, fmt.Errorf("shardPrefix requires the disk store, got %q", n.IPAM.Store)
+		}
+	}
+
+	if n.IPAM.SyncWrites != nil && n.IPAM.Store != "" && n.IPAM.Store != "disk" {
+		return nil, fmt.Errorf("syncWrites requires the disk store, got %q", n.IPAM.Store)
+	}
+
+	if err := resolvePoolCIDR(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := resolveHostCount(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateSubnets(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	level, err := log.ParseLevel(n.IPAM.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := normalizeSubnets(n.IPAM, log.NewStderr(level).With("network", n.Name)); err != nil {
+		return nil, err
+	}
+
+	if n.IPAM.LockTimeout < 0 || n.IPAM.LockRetryInterval < 0 {
+		return nil, fmt.Errorf("%q and %q must not be negative", "lockTimeout", "lockRetryInterval")
+	}
+
+	if err := validateGatewayMode(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateReuseMode(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateRoutes(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateValidationHook(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateDirection(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateReservationKey(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateReleaseGracePeriod(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfirmTTL(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateRateLimit(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateMaxUtilization(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if n.IPAM.MaxIPsPerContainer < 0 {
+		return nil, fmt.Errorf("%q must not be negative", "maxIPsPerContainer")
+	}
+
+	if n.IPAM.StartJitter && n.IPAM.Strategy != "" && n.IPAM.Strategy != "sequential" {
+		return nil, fmt.Errorf("startJitter cannot be combined with allocation strategy %q", n.IPAM.Strategy)
+	}
+
+	if n.IPAM.StickyMode && n.IPAM.Strategy != "" && n.IPAM.Strategy != "sequential" {
+		return nil, fmt.Errorf("stickyMode cannot be combined with allocation strategy %q", n.IPAM.Strategy)
+	}
+
+	if n.IPAM.MirrorOffset && n.IPAM.Strategy != "" && n.IPAM.Strategy != "sequential" {
+		return nil, fmt.Errorf("mirrorOffset cannot be combined with allocation strategy %q", n.IPAM.Strategy)
+	}
+
+	if n.IPAM.AllocationTimeout < 0 {
+		return nil, fmt.Errorf("%q must not be negative", "allocationTimeout")
+	}
+	if n.IPAM.AllocationTimeout > 0 && n.IPAM.Strategy != "" && n.IPAM.Strategy != "sequential" {
+		return nil, fmt.Errorf("allocationTimeout cannot be combined with allocation strategy %q", n.IPAM.Strategy)
+	}
+
+	if err := validateFamilies(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateDelegate(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateDualStack(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateRanges(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateExcludeIPs(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validatePreReserved(n.IPAM); err != nil {
+		return nil, err
 	}
 
 	// Copy net name into IPAM so not to drag Net struct around
 	n.IPAM.Name = n.Name
+	n.IPAM.PrevResult = n.PrevResult
+	n.IPAM.CNIVersion = n.CNIVersion
+
+	if err := validateSearchSubnet(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateRouteArgs(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateMirrorOffset(n.IPAM); err != nil {
+		return nil, err
+	}
+
+	if err := validateDNSFromSubnet(n.IPAM); err != nil {
+		return nil, err
+	}
 
 	return n.IPAM, nil
 }
+
+// normalizeSubnets masks the host bits out of subnet and subnet6, such
+// as those of "10.0.0.5/24", so that the network address is used in
+// their place, warning about each on logger. With strictSubnet a subnet
+// with host bits set fails the configuration instead.
+func normalizeSubnets(conf *IPAMConfig, logger *log.Logger) error {
+	for _, s := range []struct {
+		name   string
+		subnet *types.IPNet
+	}{{"subnet", &conf.Subnet}, {"subnet6", &conf.Subnet6}} {
+		if s.subnet.IP == nil {
+			continue
+		}
+		network := s.subnet.IP.Mask(s.subnet.Mask)
+		if network == nil || network.Equal(s.subnet.IP) {
+			continue
+		}
+		given := (*net.IPNet)(s.subnet).String()
+		masked := (&net.IPNet{IP: network, Mask: s.subnet.Mask}).String()
+		if conf.StrictSubnet {
+			return fmt.Errorf("%s %s has host bits set, the network address is %s", s.name, given, masked)
+		}
+		logger.Warnf("%s %s has host bits set, using %s", s.name, given, masked)
+		s.subnet.IP = network
+	}
+	return nil
+}
+
+// resolveHostCount synthesizes the subnet from baseAddress and
+// hostCount: the smallest subnet at baseAddress that fits hostCount
+// hosts besides the network address, the gateway and, for IPv4, the
+// broadcast address
+func resolveHostCount(conf *IPAMConfig) error {
+	if conf.HostCount == 0 && conf.BaseAddress == nil {
+		return nil
+	}
+	if conf.Subnet.IP != nil {
+		return fmt.Errorf("%q cannot be combined with %q", "subnet", "hostCount")
+	}
+	if conf.BaseAddress == nil || conf.HostCount <= 0 {
+		return fmt.Errorf("%q and a positive %q must be given together", "baseAddress", "hostCount")
+	}
+
+	base := conf.BaseAddress.To4()
+	reserved := 3
+	if base == nil {
+		base = conf.BaseAddress.To16()
+		reserved = 2
+	}
+	bits := len(base) * 8
+
+	// add in big.Int so that a huge hostCount cannot wrap around
+	needed := new(big.Int).Add(big.NewInt(int64(conf.HostCount)), big.NewInt(int64(reserved)))
+	hostBits := 0
+	for new(big.Int).Lsh(big.NewInt(1), uint(hostBits)).Cmp(needed) < 0 {
+		hostBits++
+	}
+	if hostBits > bits {
+		return fmt.Errorf("hostCount %d does not fit in an address family of %d bits", conf.HostCount, bits)
+	}
+
+	subnet := net.IPNet{IP: base, Mask: net.CIDRMask(bits-hostBits, bits)}
+	if !subnet.IP.Equal(base.Mask(subnet.Mask)) {
+		return fmt.Errorf("baseAddress %s is not the first address of a /%d subnet", conf.BaseAddress, bits-hostBits)
+	}
+	conf.Subnet = types.IPNet(subnet)
+	return nil
+}
+
+// Gateway modes select the default gateway when none is configured
+const (
+	GatewayModeFirst = "first"
+	GatewayModeLast  = "last"
+	GatewayModeNone  = "none"
+)
+
+func validateGatewayMode(conf *IPAMConfig) error {
+	if conf.GatewayOffset != 0 {
+		if conf.Gateway != nil {
+			return fmt.Errorf("%q cannot be combined with %q", "gatewayOffset", "gateway")
+		}
+		if conf.GatewayMode != "" {
+			return fmt.Errorf("%q cannot be combined with %q", "gatewayOffset", "gatewayMode")
+		}
+		if conf.Subnet.IP != nil {
+			if _, err := conf.offsetGateway(); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch conf.GatewayMode {
+	case "", GatewayModeFirst, GatewayModeLast:
+		return nil
+	case GatewayModeNone:
+		if conf.Gateway != nil {
+			return fmt.Errorf("gatewayMode %q cannot be combined with %q", GatewayModeNone, "gateway")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown gatewayMode %q", conf.GatewayMode)
+}
+
+// GatewayIP returns the configured gateway or, failing that, the one
+// picked by the gateway mode: the first address after the network
+// address, the last address before the broadcast address, or nil for
+// no gateway at all. IPv4 /31 and /32 subnets get no default gateway
+// so that all of their addresses can be handed out.
+func (c *IPAMConfig) GatewayIP() net.IP {
+	if c.Gateway != nil {
+		return c.Gateway
+	}
+	if c.GatewayOffset != 0 {
+		gw, err := c.offsetGateway()
+		if err != nil {
+			return nil
+		}
+		return gw
+	}
+	if pointToPoint((*net.IPNet)(&c.Subnet)) {
+		return nil
+	}
+	switch c.GatewayMode {
+	case GatewayModeNone:
+		return nil
+	case GatewayModeLast:
+		_, end, err := networkRange((*net.IPNet)(&c.Subnet))
+		if err != nil {
+			return nil
+		}
+		return ip.PrevIP(end)
+	}
+	if c.Subnet.IP == nil {
+		return nil
+	}
+	return ip.NextIP(c.Subnet.IP)
+}
+
+// SubnetRoutes returns the routes handed out with an address of the
+// subnet, followed by those of its family passed in the ROUTES
+// argument. With filterRoutes, routes via a gateway outside the subnet
+// are dropped; on-link routes without a gateway are always kept.
+func (c *IPAMConfig) SubnetRoutes() []types.Route {
+	all := c.Routes
+	if extra := c.argRoutes(); len(extra) > 0 {
+		all = append(append([]types.Route{}, c.Routes...), extra...)
+	}
+	if !c.FilterRoutes {
+		return all
+	}
+	var routes []types.Route
+	for _, r := range all {
+		if r.GW == nil || (*net.IPNet)(&c.Subnet).Contains(r.GW) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// DropGatewayRoutes removes the default routes without a gw from c if
+// no gateway was resolved for it, since they would be returned without
+// a next hop, and warns about each on logger. Other routes without a gw
+// are on-link and kept.
+func DropGatewayRoutes(c *types.IPConfig, logger *log.Logger) {
+	if c == nil || c.Gateway != nil {
+		return
+	}
+	// the routes may be shared with the configuration
+	routes := make([]types.Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		if r.GW == nil && isDefaultRoute(r.Dst) {
+			logger.With("ip", c.IP.IP.String()).With("dst", r.Dst.String()).Warnf("dropping route that needs a gateway, none was resolved")
+			continue
+		}
+		routes = append(routes, r)
+	}
+	if len(routes) < len(c.Routes) {
+		c.Routes = routes
+	}
+}
+
+func isDefaultRoute(dst net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return dst.Mask != nil && ones == 0
+}
+
+// Logger returns a logger at the configured logLevel, tagged with the
+// name of the network
+func (c *IPAMConfig) Logger() *log.Logger {
+	level, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		level = log.DefaultLevel
+	}
+	return log.NewStderr(level).With("network", c.Name)
+}
+
+// minRouteMTU is the smallest MTU of each family that a route may ask
+// for: the minimum IPv4 datagram size and the IPv6 link MTU (RFC 8200)
+var minRouteMTU = map[bool]int{false: 68, true: 1280}
+
+// validateRoutes checks the optional MTU and metric hints of the routes
+// of both families
+func validateRoutes(conf *IPAMConfig) error {
+	for _, routes := range [][]types.Route{conf.Routes, conf.Routes6} {
+		for _, r := range routes {
+			if r.Metric < 0 {
+				return fmt.Errorf("route %s: %q must not be negative, got %d", &r.Dst, "metric", r.Metric)
+			}
+			if r.MTU < 0 {
+				return fmt.Errorf("route %s: %q must not be negative, got %d", &r.Dst, "mtu", r.MTU)
+			}
+			if min := minRouteMTU[r.Dst.IP.To4() == nil]; r.MTU > 0 && r.MTU < min {
+				return fmt.Errorf("route %s: %q %d is below the minimum of %d", &r.Dst, "mtu", r.MTU, min)
+			}
+		}
+	}
+	return nil
+}
+
+// offsetGateway resolves GatewayOffset into an address of the subnet,
+// which may be neither the network nor the broadcast address
+func (c *IPAMConfig) offsetGateway() (net.IP, error) {
+	subnet := (*net.IPNet)(&c.Subnet)
+	start, end, err := networkRange(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	base, off := start, big.NewInt(int64(c.GatewayOffset))
+	if c.GatewayOffset < 0 {
+		base, off = end, off.Add(off, big.NewInt(1))
+	}
+	n := off.Add(off, ip.ToInt(base))
+	if n.Cmp(ip.ToInt(start)) < 0 || n.Cmp(ip.ToInt(end)) > 0 {
+		return nil, fmt.Errorf("gatewayOffset %d is outside of network: %s", c.GatewayOffset, subnet)
+	}
+	v4 := start.To4() != nil
+	gw := ip.FromInt(n, v4)
+	if v4 && !pointToPoint(subnet) && (gw.Equal(start) || gw.Equal(end)) {
+		return nil, fmt.Errorf("gatewayOffset %d selects the network or broadcast address of %s", c.GatewayOffset, subnet)
+	}
+	return gw, nil
+}
+
+// validateDelegate checks that a delegate names another plugin and does
+// not compete with subnet6 for the IPv6 side
+func validateDelegate(conf *IPAMConfig) error {
+	if conf.Delegate == nil {
+		return nil
+	}
+	if conf.Delegate.Type == "" {
+		return fmt.Errorf("missing field %q in delegate configuration", "type")
+	}
+	if conf.Delegate.Type == conf.Type {
+		return fmt.Errorf("delegate must be another plugin than %s", conf.Type)
+	}
+	if conf.Subnet6.IP != nil {
+		return fmt.Errorf("%q cannot be combined with %q", "delegate", "subnet6")
+	}
+	return nil
+}
+
+// validateFamilies checks that range boundaries and the gateway are of
+// the same address family as the subnet
+func validateFamilies(conf *IPAMConfig) error {
+	if conf.Subnet.IP == nil {
+		return nil
+	}
+	v4 := conf.Subnet.IP.To4() != nil
+
+	check := func(name string, addr net.IP) error {
+		if addr != nil && (addr.To4() != nil) != v4 {
+			return fmt.Errorf("%s %s is not in the address family of subnet %s", name, addr, (*net.IPNet)(&conf.Subnet))
+		}
+		return nil
+	}
+
+	if err := check("rangeStart", conf.RangeStart); err != nil {
+		return err
+	}
+	if err := check("rangeEnd", conf.RangeEnd); err != nil {
+		return err
+	}
+	if err := check("gateway", conf.Gateway); err != nil {
+		return err
+	}
+	for _, r := range conf.Ranges {
+		if err := check("rangeStart", r.RangeStart); err != nil {
+			return err
+		}
+		if err := check("rangeEnd", r.RangeEnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDualStack checks that a dual-stack configuration pairs an
+// IPv4 subnet with an IPv6 one
+func validateDualStack(conf *IPAMConfig) error {
+	if conf.Subnet6.IP == nil {
+		if conf.Gateway6 != nil || conf.Routes6 != nil {
+			return fmt.Errorf("%q and %q require %q", "gateway6", "routes6", "subnet6")
+		}
+		return nil
+	}
+	if conf.Subnet6.IP.To4() != nil {
+		return fmt.Errorf("subnet6 %s is not an IPv6 subnet", (*net.IPNet)(&conf.Subnet6))
+	}
+	if conf.Subnet.IP == nil || conf.Subnet.IP.To4() == nil {
+		return fmt.Errorf("subnet must be an IPv4 subnet when subnet6 is set")
+	}
+	if conf.Gateway6 != nil && conf.Gateway6.To4() != nil {
+		return fmt.Errorf("gateway6 %s is not an IPv6 address", conf.Gateway6)
+	}
+	return nil
+}
+
+// Sync reports whether the disk store fsyncs its writes, which it does
+// unless syncWrites is false
+func (c *IPAMConfig) Sync() bool {
+	return c.SyncWrites == nil || *c.SyncWrites
+}
+
+// SkipsNetworkAddress reports whether the network address of the subnet
+// is left out of its ranges, which it is unless skipNetworkAddress is
+// false
+func (c *IPAMConfig) SkipsNetworkAddress() bool {
+	return c.SkipNetworkAddress == nil || *c.SkipNetworkAddress
+}
+
+// IPv6Config returns the configuration used to allocate the IPv6 address
+// of a dual-stack network, or nil if no IPv6 subnet is set. The requested
+// IP in Args only applies to the IPv4 address.
+func (c *IPAMConfig) IPv6Config() *IPAMConfig {
+	if c.Subnet6.IP == nil {
+		return nil
+	}
+	v6 := *c
+	v6.Subnet = c.Subnet6
+	v6.Gateway = c.Gateway6
+	if c.Gateway6 != nil {
+		// an explicit gateway6 overrides how the gateway is picked
+		v6.GatewayMode = ""
+		v6.GatewayOffset = 0
+	}
+	v6.Routes = c.Routes6
+	v6.RangeStart = nil
+	v6.RangeEnd = nil
+	v6.RangeCIDR = types.IPNet{}
+	v6.RangeOffsetFromGateway = 0
+	v6.RangeSizeFromGateway = 0
+	v6.Ranges = nil
+	v6.Subnet6 = types.IPNet{}
+	v6.Gateway6 = nil
+	v6.Routes6 = nil
+	if c.Args != nil {
+		args := *c.Args
+		args.IP = nil
+		// pools are made of IPv4 ranges, and SUBNET narrows those
+		args.POOL = ""
+		args.SUBNET = ""
+		if args.PREFERRED_IP.To4() != nil {
+			args.PREFERRED_IP = nil
+		}
+		args.PREFERRED_IPS = nil
+		for _, ip := range c.Args.PREFERRED_IPS {
+			if ip.To4() == nil {
+				args.PREFERRED_IPS = append(args.PREFERRED_IPS, ip)
+			}
+		}
+		v6.Args = &args
+	}
+	return &v6
+}
+
+// validateExcludeIPs checks that every exclusion parses and lies within
+// the subnet, or within subnet6 on a dual-stack network
+func validateExcludeIPs(conf *IPAMConfig) error {
+	set, err := ParseExcludeIPs(conf.ExcludeIPs)
+	if err != nil {
+		return err
+	}
+	for i, n := range set {
+		if !subnetContains(conf.Subnet, n) && !subnetContains(conf.Subnet6, n) && !conf.subnetsContain(n) {
+			return fmt.Errorf("excludeIPs entry %q is not in network: %s", conf.ExcludeIPs[i], (*net.IPNet)(&conf.Subnet))
+		}
+	}
+	for _, b := range conf.ExcludeBoundaries {
+		n := &net.IPNet{IP: b.IP.Mask(b.Mask), Mask: b.Mask}
+		if !subnetContains(conf.Subnet, n) && !subnetContains(conf.Subnet6, n) && !conf.subnetsContain(n) {
+			return fmt.Errorf("excludeSubnetBoundaries entry %s is not in network: %s", n, (*net.IPNet)(&conf.Subnet))
+		}
+	}
+	return validateMACMappings(conf, set)
+}
+
+// subnetContains reports whether all of n lies within subnet
+func subnetContains(subnet types.IPNet, n *net.IPNet) bool {
+	if subnet.IP == nil || !(*net.IPNet)(&subnet).Contains(n.IP) {
+		return false
+	}
+	ones, bits := n.Mask.Size()
+	subnetOnes, subnetBits := subnet.Mask.Size()
+	return bits == subnetBits && ones >= subnetOnes
+}
+
+// validateRanges checks that the configured ranges lie within the
+// subnet, are not inverted and do not overlap each other
+func validateRanges(conf *IPAMConfig) error {
+	if len(conf.Ranges) > 0 && (conf.RangeStart != nil || conf.RangeEnd != nil) {
+		return fmt.Errorf("%q cannot be combined with %q or %q", "ranges", "rangeStart", "rangeEnd")
+	}
+	if conf.RangeCIDR.IP != nil {
+		if conf.RangeStart != nil || conf.RangeEnd != nil {
+			return fmt.Errorf("%q cannot be combined with %q or %q", "rangeCIDR", "rangeStart", "rangeEnd")
+		}
+		if len(conf.Ranges) > 0 {
+			return fmt.Errorf("%q cannot be combined with %q", "rangeCIDR", "ranges")
+		}
+	}
+	if conf.RangeOffsetFromGateway != 0 || conf.RangeSizeFromGateway != 0 {
+		if conf.RangeSizeFromGateway <= 0 {
+			return fmt.Errorf("%q must be positive", "rangeSizeFromGateway")
+		}
+		for _, field := range []struct {
+			name string
+			set  bool
+		}{
+			{"rangeStart", conf.RangeStart != nil},
+			{"rangeEnd", conf.RangeEnd != nil},
+			{"rangeCIDR", conf.RangeCIDR.IP != nil},
+			{"ranges", len(conf.Ranges) > 0},
+			{"reserveLow", conf.ReserveLow != 0},
+		} {
+			if field.set {
+				return fmt.Errorf("%q cannot be combined with %q", "rangeSizeFromGateway", field.name)
+			}
+		}
+	}
+	if conf.ReserveLow < 0 {
+		return fmt.Errorf("%q must not be negative", "reserveLow")
+	}
+	if conf.ReserveLow > 0 {
+		for _, field := range []struct {
+			name string
+			set  bool
+		}{
+			{"rangeStart", conf.RangeStart != nil},
+			{"rangeCIDR", conf.RangeCIDR.IP != nil},
+			{"ranges", len(conf.Ranges) > 0},
+		} {
+			if field.set {
+				return fmt.Errorf("%q cannot be combined with %q", "reserveLow", field.name)
+			}
+		}
+	}
+	if len(conf.Ranges) == 0 && conf.Subnet.IP == nil {
+		return nil
+	}
+
+	ranges, err := allRanges(conf)
+	if err != nil {
+		return err
+	}
+	for i, r := range ranges {
+		for j := 0; j < i; j++ {
+			o := ranges[j]
+			if ip.Cmp(r.Start, o.End) < 0 && ip.Cmp(o.Start, r.End) < 0 {
+				return fmt.Errorf("range %d overlaps range %d", i, j)
+			}
+		}
+	}
+	return validateRangeGateways(conf)
+}
@@ -0,0 +1,1227 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ipam/log"
+	"github.com/containernetworking/cni/pkg/types"
+	fakestore "github.com/containernetworking/cni/plugins/ipam/store/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPAM config", func() {
+	It("parses the lease TTL as a duration", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"leaseTTL": "1h30m"
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Duration(conf.LeaseTTL)).To(Equal(90 * time.Minute))
+	})
+
+	It("rejects a malformed lease TTL", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"leaseTTL": "forever"
+			}
+		}`), "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects CNI_ARGS without an ipam section", func() {
+		_, err := LoadIPAMConfig([]byte(`{"name": "test"}`), "IP=10.0.0.5")
+		Expect(err).To(MatchError("IPAM config missing 'ipam' key"))
+	})
+
+	It("labels reservations after the pod unless a label is given", func() {
+		netconf := []byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24"
+			}
+		}`)
+		conf, err := LoadIPAMConfig(netconf, "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Label()).To(Equal("default/web-0"))
+
+		conf, err = LoadIPAMConfig(netconf, "K8S_POD_NAME=web-0;LABEL=audit")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Label()).To(Equal("audit"))
+
+		_, err = LoadIPAMConfig(netconf, "LABEL=a\nb")
+		Expect(err).To(MatchError(`label "a\nb" must not contain line breaks`))
+	})
+
+	It("rejects a SUBNET argument outside of the subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/16"
+			}
+		}`), "SUBNET=10.1.5.0/24")
+		Expect(err).To(MatchError("requested subnet 10.1.5.0/24 is not within subnet 10.0.0.0/16 of network: test"))
+	})
+
+	It("parses MTU and metric hints of routes", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"routes": [
+					{ "dst": "0.0.0.0/0", "metric": 100 },
+					{ "dst": "10.1.0.0/16", "gw": "10.0.0.254", "mtu": 1450, "metric": 50 }
+				]
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Routes).To(HaveLen(2))
+		Expect(conf.Routes[0].Metric).To(Equal(100))
+		Expect(conf.Routes[0].MTU).To(BeZero())
+		Expect(conf.Routes[1].GW.String()).To(Equal("10.0.0.254"))
+		Expect(conf.Routes[1].MTU).To(Equal(1450))
+		Expect(conf.Routes[1].Metric).To(Equal(50))
+	})
+
+	It("rejects a negative route metric", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"routes": [{ "dst": "0.0.0.0/0", "metric": -1 }]
+			}
+		}`), "")
+		Expect(err).To(MatchError(`route 0.0.0.0/0: "metric" must not be negative, got -1`))
+	})
+
+	It("rejects a route MTU below the minimum of its family", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"subnet6": "fd00::/64",
+				"routes6": [{ "dst": "::/0", "mtu": 1000 }]
+			}
+		}`), "")
+		Expect(err).To(MatchError(`route ::/0: "mtu" 1000 is below the minimum of 1280`))
+	})
+
+	It("rejects allocationsPerSecond with another store", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"store": "etcd",
+				"allocationsPerSecond": 5
+			}
+		}`), "")
+		Expect(err).To(MatchError(`allocationsPerSecond requires the disk store, got "etcd"`))
+	})
+
+	It("rejects allocationBurst without allocationsPerSecond", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"allocationBurst": 5
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"allocationBurst" requires "allocationsPerSecond"`))
+	})
+
+	It("rejects dnsFromSubnet without a gateway", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"gatewayMode": "none",
+				"dnsFromSubnet": true
+			}
+		}`), "")
+		Expect(err).To(MatchError("dnsFromSubnet requires a gateway in network: 10.0.0.0/24"))
+	})
+
+	It("rejects dnsFromSubnet when the gateway is the last host address", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"gateway": "10.0.0.254",
+				"dnsFromSubnet": true
+			}
+		}`), "")
+		Expect(err).To(MatchError("dnsFromSubnet: 10.0.0.255 following gateway 10.0.0.254 is not a host address of network: 10.0.0.0/24"))
+	})
+
+	It("excludes the DNS server of every subnet with dnsFromSubnet", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"subnet6": "fd00::/64",
+				"dnsFromSubnet": true
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.SubnetDNS().String()).To(Equal("10.0.0.2"))
+		Expect(conf.IPv6Config().SubnetDNS().String()).To(Equal("fd00::2"))
+
+		set, err := Exclusions(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(set.Contains(net.ParseIP("10.0.0.2"))).To(BeTrue())
+		Expect(set.Contains(net.ParseIP("fd00::2"))).To(BeTrue())
+		Expect(set.Contains(net.ParseIP("10.0.0.3"))).To(BeFalse())
+	})
+
+	It("rejects a range gateway outside of the subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"ranges": [
+					{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.19"},
+					{"rangeStart": "10.0.0.20", "rangeEnd": "10.0.0.29", "gateway": "10.0.1.1"}
+				]
+			}
+		}`), "")
+		Expect(err).To(MatchError("range 1: gateway 10.0.1.1 is not in network: 10.0.0.0/24"))
+	})
+
+	It("rejects a negative maxIPsPerContainer", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"maxIPsPerContainer": -1
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"maxIPsPerContainer" must not be negative`))
+	})
+
+	It("rejects a relative validationHook", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"validationHook": "approve.sh"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`validationHook "approve.sh" must be an absolute path`))
+	})
+
+	It("accepts an absolute dataDir", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": "/run/cni/test"
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.DataDir).To(Equal("/run/cni/test"))
+	})
+
+	It("rejects a relative dataDir", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": "cni/test"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`dataDir "cni/test" must be an absolute path`))
+	})
+
+	It("rejects an IPv4 rangeStart in an IPv6 subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "fd00::/120",
+				"rangeStart": "10.0.0.10"
+			}
+		}`), "")
+		Expect(err).To(MatchError("rangeStart 10.0.0.10 is not in the address family of subnet fd00::/120"))
+	})
+
+	It("rejects an IPv6 range in an IPv4 subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"ranges": [{"rangeStart": "fd00::10", "rangeEnd": "fd00::20"}]
+			}
+		}`), "")
+		Expect(err).To(MatchError("rangeStart fd00::10 is not in the address family of subnet 10.0.0.0/24"))
+	})
+
+	It("rejects a rangeStart after rangeEnd", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"rangeStart": "10.0.0.50",
+				"rangeEnd": "10.0.0.10"
+			}
+		}`), "")
+		Expect(err).To(MatchError("rangeStart 10.0.0.50 is after rangeEnd 10.0.0.10"))
+	})
+
+	It("rejects a rangeEnd outside the subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"rangeEnd": "10.0.1.10"
+			}
+		}`), "")
+		Expect(err).To(MatchError("10.0.1.10 not in network: 10.0.0.0/24"))
+	})
+
+	It("parses excluded addresses and CIDRs", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"excludeIPs": ["10.0.0.5", "10.0.0.128/25"]
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.ExcludeIPs).To(Equal([]string{"10.0.0.5", "10.0.0.128/25"}))
+	})
+
+	It("rejects exclusions outside the subnet", func() {
+		for _, entry := range []string{"10.0.1.5", "10.0.0.0/16"} {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"excludeIPs": ["`+entry+`"]
+				}
+			}`), "")
+			Expect(err).To(MatchError(`excludeIPs entry "` + entry + `" is not in network: 10.0.0.0/24`))
+		}
+	})
+
+	It("rejects malformed exclusions", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"excludeIPs": ["10.0.0.300"]
+			}
+		}`), "")
+		Expect(err).To(MatchError(`invalid excludeIPs entry "10.0.0.300"`))
+	})
+
+	It("parses the POOL and PREFERRED_IP arguments", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"ranges": [{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.19", "name": "blue"}]
+			}
+		}`), "POOL=blue;PREFERRED_IP=10.0.0.12")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(conf.Args.POOL)).To(Equal("blue"))
+		Expect(conf.Args.PREFERRED_IP.String()).To(Equal("10.0.0.12"))
+		Expect(conf.Ranges[0].Name).To(Equal("blue"))
+	})
+
+	It("parses the PREFERRED_IPS argument", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24"
+			}
+		}`), "PREFERRED_IPS=10.0.0.12,10.0.0.13")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Args.PREFERRED_IPS).To(Equal(IPList{net.ParseIP("10.0.0.12"), net.ParseIP("10.0.0.13")}))
+	})
+
+	It("rejects an invalid IP in PREFERRED_IPS", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24"
+			}
+		}`), "PREFERRED_IPS=10.0.0.12,nope")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`invalid IP "nope"`))
+	})
+
+	It("rejects pre-reserved IPs outside the network", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"preReserved": ["10.0.0.7", "10.0.1.7"]
+			}
+		}`), "")
+		Expect(err).To(MatchError("preReserved IP 10.0.1.7 is not in network: 10.0.0.0/24"))
+	})
+
+	It("rejects a negative lock timeout", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"lockTimeout": "-1s"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"lockTimeout" and "lockRetryInterval" must not be negative`))
+	})
+
+	Context("with weighted subnets", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					`+ipam+`
+				}
+			}`), "")
+		}
+
+		It("loads each subnet with its weight", func() {
+			conf, err := load(`"subnets": [
+				{"subnet": "10.0.0.0/24", "weight": 3},
+				{"subnet": "10.0.1.0/24", "gateway": "10.0.1.254"}
+			], "excludeIPs": ["10.0.1.10"]`)
+			Expect(err).ToNot(HaveOccurred())
+			subs := conf.SubnetConfigs()
+			Expect(subs).To(HaveLen(2))
+			Expect((*net.IPNet)(&subs[1].Subnet).String()).To(Equal("10.0.1.0/24"))
+			Expect(subs[1].GatewayIP().String()).To(Equal("10.0.1.254"))
+			Expect(conf.SubnetWeight(0)).To(Equal(3))
+			Expect(conf.SubnetWeight(1)).To(Equal(1))
+		})
+
+		It("rejects overlapping subnets", func() {
+			_, err := load(`"subnets": [{"subnet": "10.0.0.0/16"}, {"subnet": "10.0.1.0/24"}]`)
+			Expect(err).To(MatchError("subnet 1 overlaps subnet 0"))
+		})
+
+		It("rejects subnets combined with subnet", func() {
+			_, err := load(`"subnet": "10.0.0.0/24", "subnets": [{"subnet": "10.0.1.0/24"}]`)
+			Expect(err).To(MatchError(`"subnets" cannot be combined with "subnet"`))
+		})
+
+		It("rejects a negative weight", func() {
+			_, err := load(`"subnets": [{"subnet": "10.0.1.0/24", "weight": -1}]`)
+			Expect(err).To(MatchError("subnet 0: weight -1 is negative"))
+		})
+
+		It("validates the subnetOrder", func() {
+			conf, err := load(`"subnets": [{"subnet": "10.0.1.0/24"}], "subnetOrder": "listed"`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.SubnetOrder).To(Equal(SubnetOrderListed))
+
+			_, err = load(`"subnets": [{"subnet": "10.0.1.0/24"}], "subnetOrder": "random"`)
+			Expect(err).To(MatchError(`unknown subnetOrder "random"`))
+			_, err = load(`"subnet": "10.0.1.0/24", "subnetOrder": "listed"`)
+			Expect(err).To(MatchError(`"subnetOrder" requires "subnets"`))
+		})
+
+		It("rejects a gateway outside its subnet's family", func() {
+			_, err := load(`"subnets": [{"subnet": "10.0.1.0/24", "gateway": "fd00::1"}]`)
+			Expect(err).To(MatchError("subnet 0: gateway fd00::1 is not in the address family of subnet 10.0.1.0/24"))
+		})
+	})
+
+	Context("with a host count", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					`+ipam+`
+				}
+			}`), "")
+		}
+
+		It("sizes the subnet to fit the hosts", func() {
+			conf, err := load(`"baseAddress": "10.0.0.0", "hostCount": 500`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal("10.0.0.0/23"))
+
+			start, end, err := networkRange((*net.IPNet)(&conf.Subnet))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(start.String()).To(Equal("10.0.0.0"))
+			Expect(end.String()).To(Equal("10.0.1.255"))
+		})
+
+		It("leaves room for the network, gateway and broadcast addresses", func() {
+			for count, subnet := range map[string]string{
+				"253": "10.0.0.0/24",
+				"254": "10.0.0.0/23",
+			} {
+				conf, err := load(`"baseAddress": "10.0.0.0", "hostCount": ` + count)
+				Expect(err).ToNot(HaveOccurred())
+				Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal(subnet))
+			}
+		})
+
+		It("sizes IPv6 subnets without a broadcast address", func() {
+			conf, err := load(`"baseAddress": "fd00::", "hostCount": 14`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal("fd00::/124"))
+		})
+
+		It("rejects a host count combined with a subnet", func() {
+			_, err := load(`"subnet": "10.0.0.0/24", "baseAddress": "10.0.0.0", "hostCount": 500`)
+			Expect(err).To(MatchError(`"subnet" cannot be combined with "hostCount"`))
+		})
+
+		It("rejects a base address inside the computed subnet", func() {
+			_, err := load(`"baseAddress": "10.0.1.0", "hostCount": 500`)
+			Expect(err).To(MatchError("baseAddress 10.0.1.0 is not the first address of a /23 subnet"))
+		})
+
+		It("rejects a host count too large for the address family", func() {
+			_, err := load(`"baseAddress": "10.0.0.0", "hostCount": 9223372036854775807`)
+			Expect(err).To(MatchError("hostCount 9223372036854775807 does not fit in an address family of 32 bits"))
+		})
+
+		It("rejects a host count without a base address", func() {
+			_, err := load(`"hostCount": 500`)
+			Expect(err).To(MatchError(`"baseAddress" and a positive "hostCount" must be given together`))
+		})
+	})
+
+	It("rejects an unknown reuseMode", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"reuseMode": "fifo"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`unknown reuseMode "fifo"`))
+	})
+
+	It("rejects the lifo reuseMode with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "random",
+				"reuseMode": "lifo"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`reuseMode "lifo" cannot be combined with allocation strategy "random"`))
+	})
+
+	It("rejects a releaseGracePeriod with the lifo reuseMode", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"reuseMode": "lifo",
+				"releaseGracePeriod": "30s"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"releaseGracePeriod" cannot be combined with reuseMode "lifo"`))
+	})
+
+	It("rejects an unknown reservationKey", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"reservationKey": "podName"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`unknown reservationKey "podName"`))
+	})
+
+	It("keys reservations on the pod UID only if configured and passed", func() {
+		load := func(key, args string) *IPAMConfig {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"reservationKey": "`+key+`"
+				}
+			}`), args)
+			Expect(err).ToNot(HaveOccurred())
+			return conf
+		}
+		Expect(load("podUID", "K8S_POD_UID=uid").ReservationID("cid")).To(Equal("uid"))
+		Expect(load("podUID", "").ReservationID("cid")).To(Equal("cid"))
+		Expect(load("", "K8S_POD_UID=uid").ReservationID("cid")).To(Equal("cid"))
+	})
+
+	It("rejects an unknown allocationDirection", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"allocationDirection": "down"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`unknown allocationDirection "down"`))
+	})
+
+	It("rejects the descending allocationDirection with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "roundrobin",
+				"allocationDirection": "descending"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`allocationDirection "descending" cannot be combined with allocation strategy "roundrobin"`))
+	})
+
+	It("rejects maxUtilizationPercent above 100", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"maxUtilizationPercent": 120
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"maxUtilizationPercent" must be between 1 and 100, got 120`))
+	})
+
+	It("rejects hashFilenames with another store", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"store": "memory",
+				"hashFilenames": true
+			}
+		}`), "")
+		Expect(err).To(MatchError(`hashFilenames requires the disk store, got "memory"`))
+	})
+
+	It("syncs writes unless syncWrites is false", func() {
+		load := func(sync string) *IPAMConfig {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24"`+sync+`
+				}
+			}`), "")
+			Expect(err).ToNot(HaveOccurred())
+			return conf
+		}
+		Expect(load("").Sync()).To(BeTrue())
+		Expect(load(`, "syncWrites": true`).Sync()).To(BeTrue())
+		Expect(load(`, "syncWrites": false`).Sync()).To(BeFalse())
+	})
+
+	It("skips the network address unless skipNetworkAddress is false", func() {
+		load := func(skip string) *IPAMConfig {
+			conf, err := LoadIPAMConfig([]byte(`{"name": "test", "ipam": {"type": "host-local", "subnet": "10.0.0.0/24"`+skip+`}}`), "")
+			Expect(err).ToNot(HaveOccurred())
+			return conf
+		}
+		Expect(load("").SkipsNetworkAddress()).To(BeTrue())
+		Expect(load(`, "skipNetworkAddress": true`).SkipsNetworkAddress()).To(BeTrue())
+		Expect(load(`, "skipNetworkAddress": false`).SkipsNetworkAddress()).To(BeFalse())
+	})
+
+	It("validates the storeFormat", func() {
+		load := func(ipam string) error {
+			_, err := LoadIPAMConfig([]byte(`{"name": "test", "ipam": {"type": "host-local", "subnet": "10.0.0.0/24", `+ipam+`}}`), "")
+			return err
+		}
+		Expect(load(`"storeFormat": "json"`)).To(Succeed())
+		Expect(load(`"storeFormat": "legacy"`)).To(Succeed())
+		Expect(load(`"storeFormat": "yaml"`)).To(MatchError(`unknown storeFormat "yaml"`))
+		Expect(load(`"storeFormat": "json", "store": "memory"`)).To(MatchError(`storeFormat "json" requires the disk store, got "memory"`))
+	})
+
+	It("validates the shardPrefix", func() {
+		load := func(ipam string) error {
+			_, err := LoadIPAMConfig([]byte(`{"name": "test", "ipam": {"type": "host-local", "subnet": "10.0.0.0/16", `+ipam+`}}`), "")
+			return err
+		}
+		Expect(load(`"shardPrefix": 24`)).To(Succeed())
+		Expect(load(`"shardPrefix": 32`)).To(Succeed())
+		Expect(load(`"shardPrefix": 33`)).To(MatchError("shardPrefix 33 must be between 1 and 32"))
+		Expect(load(`"shardPrefix": -8`)).To(MatchError("shardPrefix -8 must be between 1 and 32"))
+		Expect(load(`"shardPrefix": 24, "store": "memory"`)).To(MatchError(`shardPrefix requires the disk store, got "memory"`))
+	})
+
+	It("rejects syncWrites with another store", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"store": "memory",
+				"syncWrites": false
+			}
+		}`), "")
+		Expect(err).To(MatchError(`syncWrites requires the disk store, got "memory"`))
+	})
+
+	It("rejects a delegate without a type", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"delegate": {}
+			}
+		}`), "")
+		Expect(err).To(MatchError(`missing field "type" in delegate configuration`))
+	})
+
+	It("rejects a delegate combined with subnet6", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"subnet6": "fd00::/64",
+				"delegate": {"type": "dhcp"}
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"delegate" cannot be combined with "subnet6"`))
+	})
+
+	It("accepts nodeName without poolCIDR for startJitter", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"startJitter": true,
+				"nodeName": "node-a"
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.StartJitter).To(BeTrue())
+		Expect(conf.NodeName).To(Equal("node-a"))
+	})
+
+	It("rejects startJitter with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "roundrobin",
+				"startJitter": true
+			}
+		}`), "")
+		Expect(err).To(MatchError(`startJitter cannot be combined with allocation strategy "roundrobin"`))
+	})
+
+	It("rejects a negative confirmTTL", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"confirmTTL": "-1m"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"confirmTTL" must not be negative, got -1m0s`))
+	})
+
+	It("rejects confirmTTL with a release grace period", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"confirmTTL": "1m",
+				"releaseGracePeriod": "1m"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"confirmTTL" cannot be combined with "releaseGracePeriod"`))
+	})
+
+	Context("when settings are read from a configFile", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "host-local-config")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		load := func(file string, inline string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"configFile": %q
+					%s
+				}
+			}`, file, inline)), "")
+		}
+		write := func(content string) string {
+			path := filepath.Join(dir, "ipam.json")
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			return path
+		}
+
+		It("takes the inline values over those of the file", func() {
+			path := write(`{"subnet": "10.0.0.0/16", "rangeStart": "10.0.1.0", "gateway": "10.0.0.254"}`)
+			conf, err := load(path, `, "rangeStart": "10.0.2.0"`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal("10.0.0.0/16"))
+			Expect(conf.Gateway.String()).To(Equal("10.0.0.254"))
+			Expect(conf.RangeStart.String()).To(Equal("10.0.2.0"))
+		})
+
+		It("rejects a relative path", func() {
+			_, err := load("ipam.json", "")
+			Expect(err).To(MatchError(`configFile "ipam.json" must be an absolute path`))
+		})
+
+		It("reports a missing file", func() {
+			path := filepath.Join(dir, "missing.json")
+			_, err := load(path, "")
+			Expect(err).To(MatchError(fmt.Sprintf("failed to read configFile: open %s: no such file or directory", path)))
+		})
+
+		It("reports a file that is not a JSON object", func() {
+			path := write(`{"subnet": `)
+			_, err := load(path, "")
+			Expect(err).To(MatchError(HavePrefix(fmt.Sprintf("invalid configFile %s: ", path))))
+		})
+	})
+
+	It("rejects stickyMode with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "random",
+				"stickyMode": true
+			}
+		}`), "")
+		Expect(err).To(MatchError(`stickyMode cannot be combined with allocation strategy "random"`))
+	})
+
+	It("parses an allocationTimeout", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"allocationTimeout": "2s"
+			}
+		}`), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Duration(conf.AllocationTimeout)).To(Equal(2 * time.Second))
+	})
+
+	Context("when the subnet has host bits set", func() {
+		load := func(strict bool) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.5/24",
+					"subnet6": "fd00::5/64",
+					"logLevel": "error",
+					"strictSubnet": %t
+				}
+			}`, strict)), "")
+		}
+
+		It("uses the network address", func() {
+			conf, err := load(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal("10.0.0.0/24"))
+			Expect((*net.IPNet)(&conf.Subnet6).String()).To(Equal("fd00::/64"))
+			Expect(conf.GatewayIP().String()).To(Equal("10.0.0.1"))
+
+			alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.String()).To(Equal("10.0.0.2/24"))
+		})
+
+		It("warns about the host bits", func() {
+			subnet, err := types.ParseCIDR("10.0.0.5/24")
+			Expect(err).ToNot(HaveOccurred())
+			conf := &IPAMConfig{Subnet: types.IPNet(*subnet)}
+			buf := &bytes.Buffer{}
+			Expect(normalizeSubnets(conf, log.New(buf, log.LevelWarn))).To(Succeed())
+			Expect(buf.String()).To(ContainSubstring(`"msg":"subnet 10.0.0.5/24 has host bits set, using 10.0.0.0/24"`))
+		})
+
+		It("rejects it with strictSubnet", func() {
+			_, err := load(true)
+			Expect(err).To(MatchError("subnet 10.0.0.5/24 has host bits set, the network address is 10.0.0.0/24"))
+		})
+	})
+
+	It("rejects an invalid MIRROR_OFFSET with mirrorOffset", func() {
+		conf := []byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"mirrorOffset": %t
+			}
+		}`)
+		_, err := LoadIPAMConfig([]byte(fmt.Sprintf(string(conf), true)), "MIRROR_OFFSET=-3")
+		Expect(err).To(MatchError(`invalid MIRROR_OFFSET "-3": must be a non-negative integer`))
+
+		// the argument may be meant for another network
+		_, err = LoadIPAMConfig([]byte(fmt.Sprintf(string(conf), false)), "MIRROR_OFFSET=-3")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("rejects mirrorOffset with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "random",
+				"mirrorOffset": true
+			}
+		}`), "")
+		Expect(err).To(MatchError(`mirrorOffset cannot be combined with allocation strategy "random"`))
+	})
+
+	It("rejects a relative resultFile", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"resultFile": "last.json"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`resultFile "last.json" must be an absolute path`))
+	})
+
+	It("rejects a negative allocationTimeout", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"allocationTimeout": "-1s"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"allocationTimeout" must not be negative`))
+	})
+
+	It("rejects an allocationTimeout with another strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"strategy": "random",
+				"allocationTimeout": "1s"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`allocationTimeout cannot be combined with allocation strategy "random"`))
+	})
+
+	Context("when the subnet is carved from a pool", func() {
+		load := func(ipam string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"poolCIDR": "10.0.0.0/22",
+					"nodeSubnetPrefix": 24,
+					`+ipam+`
+				}
+			}`), "")
+		}
+		subnetOf := func(node string) string {
+			conf, err := load(`"nodeName": "` + node + `"`)
+			Expect(err).ToNot(HaveOccurred())
+			return (*net.IPNet)(&conf.Subnet).String()
+		}
+
+		It("derives the same subnet for a node every time", func() {
+			subnet := subnetOf("node-a")
+			Expect(subnet).To(MatchRegexp(`^10\.0\.[0-3]\.0/24$`))
+			for i := 0; i < 3; i++ {
+				Expect(subnetOf("node-a")).To(Equal(subnet))
+			}
+		})
+
+		It("gives different nodes different subnets", func() {
+			Expect(subnetOf("node-a")).ToNot(Equal(subnetOf("node-b")))
+		})
+
+		It("falls back to the hostname", func() {
+			defer func(orig func() (string, error)) { hostname = orig }(hostname)
+			hostname = func() (string, error) { return "node-a", nil }
+
+			conf, err := load(`"dataDir": "/run/cni"`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((*net.IPNet)(&conf.Subnet).String()).To(Equal(subnetOf("node-a")))
+		})
+
+		It("rejects a node prefix not within the pool", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"poolCIDR": "10.0.0.0/22",
+					"nodeSubnetPrefix": 20,
+					"nodeName": "node-a"
+				}
+			}`), "")
+			Expect(err).To(MatchError("nodeSubnetPrefix 20 must be longer than the /22 of poolCIDR 10.0.0.0/22 and at most 32"))
+		})
+
+		It("cannot be combined with a subnet", func() {
+			_, err := load(`"subnet": "10.0.0.0/24"`)
+			Expect(err).To(MatchError(`"poolCIDR" cannot be combined with "subnet"`))
+		})
+	})
+
+	It("rejects an unknown logLevel", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"logLevel": "loud"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`unknown log level "loud"`))
+	})
+
+	It("rejects gatewayOffset with an explicit gateway", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"gateway": "10.0.0.1",
+				"gatewayOffset": 1
+			}
+		}`), "")
+		Expect(err).To(MatchError(`"gatewayOffset" cannot be combined with "gateway"`))
+	})
+
+	It("rejects an unknown gatewayMode", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"gatewayMode": "middle"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`unknown gatewayMode "middle"`))
+	})
+
+	It("rejects gatewayMode none with an explicit gateway", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "test",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"gateway": "10.0.0.1",
+				"gatewayMode": "none"
+			}
+		}`), "")
+		Expect(err).To(MatchError(`gatewayMode "none" cannot be combined with "gateway"`))
+	})
+
+	Context("with MAC mappings", func() {
+		load := func(mappings, args string) (*IPAMConfig, error) {
+			return LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"macMappings": `+mappings+`
+				}
+			}`), args)
+		}
+
+		It("resolves the MAC argument to its mapped IP", func() {
+			conf, err := load(`{"00:11:22:33:44:55": "10.0.0.5"}`, "MAC=00:11:22:33:44:55")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MappedIP().String()).To(Equal("10.0.0.5"))
+		})
+
+		It("resolves nothing without a MAC argument", func() {
+			conf, err := load(`{"00:11:22:33:44:55": "10.0.0.5"}`, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MappedIP()).To(BeNil())
+		})
+
+		It("rejects an invalid MAC", func() {
+			_, err := load(`{"00:11:22": "10.0.0.5"}`, "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects an IP outside the subnet", func() {
+			_, err := load(`{"00:11:22:33:44:55": "10.0.1.5"}`, "")
+			Expect(err).To(MatchError("macMappings entry 00:11:22:33:44:55: 10.0.1.5 not in network: 10.0.0.0/24"))
+		})
+
+		It("rejects the gateway", func() {
+			_, err := load(`{"00:11:22:33:44:55": "10.0.0.1"}`, "")
+			Expect(err).To(MatchError("macMappings entry 00:11:22:33:44:55: 10.0.0.1 is the gateway"))
+		})
+
+		It("rejects two MACs mapped to the same IP", func() {
+			_, err := load(`{"00:11:22:33:44:55": "10.0.0.5", "00:11:22:33:44:66": "10.0.0.5"}`, "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with multiple ranges", func() {
+		It("loads ranges in order", func() {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"ranges": [
+						{"rangeStart": "10.0.0.100", "rangeEnd": "10.0.0.200"},
+						{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.50"}
+					]
+				}
+			}`), "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Ranges).To(HaveLen(2))
+			Expect(conf.Ranges[0].RangeStart.String()).To(Equal("10.0.0.100"))
+			Expect(conf.Ranges[1].RangeEnd.String()).To(Equal("10.0.0.50"))
+		})
+
+		It("rejects overlapping ranges", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"ranges": [
+						{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.50"},
+						{"rangeStart": "10.0.0.50", "rangeEnd": "10.0.0.60"}
+					]
+				}
+			}`), "")
+			Expect(err).To(MatchError("range 1 overlaps range 0"))
+		})
+
+		It("rejects ranges outside the subnet", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"ranges": [
+						{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.1.50"}
+					]
+				}
+			}`), "")
+			Expect(err).To(MatchError("range 0: 10.0.1.50 not in network: 10.0.0.0/24"))
+		})
+
+		It("rejects ranges whose start is after their end", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"ranges": [
+						{"rangeStart": "10.0.0.50", "rangeEnd": "10.0.0.10"}
+					]
+				}
+			}`), "")
+			Expect(err).To(MatchError("range 0: rangeStart 10.0.0.50 is after rangeEnd 10.0.0.10"))
+		})
+
+		It("rejects ranges combined with rangeStart", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "test",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"rangeStart": "10.0.0.5",
+					"ranges": [
+						{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.50"}
+					]
+				}
+			}`), "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,54 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// loadConfigFile returns the IPAM configuration read from the file that
+// the "configFile" field of the inline configuration points to, or nil
+// if there is none. The inline values are decoded over it, so they take
+// precedence.
+func loadConfigFile(bytes []byte) (*IPAMConfig, error) {
+	var n struct {
+		IPAM *struct {
+			ConfigFile string `json:"configFile"`
+		} `json:"ipam"`
+	}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, err
+	}
+	if n.IPAM == nil || n.IPAM.ConfigFile == "" {
+		return nil, nil
+	}
+
+	path := n.IPAM.ConfigFile
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("configFile %q must be an absolute path", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configFile: %v", err)
+	}
+	conf := &IPAMConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("invalid configFile %s: %v", path, err)
+	}
+	return conf, nil
+}
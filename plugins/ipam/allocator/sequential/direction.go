@@ -0,0 +1,55 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// DirectionAscending scans the ranges from their start upward
+	DirectionAscending = "ascending"
+	// DirectionDescending scans the ranges from their end downward,
+	// keeping the low addresses free for static assignment
+	DirectionDescending = "descending"
+)
+
+func validateDirection(conf *IPAMConfig) error {
+	switch conf.AllocationDirection {
+	case "", DirectionAscending:
+		return nil
+	case DirectionDescending:
+		if conf.Strategy != "" && conf.Strategy != "sequential" {
+			return fmt.Errorf("allocationDirection %q cannot be combined with allocation strategy %q", conf.AllocationDirection, conf.Strategy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown allocationDirection %q", conf.AllocationDirection)
+}
+
+// descending reports whether the scan walks the ranges downward
+func (a *IPAllocator) descending() bool {
+	return a.conf.AllocationDirection == DirectionDescending
+}
+
+// step returns the ip the scan visits after curIP in the allocation
+// direction
+func (a *IPAllocator) step(curIP net.IP) net.IP {
+	if a.descending() {
+		return a.prevIP(curIP)
+	}
+	return a.nextIP(curIP)
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// SubnetDNS returns the DNS server of the subnet with dnsFromSubnet,
+// the address following the gateway, or nil without dnsFromSubnet or a
+// gateway
+func (c *IPAMConfig) SubnetDNS() net.IP {
+	if !c.DNSFromSubnet || c.Subnet.IP == nil {
+		return nil
+	}
+	gw := c.GatewayIP()
+	if gw == nil {
+		return nil
+	}
+	return ip.NextIP(gw)
+}
+
+// dnsConfigs returns the configurations of the subnets that get a DNS
+// server with dnsFromSubnet: the subnet, subnet6 and those under
+// "subnets"
+func (c *IPAMConfig) dnsConfigs() []*IPAMConfig {
+	confs := []*IPAMConfig{c}
+	if v6 := c.IPv6Config(); v6 != nil {
+		confs = append(confs, v6)
+	}
+	return append(confs, c.SubnetConfigs()...)
+}
+
+// validateDNSFromSubnet checks that the address following the gateway
+// of every subnet is a host address of that subnet
+func validateDNSFromSubnet(conf *IPAMConfig) error {
+	if !conf.DNSFromSubnet {
+		return nil
+	}
+	for _, c := range conf.dnsConfigs() {
+		if c.Subnet.IP == nil {
+			continue
+		}
+		subnet := (*net.IPNet)(&c.Subnet)
+		gw := c.GatewayIP()
+		if gw == nil {
+			return fmt.Errorf("dnsFromSubnet requires a gateway in network: %s", subnet)
+		}
+		dns := ip.NextIP(gw)
+		_, broadcast, err := networkRange(subnet)
+		if err != nil {
+			return err
+		}
+		if !subnet.Contains(dns) || (dns.To4() != nil && dns.Equal(broadcast)) {
+			return fmt.Errorf("dnsFromSubnet: %s following gateway %s is not a host address of network: %s", dns, gw, subnet)
+		}
+	}
+	return nil
+}
+
+// dnsExclusions returns the DNS servers of dnsFromSubnet, which must
+// not be handed out
+func (c *IPAMConfig) dnsExclusions() ExcludeSet {
+	var set ExcludeSet
+	for _, conf := range c.dnsConfigs() {
+		dns := conf.SubnetDNS()
+		if dns == nil {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if v4 := dns.To4(); v4 != nil {
+			dns, bits = v4, 8*net.IPv4len
+		}
+		set = append(set, &net.IPNet{IP: dns, Mask: net.CIDRMask(bits, bits)})
+	}
+	return set
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// ErrPoolExhausted is matched by the error Get returns when the
+	// ranges have no free address left
+	ErrPoolExhausted = errors.New("no IP addresses available")
+	// ErrIPNotAvailable is matched by the error Get returns when the
+	// requested or MAC-mapped IP is held by another container
+	ErrIPNotAvailable = errors.New("requested IP address is not available")
+	// ErrUtilizationLimit is matched by the error Get returns when
+	// another reservation would exceed maxUtilizationPercent
+	ErrUtilizationLimit = errors.New("utilization limit reached")
+	// ErrContainerLimit is matched by the error Get returns when the
+	// container already holds maxIPsPerContainer addresses
+	ErrContainerLimit = errors.New("per-container limit reached")
+	// ErrAllocationTimeout is matched by the error Get returns when it
+	// ran past allocationTimeout
+	ErrAllocationTimeout = errors.New("allocation timed out")
+)
+
+// ErrIPConflict is returned by Get when the requested or MAC-mapped IP
+// is held by another container, naming that container. It matches
+// ErrIPNotAvailable with errors.Is.
+type ErrIPConflict struct {
+	IP      net.IP
+	OwnerID string
+	// MAC is the address the IP is mapped to, if it was not requested
+	MAC     string
+	Network string
+}
+
+func (e *ErrIPConflict) Error() string {
+	owner := "another container"
+	if e.OwnerID != "" {
+		owner = "container " + e.OwnerID
+	}
+	if e.MAC != "" {
+		return fmt.Sprintf("IP address %q mapped to MAC %s is reserved by %s in network: %s", e.IP, e.MAC, owner, e.Network)
+	}
+	return fmt.Sprintf("requested IP address %q is reserved by %s in network: %s", e.IP, owner, e.Network)
+}
+
+func (e *ErrIPConflict) Unwrap() error {
+	return ErrIPNotAvailable
+}
+
+// NewConflictError returns the error for a requested IP that owner
+// holds, mapped marking an IP taken from the MAC mappings
+func NewConflictError(conf *IPAMConfig, requested net.IP, owner string, mapped bool) error {
+	e := &ErrIPConflict{IP: requested, OwnerID: owner, Network: conf.Name}
+	if mapped {
+		e.MAC = string(conf.Args.MAC)
+	}
+	return e
+}
+
+// allocationError keeps its own message but matches one of the sentinel
+// errors above with errors.Is
+type allocationError struct {
+	err error
+	msg string
+}
+
+func (e *allocationError) Error() string {
+	return e.msg
+}
+
+func (e *allocationError) Unwrap() error {
+	return e.err
+}
+
+// NewAllocationError formats an error that matches err with errors.Is
+func NewAllocationError(err error, format string, a ...interface{}) error {
+	return &allocationError{err, fmt.Sprintf(format, a...)}
+}
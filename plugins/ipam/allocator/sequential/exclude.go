@@ -0,0 +1,180 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// ExcludeSet holds the addresses that must never be handed out
+type ExcludeSet []*net.IPNet
+
+// ParseExcludeIPs parses excludeIPs entries, each either a single
+// address or a CIDR
+func ParseExcludeIPs(entries []string) (ExcludeSet, error) {
+	var set ExcludeSet
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid excludeIPs entry %q: %v", e, err)
+			}
+			set = append(set, n)
+			continue
+		}
+		addr := net.ParseIP(e)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid excludeIPs entry %q", e)
+		}
+		bits := 8 * net.IPv6len
+		if v4 := addr.To4(); v4 != nil {
+			addr, bits = v4, 8*net.IPv4len
+		}
+		set = append(set, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)})
+	}
+	return set, nil
+}
+
+// Contains reports whether addr is excluded
+func (s ExcludeSet) Contains(addr net.IP) bool {
+	for _, n := range s {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// countIn returns the number of distinct excluded addresses within r
+func (s ExcludeSet) countIn(r Range) *big.Int {
+	type interval struct{ start, end *big.Int }
+	var iv []interval
+	rs, re := ip.ToInt(r.Start), ip.ToInt(r.End)
+	for _, n := range s {
+		if (n.IP.To4() != nil) != (r.Start.To4() != nil) {
+			continue
+		}
+		start := ip.ToInt(n.IP)
+		ones, bits := n.Mask.Size()
+		end := new(big.Int).Add(start, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)))
+		// clip to the range
+		if start.Cmp(rs) < 0 {
+			start = rs
+		}
+		if end.Cmp(re) > 0 {
+			end = re
+		}
+		if start.Cmp(end) < 0 {
+			iv = append(iv, interval{start, end})
+		}
+	}
+
+	// merge overlapping exclusions so no address is counted twice
+	sort.Slice(iv, func(i, j int) bool { return iv[i].start.Cmp(iv[j].start) < 0 })
+	total := new(big.Int)
+	var cur *interval
+	for i := range iv {
+		if cur != nil && iv[i].start.Cmp(cur.end) <= 0 {
+			if iv[i].end.Cmp(cur.end) > 0 {
+				cur.end = iv[i].end
+			}
+			continue
+		}
+		if cur != nil {
+			total.Add(total, new(big.Int).Sub(cur.end, cur.start))
+		}
+		cur = &iv[i]
+	}
+	if cur != nil {
+		total.Add(total, new(big.Int).Sub(cur.end, cur.start))
+	}
+	return total
+}
+
+// boundaryExclusions returns the network and broadcast addresses of the
+// excludeSubnetBoundaries entries; for IPv6, which has no broadcast,
+// the last address of the entry stands in for it
+func (c *IPAMConfig) boundaryExclusions() ExcludeSet {
+	var set ExcludeSet
+	for _, b := range c.ExcludeBoundaries {
+		first, last, err := networkRange(&net.IPNet{IP: b.IP.Mask(b.Mask), Mask: b.Mask})
+		if err != nil {
+			continue
+		}
+		_, bits := b.Mask.Size()
+		for _, addr := range []net.IP{first, last} {
+			set = append(set, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return set
+}
+
+// interfaceAddrs returns the addresses of the host's interfaces; tests
+// replace it to fake host addresses
+var interfaceAddrs = func() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var addrs []net.IP
+	for _, iface := range ifaces {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			// one unreadable interface must not hide the others
+			continue
+		}
+		for _, a := range ifaddrs {
+			if n, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, n.IP)
+			}
+		}
+	}
+	return addrs
+}
+
+// Exclusions returns the addresses of the network that must never be
+// handed out: the excludeIPs entries, the DNS servers of dnsFromSubnet,
+// the gateways of the ranges, the boundaries of the
+// excludeSubnetBoundaries entries and, with reserveHostIPs, the
+// addresses of the host's interfaces that fall within the network
+func Exclusions(conf *IPAMConfig) (ExcludeSet, error) {
+	set, err := ParseExcludeIPs(conf.ExcludeIPs)
+	if err != nil {
+		return nil, err
+	}
+	set = append(set, conf.dnsExclusions()...)
+	set = append(set, conf.rangeGatewayExclusions()...)
+	set = append(set, conf.boundaryExclusions()...)
+	if !conf.ReserveHostIPs {
+		return set, nil
+	}
+	for _, addr := range interfaceAddrs() {
+		bits := 8 * net.IPv6len
+		if v4 := addr.To4(); v4 != nil {
+			addr, bits = v4, 8*net.IPv4len
+		}
+		n := &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}
+		if subnetContains(conf.Subnet, n) || subnetContains(conf.Subnet6, n) || conf.subnetsContain(n) {
+			set = append(set, n)
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import "testing"
+
+// FuzzLoadIPAMConfig feeds arbitrary network configurations and
+// CNI_ARGS to LoadIPAMConfig, which must reject bad input with an error
+// rather than panic. Run it with
+//
+//	go test -run '^$' -fuzz FuzzLoadIPAMConfig ./plugins/ipam/allocator/sequential
+func FuzzLoadIPAMConfig(f *testing.F) {
+	for _, seed := range []struct{ conf, args string }{
+		{`{"name": "default", "ipam": {"type": "host-local", "subnet": "203.0.113.0/24"}}`, ""},
+		{`{"name": "ipv6", "ipam": {"type": "host-local", "subnet": "3ffe:ffff:0:01ff::/64", "rangeStart": "3ffe:ffff:0:01ff::0010", "rangeEnd": "3ffe:ffff:0:01ff::0020"}}`, ""},
+		{`{"name": "ranges", "ipam": {"type": "host-local", "subnet": "10.0.0.0/24", "ranges": [{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.50", "name": "blue"}]}}`, "POOL=blue;PREFERRED_IP=10.0.0.12"},
+		{`{"name": "dual", "ipam": {"type": "host-local", "subnet": "10.0.0.0/24", "subnet6": "fd00::/120", "gateway6": "fd00::1"}}`, "IP=10.0.0.5"},
+		{`{"name": "weighted", "ipam": {"type": "host-local", "subnets": [{"subnet": "10.0.0.0/24", "weight": 2}, {"subnet": "10.0.1.0/24"}]}}`, ""},
+		{`{"name": "hosts", "ipam": {"type": "host-local", "baseAddress": "10.0.0.0", "hostCount": 500, "gatewayOffset": -2}}`, ""},
+		{`{"name": "mapped", "ipam": {"type": "host-local", "subnet": "10.0.0.0/24", "macMappings": {"00:11:22:33:44:55": "10.0.0.9"}, "excludeIPs": ["10.0.0.128/25"]}}`, "MAC=00:11:22:33:44:55"},
+		{`{"name": "pool", "ipam": {"type": "host-local", "poolCIDR": "10.0.0.0/16", "nodeSubnetPrefix": 24, "nodeName": "node-a"}}`, ""},
+		{`{"name": "missing"}`, "IP=10.0.0.5"},
+	} {
+		f.Add([]byte(seed.conf), seed.args)
+	}
+
+	f.Fuzz(func(t *testing.T, conf []byte, args string) {
+		c, err := LoadIPAMConfig(conf, args)
+		if err != nil {
+			return
+		}
+		// whatever loads must also be safe to derive allocators from
+		c.GatewayIP()
+		c.IPv6Config()
+		c.SubnetConfigs()
+		Ranges(c)
+	})
+}
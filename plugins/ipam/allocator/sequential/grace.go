@@ -0,0 +1,120 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+func validateReleaseGracePeriod(conf *IPAMConfig) error {
+	if conf.ReleaseGracePeriod < 0 {
+		return fmt.Errorf("%q must not be negative, got %s", "releaseGracePeriod", time.Duration(conf.ReleaseGracePeriod))
+	}
+	// freed IPs are held rather than handed out again first
+	if conf.ReleaseGracePeriod > 0 && conf.ReuseMode == ReuseModeLIFO {
+		return fmt.Errorf("%q cannot be combined with reuseMode %q", "releaseGracePeriod", conf.ReuseMode)
+	}
+	return nil
+}
+
+// releaseWithGrace moves the IPs of the container with given ID to its
+// grace ID, where the scan of other containers passes over them. Each
+// IP changes owner in a single step, so no other container can take it
+// in between.
+func releaseWithGrace(store backend.Store, id string) error {
+	ips, err := store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		moved, err := store.ChangeOwner(ip, id, backend.GraceID(id))
+		if err != nil {
+			return err
+		}
+		if !moved {
+			return fmt.Errorf("failed to hold %s for container %s: no longer reserved by it", ip, id)
+		}
+	}
+	return nil
+}
+
+// ReclaimGrace releases the IPs whose grace period is over and returns
+// the IP the container with given ID released within the grace period,
+// reserving it for the container again. Only the requested IP is
+// reclaimed if one is given, or else the first one within ranges. It
+// returns nil if there is none or no grace period is configured. The
+// caller must hold the store lock.
+func ReclaimGrace(conf *IPAMConfig, store backend.Store, ranges []Range, id string, requested net.IP) (net.IP, error) {
+	if conf.ReleaseGracePeriod == 0 {
+		return nil, nil
+	}
+
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	// stores that record no reservation time cannot tell how long an IP
+	// was held, so it is freed
+	before := time.Now().Add(-time.Duration(conf.ReleaseGracePeriod))
+	var graced []net.IP
+	for _, r := range list {
+		owner, ok := r.GraceOwner()
+		if !ok {
+			continue
+		}
+		if r.ReservedAt.IsZero() || r.ReservedAt.Before(before) {
+			if err := store.ReleaseByIP(r.ID, r.IP); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if owner == id {
+			graced = append(graced, r.IP)
+		}
+	}
+
+	for _, ip := range graced {
+		if requested != nil && !requested.Equal(ip) {
+			continue
+		}
+		if requested == nil && !inRanges(ranges, ip) {
+			continue
+		}
+		moved, err := store.ChangeOwner(ip, backend.GraceID(id), id)
+		if err != nil {
+			return nil, err
+		}
+		if !moved {
+			// released since the list was read
+			continue
+		}
+		return ip, nil
+	}
+	return nil, nil
+}
+
+// inRanges reports whether ip lies within any of ranges
+func inRanges(ranges []Range, ip net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// defaultValidationHookTimeout bounds a run of the validation hook
+// unless validationHookTimeout is set
+const defaultValidationHookTimeout = 5 * time.Second
+
+func validateValidationHook(conf *IPAMConfig) error {
+	if conf.ValidationHookTimeout < 0 {
+		return fmt.Errorf("%q must not be negative", "validationHookTimeout")
+	}
+	if conf.ValidationHook != "" && !filepath.IsAbs(conf.ValidationHook) {
+		return fmt.Errorf("validationHook %q must be an absolute path", conf.ValidationHook)
+	}
+	return nil
+}
+
+// ApproveIP runs the validation hook, if one is configured, with a
+// candidate IP and the ID of the container it is meant for as
+// arguments. It reports whether the hook approved the IP by exiting
+// with status zero. A hook that cannot be run or does not exit in time
+// fails the allocation instead of rejecting the IP, so that a broken
+// hook is not run again for every other candidate.
+func ApproveIP(conf *IPAMConfig, id string, addr net.IP) (bool, error) {
+	if conf.ValidationHook == "" {
+		return true, nil
+	}
+	timeout := time.Duration(conf.ValidationHookTimeout)
+	if timeout == 0 {
+		timeout = defaultValidationHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, conf.ValidationHook, addr.String(), id)
+	cmd.Stderr = os.Stderr
+	// do not wait on children of a killed hook that hold on to stderr
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("validation hook %s timed out after %s for %s", conf.ValidationHook, timeout, addr)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to run validation hook %s: %v", conf.ValidationHook, err)
+	}
+	return true, nil
+}
+
+// CheckRequestedApproval fails unless the validation hook approves an
+// IP requested explicitly or through a MAC mapping, which unlike a
+// scanned candidate cannot be passed over
+func CheckRequestedApproval(conf *IPAMConfig, id string, requested net.IP) error {
+	approved, err := ApproveIP(conf, id, requested)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		return fmt.Errorf("requested IP address %q was rejected by the validation hook in network: %s", requested, conf.Name)
+	}
+	return nil
+}
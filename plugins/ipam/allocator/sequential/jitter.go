@@ -0,0 +1,69 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"hash/fnv"
+	"math/big"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// jitteredStart returns the ip a scan without a last reserved ip starts
+// from. That is the start of the ranges unless startJitter is set, in
+// which case the offset into the ranges is picked by a hash of the node
+// name, so that nodes sharing a configuration spread their first
+// allocations instead of contending for the lowest addresses. The scan
+// still wraps around, so no address is skipped.
+func (a *IPAllocator) jitteredStart() net.IP {
+	start := a.ranges[0].Start
+	if !a.conf.StartJitter {
+		return start
+	}
+	node, err := nodeName(a.conf)
+	if err != nil {
+		a.log.Warnf("not jittering the scan start: %v", err)
+		return start
+	}
+	if hashed := a.hashedIP(node); hashed != nil {
+		return hashed
+	}
+	return start
+}
+
+// hashedIP returns the ip at the offset into the ranges picked by a hash
+// of key, or nil if the ranges are empty
+func (a *IPAllocator) hashedIP(key string) net.IP {
+	size := new(big.Int)
+	for _, r := range a.ranges {
+		size.Add(size, r.size())
+	}
+	if size.Sign() == 0 {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	off := new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), size)
+
+	for _, r := range a.ranges {
+		n := r.size()
+		if off.Cmp(n) < 0 {
+			return ip.FromInt(off.Add(off, ip.ToInt(r.Start)), r.Start.To4() != nil)
+		}
+		off.Sub(off, n)
+	}
+	return nil
+}
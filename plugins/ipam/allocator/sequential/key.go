@@ -0,0 +1,69 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+const (
+	// ReservationKeyContainerID keys reservations on the container ID
+	ReservationKeyContainerID = "containerID"
+	// ReservationKeyPodUID keys reservations on the K8S_POD_UID
+	// argument when it is passed, so that a pod restarted under a new
+	// container ID keeps its address
+	ReservationKeyPodUID = "podUID"
+)
+
+func validateReservationKey(conf *IPAMConfig) error {
+	switch conf.ReservationKey {
+	case "", ReservationKeyContainerID, ReservationKeyPodUID:
+		return nil
+	}
+	return fmt.Errorf("unknown reservationKey %q", conf.ReservationKey)
+}
+
+// ReservationID returns the ID the reservations of the container with
+// given ID are made under: the pod UID if so configured and passed, or
+// else the container ID
+func (c *IPAMConfig) ReservationID(containerID string) string {
+	if c.ReservationKey == ReservationKeyPodUID && c.Args != nil && c.Args.K8S_POD_UID != "" {
+		return string(c.Args.K8S_POD_UID)
+	}
+	return containerID
+}
+
+// Reclaim returns the IP within ranges that id already holds if
+// reservations are keyed on the pod UID, so that a restarted pod gets
+// its previous address back rather than another one. It returns nil if
+// there is none. The caller must hold the store lock.
+func Reclaim(conf *IPAMConfig, store backend.Store, ranges []Range, id string) (net.IP, error) {
+	if conf.ReservationKey != ReservationKeyPodUID {
+		return nil, nil
+	}
+	ips, err := store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, held := range ips {
+		if inRanges(ranges, held) {
+			return held, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Keys of the label selector of ReleaseByLabel
+const (
+	// LabelKeyNamespace matches the namespace of a "<namespace>/<name>"
+	// label
+	LabelKeyNamespace = "namespace"
+	// LabelKeyName matches the name of a "<namespace>/<name>" label
+	LabelKeyName = "name"
+	// LabelKeyLabel matches the whole label
+	LabelKeyLabel = "label"
+)
+
+// Label returns the label recorded with the reservations of the
+// container: the LABEL argument if given, or else the namespace and
+// name of the pod as passed by Kubernetes runtimes
+func (c *IPAMConfig) Label() string {
+	if c.Args == nil {
+		return ""
+	}
+	if c.Args.LABEL != "" {
+		return string(c.Args.LABEL)
+	}
+	if c.Args.K8S_POD_NAME == "" {
+		return ""
+	}
+	if c.Args.K8S_POD_NAMESPACE == "" {
+		return string(c.Args.K8S_POD_NAME)
+	}
+	return string(c.Args.K8S_POD_NAMESPACE) + "/" + string(c.Args.K8S_POD_NAME)
+}
+
+// labelMatches reports whether label has value under key
+func labelMatches(label, key, value string) (bool, error) {
+	ns, name, pod := strings.Cut(label, "/")
+	switch key {
+	case LabelKeyLabel:
+		return label == value, nil
+	case LabelKeyNamespace:
+		return pod && ns == value, nil
+	case LabelKeyName:
+		return pod && name == value, nil
+	}
+	return false, fmt.Errorf("unknown label key %q: must be %q, %q or %q", key, LabelKeyNamespace, LabelKeyName, LabelKeyLabel)
+}
+
+// ReleaseByLabel releases every reservation in the store whose label
+// has value under key, such as all IPs of the pods of one namespace,
+// and returns how many were freed. Reservations of both address
+// families and of other ranges sharing the store are released alike.
+func (a *IPAllocator) ReleaseByLabel(key, value string) (int, error) {
+	if _, err := labelMatches("", key, value); err != nil {
+		return 0, err
+	}
+
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	list, err := a.store.List()
+	if err != nil {
+		return 0, err
+	}
+	freed := 0
+	for _, r := range list {
+		if r.PreReserved() {
+			continue
+		}
+		if ok, _ := labelMatches(r.Label, key, value); !ok {
+			continue
+		}
+		if err := a.store.ReleaseByIP(r.ID, r.IP); err != nil {
+			return freed, err
+		}
+		freed++
+		if a.conf.ReuseMode == ReuseModeLIFO {
+			if err := a.store.PushFreed(r.IP); err != nil {
+				return freed, err
+			}
+		}
+	}
+	return freed, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// MappedIP returns the IP that macMappings assigns to the MAC passed in
+// the MAC argument, or nil if there is no such mapping within the subnet
+func (c *IPAMConfig) MappedIP() net.IP {
+	if c.Args == nil || c.Args.MAC == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(string(c.Args.MAC))
+	if err != nil {
+		return nil
+	}
+	for k, addr := range c.MACMappings {
+		m, err := net.ParseMAC(k)
+		if err == nil && bytes.Equal(m, mac) && (*net.IPNet)(&c.Subnet).Contains(addr) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// validateMACMappings checks that every mapping has a valid MAC and maps
+// to a distinct, allocatable IP within the subnet or subnet6
+func validateMACMappings(conf *IPAMConfig, exclude ExcludeSet) error {
+	owners := map[string]string{}
+	for k, addr := range conf.MACMappings {
+		if _, err := net.ParseMAC(k); err != nil {
+			return fmt.Errorf("invalid MAC %q in macMappings: %v", k, err)
+		}
+		if addr == nil {
+			return fmt.Errorf("macMappings entry %s has no IP", k)
+		}
+		subnet := (*net.IPNet)(&conf.Subnet)
+		subnet6 := (*net.IPNet)(&conf.Subnet6)
+		if !subnet.Contains(addr) && !(conf.Subnet6.IP != nil && subnet6.Contains(addr)) {
+			return fmt.Errorf("macMappings entry %s: %s not in network: %s", k, addr, subnet)
+		}
+		gw := conf.GatewayIP()
+		if addr.Equal(gw) {
+			return fmt.Errorf("macMappings entry %s: %s is the gateway", k, addr)
+		}
+		if exclude.Contains(addr) {
+			return fmt.Errorf("macMappings entry %s: %s is excluded", k, addr)
+		}
+		if other, ok := owners[addr.String()]; ok {
+			return fmt.Errorf("macMappings entries %s and %s map to the same IP %s", other, k, addr)
+		}
+		owners[addr.String()] = k
+	}
+	return nil
+}
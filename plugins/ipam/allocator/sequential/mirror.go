@@ -0,0 +1,72 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// mirrorOffset parses the MIRROR_OFFSET argument, returning nil if it
+// was not passed
+func (c *IPAMConfig) mirrorOffset() (*big.Int, error) {
+	if c.Args == nil || c.Args.MIRROR_OFFSET == "" {
+		return nil, nil
+	}
+	off, ok := new(big.Int).SetString(string(c.Args.MIRROR_OFFSET), 10)
+	if !ok || off.Sign() < 0 {
+		return nil, fmt.Errorf("invalid MIRROR_OFFSET %q: must be a non-negative integer", c.Args.MIRROR_OFFSET)
+	}
+	return off, nil
+}
+
+// validateMirrorOffset checks the MIRROR_OFFSET argument of a network
+// with mirrorOffset; networks without it ignore the argument, as it is
+// meant for another network of the container
+func validateMirrorOffset(conf *IPAMConfig) error {
+	if !conf.MirrorOffset {
+		return nil
+	}
+	_, err := conf.mirrorOffset()
+	return err
+}
+
+// MirroredIP returns the address at the MIRROR_OFFSET argument from the
+// network address of the subnet with mirrorOffset, so that a container
+// gets the same host part as in its primary network. It returns nil if
+// the mode is off, no offset was passed or the offset lies past the
+// end of the subnet.
+func (c *IPAMConfig) MirroredIP() net.IP {
+	if !c.MirrorOffset {
+		return nil
+	}
+	off, err := c.mirrorOffset()
+	if err != nil || off == nil {
+		return nil
+	}
+	subnet := (*net.IPNet)(&c.Subnet)
+	start, end, err := networkRange(subnet)
+	if err != nil {
+		return nil
+	}
+	n := off.Add(off, ip.ToInt(start))
+	if n.Cmp(ip.ToInt(end)) > 0 {
+		return nil
+	}
+	return ip.FromInt(n, start.To4() != nil)
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+func validateConfirmTTL(conf *IPAMConfig) error {
+	if conf.ConfirmTTL < 0 {
+		return fmt.Errorf("%q must not be negative, got %s", "confirmTTL", time.Duration(conf.ConfirmTTL))
+	}
+	if conf.ConfirmTTL == 0 {
+		return nil
+	}
+	if conf.Strategy != "" && conf.Strategy != "sequential" {
+		return fmt.Errorf("%q cannot be combined with allocation strategy %q", "confirmTTL", conf.Strategy)
+	}
+	if len(conf.Subnets) > 0 {
+		return fmt.Errorf("%q cannot be combined with %q", "confirmTTL", "subnets")
+	}
+	// a released IP would be held for the pending ID rather than the
+	// container
+	if conf.ReleaseGracePeriod > 0 {
+		return fmt.Errorf("%q cannot be combined with %q", "confirmTTL", "releaseGracePeriod")
+	}
+	return nil
+}
+
+// ReclaimPending releases the IPs reserved for a container that were not
+// confirmed within the "confirmTTL", so that they can be allocated
+// again. The caller must hold the store lock.
+func ReclaimPending(conf *IPAMConfig, store backend.Store) error {
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+	// stores that record no reservation time cannot tell how long an IP
+	// was pending, so it is freed
+	before := time.Now().Add(-time.Duration(conf.ConfirmTTL))
+	for _, r := range list {
+		if _, ok := r.PendingOwner(); !ok {
+			continue
+		}
+		if r.ReservedAt.IsZero() || r.ReservedAt.Before(before) {
+			if err := store.ReleaseByIP(r.ID, r.IP); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Confirm makes the IPs Get reserved for the container with given ID
+// permanent, so that they are no longer released once the "confirmTTL"
+// is over. Confirming a container whose IPs were confirmed already does
+// nothing.
+func (a *IPAllocator) Confirm(id string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	pending, err := a.store.GetByID(backend.PendingID(id))
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		held, err := a.store.GetByID(id)
+		if err != nil {
+			return err
+		}
+		if len(held) == 0 {
+			return fmt.Errorf("no IP addresses pending for container %s in network: %s", id, a.conf.Name)
+		}
+		return nil
+	}
+
+	for _, ip := range pending {
+		if err := confirmIP(a.store, id, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirmIP moves ip from the pending ID of the container to its ID
+func confirmIP(store backend.Store, id string, ip net.IP) error {
+	moved, err := store.ChangeOwner(ip, backend.PendingID(id), id)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		return fmt.Errorf("failed to confirm %s for container %s: no longer pending", ip, id)
+	}
+	return nil
+}
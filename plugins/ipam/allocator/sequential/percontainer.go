@@ -0,0 +1,51 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// CheckContainerLimit returns an error matching ErrContainerLimit if
+// reserving count more addresses for the container with given ID would
+// leave it holding more than maxIPsPerContainer addresses of the
+// subnet's family. A request for an IP the container already holds is
+// let through, as it reserves nothing new. The caller must hold the
+// store lock.
+func CheckContainerLimit(conf *IPAMConfig, store backend.Store, id string, requested net.IP, count int) error {
+	if conf.MaxIPsPerContainer == 0 {
+		return nil
+	}
+	ips, err := store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	v4 := conf.Subnet.IP.To4() != nil
+	held := 0
+	for _, addr := range ips {
+		if requested != nil && addr.Equal(requested) {
+			return nil
+		}
+		if (addr.To4() != nil) == v4 {
+			held++
+		}
+	}
+	if held+count > conf.MaxIPsPerContainer {
+		return NewAllocationError(ErrContainerLimit, "container %s already holds %d of at most %d IP addresses in network: %s", id, held, conf.MaxIPsPerContainer, conf.Name)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// hostname names the node when no nodeName is configured; tests
+// replace it
+var hostname = os.Hostname
+
+// resolvePoolCIDR derives the subnet of this node from poolCIDR and
+// nodeSubnetPrefix, keyed by nodeName or, failing that, the hostname
+func resolvePoolCIDR(conf *IPAMConfig) error {
+	if conf.PoolCIDR.IP == nil {
+		// startJitter keys the first scan by nodeName as well
+		if conf.NodeSubnetPrefix != 0 || (conf.NodeName != "" && !conf.StartJitter) {
+			return fmt.Errorf("%q and %q require %q", "nodeSubnetPrefix", "nodeName", "poolCIDR")
+		}
+		return nil
+	}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"subnet", conf.Subnet.IP != nil},
+		{"subnets", len(conf.Subnets) > 0},
+		{"hostCount", conf.HostCount != 0 || conf.BaseAddress != nil},
+	} {
+		if field.set {
+			return fmt.Errorf("%q cannot be combined with %q", "poolCIDR", field.name)
+		}
+	}
+
+	node, err := nodeName(conf)
+	if err != nil {
+		return err
+	}
+	subnet, err := NodeSubnet((*net.IPNet)(&conf.PoolCIDR), conf.NodeSubnetPrefix, node)
+	if err != nil {
+		return err
+	}
+	conf.Subnet = types.IPNet(*subnet)
+	return nil
+}
+
+// nodeName returns the configured nodeName or, failing that, the
+// hostname
+func nodeName(conf *IPAMConfig) (string, error) {
+	if conf.NodeName != "" {
+		return conf.NodeName, nil
+	}
+	node, err := hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the node name: %v", err)
+	}
+	return node, nil
+}
+
+// NodeSubnet returns the subnet of the given prefix length within pool
+// that belongs to node. The subnet is picked by a hash of the node name,
+// so every node finds its own subnet without coordination and keeps it
+// across restarts. Distinct nodes may still hash to the same subnet, so
+// pools should hold many more subnets than there are nodes.
+func NodeSubnet(pool *net.IPNet, prefix int, node string) (*net.IPNet, error) {
+	base := pool.IP.Mask(pool.Mask)
+	ones, bits := pool.Mask.Size()
+	if base == nil || bits == 0 {
+		return nil, fmt.Errorf("invalid poolCIDR %s", pool)
+	}
+	if prefix <= ones || prefix > bits {
+		return nil, fmt.Errorf("nodeSubnetPrefix %d must be longer than the /%d of poolCIDR %s and at most %d", prefix, ones, pool, bits)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(prefix-ones))
+	index := new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), count)
+
+	offset := index.Lsh(index, uint(bits-prefix))
+	subnet := ip.FromInt(offset.Add(offset, ip.ToInt(base)), bits == 8*net.IPv4len)
+	return &net.IPNet{IP: subnet, Mask: net.CIDRMask(prefix, bits)}, nil
+}
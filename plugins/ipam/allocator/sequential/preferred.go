@@ -0,0 +1,51 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPList is a comma separated list of IPs such as the PREFERRED_IPS
+// argument "10.0.0.7,10.0.0.8"
+type IPList []net.IP
+
+func (l *IPList) UnmarshalText(text []byte) error {
+	var ips IPList
+	for _, s := range strings.Split(string(text), ",") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	*l = ips
+	return nil
+}
+
+// PreferredIPs returns the IPs passed as PREFERRED_IP and PREFERRED_IPS
+// in the order they are tried
+func (c *IPAMConfig) PreferredIPs() []net.IP {
+	if c.Args == nil {
+		return nil
+	}
+	var ips []net.IP
+	if c.Args.PREFERRED_IP != nil {
+		ips = append(ips, c.Args.PREFERRED_IP)
+	}
+	return append(ips, c.Args.PREFERRED_IPS...)
+}
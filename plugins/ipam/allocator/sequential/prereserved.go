@@ -0,0 +1,61 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// Prime reserves the preReserved IPs of the network under
+// backend.PreReservedID, so that they are skipped like any taken
+// address. IPs already held, by the sentinel or a container, are left
+// alone, so priming on every ADD is cheap and safe.
+func Prime(conf *IPAMConfig, store backend.Store) error {
+	if len(conf.PreReserved) == 0 {
+		return nil
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	for _, ip := range conf.PreReserved {
+		if _, _, err := store.Reserve(backend.PreReservedID, ip); err != nil {
+			return fmt.Errorf("failed to pre-reserve %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// validatePreReserved checks that every preReserved IP lies within the
+// network
+func validatePreReserved(conf *IPAMConfig) error {
+	for _, ip := range conf.PreReserved {
+		if ip == nil {
+			return fmt.Errorf("invalid IP in preReserved")
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		n := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		if !subnetContains(conf.Subnet, n) && !subnetContains(conf.Subnet6, n) && !conf.subnetsContain(n) {
+			return fmt.Errorf("preReserved IP %s is not in network: %s", ip, (*net.IPNet)(&conf.Subnet))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+)
+
+// RangeGateway returns the gateway of the entry under "ranges" that
+// holds addr, or gw if that entry has no gateway of its own or addr
+// lies in none of them
+func (c *IPAMConfig) RangeGateway(addr, gw net.IP) net.IP {
+	for _, cr := range c.Ranges {
+		if cr.Gateway == nil {
+			continue
+		}
+		r, err := newRange(c, cr.RangeStart, cr.RangeEnd)
+		if err != nil {
+			continue
+		}
+		if r.Contains(addr) {
+			return cr.Gateway
+		}
+	}
+	return gw
+}
+
+// rangeGatewayExclusions returns the gateways of the entries under
+// "ranges", which must not be handed out
+func (c *IPAMConfig) rangeGatewayExclusions() ExcludeSet {
+	var set ExcludeSet
+	for _, cr := range c.Ranges {
+		if cr.Gateway == nil {
+			continue
+		}
+		gw, bits := cr.Gateway, 8*net.IPv6len
+		if v4 := gw.To4(); v4 != nil {
+			gw, bits = v4, 8*net.IPv4len
+		}
+		set = append(set, &net.IPNet{IP: gw, Mask: net.CIDRMask(bits, bits)})
+	}
+	return set
+}
+
+// validateRangeGateways checks that the gateway of every entry under
+// "ranges" is an address of the subnet
+func validateRangeGateways(conf *IPAMConfig) error {
+	subnet := (*net.IPNet)(&conf.Subnet)
+	for i, cr := range conf.Ranges {
+		if cr.Gateway == nil {
+			continue
+		}
+		if err := CheckFamily(cr.Gateway, subnet); err != nil {
+			return fmt.Errorf("range %d: gateway: %v", i, err)
+		}
+		if !subnet.Contains(cr.Gateway) {
+			return fmt.Errorf("range %d: gateway %s is not in network: %s", i, cr.Gateway, subnet)
+		}
+	}
+	return nil
+}
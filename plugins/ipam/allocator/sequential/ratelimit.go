@@ -0,0 +1,44 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import "fmt"
+
+func validateRateLimit(conf *IPAMConfig) error {
+	if conf.AllocationsPerSecond < 0 {
+		return fmt.Errorf("%q must not be negative, got %g", "allocationsPerSecond", conf.AllocationsPerSecond)
+	}
+	if conf.AllocationBurst < 0 {
+		return fmt.Errorf("%q must not be negative, got %d", "allocationBurst", conf.AllocationBurst)
+	}
+	if conf.AllocationBurst > 0 && conf.AllocationsPerSecond == 0 {
+		return fmt.Errorf("%q requires %q", "allocationBurst", "allocationsPerSecond")
+	}
+	// the limit is shared between plugins through the store, which
+	// only the disk store supports
+	if conf.AllocationsPerSecond > 0 && conf.Store != "" && conf.Store != "disk" {
+		return fmt.Errorf("allocationsPerSecond requires the disk store, got %q", conf.Store)
+	}
+	return nil
+}
+
+// Burst returns the number of allocations that may be made at once
+// before the allocation rate limit applies, which defaults to one
+func (c *IPAMConfig) Burst() int {
+	if c.AllocationBurst == 0 {
+		return 1
+	}
+	return c.AllocationBurst
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// ReuseModeLIFO hands out the most recently freed IP before scanning
+// the range, keeping the set of addresses in use small
+const ReuseModeLIFO = "lifo"
+
+func validateReuseMode(conf *IPAMConfig) error {
+	switch conf.ReuseMode {
+	case "":
+		return nil
+	case ReuseModeLIFO:
+		if conf.Strategy != "" && conf.Strategy != "sequential" {
+			return fmt.Errorf("reuseMode %q cannot be combined with allocation strategy %q", conf.ReuseMode, conf.Strategy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reuseMode %q", conf.ReuseMode)
+}
+
+// ReleaseByID releases all IPs of the container with given ID and, in
+// the "lifo" reuse mode, records them as freed. With a release grace
+// period they are held for the container instead. IPs still pending
+// confirmation are released as well. The caller must hold the store
+// lock.
+func ReleaseByID(conf *IPAMConfig, store backend.Store, id string) error {
+	if conf.ConfirmTTL > 0 {
+		if err := store.ReleaseByID(backend.PendingID(id)); err != nil {
+			return err
+		}
+	}
+	if conf.ReleaseGracePeriod > 0 {
+		return releaseWithGrace(store, id)
+	}
+	if conf.ReuseMode != ReuseModeLIFO {
+		return store.ReleaseByID(id)
+	}
+
+	ips, err := store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := store.ReleaseByID(id); err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := store.PushFreed(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reuseFreed reserves the most recently freed IP that is still free
+// and within the ranges, returning a nil config if there is none.
+// Freed IPs of other ranges sharing the store, such as those of another
+// subnet, are put back in their order; the others are dropped.
+func (a *IPAllocator) reuseFreed(id string, gw net.IP) (*types.IPConfig, error) {
+	held, err := HeldIPs(a.store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var foreign []net.IP
+	defer func() {
+		for i := len(foreign) - 1; i >= 0; i-- {
+			if perr := a.store.PushFreed(foreign[i]); perr != nil {
+				a.log.Warnf("failed to put back freed IP %s: %v", foreign[i], perr)
+			}
+		}
+	}()
+
+	v6 := a.ranges[0].Start.To4() == nil
+	for {
+		cur, err := a.store.PopFreed(v6)
+		if err != nil || cur == nil {
+			return nil, err
+		}
+		if a.rangeIndex(cur) < 0 {
+			foreign = append(foreign, cur)
+			continue
+		}
+		if (gw != nil && cur.Equal(gw)) || a.exclude.Contains(cur) || held[cur.String()] {
+			continue
+		}
+
+		reserved, _, err := a.store.Reserve(id, cur)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			a.log.With("containerID", id).With("ip", cur.String()).Debugf("reused freed IP")
+			return &types.IPConfig{
+				IP:      net.IPNet{IP: cur, Mask: a.conf.Subnet.Mask},
+				Gateway: a.conf.RangeGateway(cur, gw),
+				Routes:  a.conf.SubnetRoutes(),
+			}, nil
+		}
+	}
+}
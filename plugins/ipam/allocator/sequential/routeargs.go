@@ -0,0 +1,87 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// RouteArgs are the routes passed through the ROUTES argument, as
+// "dst[,gw]" entries separated by "|", such as
+// "10.96.0.0/12,10.0.0.254|172.16.0.0/16"
+type RouteArgs []types.Route
+
+func (r *RouteArgs) UnmarshalText(text []byte) error {
+	var routes RouteArgs
+	for _, entry := range strings.Split(string(text), "|") {
+		parts := strings.Split(entry, ",")
+		if len(parts) > 2 {
+			return fmt.Errorf("invalid route %q: must be dst[,gw]", entry)
+		}
+		dst, err := types.ParseCIDR(parts[0])
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %v", entry, err)
+		}
+		route := types.Route{Dst: *dst}
+		if len(parts) == 2 {
+			gw := net.ParseIP(parts[1])
+			if gw == nil {
+				return fmt.Errorf("invalid route %q: invalid gateway %q", entry, parts[1])
+			}
+			if (gw.To4() != nil) != (dst.IP.To4() != nil) {
+				return fmt.Errorf("invalid route %q: gateway is not in the address family of the destination", entry)
+			}
+			route.GW = gw
+		}
+		routes = append(routes, route)
+	}
+	*r = routes
+	return nil
+}
+
+// validateRouteArgs checks that every route passed through the ROUTES
+// argument can be handed out with an address of the network
+func validateRouteArgs(conf *IPAMConfig) error {
+	if conf.Args == nil {
+		return nil
+	}
+	families := conf.families()
+	for _, r := range conf.Args.ROUTES {
+		if !families[r.Dst.IP.To4() == nil] {
+			return fmt.Errorf("route %s passed in ROUTES is not in the address family of any subnet of network: %s", &r.Dst, conf.Name)
+		}
+	}
+	return nil
+}
+
+// argRoutes returns the routes passed through the ROUTES argument that
+// are of the address family of the subnet
+func (c *IPAMConfig) argRoutes() []types.Route {
+	if c.Args == nil {
+		return nil
+	}
+	v4 := c.Subnet.IP.To4() != nil
+	var routes []types.Route
+	for _, r := range c.Args.ROUTES {
+		if (r.Dst.IP.To4() != nil) == v4 {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
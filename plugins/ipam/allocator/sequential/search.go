@@ -0,0 +1,77 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// searchSubnet returns the subnet requested through the SUBNET argument
+// to narrow the scan of a single allocation, or nil if none was
+func searchSubnet(conf *IPAMConfig) (*net.IPNet, error) {
+	if conf.Args == nil || conf.Args.SUBNET == "" {
+		return nil, nil
+	}
+	_, n, err := net.ParseCIDR(string(conf.Args.SUBNET))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SUBNET argument: %v", err)
+	}
+	if !subnetContains(conf.Subnet, n) {
+		return nil, fmt.Errorf("requested subnet %s is not within subnet %s of network: %s", n, (*net.IPNet)(&conf.Subnet), conf.Name)
+	}
+	return n, nil
+}
+
+func validateSearchSubnet(conf *IPAMConfig) error {
+	if conf.Args == nil || conf.Args.SUBNET == "" {
+		return nil
+	}
+	if len(conf.Subnets) > 0 {
+		return fmt.Errorf("the SUBNET argument cannot be combined with %q", "subnets")
+	}
+	_, err := searchSubnet(conf)
+	return err
+}
+
+// narrowRanges clips the ranges to the addresses of n, dropping those
+// that share none with it. The network and broadcast addresses of n are
+// kept, as n only narrows the search within the larger subnet.
+func narrowRanges(conf *IPAMConfig, ranges []Range, n *net.IPNet) ([]Range, error) {
+	first, last, err := networkRange(n)
+	if err != nil {
+		return nil, err
+	}
+	end := exclusiveEnd(last)
+
+	var narrowed []Range
+	for _, r := range ranges {
+		if ip.Cmp(r.Start, first) < 0 {
+			r.Start = first
+		}
+		if ip.Cmp(r.End, end) > 0 {
+			r.End = end
+		}
+		if !r.Empty() {
+			narrowed = append(narrowed, r)
+		}
+	}
+	if len(narrowed) == 0 {
+		return nil, fmt.Errorf("requested subnet %s holds no allocatable addresses in network: %s", n, conf.Name)
+	}
+	return narrowed, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// WeightedSubnet is one of several subnets a network allocates from,
+// with a gateway of its own and a weight that scales its share of the
+// allocations relative to its capacity
+type WeightedSubnet struct {
+	Subnet  types.IPNet `json:"subnet"`
+	Gateway net.IP      `json:"gateway"`
+	Weight  int         `json:"weight"`
+}
+
+// SubnetOrderListed fills the subnets listed under "subnets" in the
+// order they are listed, moving on to the next one only once a subnet is
+// full, instead of by weight
+const SubnetOrderListed = "listed"
+
+// SubnetConfigs returns the configuration of each of the subnets listed
+// under "subnets", for allocating from that subnet alone
+func (c *IPAMConfig) SubnetConfigs() []*IPAMConfig {
+	confs := make([]*IPAMConfig, 0, len(c.Subnets))
+	for _, s := range c.Subnets {
+		sub := *c
+		sub.Subnet = s.Subnet
+		sub.Gateway = s.Gateway
+		sub.Subnets = nil
+		sub.inSubnets = true
+		confs = append(confs, &sub)
+	}
+	return confs
+}
+
+// SubnetWeight returns the weight of subnet i, defaulting to 1
+func (c *IPAMConfig) SubnetWeight(i int) int {
+	if w := c.Subnets[i].Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// validateSubnets checks that the subnets listed under "subnets" are
+// valid on their own, do not overlap and are not combined with options
+// that only apply to a single subnet
+func validateSubnets(conf *IPAMConfig) error {
+	if conf.SubnetOrder != "" && conf.SubnetOrder != SubnetOrderListed {
+		return fmt.Errorf("unknown subnetOrder %q", conf.SubnetOrder)
+	}
+	if len(conf.Subnets) == 0 {
+		if conf.SubnetOrder != "" {
+			return fmt.Errorf("%q requires %q", "subnetOrder", "subnets")
+		}
+		return nil
+	}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"subnet", conf.Subnet.IP != nil},
+		{"subnet6", conf.Subnet6.IP != nil},
+		{"gateway", conf.Gateway != nil},
+		{"rangeStart", conf.RangeStart != nil},
+		{"rangeEnd", conf.RangeEnd != nil},
+		{"rangeCIDR", conf.RangeCIDR.IP != nil},
+		{"rangeSizeFromGateway", conf.RangeSizeFromGateway != 0},
+		{"ranges", len(conf.Ranges) > 0},
+		{"macMappings", len(conf.MACMappings) > 0},
+	} {
+		if field.set {
+			return fmt.Errorf("%q cannot be combined with %q", "subnets", field.name)
+		}
+	}
+
+	subs := conf.SubnetConfigs()
+	var v4 bool
+	for i, sub := range subs {
+		if conf.Subnets[i].Weight < 0 {
+			return fmt.Errorf("subnet %d: weight %d is negative", i, conf.Subnets[i].Weight)
+		}
+		if sub.Subnet.IP == nil {
+			return fmt.Errorf("subnet %d: missing field %q", i, "subnet")
+		}
+		if i == 0 {
+			v4 = sub.Subnet.IP.To4() != nil
+		} else if (sub.Subnet.IP.To4() != nil) != v4 {
+			return fmt.Errorf("subnet %d is not in the address family of subnet 0", i)
+		}
+		for _, validate := range []func(*IPAMConfig) error{validateGatewayMode, validateFamilies, validateRanges} {
+			if err := validate(sub); err != nil {
+				return fmt.Errorf("subnet %d: %v", i, err)
+			}
+		}
+
+		n := (*net.IPNet)(&sub.Subnet)
+		for j := 0; j < i; j++ {
+			o := (*net.IPNet)(&subs[j].Subnet)
+			if n.Contains(o.IP) || o.Contains(n.IP) {
+				return fmt.Errorf("subnet %d overlaps subnet %d", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// subnetsContain reports whether all of n lies within one of the
+// subnets listed under "subnets"
+func (c *IPAMConfig) subnetsContain(n *net.IPNet) bool {
+	for _, s := range c.Subnets {
+		if subnetContains(s.Subnet, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// InNetwork reports whether addr lies in the subnet, subnet6 or one of
+// the subnets under "subnets" of the network
+func (c *IPAMConfig) InNetwork(addr net.IP) bool {
+	for _, subnet := range []types.IPNet{c.Subnet, c.Subnet6} {
+		if subnet.IP != nil && (*net.IPNet)(&subnet).Contains(addr) {
+			return true
+		}
+	}
+	return c.SubnetIndex(addr) >= 0
+}
+
+// families returns the address families of the subnets of the network,
+// keyed by whether they are IPv6
+func (c *IPAMConfig) families() map[bool]bool {
+	families := map[bool]bool{}
+	for _, n := range []types.IPNet{c.Subnet, c.Subnet6} {
+		if n.IP != nil {
+			families[n.IP.To4() == nil] = true
+		}
+	}
+	for _, s := range c.Subnets {
+		families[s.Subnet.IP.To4() == nil] = true
+	}
+	return families
+}
+
+// CheckReservations returns an error if the store holds a reservation
+// outside of the network, as is left behind when a subnet is shrunk.
+// Reservations of an address family the network has no subnet of, such
+// as those of the other side of a dual-stack network, are ignored.
+func CheckReservations(conf *IPAMConfig, store backend.Store) error {
+	var ips []net.IP
+	if index, ok := store.(backend.Index); ok {
+		var err error
+		if ips, err = index.ReservedIPs(); err != nil {
+			return err
+		}
+	} else {
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, r := range list {
+			ips = append(ips, r.IP)
+		}
+	}
+
+	families := conf.families()
+	for _, addr := range ips {
+		if families[addr.To4() == nil] && !conf.InNetwork(addr) {
+			return fmt.Errorf("reserved IP %s is outside of network: %s; release it before shrinking the subnet", addr, conf.Name)
+		}
+	}
+	return nil
+}
+
+// SubnetIndex returns the index of the subnet under "subnets" that
+// holds addr, or -1
+func (c *IPAMConfig) SubnetIndex(addr net.IP) int {
+	for i, s := range c.Subnets {
+		n := (*net.IPNet)(&s.Subnet)
+		if n.Contains(addr) {
+			return i
+		}
+	}
+	return -1
+}
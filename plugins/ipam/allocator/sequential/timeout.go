@@ -0,0 +1,52 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// startDeadline starts the allocationTimeout of a Get
+func (a *IPAllocator) startDeadline() {
+	a.deadline = time.Time{}
+	if a.conf.AllocationTimeout > 0 {
+		a.deadline = time.Now().Add(time.Duration(a.conf.AllocationTimeout))
+	}
+}
+
+// checkDeadline returns an error matching ErrAllocationTimeout once the
+// Get in progress ran past its deadline
+func (a *IPAllocator) checkDeadline() error {
+	if a.deadline.IsZero() || time.Now().Before(a.deadline) {
+		return nil
+	}
+	return NewAllocationError(ErrAllocationTimeout, "allocation in network %s timed out after %v", a.conf.Name, time.Duration(a.conf.AllocationTimeout))
+}
+
+// rollBackLate releases cur again if its reservation only completed
+// past the deadline, since the runtime may have given up on the ADD by
+// then. The caller must hold the store lock.
+func (a *IPAllocator) rollBackLate(id string, cur net.IP) error {
+	err := a.checkDeadline()
+	if err == nil {
+		return nil
+	}
+	if rerr := a.store.ReleaseByIP(id, cur); rerr != nil {
+		return fmt.Errorf("%w; failed to roll back %s: %v", err, cur, rerr)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sequential
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+func validateMaxUtilization(conf *IPAMConfig) error {
+	if conf.MaxUtilizationPercent < 0 || conf.MaxUtilizationPercent > 100 {
+		return fmt.Errorf("%q must be between 1 and 100, got %d", "maxUtilizationPercent", conf.MaxUtilizationPercent)
+	}
+	return nil
+}
+
+// Usage returns the number of allocatable addresses in ranges, not
+// counting the gateway and excluded IPs, and how many of them are
+// reserved in the store. Ranges too large to count, such as a whole
+// IPv6 /64, report a total of math.MaxInt.
+func Usage(conf *IPAMConfig, store backend.Store, ranges []Range, exclude ExcludeSet) (total, used int, err error) {
+	contains := func(addr net.IP) bool {
+		for _, r := range ranges {
+			if r.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	size := new(big.Int)
+	for _, r := range ranges {
+		if !r.Empty() {
+			size.Add(size, r.size())
+			size.Sub(size, exclude.countIn(r))
+		}
+	}
+	gw := conf.GatewayIP()
+	if gw != nil && contains(gw) && !exclude.Contains(gw) {
+		size.Sub(size, big.NewInt(1))
+	}
+	total = math.MaxInt
+	if size.IsInt64() && size.Int64() < math.MaxInt {
+		total = int(size.Int64())
+	}
+
+	reservations, err := store.List()
+	if err != nil {
+		return total, 0, err
+	}
+	for _, res := range reservations {
+		if contains(res.IP) && !exclude.Contains(res.IP) {
+			used++
+		}
+	}
+	return total, used, nil
+}
+
+// CheckUtilization returns an error matching ErrUtilizationLimit if
+// reserving one more address in ranges would push their utilization
+// above maxUtilizationPercent. A request for an IP the container
+// already holds is let through, as it reserves nothing new. The caller
+// must hold the store lock.
+func CheckUtilization(conf *IPAMConfig, store backend.Store, ranges []Range, exclude ExcludeSet, id string, requested net.IP) error {
+	if conf.MaxUtilizationPercent == 0 {
+		return nil
+	}
+	if requested != nil {
+		held, err := HeldIPs(store, id)
+		if err != nil {
+			return err
+		}
+		if held[requested.String()] {
+			return nil
+		}
+	}
+
+	total, used, err := Usage(conf, store, ranges, exclude)
+	if err != nil {
+		return err
+	}
+	// (used+1) / total > max / 100, without rounding
+	next := new(big.Int).Mul(big.NewInt(int64(used)+1), big.NewInt(100))
+	limit := new(big.Int).Mul(big.NewInt(int64(total)), big.NewInt(int64(conf.MaxUtilizationPercent)))
+	if next.Cmp(limit) > 0 {
+		return NewAllocationError(ErrUtilizationLimit, "allocating another IP address would exceed %d%% utilization of network: %s (%d of %d addresses in use)", conf.MaxUtilizationPercent, conf.Name, used, total)
+	}
+	return nil
+}
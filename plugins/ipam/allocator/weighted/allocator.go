@@ -0,0 +1,291 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package weighted spreads the allocations of a network across several
+// subnets, delegating to a sequential allocator per subnet.
+package weighted
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+type pool struct {
+	conf   *sequential.IPAMConfig
+	alloc  *sequential.IPAllocator
+	ranges []sequential.Range
+	weight int
+}
+
+type IPAllocator struct {
+	conf    *sequential.IPAMConfig
+	store   backend.Store
+	pools   []pool
+	exclude sequential.ExcludeSet
+}
+
+func NewIPAllocator(conf *sequential.IPAMConfig, store backend.Store) (*IPAllocator, error) {
+	if len(conf.Subnets) == 0 {
+		return nil, fmt.Errorf("missing field %q in IPAM configuration", "subnets")
+	}
+	exclude, err := sequential.Exclusions(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := sequential.CheckReservations(conf, store); err != nil {
+		return nil, err
+	}
+	var pools []pool
+	for i, sub := range conf.SubnetConfigs() {
+		if sub.Args != nil {
+			// the preferred IP is tried once across all subnets by Get
+			args := *sub.Args
+			args.PREFERRED_IP = nil
+			args.PREFERRED_IPS = nil
+			sub.Args = &args
+		}
+		alloc, err := sequential.NewIPAllocator(sub, store)
+		if err != nil {
+			return nil, fmt.Errorf("subnet %d: %v", i, err)
+		}
+		ranges, err := sequential.Ranges(sub)
+		if err != nil {
+			return nil, fmt.Errorf("subnet %d: %v", i, err)
+		}
+		pools = append(pools, pool{sub, alloc, ranges, conf.SubnetWeight(i)})
+	}
+	return &IPAllocator{conf, store, pools, exclude}, nil
+}
+
+// Get allocates from the subnet that is least utilized relative to its
+// weight, or from the first one listed with the "listed" subnetOrder,
+// moving on to the next one if it turns out to be full. A
+// requested IP is allocated from the subnet that holds it, and a
+// preferred IP is tried in its subnet before the others are considered.
+func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
+	if a.conf.Args != nil && a.conf.Args.IP != nil {
+		i := a.conf.SubnetIndex(a.conf.Args.IP)
+		if i < 0 {
+			return nil, fmt.Errorf("%s not in any subnet of network: %s", a.conf.Args.IP, a.conf.Name)
+		}
+		return a.pools[i].alloc.Get(id)
+	}
+
+	res, err := a.reclaim(id)
+	if err != nil || res != nil {
+		return res, err
+	}
+
+	if len(a.conf.PreferredIPs()) > 0 {
+		res, err := a.getPreferred(id)
+		if err != nil || res != nil {
+			return res, err
+		}
+	}
+
+	// subnets at their utilization limit are passed over like full ones,
+	// but the limit is reported if no subnet had room
+	var limited error
+	for _, i := range a.order() {
+		res, err := a.pools[i].alloc.Get(id)
+		if errors.Is(err, sequential.ErrPoolExhausted) {
+			continue
+		}
+		if errors.Is(err, sequential.ErrUtilizationLimit) {
+			limited = err
+			continue
+		}
+		return res, err
+	}
+	if limited != nil {
+		return nil, limited
+	}
+	return nil, sequential.NewAllocationError(sequential.ErrPoolExhausted, "no IP addresses available in network: %s", a.conf.Name)
+}
+
+// reclaim returns the IP id released within the grace period or, if
+// reservations are keyed on the pod UID, already holds in any subnet,
+// before the least utilized subnet would hand out another one. It
+// returns a nil config if there is none.
+func (a *IPAllocator) reclaim(id string) (*types.IPConfig, error) {
+	if a.conf.ReservationKey != sequential.ReservationKeyPodUID && a.conf.ReleaseGracePeriod == 0 {
+		return nil, nil
+	}
+
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	for _, p := range a.pools {
+		held, err := sequential.ReclaimGrace(a.conf, a.store, p.ranges, id, nil)
+		if err != nil {
+			return nil, err
+		}
+		if held == nil {
+			if held, err = sequential.Reclaim(a.conf, a.store, p.ranges, id); err != nil {
+				return nil, err
+			}
+		}
+		if held != nil {
+			c := &types.IPConfig{
+				IP:      net.IPNet{IP: held, Mask: p.conf.Subnet.Mask},
+				Gateway: p.conf.GatewayIP(),
+				Routes:  p.conf.SubnetRoutes(),
+			}
+			sequential.DropGatewayRoutes(c, p.conf.Logger())
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// getPreferred reserves the first available preferred IP in the subnet
+// that holds it, returning a nil config if none is available
+func (a *IPAllocator) getPreferred(id string) (*types.IPConfig, error) {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	// the subnets share an address family, which the limit counts
+	if err := sequential.CheckContainerLimit(a.pools[0].conf, a.store, id, nil, 1); err != nil {
+		return nil, err
+	}
+	for _, ip := range a.conf.PreferredIPs() {
+		i := a.conf.SubnetIndex(ip)
+		if i < 0 {
+			continue
+		}
+		p := a.pools[i]
+		gw := p.conf.GatewayIP()
+
+		preferred, err := sequential.ReservePreferredIP(a.conf, a.store, p.ranges, a.exclude, id, gw, ip)
+		if err != nil {
+			return nil, err
+		}
+		if preferred != nil {
+			c := &types.IPConfig{
+				IP:      net.IPNet{IP: preferred, Mask: p.conf.Subnet.Mask},
+				Gateway: gw,
+				Routes:  p.conf.SubnetRoutes(),
+			}
+			sequential.DropGatewayRoutes(c, p.conf.Logger())
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// order returns the pool indexes by ascending utilization divided by
+// weight, so that each subnet fills in proportion to its capacity times
+// its weight. Ties go to the subnet listed first. With the "listed"
+// subnetOrder the pools keep the order they are listed in.
+func (a *IPAllocator) order() []int {
+	scores := make([]float64, len(a.pools))
+	order := make([]int, len(a.pools))
+	for i := range a.pools {
+		order[i] = i
+	}
+	if a.conf.SubnetOrder == sequential.SubnetOrderListed {
+		return order
+	}
+	for i, p := range a.pools {
+		total, used := p.alloc.Stats()
+		if total == 0 {
+			scores[i] = 1
+			continue
+		}
+		scores[i] = float64(used) / float64(total) / float64(p.weight)
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		return scores[order[x]] < scores[order[y]]
+	})
+	return order
+}
+
+// Releases all IPs allocated for the container with given ID
+func (a *IPAllocator) Release(id string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	return sequential.ReleaseByID(a.conf, a.store, id)
+}
+
+// ReleaseIP releases a single IP held by the container with given ID,
+// through the allocator of the subnet that holds it
+func (a *IPAllocator) ReleaseIP(id string, ip net.IP) error {
+	i := a.conf.SubnetIndex(ip)
+	if i < 0 {
+		return fmt.Errorf("%s not in any subnet of network: %s", ip, a.conf.Name)
+	}
+	return a.pools[i].alloc.ReleaseIP(id, ip)
+}
+
+// Check verifies that the container with given ID holds reservations
+// inside the ranges of the subnets, among them expected if it is set
+func (a *IPAllocator) Check(id string, expected net.IP) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	ips, err := a.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IP addresses reserved for container %s in network: %s", id, a.conf.Name)
+	}
+
+	found := expected == nil
+	for _, reserved := range ips {
+		if !a.inRange(reserved) {
+			return fmt.Errorf("reserved IP %s for container %s is outside the configured range of network: %s", reserved, id, a.conf.Name)
+		}
+		if expected != nil && reserved.Equal(expected) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("expected IP %s is not reserved for container %s in network: %s", expected, id, a.conf.Name)
+	}
+	return nil
+}
+
+func (a *IPAllocator) inRange(addr net.IP) bool {
+	for _, p := range a.pools {
+		for _, r := range p.ranges {
+			if r.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stats sums the stats of the subnets
+func (a *IPAllocator) Stats() (total, used int) {
+	for _, p := range a.pools {
+		t, u := p.alloc.Stats()
+		if t > math.MaxInt-total {
+			total = math.MaxInt
+		} else {
+			total += t
+		}
+		used += u
+	}
+	return total, used
+}
@@ -0,0 +1,221 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weighted
+
+import (
+	"errors"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	fakestore "github.com/containernetworking/cni/plugins/ipam/store/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func subnet(cidr string, weight int) sequential.WeightedSubnet {
+	n, err := types.ParseCIDR(cidr)
+	Expect(err).ToNot(HaveOccurred())
+	return sequential.WeightedSubnet{
+		Subnet: types.IPNet{IP: n.IP, Mask: n.Mask},
+		Weight: weight,
+	}
+}
+
+var _ = Describe("weighted allocator", func() {
+	var store *fakestore.FakeStore
+
+	newAllocator := func(ipmap map[string]string, subnets ...sequential.WeightedSubnet) *IPAllocator {
+		store = fakestore.NewFakeStore(ipmap, nil)
+		conf := &sequential.IPAMConfig{Name: "test", Subnets: subnets}
+		alloc, err := NewIPAllocator(conf, store)
+		Expect(err).ToNot(HaveOccurred())
+		return alloc
+	}
+
+	// allocate runs n ADDs and counts the allocations per /24
+	allocate := func(alloc *IPAllocator, n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			counts[res.IP.IP.Mask(net.CIDRMask(24, 32)).String()]++
+		}
+		return counts
+	}
+
+	Context("when the subnets are filled in the listed order", func() {
+		var alloc *IPAllocator
+
+		BeforeEach(func() {
+			store = fakestore.NewFakeStore(map[string]string{}, nil)
+			conf := &sequential.IPAMConfig{
+				Name: "test",
+				// the weight is ignored
+				Subnets:     []sequential.WeightedSubnet{subnet("10.0.0.0/29", 1), subnet("10.0.1.0/29", 10)},
+				SubnetOrder: sequential.SubnetOrderListed,
+			}
+			var err error
+			alloc, err = NewIPAllocator(conf, store)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("moves on to the next subnet only once the first is exhausted", func() {
+			Expect(allocate(alloc, 5)).To(Equal(map[string]int{"10.0.0.0": 5}))
+			Expect(allocate(alloc, 5)).To(Equal(map[string]int{"10.0.1.0": 5}))
+
+			_, err := alloc.Get("ID")
+			Expect(errors.Is(err, sequential.ErrPoolExhausted)).To(BeTrue())
+		})
+
+		It("goes back to the first subnet once it has room again", func() {
+			allocate(alloc, 6)
+			Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.0.4"))).To(Succeed())
+			Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.1.2"))).To(Succeed())
+
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal("10.0.0.4"))
+			Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+		})
+	})
+
+	It("spreads allocations evenly across equal subnets", func() {
+		alloc := newAllocator(map[string]string{},
+			subnet("10.0.0.0/28", 0),
+			subnet("10.0.1.0/28", 0),
+		)
+		Expect(allocate(alloc, 10)).To(Equal(map[string]int{"10.0.0.0": 5, "10.0.1.0": 5}))
+	})
+
+	It("fills subnets in proportion to their capacity", func() {
+		// 13 and 29 allocatable addresses
+		alloc := newAllocator(map[string]string{},
+			subnet("10.0.0.0/28", 1),
+			subnet("10.0.1.0/27", 1),
+		)
+		counts := allocate(alloc, 21)
+		Expect(counts["10.0.0.0"]).To(BeNumerically("~", 6.5, 1))
+		Expect(counts["10.0.1.0"]).To(BeNumerically("~", 14.5, 1))
+	})
+
+	It("skews allocations by weight", func() {
+		alloc := newAllocator(map[string]string{},
+			subnet("10.0.0.0/27", 3),
+			subnet("10.0.1.0/27", 1),
+		)
+		counts := allocate(alloc, 12)
+		Expect(counts["10.0.0.0"]).To(BeNumerically("~", 9, 1))
+		Expect(counts["10.0.1.0"]).To(BeNumerically("~", 3, 1))
+	})
+
+	It("falls through to the next subnet when the chosen one is full", func() {
+		// 10.0.0.0/30 only has .2, which is taken, but its weight
+		// keeps it first in line
+		alloc := newAllocator(map[string]string{"10.0.0.2": "other", "10.0.0.3": "other"},
+			subnet("10.0.0.0/30", 100),
+			subnet("10.0.1.0/28", 1),
+		)
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.1.2"))
+		Expect(res.Gateway.String()).To(Equal("10.0.1.1"))
+	})
+
+	It("passes over subnets at their utilization limit", func() {
+		conf := &sequential.IPAMConfig{
+			Name:                  "test",
+			Subnets:               []sequential.WeightedSubnet{subnet("10.0.0.0/30", 100), subnet("10.0.1.0/28", 1)},
+			MaxUtilizationPercent: 50,
+		}
+		alloc, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		Expect(err).ToNot(HaveOccurred())
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.1.2"))
+
+		conf.Subnets = conf.Subnets[:1]
+		alloc, err = NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = alloc.Get("ID")
+		Expect(errors.Is(err, sequential.ErrUtilizationLimit)).To(BeTrue())
+	})
+
+	It("reports exhaustion once every subnet is full", func() {
+		alloc := newAllocator(map[string]string{"10.0.0.2": "other", "10.0.0.3": "other"},
+			subnet("10.0.0.0/30", 1),
+		)
+		_, err := alloc.Get("ID")
+		Expect(errors.Is(err, sequential.ErrPoolExhausted)).To(BeTrue())
+		Expect(err).To(MatchError("no IP addresses available in network: test"))
+	})
+
+	It("tries a preferred IP in its subnet before the least used one", func() {
+		alloc := newAllocator(map[string]string{"10.0.1.2": "other"}, subnet("10.0.0.0/24", 1), subnet("10.0.1.0/24", 1))
+		alloc.conf.Args = &sequential.IPAMArgs{PREFERRED_IP: net.ParseIP("10.0.1.7")}
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.1.7"))
+		Expect(res.Gateway.String()).To(Equal("10.0.1.1"))
+
+		// once taken, the usual order applies again
+		res, err = alloc.Get("ID2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+	})
+
+	It("tries preferred IPs in order across subnets", func() {
+		alloc := newAllocator(map[string]string{"10.0.1.7": "other"}, subnet("10.0.0.0/24", 1), subnet("10.0.1.0/24", 1))
+		alloc.conf.Args = &sequential.IPAMArgs{PREFERRED_IPS: sequential.IPList{net.ParseIP("10.0.1.7"), net.ParseIP("10.0.1.8"), net.ParseIP("10.0.0.9")}}
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.1.8"))
+		Expect(res.Gateway.String()).To(Equal("10.0.1.1"))
+	})
+
+	It("releases an IP through the subnet that holds it", func() {
+		alloc := newAllocator(map[string]string{"10.0.1.5": "ID", "10.0.0.5": "ID"},
+			subnet("10.0.0.0/24", 1),
+			subnet("10.0.1.0/24", 1),
+		)
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.1.5"))).To(Succeed())
+		ips, err := store.GetByID("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].String()).To(Equal("10.0.0.5"))
+
+		Expect(alloc.ReleaseIP("ID", net.ParseIP("10.0.2.5"))).To(MatchError("10.0.2.5 not in any subnet of network: test"))
+	})
+
+	It("checks reservations across all subnets", func() {
+		alloc := newAllocator(map[string]string{"10.0.1.5": "ID"},
+			subnet("10.0.0.0/24", 1),
+			subnet("10.0.1.0/24", 1),
+		)
+		Expect(alloc.Check("ID", net.ParseIP("10.0.1.5"))).To(Succeed())
+		Expect(alloc.Check("ID", net.ParseIP("10.0.0.5"))).To(MatchError("expected IP 10.0.0.5 is not reserved for container ID in network: test"))
+		Expect(alloc.Check("other", nil)).To(HaveOccurred())
+	})
+
+	It("refuses a store holding reservations outside of every subnet", func() {
+		conf := &sequential.IPAMConfig{Name: "test", Subnets: []sequential.WeightedSubnet{
+			subnet("10.0.0.0/24", 1),
+			subnet("10.0.1.0/24", 1),
+		}}
+		_, err := NewIPAllocator(conf, fakestore.NewFakeStore(map[string]string{"10.0.0.5": "a", "10.0.1.5": "b", "10.0.2.5": "c"}, nil))
+		Expect(err).To(MatchError("reserved IP 10.0.2.5 is outside of network: test; release it before shrinking the subnet"))
+	})
+})
@@ -0,0 +1,76 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// clearEnv selects the removal of every reservation of the network
+// configured on stdin instead of a CNI command. It must be set to the
+// name of that network, so that a stray variable or a configuration
+// piped in by mistake cannot wipe a network.
+const clearEnv = "HOST_LOCAL_CLEAR"
+
+// clearResult reports the number of reservations removed, or that would
+// be removed in dry-run mode
+type clearResult struct {
+	Network string `json:"network"`
+	Cleared int    `json:"cleared"`
+}
+
+// runClear removes every reservation of the network and prints how many
+// there were to stdout
+func runClear(stdin io.Reader, stdout io.Writer, network string) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	if network != ipamConf.Name {
+		return fmt.Errorf("%s must be set to the name of the network to clear, %q, got %q", clearEnv, ipamConf.Name, network)
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	res := clearResult{Network: ipamConf.Name}
+	if ipamConf.DryRun {
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		res.Cleared = len(list)
+	} else if res.Cleared, err = sequential.ClearAll(ipamConf, store); err != nil {
+		return err
+	}
+	return json.NewEncoder(stdout).Encode(res)
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("clear", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-clear")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(ipam string, env ...string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "clear",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q%s
+			}
+		}`, dataDir, ipam))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+	add := func(id string) *gexec.Session {
+		return run("",
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID="+id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		)
+	}
+	reserved := func(addr string) bool {
+		_, err := os.Stat(filepath.Join(dataDir, "clear", addr))
+		return err == nil
+	}
+
+	BeforeEach(func() {
+		Expect(add("first").ExitCode()).To(Equal(0))
+		Expect(add("second").ExitCode()).To(Equal(0))
+	})
+
+	It("removes every reservation of the network and starts over", func() {
+		session := run("", "HOST_LOCAL_CLEAR=clear")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(`{"network": "clear", "cleared": 2}`))
+		Expect(reserved("10.0.0.2")).To(BeFalse())
+		Expect(reserved("10.0.0.3")).To(BeFalse())
+
+		session = add("third")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`"10.0.0.2/24"`))
+	})
+
+	It("requires the name of the network", func() {
+		session := run("", "HOST_LOCAL_CLEAR=yes")
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`HOST_LOCAL_CLEAR must be set to the name of the network to clear, \"clear\", got \"yes\"`))
+		Expect(reserved("10.0.0.2")).To(BeTrue())
+	})
+
+	It("only counts the reservations in dry-run mode", func() {
+		session := run(`, "dryRun": true`, "HOST_LOCAL_CLEAR=clear")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(`{"network": "clear", "cleared": 2}`))
+		Expect(reserved("10.0.0.2")).To(BeTrue())
+		Expect(reserved("10.0.0.3")).To(BeTrue())
+	})
+})
@@ -0,0 +1,58 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// confirmEnv selects the confirmation of the addresses reserved for the
+// container with the ID it is set to, in the network configured on
+// stdin, instead of a CNI command
+const confirmEnv = "HOST_LOCAL_CONFIRM"
+
+// runConfirm confirms the addresses pending for the container with
+// given ID
+func runConfirm(stdin io.Reader, id string) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	if ipamConf.ConfirmTTL == 0 {
+		return fmt.Errorf("%q is not set in network: %s", "confirmTTL", ipamConf.Name)
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// the IPv4 and IPv6 addresses share the store, so one allocator
+	// confirms both
+	allocator, err := sequential.NewIPAllocator(ipamConf, store)
+	if err != nil {
+		return err
+	}
+	return allocator.Confirm(id)
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("confirm", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-confirm")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(env ...string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "confirm",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"confirmTTL": "1m",
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	holder := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(dataDir, "confirm", "10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		return strings.SplitN(string(data), "\n", 2)[0]
+	}
+
+	It("makes the address of an ADD permanent", func() {
+		Eventually(run(
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=dummy",
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		)).Should(gexec.Exit(0))
+		Expect(holder()).To(Equal("__pending__/dummy"))
+
+		Eventually(run("HOST_LOCAL_CONFIRM=dummy")).Should(gexec.Exit(0))
+		Expect(holder()).To(Equal("dummy"))
+	})
+
+	It("fails for a container without addresses", func() {
+		session := run("HOST_LOCAL_CONFIRM=unknown")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring("no IP addresses pending for container unknown in network: confirm"))
+	})
+})
@@ -0,0 +1,55 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/ipam/log"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// delegateAdd runs ADD of the delegate plugin with the configuration
+// host-local was given and merges its IPv6 address into r, which holds
+// the IPv4 address of host-local. The delegate's DNS settings are used
+// only if the network configures none.
+func delegateAdd(conf *sequential.IPAMConfig, stdin []byte, r *types.Result, logger *log.Logger) error {
+	res, err := invoke.DelegateAdd(conf.Delegate.Type, stdin)
+	if err != nil {
+		return fmt.Errorf("delegate %s failed: %v", conf.Delegate.Type, err)
+	}
+	if res.IP4 != nil {
+		logger.Warnf("ignoring IPv4 address %s of delegate %s", res.IP4.IP.String(), conf.Delegate.Type)
+	}
+	r.IP6 = res.IP6
+	if isEmptyDNS(r.DNS) {
+		r.DNS = res.DNS
+	}
+	return nil
+}
+
+// delegateDel runs DEL of the delegate plugin
+func delegateDel(conf *sequential.IPAMConfig, stdin []byte) error {
+	if err := invoke.DelegateDel(conf.Delegate.Type, stdin); err != nil {
+		return fmt.Errorf("delegate %s failed: %v", conf.Delegate.Type, err)
+	}
+	return nil
+}
+
+func isEmptyDNS(dns types.DNS) bool {
+	return len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("delegate IPAM", func() {
+	var dataDir, pluginDir, callsFile string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-delegate")
+		Expect(err).ToNot(HaveOccurred())
+		pluginDir, err = ioutil.TempDir("", "host-local-delegate-bin")
+		Expect(err).ToNot(HaveOccurred())
+		callsFile = filepath.Join(pluginDir, "calls")
+
+		// the stub records each command and hands out a fixed IPv6
+		// address on ADD
+		stub := fmt.Sprintf(`#!/bin/sh
+echo "$CNI_COMMAND" >> %s
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"ip6":{"ip":"fd00::5/64","gateway":"fd00::1","routes":[{"dst":"::/0"}]}}'
+fi
+`, callsFile)
+		Expect(ioutil.WriteFile(filepath.Join(pluginDir, "stub-ipam"), []byte(stub), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(os.RemoveAll(pluginDir)).To(Succeed())
+	})
+
+	run := func(command string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=dummy",
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=" + pluginDir,
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q,
+				"delegate": {"type": "stub-ipam"}
+			}
+		}`, dataDir))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	calls := func() []string {
+		contents, err := ioutil.ReadFile(callsFile)
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Fields(string(contents))
+	}
+
+	It("merges the IPv6 address of the delegate and releases both on DEL", func() {
+		session := run("ADD")
+		Eventually(session).Should(gexec.Exit(0))
+
+		var res types.Result
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		Expect(res.IP4).NotTo(BeNil())
+		Expect(res.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+		Expect(res.IP6).NotTo(BeNil())
+		Expect(res.IP6.IP.String()).To(Equal("fd00::5/64"))
+		Expect(res.IP6.Gateway.String()).To(Equal("fd00::1"))
+		Expect(res.IP6.Routes).To(HaveLen(1))
+		Expect(res.IP6.Routes[0].Dst.String()).To(Equal("::/0"))
+		Expect(calls()).To(Equal([]string{"ADD"}))
+
+		reservation := filepath.Join(dataDir, "mynet", "10.1.2.2")
+		Expect(reservation).To(BeAnExistingFile())
+
+		session = run("DEL")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Out.Contents()).To(MatchJSON("{}"))
+		Expect(calls()).To(Equal([]string{"ADD", "DEL"}))
+		Expect(reservation).NotTo(BeAnExistingFile())
+	})
+
+	It("rolls back the local reservation when the delegate fails", func() {
+		Expect(ioutil.WriteFile(filepath.Join(pluginDir, "stub-ipam"), []byte("#!/bin/sh\nexit 1\n"), 0755)).To(Succeed())
+
+		session := run("ADD")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Out.Contents()).To(ContainSubstring("delegate stub-ipam failed"))
+		Expect(filepath.Join(dataDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+	})
+})
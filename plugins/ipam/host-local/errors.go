@@ -0,0 +1,72 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// Error codes of the CNI error results host-local prints. The first
+// ones are those the CNI spec defines, the others lie in the range it
+// leaves to plugins; 100 remains the code of every other failure.
+const (
+	codeIncompatibleVersion = 1
+	codeInvalidConfig       = 7
+	codePoolExhausted       = 101
+	codeIPConflict          = 102
+	codeUtilizationLimit    = 103
+	codeContainerLimit      = 104
+	codeAllocationTimeout   = 105
+)
+
+// allocationErrors maps the errors of the allocators to their code and
+// the name reported in the details of the error result
+var allocationErrors = []struct {
+	err  error
+	code uint
+	name string
+}{
+	{sequential.ErrPoolExhausted, codePoolExhausted, "POOL_EXHAUSTED"},
+	{sequential.ErrIPNotAvailable, codeIPConflict, "IP_CONFLICT"},
+	{sequential.ErrUtilizationLimit, codeUtilizationLimit, "UTILIZATION_LIMIT"},
+	{sequential.ErrContainerLimit, codeContainerLimit, "CONTAINER_LIMIT"},
+	{sequential.ErrAllocationTimeout, codeAllocationTimeout, "ALLOCATION_TIMEOUT"},
+}
+
+// allocationError returns a CNI error result for an error of the
+// allocators, or err itself if it is none of theirs
+func allocationError(err error) error {
+	for _, e := range allocationErrors {
+		if errors.Is(err, e.err) {
+			return &types.Error{Code: e.code, Msg: err.Error(), Details: e.name}
+		}
+	}
+	return err
+}
+
+// configError returns a CNI error result for a configuration that
+// cannot be loaded
+func configError(err error) error {
+	return &types.Error{Code: codeInvalidConfig, Msg: err.Error(), Details: "CONFIG_INVALID"}
+}
+
+// versionError returns a CNI error result for a cniVersion the plugin
+// cannot print a result for
+func versionError(err error) error {
+	return &types.Error{Code: codeIncompatibleVersion, Msg: err.Error(), Details: "INCOMPATIBLE_VERSION"}
+}
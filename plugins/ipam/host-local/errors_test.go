@@ -0,0 +1,133 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("the error result of a failed ADD", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-errors")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	type errorResult struct {
+		Code    uint   `json:"code"`
+		Msg     string `json:"msg"`
+		Details string `json:"details"`
+	}
+
+	// add runs an ADD in a /30, which has a single address to hand out
+	add := func(id, cniArgs, ipam string) (int, errorResult) {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+			"CNI_ARGS=" + cniArgs,
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "errors",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/30",
+				"dataDir": %q%s
+			}
+		}`, dataDir, ipam))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+
+		var result errorResult
+		if session.ExitCode() != 0 {
+			Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+		}
+		return session.ExitCode(), result
+	}
+
+	It("reports an exhausted pool", func() {
+		code, _ := add("first", "", "")
+		Expect(code).To(Equal(0))
+
+		code, result := add("second", "", "")
+		Expect(code).To(Equal(1))
+		Expect(result).To(Equal(errorResult{
+			Code:    101,
+			Msg:     "no IP addresses available in network: errors",
+			Details: "POOL_EXHAUSTED",
+		}))
+	})
+
+	It("reports a requested IP held by another container", func() {
+		code, _ := add("first", "", "")
+		Expect(code).To(Equal(0))
+
+		code, result := add("second", "IP=10.0.0.2", "")
+		Expect(code).To(Equal(1))
+		Expect(result.Code).To(BeEquivalentTo(102))
+		Expect(result.Details).To(Equal("IP_CONFLICT"))
+		Expect(result.Msg).To(ContainSubstring("is reserved by container first"))
+	})
+
+	It("reports an allocation that runs past allocationTimeout", func() {
+		hook := dataDir + "/slow-hook"
+		Expect(ioutil.WriteFile(hook, []byte("#!/bin/sh\nsleep 0.3\n"), 0755)).To(Succeed())
+		code, result := add("first", "", fmt.Sprintf(`, "validationHook": %q, "allocationTimeout": "100ms"`, hook))
+		Expect(code).To(Equal(1))
+		Expect(result).To(Equal(errorResult{
+			Code:    105,
+			Msg:     "allocation in network errors timed out after 100ms",
+			Details: "ALLOCATION_TIMEOUT",
+		}))
+
+		// the late reservation was rolled back
+		code, _ = add("second", "", "")
+		Expect(code).To(Equal(0))
+	})
+
+	It("reports an invalid configuration", func() {
+		code, result := add("first", "", `, "reuseMode": "sometimes"`)
+		Expect(code).To(Equal(1))
+		Expect(result.Code).To(BeEquivalentTo(7))
+		Expect(result.Details).To(Equal("CONFIG_INVALID"))
+	})
+
+	It("keeps the generic code for other failures", func() {
+		Expect(ioutil.WriteFile(dataDir+"/errors", nil, 0644)).To(Succeed())
+		code, result := add("first", "", "")
+		Expect(code).To(Equal(1))
+		Expect(result.Code).To(BeEquivalentTo(100))
+		Expect(result.Details).To(BeEmpty())
+	})
+})
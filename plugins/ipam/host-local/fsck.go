@@ -0,0 +1,93 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store/disk"
+)
+
+// fsckEnv selects a consistency check of the disk store instead of a
+// CNI command. "check" only reports problems, "repair" also removes the
+// invalid files.
+const fsckEnv = "HOST_LOCAL_FSCK"
+
+// fsckResult lists the problems found by a consistency check
+type fsckResult struct {
+	Invalid      []fsckInvalid   `json:"invalid"`
+	OutOfNetwork []gcReservation `json:"outOfNetwork"`
+	Duplicates   []fsckDuplicate `json:"duplicates"`
+}
+
+type fsckInvalid struct {
+	File    string `json:"file"`
+	Reason  string `json:"reason"`
+	Removed bool   `json:"removed"`
+}
+
+type fsckDuplicate struct {
+	ContainerID string   `json:"containerID"`
+	IPs         []string `json:"ips"`
+}
+
+// runFsck checks the disk store of the network configured on stdin and
+// prints the problems found to stdout. In dry-run mode a repair only
+// reports what it would remove.
+func runFsck(stdin io.Reader, stdout io.Writer, mode string) error {
+	if mode != "check" && mode != "repair" {
+		return fmt.Errorf("invalid %s %q: must be %q or %q", fsckEnv, mode, "check", "repair")
+	}
+
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	if ipamConf.Store != "" && ipamConf.Store != "disk" {
+		return fmt.Errorf("%s requires the disk store, got %q", fsckEnv, ipamConf.Store)
+	}
+
+	store, err := disk.Open(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Check(ipamConf, mode == "repair" && !ipamConf.DryRun)
+	if err != nil {
+		return err
+	}
+
+	res := fsckResult{Invalid: []fsckInvalid{}, OutOfNetwork: gcReservations(report.OutOfNetwork), Duplicates: []fsckDuplicate{}}
+	for _, f := range report.Invalid {
+		res.Invalid = append(res.Invalid, fsckInvalid{f.Name, f.Reason, f.Removed})
+	}
+	for _, d := range report.Duplicates {
+		var ips []string
+		for _, ip := range d.IPs {
+			ips = append(ips, ip.String())
+		}
+		res.Duplicates = append(res.Duplicates, fsckDuplicate{d.ID, ips})
+	}
+	return json.NewEncoder(stdout).Encode(res)
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("store consistency check", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-fsck")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dataDir, "fsck"), 0700)).To(Succeed())
+
+		for name, contents := range map[string]string{
+			"10.0.0.2": "valid",
+			"10.0.0.3": "corrupt\nnot a time",
+			"10.9.0.2": "renumbered",
+			"garbage":  "x",
+		} {
+			Expect(ioutil.WriteFile(filepath.Join(dataDir, "fsck", name), []byte(contents), 0644)).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	type result struct {
+		Invalid []struct {
+			File    string `json:"file"`
+			Removed bool   `json:"removed"`
+		} `json:"invalid"`
+		OutOfNetwork []struct {
+			IP          string `json:"ip"`
+			ContainerID string `json:"containerID"`
+		} `json:"outOfNetwork"`
+	}
+
+	run := func(mode string) *gexec.Session {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{"HOST_LOCAL_FSCK=" + mode}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "fsck",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dataDir, "fsck", name))
+		return err == nil
+	}
+
+	It("reports problems without touching the store", func() {
+		session := run("check")
+		Eventually(session).Should(gexec.Exit(0))
+
+		var res result
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		Expect(res.Invalid).To(HaveLen(2))
+		Expect(res.Invalid[0].File).To(Equal("10.0.0.3"))
+		Expect(res.Invalid[0].Removed).To(BeFalse())
+		Expect(res.Invalid[1].File).To(Equal("garbage"))
+		Expect(res.OutOfNetwork).To(HaveLen(1))
+		Expect(res.OutOfNetwork[0].IP).To(Equal("10.9.0.2"))
+		Expect(res.OutOfNetwork[0].ContainerID).To(Equal("renumbered"))
+
+		for _, name := range []string{"10.0.0.2", "10.0.0.3", "10.9.0.2", "garbage"} {
+			Expect(exists(name)).To(BeTrue(), name)
+		}
+	})
+
+	It("removes the invalid files when repairing", func() {
+		session := run("repair")
+		Eventually(session).Should(gexec.Exit(0))
+
+		var res result
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		Expect(res.Invalid).To(HaveLen(2))
+		Expect(res.Invalid[0].Removed).To(BeTrue())
+
+		for name, kept := range map[string]bool{"10.0.0.2": true, "10.0.0.3": false, "10.9.0.2": true, "garbage": false} {
+			Expect(exists(name)).To(Equal(kept), name)
+		}
+	})
+
+	It("rejects an unknown mode", func() {
+		session := run("fix")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`invalid HOST_LOCAL_FSCK \"fix\"`))
+	})
+})
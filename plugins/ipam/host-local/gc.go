@@ -0,0 +1,103 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// gcAgeEnv selects garbage collection instead of a CNI command: every
+// reservation older than its value, a duration such as "72h", is
+// released
+const gcAgeEnv = "HOST_LOCAL_GC_AGE"
+
+// gcResult summarizes a garbage collection run
+type gcResult struct {
+	Released []gcReservation `json:"released"`
+}
+
+type gcReservation struct {
+	IP          string    `json:"ip"`
+	ContainerID string    `json:"containerID"`
+	ReservedAt  time.Time `json:"reservedAt"`
+	Label       string    `json:"label,omitempty"`
+}
+
+// gcReservations converts reservations for output, giving an empty
+// list rather than null if there are none
+func gcReservations(list []backend.Reservation) []gcReservation {
+	res := []gcReservation{}
+	for _, r := range list {
+		res = append(res, gcReservation{r.IP.String(), r.ID, r.ReservedAt, r.Label})
+	}
+	return res
+}
+
+// runGC releases the reservations of the network configured on stdin
+// that are older than age and prints the released ones to stdout
+func runGC(stdin io.Reader, stdout io.Writer, age string) error {
+	maxAge, err := time.ParseDuration(age)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", gcAgeEnv, age, err)
+	}
+	if maxAge <= 0 {
+		return fmt.Errorf("%s must be positive, got %q", gcAgeEnv, age)
+	}
+
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	released, err := collect(ipamConf, store, time.Now().Add(-maxAge))
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(stdout).Encode(gcResult{Released: gcReservations(released)})
+}
+
+// collect releases the reservations made before the given time under
+// the store lock, so that it can run alongside ADD and DEL. In dry-run
+// mode it reports what would be released without touching the store.
+func collect(ipamConf *sequential.IPAMConfig, store backend.Store, before time.Time) ([]backend.Reservation, error) {
+	if ipamConf.DryRun {
+		store = backend.NewDryRun(store)
+	}
+
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	return backend.ReleaseStale(store, before)
+}
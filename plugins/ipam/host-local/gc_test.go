@@ -0,0 +1,102 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("garbage collection", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-gc")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dataDir, "gc"), 0700)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(ip, id string, age time.Duration) {
+		contents := id
+		if age > 0 {
+			contents += "\n" + time.Now().Add(-age).UTC().Format(time.RFC3339Nano)
+		}
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "gc", ip), []byte(contents), 0644)).To(Succeed())
+	}
+
+	run := func(age string) *gexec.Session {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{"HOST_LOCAL_GC_AGE=" + age}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "gc",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("releases only reservations older than the given age", func() {
+		reserve("10.0.0.2", "stale", 48*time.Hour)
+		reserve("10.0.0.3", "fresh", time.Minute)
+		reserve("10.0.0.4", "__reserved__", 48*time.Hour)
+		// files written by older versions carry no time
+		reserve("10.0.0.5", "untimed", 0)
+
+		session := run("24h")
+		Eventually(session).Should(gexec.Exit(0))
+
+		var res struct {
+			Released []struct {
+				IP          string `json:"ip"`
+				ContainerID string `json:"containerID"`
+			} `json:"released"`
+		}
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		Expect(res.Released).To(HaveLen(1))
+		Expect(res.Released[0].IP).To(Equal("10.0.0.2"))
+		Expect(res.Released[0].ContainerID).To(Equal("stale"))
+
+		for ip, kept := range map[string]bool{"10.0.0.2": false, "10.0.0.3": true, "10.0.0.4": true, "10.0.0.5": true} {
+			_, err := os.Stat(filepath.Join(dataDir, "gc", ip))
+			Expect(err == nil).To(Equal(kept), ip)
+		}
+	})
+
+	It("rejects an invalid age", func() {
+		session := run("-1h")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring("HOST_LOCAL_GC_AGE must be positive"))
+	})
+})
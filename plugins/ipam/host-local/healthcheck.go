@@ -0,0 +1,75 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// healthcheckEnv selects a check that the store of the network
+// configured on stdin is usable, for node readiness probes, instead of
+// a CNI command
+const healthcheckEnv = "HOST_LOCAL_HEALTHCHECK"
+
+// runHealthcheck checks the store of the network configured on stdin,
+// printing nothing if it is healthy
+func runHealthcheck(stdin io.Reader) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	return Healthcheck(ipamConf)
+}
+
+// Healthcheck opens the store of the network, lists its reservations
+// and checks that the last reserved IP of each subnet, if any, is an
+// address of that subnet. It changes nothing in the store.
+func Healthcheck(conf *sequential.IPAMConfig) error {
+	store, err := newStore(conf)
+	if err != nil {
+		return fmt.Errorf("failed to open the store of network %s: %v", conf.Name, err)
+	}
+	defer store.Close()
+
+	if _, err := store.List(); err != nil {
+		return fmt.Errorf("failed to list the reservations of network %s: %v", conf.Name, err)
+	}
+
+	confs := []*sequential.IPAMConfig{conf}
+	if len(conf.Subnets) > 0 {
+		confs = conf.SubnetConfigs()
+	}
+	if conf6 := conf.IPv6Config(); conf6 != nil {
+		confs = append(confs, conf6)
+	}
+	for _, c := range confs {
+		a, err := sequential.NewIPAllocator(c, store)
+		if err != nil {
+			return err
+		}
+		if err := a.CheckLastReserved(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Healthcheck", func() {
+	var (
+		dataDir string
+		conf    *sequential.IPAMConfig
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-healthcheck")
+		Expect(err).ToNot(HaveOccurred())
+		conf, err = sequential.LoadIPAMConfig([]byte(fmt.Sprintf(`{
+			"name": "health",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q
+			}
+		}`, dataDir)), "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	writeLast := func(data string) {
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "health", "last_reserved_ip"), []byte(data), 0644)).To(Succeed())
+	}
+
+	It("passes a healthy store", func() {
+		Expect(Healthcheck(conf)).To(Succeed())
+
+		store, err := newStore(conf)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = allocate(conf, store, "ID")
+		store.Close()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(Healthcheck(conf)).To(Succeed())
+	})
+
+	It("fails a last reserved IP outside of the subnet", func() {
+		Expect(Healthcheck(conf)).To(Succeed())
+		writeLast("10.0.9.9")
+		Expect(Healthcheck(conf)).To(MatchError("last reserved IP 10.0.9.9 is not in network: 10.0.0.0/24"))
+	})
+
+	It("fails a last reserved IP that is not an address", func() {
+		Expect(Healthcheck(conf)).To(Succeed())
+		writeLast("bogus")
+		err := Healthcheck(conf)
+		Expect(err).To(MatchError(ContainSubstring("failed to read the last reserved IP of network health: malformed last reserved ip file")))
+	})
+
+	It("fails a store that cannot be opened", func() {
+		// a file where the network directory should be
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "health"), nil, 0644)).To(Succeed())
+		err := Healthcheck(conf)
+		Expect(err).To(MatchError(ContainSubstring("failed to open the store of network health")))
+	})
+})
@@ -15,13 +15,27 @@
 package main_test
 
 import (
+	"github.com/onsi/gomega/gexec"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"testing"
 )
 
+var pathToHostLocal string
+
 func TestHostLocal(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "HostLocal Suite")
 }
+
+var _ = BeforeSuite(func() {
+	var err error
+	pathToHostLocal, err = gexec.Build("github.com/containernetworking/cni/plugins/ipam/host-local")
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
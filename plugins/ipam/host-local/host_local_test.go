@@ -0,0 +1,257 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store/disk"
+	"github.com/containernetworking/cni/plugins/ipam/store/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local", func() {
+	Context("with a DNS block", func() {
+		load := func(dns string) *sequential.IPAMConfig {
+			conf, err := sequential.LoadIPAMConfig([]byte(`{
+				"name": "dns",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24"`+dns+`
+				}
+			}`), "")
+			Expect(err).ToNot(HaveOccurred())
+			return conf
+		}
+
+		It("returns the configured DNS settings verbatim", func() {
+			conf := load(`,
+				"dns": {
+					"nameservers": ["10.0.0.53", "fd00::53"],
+					"domain": "example.com",
+					"search": ["svc.example.com", "example.com"],
+					"options": ["ndots:5", "rotate"]
+				}`)
+			r, err := allocate(conf, memory.New(), "ID")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := json.Marshal(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"dns":{"nameservers":["10.0.0.53","fd00::53"],"domain":"example.com","search":["svc.example.com","example.com"],"options":["ndots:5","rotate"]}`))
+		})
+
+		It("omits the DNS section when the block is empty", func() {
+			r, err := allocate(load(`, "dns": {}`), memory.New(), "ID")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := json.Marshal(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).ToNot(ContainSubstring("dns"))
+		})
+
+		It("returns the address following the gateway with dnsFromSubnet", func() {
+			r, err := allocate(load(`, "dnsFromSubnet": true`), memory.New(), "ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.DNS.Nameservers).To(Equal([]string{"10.0.0.2"}))
+			// the DNS server is never handed out
+			Expect(r.IP4.IP.IP.String()).To(Equal("10.0.0.3"))
+		})
+
+		It("prefers a configured DNS block to dnsFromSubnet", func() {
+			r, err := allocate(load(`, "dnsFromSubnet": true, "dns": {"nameservers": ["10.0.0.53"]}`), memory.New(), "ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.DNS.Nameservers).To(Equal([]string{"10.0.0.53"}))
+			// the computed address stays excluded all the same
+			Expect(r.IP4.IP.IP.String()).To(Equal("10.0.0.3"))
+		})
+
+		It("rejects a DNS block of the wrong type", func() {
+			_, err := sequential.LoadIPAMConfig([]byte(`{
+				"name": "dns",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"dns": {"nameservers": "10.0.0.53"}
+				}
+			}`), "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a dual-stack network", func() {
+		var (
+			store *memory.Store
+			conf  *sequential.IPAMConfig
+		)
+
+		BeforeEach(func() {
+			var err error
+			store = memory.New()
+			conf, err = sequential.LoadIPAMConfig([]byte(`{
+				"name": "dual",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"subnet6": "fd00::/120",
+					"ranges": [{"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.20"}]
+				}
+			}`), "")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("allocates an address of each family", func() {
+			r, err := allocate(conf, store, "ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.IP4.IP.String()).To(Equal("10.0.0.10/24"))
+			Expect(r.IP6.IP.String()).To(Equal("fd00::2/120"))
+			Expect(r.IP6.Gateway.String()).To(Equal("fd00::1"))
+		})
+
+		It("resumes each family after its own last reserved address", func() {
+			_, err := allocate(conf, store, "ID1")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = allocate(conf, store, "ID2")
+			Expect(err).ToNot(HaveOccurred())
+
+			allocator, err := newAllocator(conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocator.Release("ID1")).To(Succeed())
+
+			r, err := allocate(conf, store, "ID3")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.IP4.IP.IP.String()).To(Equal("10.0.0.12"))
+			Expect(r.IP6.IP.IP.String()).To(Equal("fd00::4"))
+		})
+
+		It("releases both addresses on DEL", func() {
+			_, err := allocate(conf, store, "ID")
+			Expect(err).ToNot(HaveOccurred())
+
+			allocator, err := newAllocator(conf, store)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocator.Release("ID")).To(Succeed())
+
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("rolls back the IPv4 address when IPv6 allocation fails", func() {
+			conf.Subnet6.Mask = []byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+			}
+			// fd00::/127 only has the network address and the gateway
+			_, err := allocate(conf, store, "ID")
+			Expect(err).To(MatchError("no IP addresses available in network: dual"))
+
+			ips, err := store.GetByID("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("rolls back a pending IPv4 address when IPv6 allocation fails", func() {
+			conf.ConfirmTTL = sequential.Duration(time.Minute)
+			conf.Subnet6.Mask = []byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+			}
+			_, err := allocate(conf, store, "ID")
+			Expect(err).To(MatchError("no IP addresses available in network: dual"))
+
+			list, err := store.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(BeEmpty())
+		})
+	})
+
+	Context("in dry-run mode", func() {
+		var dataDir string
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "host-local")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dataDir)).To(Succeed())
+		})
+
+		load := func(dryRun bool) *sequential.IPAMConfig {
+			conf, err := sequential.LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"name": "dry",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/24",
+					"subnet6": "fd00::/120",
+					"dataDir": %q,
+					"dryRun": %t
+				}
+			}`, dataDir, dryRun)), "")
+			Expect(err).ToNot(HaveOccurred())
+			return conf
+		}
+
+		// snapshot maps every file of the store to its contents
+		snapshot := func() map[string]string {
+			files := map[string]string{}
+			err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				data, err := ioutil.ReadFile(path)
+				files[path] = string(data)
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return files
+		}
+
+		add := func(conf *sequential.IPAMConfig, id string) *types.Result {
+			store, err := disk.New(conf)
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+			r, err := allocate(conf, store, id)
+			Expect(err).ToNot(HaveOccurred())
+			return r
+		}
+
+		It("reports the next addresses without changing the store", func() {
+			add(load(false), "ID1")
+			before := snapshot()
+
+			r := add(load(true), "ID2")
+			Expect(r.IP4.IP.String()).To(Equal("10.0.0.3/24"))
+			Expect(r.IP6.IP.String()).To(Equal("fd00::3/120"))
+			Expect(snapshot()).To(Equal(before))
+
+			// the real ADD gets the addresses the dry run predicted
+			r = add(load(false), "ID2")
+			Expect(r.IP4.IP.String()).To(Equal("10.0.0.3/24"))
+			Expect(r.IP6.IP.String()).To(Equal("fd00::3/120"))
+		})
+	})
+})
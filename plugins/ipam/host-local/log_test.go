@@ -0,0 +1,94 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("debug logging", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-log")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(cmd string) map[string]string {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{
+			"CNI_COMMAND=" + cmd,
+			"CNI_CONTAINERID=dummy",
+			"CNI_NETNS=/var/run/netns/dummy",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/opt/cni/bin",
+		}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "log",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q,
+				"logLevel": "debug"
+			}
+		}`, dataDir))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		var entry map[string]string
+		for _, line := range strings.Split(strings.TrimSpace(string(session.Err.Contents())), "\n") {
+			Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed(), line)
+		}
+		return entry
+	}
+
+	It("logs the container and its addresses on ADD and DEL", func() {
+		fields := map[string]string{
+			"level":       "debug",
+			"network":     "log",
+			"containerID": "dummy",
+			"netns":       "/var/run/netns/dummy",
+			"ifName":      "eth0",
+			"ips":         "10.0.0.2",
+		}
+
+		entry := run("ADD")
+		for k, v := range fields {
+			Expect(entry).To(HaveKeyWithValue(k, v))
+		}
+		Expect(entry).To(HaveKeyWithValue("msg", "allocated addresses"))
+
+		entry = run("DEL")
+		for k, v := range fields {
+			Expect(entry).To(HaveKeyWithValue(k, v))
+		}
+		Expect(entry).To(HaveKeyWithValue("msg", "released addresses"))
+	})
+})
@@ -15,61 +15,446 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/random"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/roundrobin"
 	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/weighted"
+	"github.com/containernetworking/cni/plugins/ipam/notify"
+	"github.com/containernetworking/cni/plugins/ipam/store"
 	"github.com/containernetworking/cni/plugins/ipam/store/disk"
+	"github.com/containernetworking/cni/plugins/ipam/store/etcd"
+	"github.com/containernetworking/cni/plugins/ipam/store/memory"
+	"github.com/containernetworking/cni/plugins/ipam/store/redis"
+	"github.com/containernetworking/cni/plugins/ipam/store/sqlite"
 
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam/log"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	// a garbage collection run replaces the CNI command
+	if age := os.Getenv(gcAgeEnv); age != "" {
+		if err := runGC(os.Stdin, os.Stdout, age); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// so does a consistency check of the disk store
+	if mode := os.Getenv(fsckEnv); mode != "" {
+		if err := runFsck(os.Stdin, os.Stdout, mode); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// and a migration from another store
+	if from := os.Getenv(migrateEnv); from != "" {
+		if err := runMigrate(os.Stdin, os.Stdout, from); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// and a report of the pool
+	if os.Getenv(statusEnv) != "" {
+		if err := runStatus(os.Stdin, os.Stdout); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// and a check for readiness probes
+	if os.Getenv(healthcheckEnv) != "" {
+		if err := runHealthcheck(os.Stdin); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// and the confirmation of a tentative allocation
+	if id := os.Getenv(confirmEnv); id != "" {
+		if err := runConfirm(os.Stdin, id); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	// and the removal of every reservation of a network
+	if network := os.Getenv(clearEnv); network != "" {
+		if err := runClear(os.Stdin, os.Stdout, network); err != nil {
+			e := &types.Error{Code: 100, Msg: err.Error()}
+			e.Print()
+			os.Exit(1)
+		}
+		return
+	}
+	skel.PluginMainWithVersions(cmdAdd, cmdCheck, cmdDel, version.All)
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
 	ipamConf, err := sequential.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
-		return err
+		return configError(err)
+	}
+	// fail before reserving anything that could not be reported
+	if err := types.CheckVersion(ipamConf.CNIVersion); err != nil {
+		return versionError(err)
 	}
 
-	store, err := disk.New(ipamConf)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	allocator, err := sequential.NewIPAllocator(ipamConf, store)
-	if err != nil {
+	logger := commandLogger(ipamConf, args)
+	if err := throttle(ipamConf, store, logger); err != nil {
 		return err
 	}
 
-	ipConf, err := allocator.Get(args.ContainerID)
+	r, err := allocate(ipamConf, store, ipamConf.ReservationID(args.ContainerID))
 	if err != nil {
+		return allocationError(err)
+	}
+
+	if ipamConf.Delegate != nil && !ipamConf.DryRun {
+		if err := delegateAdd(ipamConf, args.StdinData, r, logger); err != nil {
+			if rerr := releaseLocal(ipamConf, store, ipamConf.ReservationID(args.ContainerID)); rerr != nil {
+				return fmt.Errorf("%v; failed to roll back %s: %v", err, r.IP4.IP.IP, rerr)
+			}
+			return err
+		}
+	}
+
+	ips := []net.IP{r.IP4.IP.IP}
+	if r.IP6 != nil {
+		ips = append(ips, r.IP6.IP.IP)
+	}
+	logger.With("ips", joinIPs(ips)).Debugf("allocated addresses")
+	if !ipamConf.DryRun {
+		sendEvents(ipamConf, notify.ActionReserve, args.ContainerID, ips, logger)
+		writeResultFile(ipamConf, args.ContainerID, ips, logger)
+	}
+	return r.PrintVersion(ipamConf.CNIVersion)
+}
+
+// releaseLocal releases the addresses host-local reserved for the
+// container with given ID. It does without an allocator, which refuses
+// a store holding reservations outside of the network, so that a DEL
+// still succeeds after the subnet was shrunk.
+func releaseLocal(ipamConf *sequential.IPAMConfig, store backend.Store, id string) error {
+	if err := store.Lock(); err != nil {
 		return err
 	}
+	defer store.Unlock()
+
+	return sequential.ReleaseByID(ipamConf, store, id)
+}
+
+// commandLogger returns a logger tagged with what identifies the
+// container of a CNI command, so that an allocation can be tied back to
+// its network namespace
+func commandLogger(conf *sequential.IPAMConfig, args *skel.CmdArgs) *log.Logger {
+	// the level was validated by LoadIPAMConfig
+	level, _ := log.ParseLevel(conf.LogLevel)
+	return log.NewStderr(level).
+		With("network", conf.Name).
+		With("containerID", args.ContainerID).
+		With("netns", args.Netns).
+		With("ifName", args.IfName)
+}
+
+func joinIPs(ips []net.IP) string {
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// allocate reserves the addresses for the container with given ID and
+// builds the result to return to the runtime. In dry-run mode the
+// result is worked out the same way but nothing is written to the store.
+func allocate(ipamConf *sequential.IPAMConfig, store backend.Store, id string) (*types.Result, error) {
+	if ipamConf.DryRun {
+		store = backend.NewDryRun(store)
+	}
+
+	if err := sequential.Prime(ipamConf, store); err != nil {
+		return nil, err
+	}
+
+	allocator, err := newAllocator(ipamConf, store)
+	if err != nil {
+		return nil, err
+	}
+
+	ipConf, err := allocator.Get(id)
+	if err != nil {
+		return nil, err
+	}
 
 	r := &types.Result{
 		IP4: ipConf,
+		DNS: ipamConf.DNS,
+	}
+
+	// dual-stack networks get their IPv6 address from the same store
+	if conf6 := ipamConf.IPv6Config(); conf6 != nil {
+		ip6Conf, err := allocateIPv6(conf6, store, id)
+		if err != nil {
+			// never leave a half-assigned pair behind
+			if rerr := allocator.ReleaseIP(id, ipConf.IP.IP); rerr != nil {
+				return nil, fmt.Errorf("%w; failed to roll back %s: %v", err, ipConf.IP.IP, rerr)
+			}
+			return nil, err
+		}
+		r.IP6 = ip6Conf
+	}
+	if ipamConf.DNSFromSubnet && isEmptyDNS(r.DNS) {
+		r.DNS.Nameservers = subnetNameservers(r)
 	}
-	return r.Print()
+	return r, nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+// subnetNameservers returns the DNS servers of dnsFromSubnet for the
+// addresses of r: the address following the gateway of each, which the
+// allocators never hand out
+func subnetNameservers(r *types.Result) []string {
+	var servers []string
+	for _, c := range []*types.IPConfig{r.IP4, r.IP6} {
+		if c != nil && c.Gateway != nil {
+			servers = append(servers, ip.NextIP(c.Gateway).String())
+		}
+	}
+	return servers
+}
+
+func allocateIPv6(conf *sequential.IPAMConfig, store backend.Store, id string) (*types.IPConfig, error) {
+	allocator, err := newAllocator(conf, store)
+	if err != nil {
+		return nil, err
+	}
+	return allocator.Get(id)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
 	ipamConf, err := sequential.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
 
-	store, err := disk.New(ipamConf)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
+	var expected net.IP
+	if r := ipamConf.PrevResult; r != nil && r.IP4 != nil {
+		expected = r.IP4.IP.IP
+	}
+
+	if len(ipamConf.Subnets) > 0 {
+		allocator, err := weighted.NewIPAllocator(ipamConf, store)
+		if err != nil {
+			return err
+		}
+		return allocator.Check(ipamConf.ReservationID(args.ContainerID), expected)
+	}
+
+	// reservations are checked the same way regardless of the
+	// strategy used to allocate them
 	allocator, err := sequential.NewIPAllocator(ipamConf, store)
 	if err != nil {
 		return err
 	}
 
-	return allocator.Release(args.ContainerID)
+	if err := allocator.Check(ipamConf.ReservationID(args.ContainerID), expected); err != nil {
+		return err
+	}
+
+	if conf6 := ipamConf.IPv6Config(); conf6 != nil {
+		allocator6, err := sequential.NewIPAllocator(conf6, store)
+		if err != nil {
+			return err
+		}
+		var expected6 net.IP
+		if r := ipamConf.PrevResult; r != nil && r.IP6 != nil {
+			expected6 = r.IP6.IP.IP
+		}
+		return allocator6.Check(ipamConf.ReservationID(args.ContainerID), expected6)
+	}
+	return nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	ipamConf, err := sequential.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return configError(err)
+	}
+
+	logger := commandLogger(ipamConf, args)
+	err = release(ipamConf, args, logger)
+
+	// the delegate holds addresses of its own, so it is torn down even
+	// if the local release failed
+	if ipamConf.Delegate != nil && !ipamConf.DryRun {
+		err = errors.Join(err, delegateDel(ipamConf, args.StdinData))
+	}
+	if err != nil {
+		return err
+	}
+	// strict runtimes parse the output of DEL as well, so print an empty
+	// result rather than nothing
+	return (&types.Result{}).Print()
+}
+
+// release releases the addresses host-local holds for the container of
+// a DEL command
+func release(ipamConf *sequential.IPAMConfig, args *skel.CmdArgs, logger *log.Logger) error {
+	// a store that turned read-only or conflicts with the network must
+	// not block the teardown of the container, so release what can be
+	// released and log the rest
+	store, err := newStore(ipamConf)
+	var notWritable *disk.NotWritableError
+	var conflict *disk.NetworkConflictError
+	if errors.As(err, &notWritable) || errors.As(err, &conflict) {
+		logger.Warnf("%v; releasing anyway", err)
+		if store, err = disk.Open(ipamConf); err != nil {
+			logger.Warnf("failed to open the store, skipping release: %v", err)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var held []net.IP
+	if logger.Enabled(log.LevelDebug) || ipamConf.NotifySocket != "" {
+		// only look up what is released when it is going to be logged
+		// or reported
+		if held, err = store.GetByID(ipamConf.ReservationID(args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
+	// the IPv6 address of a dual-stack network lives in the same store,
+	// so this releases both families
+	if err := releaseLocal(ipamConf, store, ipamConf.ReservationID(args.ContainerID)); err != nil {
+		if notWritable == nil {
+			return err
+		}
+		logger.Warnf("failed to release addresses: %v", err)
+		return nil
+	}
+	logger.With("ips", joinIPs(held)).Debugf("released addresses")
+	sendEvents(ipamConf, notify.ActionRelease, args.ContainerID, held, logger)
+	return nil
+}
+
+// sendEvents reports the action on ips to the "notifySocket", if one is
+// configured. A failure is only logged, so that an agent that is down
+// or slow never fails the command.
+func sendEvents(ipamConf *sequential.IPAMConfig, action, containerID string, ips []net.IP, logger *log.Logger) {
+	if ipamConf.NotifySocket == "" || len(ips) == 0 {
+		return
+	}
+	events := make([]notify.Event, len(ips))
+	for i, ip := range ips {
+		events[i] = notify.Event{Action: action, IP: ip, ContainerID: containerID, Network: ipamConf.Name}
+	}
+	if err := notify.Send(ipamConf.NotifySocket, events...); err != nil {
+		logger.Warnf("failed to send events to %s: %v", ipamConf.NotifySocket, err)
+	}
+}
+
+// newAllocator returns the allocator selected by the "strategy" field
+func newAllocator(conf *sequential.IPAMConfig, store backend.Store) (allocator.Allocator, error) {
+	if len(conf.Subnets) > 0 {
+		// each subnet of a weighted network is scanned sequentially
+		if conf.Strategy != "" && conf.Strategy != "sequential" {
+			return nil, fmt.Errorf("allocation strategy %q cannot be combined with %q", conf.Strategy, "subnets")
+		}
+		a, err := weighted.NewIPAllocator(conf, store)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	switch conf.Strategy {
+	case "", "sequential":
+		a, err := sequential.NewIPAllocator(conf, store)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	case "random":
+		a, err := random.NewIPAllocator(conf, store)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	case "roundrobin":
+		a, err := roundrobin.NewIPAllocator(conf, store)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy %q", conf.Strategy)
+	}
+}
+
+// newStore returns the store backend selected by the "store" field
+func newStore(conf *sequential.IPAMConfig) (backend.Store, error) {
+	switch conf.Store {
+	case "", "disk":
+		s, err := disk.New(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return memory.New(), nil
+	case "etcd":
+		s, err := etcd.New(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "redis":
+		s, err := redis.New(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "sqlite":
+		s, err := sqlite.New(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", conf.Store)
+	}
 }
@@ -0,0 +1,100 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+	"github.com/containernetworking/cni/plugins/ipam/store/disk"
+)
+
+// migrateEnv selects a migration of the reservations of the network
+// from the named store into the store configured on stdin instead of a
+// CNI command
+const migrateEnv = "HOST_LOCAL_MIGRATE_FROM"
+
+// migrateResult lists the reservations of the source store by what
+// became of them in the target store
+type migrateResult struct {
+	Migrated  []gcReservation `json:"migrated"`
+	Skipped   []gcReservation `json:"skipped"`
+	Conflicts []gcReservation `json:"conflicts"`
+}
+
+// runMigrate copies the reservations of the network configured on
+// stdin from the source store into the configured store and prints the
+// outcome to stdout. In dry-run mode the target is left untouched.
+func runMigrate(stdin io.Reader, stdout io.Writer, from string) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	if storeType(from) == storeType(ipamConf.Store) {
+		return fmt.Errorf("%s must name another store than the configured %q", migrateEnv, storeType(ipamConf.Store))
+	}
+
+	srcConf := *ipamConf
+	srcConf.Store = from
+	var src backend.Store
+	if storeType(from) == "disk" {
+		// the source is only read, so it need not be writable
+		src, err = disk.Open(&srcConf)
+	} else {
+		src, err = newStore(&srcConf)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open the %s store: %v", storeType(from), err)
+	}
+	defer src.Close()
+
+	dst, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if ipamConf.DryRun {
+		dst = backend.NewDryRun(dst)
+	}
+
+	migrated, err := backend.Migrate(src, dst)
+	if err != nil {
+		return err
+	}
+
+	res := migrateResult{
+		Migrated:  gcReservations(migrated.Migrated),
+		Skipped:   gcReservations(migrated.Skipped),
+		Conflicts: gcReservations(migrated.Conflicts),
+	}
+	return json.NewEncoder(stdout).Encode(res)
+}
+
+// storeType returns the store selected by a "store" field, where an
+// empty one selects the disk store
+func storeType(name string) string {
+	if name == "" {
+		return "disk"
+	}
+	return name
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("store migration", func() {
+	It("refuses to migrate a store into itself", func() {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{"HOST_LOCAL_MIGRATE_FROM=disk"}
+		command.Stdin = strings.NewReader(`{
+			"name": "migrate",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": "/tmp/host-local-migrate"
+			}
+		}`)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`HOST_LOCAL_MIGRATE_FROM must name another store than the configured \"disk\"`))
+	})
+})
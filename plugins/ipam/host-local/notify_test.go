@@ -0,0 +1,100 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/notify"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("notifySocket", func() {
+	var (
+		dataDir  string
+		listener *notify.Listener
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-notify")
+		Expect(err).ToNot(HaveOccurred())
+		listener, err = notify.Listen(filepath.Join(dataDir, "events.sock"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listener.SetDeadline(time.Now().Add(10 * time.Second))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			Expect(listener.Close()).To(Succeed())
+		}
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(command string) {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=dummy",
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "notify",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q,
+				"notifySocket": %q
+			}
+		}`, dataDir, filepath.Join(dataDir, "events.sock")))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+	}
+
+	It("reports the allocation and the release of an address", func() {
+		run("ADD")
+		e, err := listener.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Action).To(Equal("reserve"))
+		Expect(e.IP.String()).To(Equal("10.0.0.2"))
+		Expect(e.ContainerID).To(Equal("dummy"))
+		Expect(e.Network).To(Equal("notify"))
+
+		run("DEL")
+		e, err = listener.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Action).To(Equal("release"))
+		Expect(e.IP.String()).To(Equal("10.0.0.2"))
+		Expect(e.ContainerID).To(Equal("dummy"))
+	})
+
+	It("does not fail the command without a listener", func() {
+		Expect(listener.Close()).To(Succeed())
+		listener = nil
+		run("ADD")
+	})
+})
@@ -0,0 +1,100 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("reservations keyed on the pod UID", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-podkey")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(command, id, uid, key string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+			"CNI_ARGS=IgnoreUnknown=1;K8S_POD_UID=" + uid,
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "podkey",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q,
+				"reservationKey": %q
+			}
+		}`, dataDir, key))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	add := func(id, uid, key string) string {
+		session := run("ADD", id, uid, key)
+		Eventually(session).Should(gexec.Exit(0))
+		var res struct {
+			IP4 struct {
+				IP string `json:"ip"`
+			} `json:"ip4"`
+		}
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		return res.IP4.IP
+	}
+
+	It("gives a pod restarted under a new container ID its previous address", func() {
+		Expect(add("container1", "pod-a", "podUID")).To(Equal("10.0.0.2/24"))
+		Expect(add("container2", "pod-a", "podUID")).To(Equal("10.0.0.2/24"))
+		Expect(add("container3", "pod-b", "podUID")).To(Equal("10.0.0.3/24"))
+
+		contents, err := ioutil.ReadFile(filepath.Join(dataDir, "podkey", "10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Split(string(contents), "\n")[0]).To(Equal("pod-a"))
+
+		Eventually(run("DEL", "container2", "pod-a", "podUID")).Should(gexec.Exit(0))
+		_, err = os.Stat(filepath.Join(dataDir, "podkey", "10.0.0.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(filepath.Join(dataDir, "podkey", "10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("keys on the container ID by default", func() {
+		Expect(add("container1", "pod-a", "containerID")).To(Equal("10.0.0.2/24"))
+		Expect(add("container2", "pod-a", "containerID")).To(Equal("10.0.0.3/24"))
+	})
+})
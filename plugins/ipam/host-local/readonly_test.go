@@ -0,0 +1,81 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("a store that is not writable", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-ro")
+		Expect(err).ToNot(HaveOccurred())
+		// a file where the network directory should be keeps the store
+		// from being created even when running as root
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "ro"), nil, 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(cmd string) *gexec.Session {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{
+			"CNI_COMMAND=" + cmd,
+			"CNI_CONTAINERID=dummy",
+			"CNI_NETNS=/var/run/netns/dummy",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/opt/cni/bin",
+		}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "ro",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("fails ADD with the cause", func() {
+		session := run("ADD")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(fmt.Sprintf("IPAM store directory %s is not writable", filepath.Join(dataDir, "ro"))))
+	})
+
+	It("logs the failure but lets DEL succeed", func() {
+		session := run("DEL")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Out.Contents()).To(MatchJSON("{}"))
+		Expect(string(session.Err.Contents())).To(ContainSubstring("is not writable"))
+		Expect(string(session.Err.Contents())).To(ContainSubstring("skipping release"))
+	})
+})
@@ -0,0 +1,77 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("a shrunk subnet", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-resize")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dataDir, "resize"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "resize", "10.0.0.200"), []byte("outside"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(command, id string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "resize",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/25",
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("fails an ADD until the reservations outside of it are released", func() {
+		session := run("ADD", "new")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring("reserved IP 10.0.0.200 is outside of network: resize"))
+
+		// DEL does not check the reservations, so the old container can
+		// still be torn down
+		Eventually(run("DEL", "outside")).Should(gexec.Exit(0))
+		Eventually(run("ADD", "new")).Should(gexec.Exit(0))
+	})
+})
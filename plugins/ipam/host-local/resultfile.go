@@ -0,0 +1,70 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/ipam/log"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// resultFileContent is what an ADD leaves in the resultFile
+type resultFileContent struct {
+	ContainerID string   `json:"containerID"`
+	Network     string   `json:"network"`
+	IPs         []net.IP `json:"ips"`
+}
+
+// writeResultFile replaces the resultFile, if one is configured, with
+// the addresses allocated to the container. A failure is logged rather
+// than failing the ADD, whose addresses are reserved by then.
+func writeResultFile(ipamConf *sequential.IPAMConfig, containerID string, ips []net.IP, logger *log.Logger) {
+	if ipamConf.ResultFile == "" {
+		return
+	}
+	data, err := json.Marshal(resultFileContent{containerID, ipamConf.Name, ips})
+	if err == nil {
+		err = replaceFile(ipamConf.ResultFile, data)
+	}
+	if err != nil {
+		logger.Warnf("failed to write result file %s: %v", ipamConf.ResultFile, err)
+	}
+}
+
+// replaceFile writes data to a temporary file next to path and renames
+// it into place, so that readers never see a partial write
+func replaceFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
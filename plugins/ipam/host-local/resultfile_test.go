@@ -0,0 +1,101 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("resultFile", func() {
+	var dataDir, resultFile string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-resultfile")
+		Expect(err).ToNot(HaveOccurred())
+		resultFile = filepath.Join(dataDir, "last-result.json")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	add := func(id string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "resultfile",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q,
+				"resultFile": %q
+			}
+		}`, dataDir, resultFile))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+		return session
+	}
+
+	type content struct {
+		ContainerID string   `json:"containerID"`
+		Network     string   `json:"network"`
+		IPs         []string `json:"ips"`
+	}
+
+	read := func() content {
+		data, err := ioutil.ReadFile(resultFile)
+		Expect(err).ToNot(HaveOccurred())
+		var c content
+		Expect(json.Unmarshal(data, &c)).To(Succeed())
+		return c
+	}
+
+	It("holds the address of the last ADD", func() {
+		add("first")
+		Expect(read()).To(Equal(content{"first", "resultfile", []string{"10.0.0.2"}}))
+
+		add("second")
+		Expect(read()).To(Equal(content{"second", "resultfile", []string{"10.0.0.3"}}))
+
+		// no temporary files are left behind
+		matches, err := filepath.Glob(filepath.Join(dataDir, ".last-result.json*"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(matches).To(BeEmpty())
+	})
+
+	It("does not fail the ADD if the file cannot be written", func() {
+		resultFile = filepath.Join(dataDir, "missing", "last-result.json")
+		session := add("first")
+		Expect(string(session.Err.Contents())).To(ContainSubstring("failed to write result file " + resultFile))
+	})
+})
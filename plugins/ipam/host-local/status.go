@@ -0,0 +1,124 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// statusEnv selects a report of the pool of the network configured on
+// stdin instead of a CNI command. The store is only read.
+const statusEnv = "HOST_LOCAL_STATUS"
+
+// statusResult is the pool report printed to stdout:
+//
+//	{
+//	  "network": "mynet",
+//	  "subnet": "10.1.2.0/24",
+//	  "gateway": "10.1.2.1",
+//	  "total": 253,
+//	  "used": 2,
+//	  "free": 251,
+//	  "reservations": [
+//	    {"ip": "10.1.2.2", "containerID": "...", "reservedAt": "...", "label": "..."}
+//	  ]
+//	}
+//
+// total counts the allocatable addresses of the ranges, leaving out the
+// gateway and excluded IPs; ranges too large to count report the
+// largest int. used counts the reservations within them, and
+// reservations lists every reservation of the network, including ones
+// outside of the ranges. gateway is omitted if the network has none.
+type statusResult struct {
+	Network      string          `json:"network"`
+	Subnet       string          `json:"subnet"`
+	Gateway      string          `json:"gateway,omitempty"`
+	Total        int             `json:"total"`
+	Used         int             `json:"used"`
+	Free         int             `json:"free"`
+	Reservations []gcReservation `json:"reservations"`
+}
+
+// runStatus prints a report of the pool of the network configured on
+// stdin to stdout
+func runStatus(stdin io.Reader, stdout io.Writer) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	ipamConf, err := sequential.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	res, err := status(ipamConf, store)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(stdout).Encode(res)
+}
+
+// status works out the report under the store lock, so that the counts
+// and the reservations listed agree
+func status(ipamConf *sequential.IPAMConfig, store backend.Store) (*statusResult, error) {
+	ranges, err := sequential.Ranges(ipamConf)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := sequential.Exclusions(ipamConf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	total, used, err := sequential.Usage(ipamConf, store, ranges, exclude)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &statusResult{
+		Network:      ipamConf.Name,
+		Subnet:       (*net.IPNet)(&ipamConf.Subnet).String(),
+		Total:        total,
+		Used:         used,
+		Free:         total - used,
+		Reservations: gcReservations(reservations),
+	}
+	if gw := ipamConf.GatewayIP(); gw != nil {
+		res.Gateway = gw.String()
+	}
+	return res, nil
+}
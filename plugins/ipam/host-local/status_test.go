@@ -0,0 +1,104 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("status", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-status")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dataDir, "status"), 0700)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(ip, id string) {
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "status", ip), []byte(id), 0644)).To(Succeed())
+	}
+
+	run := func() *gexec.Session {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{"HOST_LOCAL_STATUS=1"}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "status",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/28",
+				"rangeStart": "10.0.0.2",
+				"rangeEnd": "10.0.0.10",
+				"excludeIPs": ["10.0.0.5"],
+				"dataDir": %q
+			}
+		}`, dataDir))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("reports the usage of the pool without changing the store", func() {
+		reserve("10.0.0.2", "a")
+		reserve("10.0.0.3", "b")
+		// excluded and out-of-range reservations are listed but not counted
+		reserve("10.0.0.5", "c")
+		reserve("10.0.0.12", "d")
+
+		session := run()
+		Eventually(session).Should(gexec.Exit(0))
+
+		var res struct {
+			Network      string `json:"network"`
+			Subnet       string `json:"subnet"`
+			Gateway      string `json:"gateway"`
+			Total        int    `json:"total"`
+			Used         int    `json:"used"`
+			Free         int    `json:"free"`
+			Reservations []struct {
+				IP          string `json:"ip"`
+				ContainerID string `json:"containerID"`
+			} `json:"reservations"`
+		}
+		Expect(json.Unmarshal(session.Out.Contents(), &res)).To(Succeed())
+		Expect(res.Network).To(Equal("status"))
+		Expect(res.Subnet).To(Equal("10.0.0.0/28"))
+		Expect(res.Gateway).To(Equal("10.0.0.1"))
+		// .2 to .10 less the excluded .5
+		Expect(res.Total).To(Equal(8))
+		Expect(res.Used).To(Equal(2))
+		Expect(res.Free).To(Equal(6))
+		Expect(res.Reservations).To(HaveLen(4))
+
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "status"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(4))
+	})
+})
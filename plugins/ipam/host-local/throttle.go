@@ -0,0 +1,51 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ipam/log"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// throttle holds an ADD back until the allocation rate limit of the
+// network lets it through, so that a burst of ADDs does not pile up on
+// the store lock. It fails if the wait would exceed the lock timeout.
+// Dry runs are not limited, as they reserve nothing.
+func throttle(conf *sequential.IPAMConfig, store backend.Store, logger *log.Logger) error {
+	if conf.AllocationsPerSecond == 0 || conf.DryRun {
+		return nil
+	}
+	t, ok := store.(backend.Throttler)
+	if !ok {
+		return fmt.Errorf("allocationsPerSecond is not supported by the %s store", storeType(conf.Store))
+	}
+
+	wait, ok, err := t.TakeToken(conf.AllocationsPerSecond, conf.Burst(), time.Duration(conf.LockTimeout), time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("allocation rate limit of %g per second exceeded in network: %s", conf.AllocationsPerSecond, conf.Name)
+	}
+	if wait > 0 {
+		logger.Debugf("waiting %s for the allocation rate limit", wait)
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("allocation rate limit", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-throttle")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	add := func(id, limits string) *gexec.Session {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		command.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "throttled",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q,
+				%s
+			}
+		}`, dataDir, limits))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("throttles rapid allocations to the configured rate", func() {
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			Eventually(add(fmt.Sprintf("id%d", i), `"allocationsPerSecond": 10`), 5*time.Second).Should(gexec.Exit(0))
+		}
+		// the first ADD goes through at once, the others 100ms apart
+		Expect(time.Since(start)).To(BeNumerically(">=", 350*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically("<", 3*time.Second))
+	})
+
+	It("fails an ADD that would wait longer than the lock timeout", func() {
+		limits := `"allocationsPerSecond": 1, "lockTimeout": "100ms"`
+		Eventually(add("id0", limits)).Should(gexec.Exit(0))
+		session := add("id1", limits)
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring("allocation rate limit of 1 per second exceeded in network: throttled"))
+	})
+})
@@ -0,0 +1,109 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("VERSION", func() {
+	It("advertises the supported spec versions", func() {
+		command := exec.Command(pathToHostLocal)
+		command.Env = []string{"CNI_COMMAND=VERSION"}
+
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		var info struct {
+			CNIVersion        string   `json:"cniVersion"`
+			SupportedVersions []string `json:"supportedVersions"`
+		}
+		Expect(json.Unmarshal(session.Out.Contents(), &info)).To(Succeed())
+		Expect(info.CNIVersion).To(Equal("0.2.0"))
+		Expect(info.SupportedVersions).To(Equal([]string{"0.1.0", "0.2.0", "0.3.0"}))
+	})
+})
+
+var _ = Describe("the result of an ADD", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-version")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	add := func(cniVersion, id string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=" + id,
+			"CNI_NETNS=/some/where",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"cniVersion": %q,
+			"name": "version",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/24",
+				"dataDir": %q
+			}
+		}`, cniVersion, dataDir))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	It("is printed in the format of the requested spec version", func() {
+		session := add("0.2.0", "first")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(`{
+			"ip4": {"ip": "10.0.0.2/24", "gateway": "10.0.0.1"}
+		}`))
+
+		session = add("0.3.0", "second")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(`{
+			"cniVersion": "0.3.0",
+			"ips": [{"version": "4", "address": "10.0.0.3/24", "gateway": "10.0.0.1"}]
+		}`))
+	})
+
+	It("fails for an unsupported version without reserving an IP", func() {
+		session := add("9.9.9", "dummy")
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`unsupported CNI version \"9.9.9\"`))
+
+		_, err := os.Stat(dataDir + "/version/10.0.0.2")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,112 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify carries reservation changes of host-local to a
+// node-local agent over a Unix datagram socket, one JSON event per
+// datagram.
+package notify
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+)
+
+// The actions of an Event
+const (
+	ActionReserve = "reserve"
+	ActionRelease = "release"
+)
+
+// Event reports that ip was reserved for or released by a container
+type Event struct {
+	Action      string `json:"action"`
+	IP          net.IP `json:"ip"`
+	ContainerID string `json:"containerID"`
+	Network     string `json:"network,omitempty"`
+}
+
+// sendTimeout bounds how long Send waits on a reader that does not keep
+// up, so that a stuck agent cannot hold up the plugin
+var sendTimeout = 100 * time.Millisecond
+
+// Send writes each of events to the datagram socket at path. It gives
+// up on the first event that cannot be delivered.
+func Send(path string, events ...Event) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(sendTimeout)); err != nil {
+		return err
+	}
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxEventSize bounds the size of a datagram Next reads
+const maxEventSize = 4096
+
+// Listener receives the events sent to its socket
+type Listener struct {
+	conn *net.UnixConn
+	path string
+}
+
+// Listen creates the datagram socket at path and returns a Listener for
+// it. The socket is removed again by Close.
+func Listen(path string) (*Listener, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{conn: conn, path: path}, nil
+}
+
+// Next blocks until the next event arrives and returns it
+func (l *Listener) Next() (Event, error) {
+	buf := make([]byte, maxEventSize)
+	n, err := l.conn.Read(buf)
+	if err != nil {
+		return Event{}, err
+	}
+	var e Event
+	err = json.Unmarshal(buf[:n], &e)
+	return e, err
+}
+
+// SetDeadline makes Next fail once t has passed
+func (l *Listener) SetDeadline(t time.Time) error {
+	return l.conn.SetReadDeadline(t)
+}
+
+// Close closes the socket and removes it
+func (l *Listener) Close() error {
+	err := l.conn.Close()
+	if rerr := os.Remove(l.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
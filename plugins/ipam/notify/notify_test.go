@@ -0,0 +1,95 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("notify", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "host-local-notify")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "events.sock")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("delivers each event to the listener", func() {
+		l, err := Listen(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer l.Close()
+
+		Expect(Send(path,
+			Event{Action: ActionReserve, IP: net.ParseIP("10.0.0.2"), ContainerID: "a", Network: "net"},
+			Event{Action: ActionRelease, IP: net.ParseIP("10.0.0.3"), ContainerID: "b"},
+		)).To(Succeed())
+
+		Expect(l.SetDeadline(time.Now().Add(time.Second))).To(Succeed())
+		e, err := l.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Action).To(Equal(ActionReserve))
+		Expect(e.IP.String()).To(Equal("10.0.0.2"))
+		Expect(e.ContainerID).To(Equal("a"))
+		Expect(e.Network).To(Equal("net"))
+
+		e, err = l.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Action).To(Equal(ActionRelease))
+		Expect(e.IP.String()).To(Equal("10.0.0.3"))
+	})
+
+	It("fails to send without a listener", func() {
+		Expect(Send(path, Event{Action: ActionReserve})).ToNot(Succeed())
+	})
+
+	It("gives up on a listener that does not read", func() {
+		saved := sendTimeout
+		sendTimeout = 10 * time.Millisecond
+		defer func() { sendTimeout = saved }()
+
+		l, err := Listen(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer l.Close()
+
+		events := make([]Event, 100000)
+		done := make(chan error, 1)
+		go func() { done <- Send(path, events...) }()
+		Eventually(done, 5*time.Second).Should(Receive(HaveOccurred()))
+	})
+
+	It("removes the socket on close", func() {
+		l, err := Listen(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l.Close()).To(Succeed())
+		_, err = os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -22,6 +22,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
 	"github.com/hashicorp/consul/api"
 )
 
@@ -198,25 +199,48 @@ func LeaseJson(ip net.IP, id string) (conf []byte, err error) {
 	return conf, err
 }
 
-func (s *Store) Reserve(id string, ip net.IP) (bool, error) {
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
 	// get consul KV
 	kv := s.Consul.KV()
 	// create path
 	path := s.Key + "/" + fmt.Sprintf("%s", ip)
 	pair, _ := GetKV(path, kv)
-	// if key exists return false
+	// if key exists only its owner may reserve it again
 	if len(pair) != 0 {
-		return false, nil
+		for _, p := range pair {
+			if p.Key != path {
+				continue
+			}
+			var lease Lease
+			if err := json.Unmarshal(p.Value, &lease); err != nil {
+				return false, "", err
+			}
+			return lease.Id == id, lease.Id, nil
+		}
+		return false, "", nil
 	}
 	// otherwise create a byte object and put
 	b, _ := LeaseJson(ip, id)
 	PutKV(path, b, kv)
-	return true, nil
+	return true, id, nil
 }
 
-// LastReservedIP returns the last reserved IP if exists
-func (s *Store) LastReservedIP() (net.IP, error) {
+// LastReservedIP returns the last reserved IP of the given range or,
+// failing that, of the given family if exists
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
 	kv := s.Consul.KV()
+	pair, _, err := kv.Get(s.lastInRangeKey(rangeID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil {
+		var lease Lease
+		if err := json.Unmarshal(pair.Value, &lease); err != nil {
+			return nil, err
+		}
+		return lease.IP, nil
+	}
+
 	pairs, _ := GetKV(s.Key, kv)
 
 	var lease Lease
@@ -229,6 +253,9 @@ func (s *Store) LastReservedIP() (net.IP, error) {
 		if err := json.Unmarshal(pair.Value, &lease); err != nil {
 			return nil, err
 		}
+		if (lease.IP.To4() == nil) != v6 {
+			continue
+		}
 		if lease.Timestamp > prev_TS {
 			latest_ip = pair.Key
 		}
@@ -236,6 +263,114 @@ func (s *Store) LastReservedIP() (net.IP, error) {
 	return net.ParseIP(latest_ip), nil
 }
 
+// SetLastReservedIP records ip as the last reserved IP of the range.
+// Like the high-water mark it is kept as a lease without an ID.
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	b, err := json.Marshal(Lease{IP: ip})
+	if err != nil {
+		return err
+	}
+	_, err = PutKV(s.lastInRangeKey(rangeID), b, s.Consul.KV())
+	return err
+}
+
+func (s *Store) lastInRangeKey(rangeID string) string {
+	return s.Key + "/last_reserved_range/" + rangeID
+}
+
+// HighWaterMark returns the high-water mark of the given family if
+// exists
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	kv := s.Consul.KV()
+	pair, _, err := kv.Get(s.highWaterMarkKey(v6), nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	var lease Lease
+	if err := json.Unmarshal(pair.Value, &lease); err != nil {
+		return nil, err
+	}
+	return lease.IP, nil
+}
+
+// SetHighWaterMark records ip as the high-water mark of its family. It
+// is kept as a lease without an ID so it is skipped alongside the
+// network settings when leases are scanned.
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	b, err := json.Marshal(Lease{IP: ip})
+	if err != nil {
+		return err
+	}
+	_, err = PutKV(s.highWaterMarkKey(ip.To4() == nil), b, s.Consul.KV())
+	return err
+}
+
+// freedIPs is the stack of freed IPs of a family, most recently freed
+// last. Like the high-water mark it has no ID, so it is skipped when
+// leases are scanned.
+type freedIPs struct {
+	IPs []net.IP `json:"freed"`
+}
+
+func (s *Store) getFreed(v6 bool) ([]net.IP, error) {
+	pair, _, err := s.Consul.KV().Get(s.freedKey(v6), nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	var freed freedIPs
+	if err := json.Unmarshal(pair.Value, &freed); err != nil {
+		return nil, err
+	}
+	return freed.IPs, nil
+}
+
+func (s *Store) putFreed(v6 bool, ips []net.IP) error {
+	b, err := json.Marshal(freedIPs{IPs: ips})
+	if err != nil {
+		return err
+	}
+	_, err = PutKV(s.freedKey(v6), b, s.Consul.KV())
+	return err
+}
+
+// PushFreed records ip as the most recently freed IP of its family.
+// The caller must hold the store lock.
+func (s *Store) PushFreed(ip net.IP) error {
+	v6 := ip.To4() == nil
+	stack, err := s.getFreed(v6)
+	if err != nil {
+		return err
+	}
+	return s.putFreed(v6, append(backend.RemoveIP(stack, ip), ip))
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none. The caller must hold the store lock.
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	stack, err := s.getFreed(v6)
+	if err != nil || len(stack) == 0 {
+		return nil, err
+	}
+	if err := s.putFreed(v6, stack[:len(stack)-1]); err != nil {
+		return nil, err
+	}
+	return stack[len(stack)-1], nil
+}
+
+func (s *Store) freedKey(v6 bool) string {
+	if v6 {
+		return s.Key + "/freed_ips6"
+	}
+	return s.Key + "/freed_ips"
+}
+
+func (s *Store) highWaterMarkKey(v6 bool) string {
+	if v6 {
+		return s.Key + "/high_water_mark6"
+	}
+	return s.Key + "/high_water_mark"
+}
+
 func (s *Store) Release(ip net.IP) error {
 	kv := s.Consul.KV()
 	path := s.Key + "/" + fmt.Sprintf("%s", ip)
@@ -261,6 +396,115 @@ func (s *Store) ReleaseByID(id string) error {
 	return nil
 }
 
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	kv := s.Consul.KV()
+	path := s.Key + "/" + fmt.Sprintf("%s", ip)
+	pair, _, err := kv.Get(path, nil)
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+
+	var lease Lease
+	if err := json.Unmarshal(pair.Value, &lease); err != nil {
+		return err
+	}
+	if lease.Id != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	_, err = kv.Delete(path, nil)
+	return err
+}
+
+// ChangeOwner rewrites the lease of ip for the container with ID to,
+// using check-and-set so that it fails if the lease changed since it
+// was read
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	kv := s.Consul.KV()
+	path := s.Key + "/" + fmt.Sprintf("%s", ip)
+	pair, _, err := kv.Get(path, nil)
+	if err != nil || pair == nil {
+		return false, err
+	}
+
+	var lease Lease
+	if err := json.Unmarshal(pair.Value, &lease); err != nil {
+		return false, err
+	}
+	if lease.Id != from {
+		return false, nil
+	}
+	b, err := LeaseJson(ip, to)
+	if err != nil {
+		return false, err
+	}
+	ok, _, err := kv.CAS(&api.KVPair{Key: path, Value: b, ModifyIndex: pair.ModifyIndex}, nil)
+	return ok, err
+}
+
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	kv := s.Consul.KV()
+	pairs, _ := GetKV(s.Key, kv)
+
+	var ips []net.IP
+
+	for _, pair := range pairs {
+		var lease Lease
+		if err := json.Unmarshal(pair.Value, &lease); err != nil {
+			return nil, err
+		}
+		if lease.Id == id {
+			ips = append(ips, lease.IP)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	kv := s.Consul.KV()
+	pairs, _ := GetKV(s.Key, kv)
+
+	var freed []net.IP
+
+	for _, pair := range pairs {
+		var lease Lease
+		if err := json.Unmarshal(pair.Value, &lease); err != nil {
+			return freed, err
+		}
+		if lease.Id == "" || lease.Id == backend.PreReservedID || lease.Timestamp >= before.Unix() {
+			continue
+		}
+		if _, err := kv.Delete(pair.Key, nil); err != nil {
+			return freed, err
+		}
+		freed = append(freed, lease.IP)
+	}
+	return freed, nil
+}
+
+// List returns every reservation in the store
+func (s *Store) List() ([]backend.Reservation, error) {
+	kv := s.Consul.KV()
+	pairs, _ := GetKV(s.Key, kv)
+
+	var list []backend.Reservation
+
+	for _, pair := range pairs {
+		var lease Lease
+		if err := json.Unmarshal(pair.Value, &lease); err != nil {
+			return nil, err
+		}
+		// the network settings live under the store key itself
+		if lease.Id == "" {
+			continue
+		}
+		list = append(list, backend.Reservation{IP: lease.IP, ID: lease.Id, ReservedAt: time.Unix(lease.Timestamp, 0)})
+	}
+	return list, nil
+}
+
 func (s *Store) Close() error {
 	// stub we don't need close anything
 	return nil
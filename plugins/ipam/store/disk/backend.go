@@ -15,97 +15,972 @@
 package disk
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
 )
 
-const lastIPFile = "last_reserved_ip"
+// lastIPFile holds the last reserved IPv4 address and lastIP6File the
+// last reserved IPv6 address
+const (
+	lastIPFile  = "last_reserved_ip"
+	lastIP6File = "last_reserved_ip6"
+)
+
+// highWaterMarkFile and highWaterMark6File hold the round-robin
+// allocator's high-water mark of each family
+const (
+	highWaterMarkFile  = "high_water_mark"
+	highWaterMark6File = "high_water_mark6"
+)
+
+// freedIPFile and freedIP6File hold the stack of freed IPs of each
+// family for the "lifo" reuse mode
+const (
+	freedIPFile  = "freed_ips"
+	freedIP6File = "freed_ips6"
+)
+
+// tokensFile holds the token bucket of the allocation rate limit
+const tokensFile = "allocation_tokens"
 
 var defaultDataDir = "/var/lib/cni/networks"
 
+// Store keeps a file per reserved IP. Reserve claims an IP by linking
+// a complete reservation file into place, which fails if the IP is
+// already taken, so two plugins never reserve the same IP even without
+// the lock. The operations that remove, move or update the bookkeeping
+// files take the store's file lock on their own, and may also be
+// called by a holder of it; since a reservation file is only replaced
+// by ChangeOwner under the lock, an owner read under the lock stays
+// valid until the lock is released.
 type Store struct {
-	FileLock
+	lock    *FileLock
 	dataDir string
+	// hashFilenames names reservation files after a hash of the IP,
+	// which is then recorded in the file
+	hashFilenames bool
+	// label is recorded in the files of the reservations made
+	label string
+	// sync fsyncs the files written and the data directory, so that
+	// reservations survive a power loss
+	sync bool
+	// jsonFormat writes reservation files as JSON rather than lines
+	jsonFormat bool
+	// shardPrefix, if set, places reservation files in a subdirectory
+	// per IPv4 prefix of that length, or IPv6 prefix covering as many
+	// addresses, see shardDir
+	shardPrefix int
+
+	// index holds the names of the reservation files, read from the
+	// data directory the first time it is consulted and kept up to date
+	// with the reservations made and released through this Store
+	indexMu sync.Mutex
+	index   map[string]bool
+
+	// network and subnets are those of the network the store was
+	// opened for by New; recordPending is set until they are recorded,
+	// see checkNetwork
+	network       string
+	subnets       []*net.IPNet
+	recordPending bool
 }
 
+// NotWritableError is returned by New when the data directory cannot
+// be written to, as happens on a read-only filesystem
+type NotWritableError struct {
+	Dir string
+	Err error
+}
+
+func (e *NotWritableError) Error() string {
+	return fmt.Sprintf("IPAM store directory %s is not writable: %v", e.Dir, e.Err)
+}
+
+func (e *NotWritableError) Unwrap() error {
+	return e.Err
+}
+
+// New opens the store of the network under the configured dataDir,
+// falling back to /var/lib/cni/networks. The directory is created if
+// needed and probed for writability, so that a read-only filesystem is
+// reported up front rather than by the first reservation. New also
+// refuses a store that belongs to a conflicting network, see
+// NetworkConflictError.
 func New(n *sequential.IPAMConfig) (*Store, error) {
-	network := n.Name
-	dir := filepath.Join(defaultDataDir, network)
-	if err := os.MkdirAll(dir, 0644); err != nil {
+	dir := storeDir(n)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, &NotWritableError{dir, err}
+	}
+
+	s, err := Open(n)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := s.writeTemp("")
+	if err != nil {
+		s.Close()
+		return nil, &NotWritableError{dir, err}
+	}
+	os.Remove(tmp)
+	if err := s.checkNetwork(n); err != nil {
+		s.Close()
 		return nil, err
 	}
+	return s, nil
+}
 
+// Open opens an existing store without checking that it is writable,
+// for callers such as DEL that should get as far as they can even if
+// the data directory has turned read-only
+func Open(n *sequential.IPAMConfig) (*Store, error) {
+	dir := storeDir(n)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("IPAM store directory %s is not a directory", dir)
+	}
 	lk, err := NewFileLock(dir)
 	if err != nil {
 		return nil, err
 	}
+	lk.SetTimeout(time.Duration(n.LockTimeout), time.Duration(n.LockRetryInterval))
+
+	return &Store{
+		lock:          lk,
+		dataDir:       dir,
+		hashFilenames: n.HashFilenames,
+		label:         n.Label(),
+		sync:          n.Sync(),
+		jsonFormat:    n.StoreFormat == sequential.StoreFormatJSON,
+		shardPrefix:   n.ShardPrefix,
+	}, nil
+}
+
+func storeDir(n *sequential.IPAMConfig) string {
+	dataDir := n.DataDir
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	return filepath.Join(dataDir, n.Name)
+}
 
-	return &Store{*lk, dir}, nil
+// Lock takes the store's file lock, serializing the plugins that
+// allocate from or release to the directory. Reserve stays safe without
+// it, but the checks that count or move reservations, such as the
+// utilization limit and the confirmation of pending reservations, rely
+// on nothing changing under them until Unlock.
+func (s *Store) Lock() error {
+	return s.lock.Lock()
 }
 
-func (s *Store) Reserve(id string, ip net.IP) (bool, error) {
-	fname := filepath.Join(s.dataDir, ip.String())
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+// Unlock releases the store's file lock
+func (s *Store) Unlock() error {
+	return s.lock.Unlock()
+}
+
+// Close flushes the data directory to disk and releases the store's
+// file lock
+func (s *Store) Close() error {
+	err := s.syncDir()
+	if cerr := s.lock.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
+	if s.recordPending {
+		// the reservation must not wait on the lock for this, so a
+		// timeout leaves the recording to a later Reserve
+		if err := s.recordNetwork(); err != nil && !errors.Is(err, ErrLockTimeout) {
+			return false, "", err
+		}
+	}
+
+	data, err := s.encodeReservation(id, ip)
+	if err != nil {
+		return false, "", err
+	}
+	tmp, err := s.writeTemp(data)
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(tmp)
+
+	// linking only succeeds if no reservation file exists, so of several
+	// racing plugins exactly one wins, and readers never see the file
+	// before its contents
+	fname := s.reservationPath(ip)
+	err = os.Link(tmp, fname)
+	if os.IsNotExist(err) && s.shardPrefix != 0 {
+		// the first reservation of the shard creates its directory
+		if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+			return false, "", err
+		}
+		if err := s.syncDir(); err != nil {
+			return false, "", err
+		}
+		err = os.Link(tmp, fname)
+	}
 	if os.IsExist(err) {
-		return false, nil
+		s.indexUpdate(fname, true)
+		// a retried request for an IP the container already holds
+		// succeeds again
+		r, err := s.readReservation(fname)
+		if os.IsNotExist(err) {
+			// released in the meantime; another attempt may win it
+			return false, "", nil
+		}
+		if err != nil {
+			return false, "", err
+		}
+		return r.ID == id, r.ID, nil
 	}
 	if err != nil {
-		return false, err
+		return false, "", err
+	}
+	s.indexUpdate(fname, true)
+	if err := s.syncDirAt(filepath.Dir(fname)); err != nil {
+		return false, "", err
+	}
+
+	// store the reserved ip in the last ip file of its family
+	if err := s.writeLocked(s.lastIPPath(ip.To4() == nil), ip.String()); err != nil {
+		return false, "", err
 	}
-	if _, err := f.WriteString(id); err != nil {
+	return true, id, nil
+}
+
+// writeTemp writes data to a new temporary file in the data directory
+// and returns its path. Temporary files are not named after an IP, so
+// they are never taken for reservations.
+func (s *Store) writeTemp(data string) (string, error) {
+	f, err := ioutil.TempFile(s.dataDir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(data); err != nil {
 		f.Close()
 		os.Remove(f.Name())
-		return false, err
+		return "", err
+	}
+	if s.sync {
+		if err := syncFile(f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
 	}
 	if err := f.Close(); err != nil {
 		os.Remove(f.Name())
-		return false, err
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return "", err
 	}
-	// store the reserved ip in lastIPFile
-	ipfile := filepath.Join(s.dataDir, lastIPFile)
-	err = ioutil.WriteFile(ipfile, []byte(ip.String()), 0644)
+	return f.Name(), nil
+}
+
+// writeLocked replaces the bookkeeping file at path with data under the
+// store lock. The file is swapped in by a rename, so readers see either
+// the old or the new contents.
+func (s *Store) writeLocked(path, data string) error {
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	return s.replace(path, data)
+}
+
+// replace swaps in a file at path holding data; the caller must hold
+// the store lock
+func (s *Store) replace(path, data string) error {
+	tmp, err := s.writeTemp(data)
 	if err != nil {
-		return false, err
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return s.syncDir()
+}
+
+// syncFile flushes a file to disk; tests swap it out to observe the
+// calls
+var syncFile = func(f *os.File) error {
+	return f.Sync()
+}
+
+// syncDir flushes the data directory to disk, so that files linked or
+// renamed into it survive a power loss along with their contents
+func (s *Store) syncDir() error {
+	return s.syncDirAt(s.dataDir)
+}
+
+// syncDirAt flushes dir, the data directory or one of its shards, to
+// disk
+func (s *Store) syncDirAt(dir string) error {
+	if !s.sync {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	return true, nil
+	defer d.Close()
+	return syncFile(d)
 }
 
-// LastReservedIP returns the last reserved IP if exists
-func (s *Store) LastReservedIP() (net.IP, error) {
-	ipfile := filepath.Join(s.dataDir, lastIPFile)
-	data, err := ioutil.ReadFile(ipfile)
+// LastReservedIP returns the last reserved IP of the given range or,
+// failing that, of the given family, or nil if none was recorded yet
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	path := s.lastInRangePath(rangeID)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = s.lastIPPath(v6)
+		data, err = ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to retrieve last reserved ip: %v", err)
 	}
+	last := net.ParseIP(string(data))
+	if last == nil {
+		return nil, fmt.Errorf("malformed last reserved ip file %s: %q", path, data)
+	}
+	return last, nil
+}
+
+// HighWaterMark returns the high-water mark of the given family, or nil
+// if none was recorded yet
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	data, err := ioutil.ReadFile(s.highWaterMarkPath(v6))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 	return net.ParseIP(string(data)), nil
 }
 
+// SetHighWaterMark records ip as the high-water mark of its family
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	return s.writeLocked(s.highWaterMarkPath(ip.To4() == nil), ip.String())
+}
+
+// PushFreed records ip as the most recently freed IP of its family
+func (s *Store) PushFreed(ip net.IP) error {
+	return s.updateFreed(ip.To4() == nil, func(stack []net.IP) []net.IP {
+		return append(backend.RemoveIP(stack, ip), ip)
+	})
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	var top net.IP
+	err := s.updateFreed(v6, func(stack []net.IP) []net.IP {
+		if len(stack) == 0 {
+			return stack
+		}
+		top = stack[len(stack)-1]
+		return stack[:len(stack)-1]
+	})
+	return top, err
+}
+
+// updateFreed replaces the freed IPs of the given family, kept one per
+// line with the most recently freed last, with the result of fn
+func (s *Store) updateFreed(v6 bool, fn func([]net.IP) []net.IP) error {
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	path := s.freedPath(v6)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.replace(path, string(backend.FormatIPs(fn(backend.ParseIPs(data)))))
+}
+
+func (s *Store) freedPath(v6 bool) string {
+	if v6 {
+		return filepath.Join(s.dataDir, freedIP6File)
+	}
+	return filepath.Join(s.dataDir, freedIPFile)
+}
+
+func (s *Store) highWaterMarkPath(v6 bool) string {
+	if v6 {
+		return filepath.Join(s.dataDir, highWaterMark6File)
+	}
+	return filepath.Join(s.dataDir, highWaterMarkFile)
+}
+
+// TakeToken takes a token from the bucket of the allocation rate limit,
+// which is kept in a file updated under the store lock so that it is
+// shared by every plugin on the node. A file that cannot be parsed is
+// taken for a full bucket, so that it never blocks allocation.
+func (s *Store) TakeToken(rate float64, burst int, maxWait time.Duration, now time.Time) (time.Duration, bool, error) {
+	if err := s.lock.Lock(); err != nil {
+		return 0, false, err
+	}
+	defer s.lock.Unlock()
+
+	path := filepath.Join(s.dataDir, tokensFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	var bucket backend.TokenBucket
+	lines := strings.SplitN(string(data), "\n", 2)
+	if len(lines) == 2 {
+		tokens, terr := strconv.ParseFloat(lines[0], 64)
+		updated, uerr := time.Parse(time.RFC3339Nano, strings.TrimSpace(lines[1]))
+		if terr == nil && uerr == nil {
+			bucket = backend.TokenBucket{Tokens: tokens, Updated: updated}
+		}
+	}
+
+	bucket, wait, ok := bucket.Take(rate, burst, maxWait, now)
+	if !ok {
+		return wait, false, nil
+	}
+	data = []byte(strconv.FormatFloat(bucket.Tokens, 'g', -1, 64) + "\n" + bucket.Updated.UTC().Format(time.RFC3339Nano))
+	if err := s.replace(path, string(data)); err != nil {
+		return 0, false, err
+	}
+	return wait, true, nil
+}
+
+// SetLastReservedIP records ip as the last reserved IP of the range
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	return s.writeLocked(s.lastInRangePath(rangeID), ip.String())
+}
+
+// lastInRangePath names the file of a range after a hash of its ID,
+// which may be too long for a file name
+func (s *Store) lastInRangePath(rangeID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rangeID))
+	return filepath.Join(s.dataDir, fmt.Sprintf("%s-%016x", lastIPFile, h.Sum64()))
+}
+
+func (s *Store) lastIPPath(v6 bool) string {
+	if v6 {
+		return filepath.Join(s.dataDir, lastIP6File)
+	}
+	return filepath.Join(s.dataDir, lastIPFile)
+}
+
 func (s *Store) Release(ip net.IP) error {
-	return os.Remove(filepath.Join(s.dataDir, ip.String()))
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	return s.remove(s.reservationPath(ip))
 }
 
 // N.B. This function eats errors to be tolerant and
 // release as much as possible
 func (s *Store) ReleaseByID(id string) error {
-	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	// releasing a container that holds nothing succeeds, so that DEL
+	// can be repeated; only I/O errors are reported
+	return filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !s.isReservation(info.Name()) {
 			return nil
 		}
 		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, err := s.parseReservation(path, data)
+		if err != nil || r.ID != id {
+			// a malformed file belongs to no container
+			return nil
+		}
+		if err := s.remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Clear removes every reservation file, in the shards too, and the
+// bookkeeping files of the scans: the last reserved IPs, high-water
+// marks and freed IPs. The network record and the token bucket of the
+// rate limit are kept.
+func (s *Store) Clear() (int, error) {
+	if err := s.lock.Lock(); err != nil {
+		return 0, err
+	}
+	defer s.lock.Unlock()
+
+	names, err := s.checkedFiles()
+	if err != nil {
+		return 0, err
+	}
+	cleared := 0
+	for _, name := range names {
+		if !s.isReservation(filepath.Base(name)) {
+			continue
+		}
+		err := s.remove(filepath.Join(s.dataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cleared, err
+		}
+		cleared++
+	}
+
+	top, err := readNames(s.dataDir)
+	if err != nil {
+		return cleared, err
+	}
+	for _, name := range top {
+		switch {
+		case name == lastIPFile, name == lastIP6File, strings.HasPrefix(name, lastIPFile+"-"),
+			name == highWaterMarkFile, name == highWaterMark6File, name == freedIPFile, name == freedIP6File:
+			if err := os.Remove(filepath.Join(s.dataDir, name)); err != nil && !os.IsNotExist(err) {
+				return cleared, err
+			}
+		}
+	}
+	return cleared, s.syncDir()
+}
+
+// ReleaseByIP releases ip if it is reserved by the container with given
+// ID and returns an error otherwise
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	fname := s.reservationPath(ip)
+	r, err := s.readReservation(fname)
+	if os.IsNotExist(err) || (err == nil && !r.IP.Equal(ip)) {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	if err != nil {
+		return err
+	}
+	if r.ID != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	return s.remove(fname)
+}
+
+// ChangeOwner replaces the reservation file of ip by one for the
+// container with ID to if it is held by from. The new file is renamed
+// over the old one, so ip stays reserved throughout.
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	if err := s.lock.Lock(); err != nil {
+		return false, err
+	}
+	defer s.lock.Unlock()
+
+	fname := s.reservationPath(ip)
+	r, err := s.readReservation(fname)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if r.ID != from || !r.IP.Equal(ip) {
+		return false, nil
+	}
+
+	data, err := s.encodeReservation(to, ip)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := s.writeTemp(data)
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, s.syncDirAt(filepath.Dir(fname))
+}
+
+// GetByID returns the IPs reserved for the container with given ID
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	var ips []net.IP
+	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
+			return err
+		}
+		if info.IsDir() {
 			return nil
 		}
-		if string(data) == id {
-			if err := os.Remove(path); err != nil {
-				return nil
+		if !s.isReservation(info.Name()) {
+			return nil
+		}
+		r, err := s.readReservation(path)
+		if os.IsNotExist(err) {
+			// released while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.ID == id {
+			ips = append(ips, r.IP)
+		}
+		return nil
+	})
+	return ips, err
+}
+
+// ReleaseExpired releases all reservations made before the given time
+// and returns the freed IPs. Pre-reserved IPs and reservations written
+// without a timestamp never expire.
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	if err := s.lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	var freed []net.IP
+	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !s.isReservation(info.Name()) {
+			return nil
+		}
+		r, err := s.readReservation(path)
+		if os.IsNotExist(err) {
+			// released while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.PreReserved() || r.ReservedAt.IsZero() || !r.ReservedAt.Before(before) {
+			return nil
+		}
+		if err := s.remove(path); err != nil {
+			return err
+		}
+		freed = append(freed, r.IP)
+		return nil
+	})
+	return freed, err
+}
+
+// List returns every reservation in the store. Reservations are read
+// without the store lock, so one being released concurrently may be
+// reported or not.
+func (s *Store) List() ([]backend.Reservation, error) {
+	var list []backend.Reservation
+	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != s.dataDir && !isShardDir(path, s.dataDir) {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+		if !s.isReservation(info.Name()) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// released while walking
+			return nil
 		}
+		if err != nil {
+			return err
+		}
+		r, err := s.parseReservation(path, data)
+		if err != nil || r.ID == "" {
+			// a malformed file must not hide the other reservations
+			return nil
+		}
+		list = append(list, r)
 		return nil
 	})
+	return list, err
+}
+
+// remove removes the reservation file at path
+func (s *Store) remove(path string) error {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		s.indexUpdate(path, false)
+	}
 	return err
 }
+
+// IsReserved reports whether a reservation file of ip existed when the
+// index was built or was since created through this Store
+func (s *Store) IsReserved(ip net.IP) (bool, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if s.index == nil {
+		if err := s.loadIndex(); err != nil {
+			return false, err
+		}
+	}
+	return s.index[filepath.Base(s.reservationPath(ip))], nil
+}
+
+// RefreshIndex rereads the names of the reservation files, picking up
+// the reservations made and released by other plugins
+func (s *Store) RefreshIndex() error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	return s.loadIndex()
+}
+
+// ReservedIPs returns the IPs of the reservation files. With hashed
+// file names the IPs are read from the files.
+func (s *Store) ReservedIPs() ([]net.IP, error) {
+	var ips []net.IP
+	if s.hashFilenames {
+		list, err := s.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range list {
+			ips = append(ips, r.IP)
+		}
+		return ips, nil
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if s.index == nil {
+		if err := s.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+	for name := range s.index {
+		ips = append(ips, net.ParseIP(name))
+	}
+	return ips, nil
+}
+
+// loadIndex builds the index from the names in the data directory and
+// its shards, without reading the files; the caller must hold indexMu
+func (s *Store) loadIndex() error {
+	names, err := readNames(s.dataDir)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]bool, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, shardDirPrefix) {
+			shard, err := readNames(filepath.Join(s.dataDir, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, name := range shard {
+				if s.isReservation(name) {
+					index[name] = true
+				}
+			}
+			continue
+		}
+		if s.isReservation(name) {
+			index[name] = true
+		}
+	}
+	s.index = index
+	return nil
+}
+
+// readNames returns the names in the directory dir
+func readNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// indexUpdate records whether the reservation file at path exists, if
+// the index has been built
+func (s *Store) indexUpdate(path string, reserved bool) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if s.index == nil {
+		return
+	}
+	if reserved {
+		s.index[filepath.Base(path)] = true
+	} else {
+		delete(s.index, filepath.Base(path))
+	}
+}
+
+// hashedPrefix starts the names of reservation files named after a hash
+// of their IP
+const hashedPrefix = "ip-"
+
+// reservationPath returns the path of the reservation file of ip, which
+// is named after the IP or, with hashed file names, after the first 16
+// bytes of the SHA-256 hash of the IP, so that names do not grow with
+// long IPv6 addresses
+func (s *Store) reservationPath(ip net.IP) string {
+	if !s.hashFilenames {
+		return filepath.Join(s.shardDir(ip), ip.String())
+	}
+	sum := sha256.Sum256([]byte(ip.String()))
+	return filepath.Join(s.shardDir(ip), hashedPrefix+hex.EncodeToString(sum[:16]))
+}
+
+// shardDirPrefix starts the names of the shard directories
+const shardDirPrefix = "shard-"
+
+// shardDir returns the directory of the reservation file of ip: the
+// data directory, or with shardPrefix set the shard named after the
+// prefix of ip. IPv6 prefixes are longer by 96 bits, so that shards of
+// either family hold as many addresses.
+func (s *Store) shardDir(ip net.IP) string {
+	if s.shardPrefix == 0 {
+		return s.dataDir
+	}
+	mask := net.CIDRMask(s.shardPrefix, 32)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		mask = net.CIDRMask(s.shardPrefix+96, 128)
+	}
+	return filepath.Join(s.dataDir, shardDirPrefix+ip.Mask(mask).String())
+}
+
+// isShardDir reports whether path is a shard directory of dataDir
+func isShardDir(path, dataDir string) bool {
+	return filepath.Dir(path) == dataDir && strings.HasPrefix(filepath.Base(path), shardDirPrefix)
+}
+
+// isReservation reports whether name is that of a reservation file
+func (s *Store) isReservation(name string) bool {
+	if s.hashFilenames {
+		return strings.HasPrefix(name, hashedPrefix)
+	}
+	return net.ParseIP(name) != nil
+}
+
+// Owner returns the ID recorded in the reservation file of ip, or "" if
+// there is none. Like Reserve it needs no lock.
+func (s *Store) Owner(ip net.IP) (string, error) {
+	r, err := s.readReservation(s.reservationPath(ip))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// readReservation returns the reservation recorded in a reservation
+// file: the owning container ID, the reservation time, the IP, which
+// is taken from the file name unless file names are hashed, and the
+// optional label. Files written before reservation times were recorded
+// hold only the ID and yield a zero time.
+func (s *Store) readReservation(path string) (backend.Reservation, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return backend.Reservation{}, err
+	}
+	return s.parseReservation(path, data)
+}
+
+func (s *Store) parseReservation(path string, data []byte) (backend.Reservation, error) {
+	if isJSONReservation(data) {
+		return s.parseJSONReservation(path, data)
+	}
+	lines := strings.SplitN(string(data), "\n", 4)
+	r := backend.Reservation{ID: lines[0]}
+	if len(lines) >= 2 {
+		reservedAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(lines[1]))
+		if err != nil {
+			return backend.Reservation{}, fmt.Errorf("invalid reservation time in %s: %v", path, err)
+		}
+		r.ReservedAt = reservedAt
+	}
+	if len(lines) == 4 {
+		r.Label = strings.TrimSpace(lines[3])
+	}
+
+	if !s.hashFilenames {
+		r.IP = net.ParseIP(filepath.Base(path))
+		return r, nil
+	}
+	if len(lines) >= 3 {
+		r.IP = net.ParseIP(strings.TrimSpace(lines[2]))
+	}
+	if r.IP == nil {
+		return backend.Reservation{}, fmt.Errorf("missing IP address in %s", path)
+	}
+	return r, nil
+}
@@ -0,0 +1,1390 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+	"github.com/containernetworking/cni/plugins/ipam/store/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("disk store", func() {
+	var (
+		tmpDir string
+		s      *Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host-local-disk")
+		Expect(err).ToNot(HaveOccurred())
+
+		s, err = New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	reserve := func(id, addr string) {
+		reserved, _, err := s.Reserve(id, net.ParseIP(addr))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	}
+
+	It("creates a missing data directory tree accessible only to its owner", func() {
+		dataDir := filepath.Join(tmpDir, "a", "b")
+		other, err := New(&sequential.IPAMConfig{Name: "net", DataDir: dataDir})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+
+		for _, dir := range []string{dataDir, filepath.Join(dataDir, "net")} {
+			info, err := os.Stat(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		}
+	})
+
+	Context("when the data directory is not writable", func() {
+		It("reports a directory that cannot be created", func() {
+			// a file where the network directory should be
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "blocked"), nil, 0644)).To(Succeed())
+			_, err := New(&sequential.IPAMConfig{Name: "blocked", DataDir: tmpDir})
+			var nw *NotWritableError
+			Expect(errors.As(err, &nw)).To(BeTrue())
+			Expect(err.Error()).To(HavePrefix(fmt.Sprintf("IPAM store directory %s is not writable: ", filepath.Join(tmpDir, "blocked"))))
+		})
+
+		It("reports a read-only directory at open time", func() {
+			if os.Geteuid() == 0 {
+				Skip("root can write to read-only directories")
+			}
+			dir := filepath.Join(tmpDir, "ro")
+			Expect(os.Mkdir(dir, 0500)).To(Succeed())
+			defer os.Chmod(dir, 0700)
+
+			_, err := New(&sequential.IPAMConfig{Name: "ro", DataDir: tmpDir})
+			Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("IPAM store directory %s is not writable: ", dir))))
+
+			// the store can still be opened to release what it can
+			other, err := Open(&sequential.IPAMConfig{Name: "ro", DataDir: tmpDir})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other.ReleaseByID("ID")).To(Succeed())
+			Expect(other.Close()).To(Succeed())
+		})
+	})
+
+	Context("when the lock is contended", func() {
+		It("lets one holder in and times the other out", func() {
+			conf := &sequential.IPAMConfig{
+				Name:              "net",
+				DataDir:           tmpDir,
+				LockTimeout:       sequential.Duration(200 * time.Millisecond),
+				LockRetryInterval: sequential.Duration(5 * time.Millisecond),
+			}
+			results := make(chan error, 2)
+			for i := 0; i < 2; i++ {
+				store, err := New(conf)
+				Expect(err).ToNot(HaveOccurred())
+				defer store.Close()
+				// the winner keeps the lock until both have returned
+				go func() { results <- store.lock.Lock() }()
+			}
+
+			start := time.Now()
+			var errs []error
+			for i := 0; i < 2; i++ {
+				errs = append(errs, <-results)
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+
+			Expect(errs).To(ContainElement(BeNil()))
+			Expect(errs).To(ContainElement(MatchError(ContainSubstring("timed out waiting for lock"))))
+			for _, err := range errs {
+				if err != nil {
+					Expect(errors.Is(err, ErrLockTimeout)).To(BeTrue())
+				}
+			}
+		})
+
+		It("waits for the holder to let go", func() {
+			reserve("id1", "10.0.0.2")
+			Expect(s.lock.Lock()).To(Succeed())
+			store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir, LockTimeout: sequential.Duration(time.Second)})
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+
+			holder, released := s.lock, make(chan error)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				released <- holder.Unlock()
+			}()
+			Expect(store.ReleaseByID("id1")).To(Succeed())
+			Expect(<-released).To(Succeed())
+		})
+
+		It("times out releases but not reservations", func() {
+			Expect(s.Lock()).To(Succeed())
+			defer s.Unlock()
+			store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir, LockTimeout: sequential.Duration(50 * time.Millisecond)})
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+
+			err = store.Lock()
+			Expect(errors.Is(err, ErrLockTimeout)).To(BeTrue())
+			err = store.ReleaseByID("id1")
+			Expect(errors.Is(err, ErrLockTimeout)).To(BeTrue())
+
+			// claiming the IP needs no lock, only recording it as the
+			// last reserved one does
+			_, _, err = store.Reserve("id1", net.ParseIP("10.0.0.2"))
+			Expect(errors.Is(err, ErrLockTimeout)).To(BeTrue())
+			ips, err := store.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("lets the holder release and record without letting go", func() {
+			reserve("id1", "10.0.0.2")
+			Expect(s.Lock()).To(Succeed())
+			store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir, LockTimeout: sequential.Duration(50 * time.Millisecond)})
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+
+			Expect(s.ReleaseByID("id1")).To(Succeed())
+			Expect(s.SetLastReservedIP("", net.ParseIP("10.0.0.2"))).To(Succeed())
+			// the operations above must not have dropped the lock
+			err = store.Lock()
+			Expect(errors.Is(err, ErrLockTimeout)).To(BeTrue())
+
+			Expect(s.Unlock()).To(Succeed())
+			Expect(store.Lock()).To(Succeed())
+			Expect(store.Unlock()).To(Succeed())
+		})
+	})
+
+	Context("when plugins race", func() {
+		It("lets exactly one of many claim the same IP", func() {
+			const racers = 50
+			results := make(chan bool, racers)
+			for i := 0; i < racers; i++ {
+				store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+				Expect(err).ToNot(HaveOccurred())
+				defer store.Close()
+				go func(id string) {
+					defer GinkgoRecover()
+					reserved, _, err := store.Reserve(id, net.ParseIP("10.0.0.2"))
+					Expect(err).ToNot(HaveOccurred())
+					results <- reserved
+				}(fmt.Sprintf("id%d", i))
+			}
+
+			won := 0
+			for i := 0; i < racers; i++ {
+				if <-results {
+					won++
+				}
+			}
+			Expect(won).To(Equal(1))
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+		})
+
+		It("releases a container's IPs without touching concurrent reservations", func() {
+			for i := 2; i < 12; i++ {
+				reserve("old", fmt.Sprintf("10.0.0.%d", i))
+			}
+
+			done := make(chan struct{})
+			for i := 12; i < 22; i++ {
+				store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+				Expect(err).ToNot(HaveOccurred())
+				defer store.Close()
+				go func(addr string) {
+					defer GinkgoRecover()
+					reserved, _, err := store.Reserve("new", net.ParseIP(addr))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(reserved).To(BeTrue())
+					done <- struct{}{}
+				}(fmt.Sprintf("10.0.0.%d", i))
+			}
+			Expect(s.ReleaseByID("old")).To(Succeed())
+			for i := 12; i < 22; i++ {
+				<-done
+			}
+
+			old, err := s.GetByID("old")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(old).To(BeEmpty())
+			held, err := s.GetByID("new")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(held).To(HaveLen(10))
+		})
+	})
+
+	It("keeps pre-reserved IPs across allocator restarts", func() {
+		subnet, err := types.ParseCIDR("10.0.0.0/29")
+		Expect(err).ToNot(HaveOccurred())
+		conf := &sequential.IPAMConfig{
+			Name:        "net",
+			DataDir:     tmpDir,
+			Subnet:      types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			PreReserved: []net.IP{net.ParseIP("10.0.0.2")},
+		}
+		Expect(sequential.Prime(conf, s)).To(Succeed())
+
+		// a later invocation without the list still skips the address
+		conf.PreReserved = nil
+		restarted, err := New(conf)
+		Expect(err).ToNot(HaveOccurred())
+		defer restarted.Close()
+		alloc, err := sequential.NewIPAllocator(conf, restarted)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.0.3"))
+
+		list, err := restarted.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(2))
+		for _, r := range list {
+			Expect(r.PreReserved()).To(Equal(r.IP.String() == "10.0.0.2"))
+		}
+	})
+
+	It("keeps networks of the same name in different data directories apart", func() {
+		other, err := New(&sequential.IPAMConfig{Name: "net", DataDir: filepath.Join(tmpDir, "other")})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+
+		reserve("id1", "10.0.0.2")
+		reserved, _, err := other.Reserve("id2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	})
+
+	It("names IPv6 reservation files by the canonical address", func() {
+		reserve("id1", "fd00:0000::0002")
+
+		_, err := os.Stat(filepath.Join(tmpDir, "net", "fd00::2"))
+		Expect(err).ToNot(HaveOccurred())
+		ips, err := s.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].Equal(net.ParseIP("fd00::2"))).To(BeTrue())
+
+		last, err := s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::2"))
+	})
+
+	It("reserves an IP again only for the container holding it", func() {
+		reserve("id1", "10.0.0.2")
+
+		reserved, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, owner, err := s.Reserve("id2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		Expect(owner).To(Equal("id1"))
+
+		ips, err := s.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("looks up the owner of an IP while the store is locked", func() {
+		reserve("id1", "10.0.0.2")
+		Expect(s.Lock()).To(Succeed())
+		defer s.Unlock()
+
+		owner, err := s.Owner(net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(owner).To(Equal("id1"))
+		owner, err = s.Owner(net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(owner).To(BeEmpty())
+	})
+
+	It("keeps a last reserved IP file per family", func() {
+		reserve("id1", "10.0.0.2")
+		reserve("id1", "fd00::2")
+
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+		last, err = s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::2"))
+
+		// neither file is mistaken for a reservation
+		ips, err := s.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+	})
+
+	It("keeps a last reserved IP file per range", func() {
+		reserve("id1", "10.0.0.2")
+		Expect(s.SetLastReservedIP("10.0.0.2-10.0.0.9", net.ParseIP("10.0.0.2"))).To(Succeed())
+		Expect(s.SetLastReservedIP("10.0.1.2-10.0.1.9", net.ParseIP("10.0.1.4"))).To(Succeed())
+
+		last, err := s.LastReservedIP("10.0.0.2-10.0.0.9", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+		last, err = s.LastReservedIP("10.0.1.2-10.0.1.9", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.1.4"))
+
+		// a range without a pointer of its own falls back to the family
+		last, err = s.LastReservedIP("10.0.2.2-10.0.2.9", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+
+		ips, err := s.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("persists the high-water mark of each family", func() {
+		mark, err := s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark).To(BeNil())
+
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.5"))).To(Succeed())
+		Expect(s.SetHighWaterMark(net.ParseIP("fd00::5"))).To(Succeed())
+		mark, err = s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("10.0.0.5"))
+		mark, err = s.HighWaterMark(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("fd00::5"))
+
+		// the mark files are not reservations
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+	})
+
+	It("persists a stack of freed IPs per family", func() {
+		ip, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3", "fd00::2", "10.0.0.2"} {
+			Expect(s.PushFreed(net.ParseIP(addr))).To(Succeed())
+		}
+		// 10.0.0.2 was pushed twice and only moved to the top
+		for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+			ip, err := s.PopFreed(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal(expected))
+		}
+		ip, err = s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		ip, err = s.PopFreed(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::2"))
+
+		// the freed IPs are not reservations
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+	})
+
+	Describe("the reservation index", func() {
+		isReserved := func(addr string) bool {
+			reserved, err := s.IsReserved(net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+			return reserved
+		}
+
+		It("tracks the reservations made and released through the store", func() {
+			reserve("a", "10.0.0.2")
+			Expect(isReserved("10.0.0.2")).To(BeTrue())
+			Expect(isReserved("10.0.0.3")).To(BeFalse())
+
+			reserve("b", "10.0.0.3")
+			Expect(isReserved("10.0.0.3")).To(BeTrue())
+			Expect(s.ReleaseByID("a")).To(Succeed())
+			Expect(isReserved("10.0.0.2")).To(BeFalse())
+		})
+
+		It("picks up the changes of other plugins on refresh", func() {
+			reserve("a", "10.0.0.2")
+			Expect(isReserved("10.0.0.2")).To(BeTrue())
+
+			other, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+			Expect(err).ToNot(HaveOccurred())
+			defer other.Close()
+			Expect(other.ReleaseByID("a")).To(Succeed())
+			reserved, _, err := other.Reserve("b", net.ParseIP("10.0.0.3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+
+			Expect(isReserved("10.0.0.2")).To(BeTrue())
+			Expect(isReserved("10.0.0.3")).To(BeFalse())
+			Expect(s.RefreshIndex()).To(Succeed())
+			Expect(isReserved("10.0.0.2")).To(BeFalse())
+			Expect(isReserved("10.0.0.3")).To(BeTrue())
+		})
+
+		It("indexes hashed file names", func() {
+			hashed, err := New(&sequential.IPAMConfig{Name: "hashed", DataDir: tmpDir, HashFilenames: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer hashed.Close()
+			reserved, _, err := hashed.Reserve("a", net.ParseIP("fd00::2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			Expect(hashed.RefreshIndex()).To(Succeed())
+
+			Expect(hashed.IsReserved(net.ParseIP("fd00::2"))).To(BeTrue())
+			Expect(hashed.IsReserved(net.ParseIP("fd00::3"))).To(BeFalse())
+		})
+
+		Context("when scanning with a stale index", func() {
+			var (
+				alloc *sequential.IPAllocator
+				other *Store
+			)
+
+			BeforeEach(func() {
+				subnet, err := types.ParseCIDR("10.0.0.0/29")
+				Expect(err).ToNot(HaveOccurred())
+				conf := &sequential.IPAMConfig{
+					Name:    "net",
+					DataDir: tmpDir,
+					Subnet:  types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+				}
+				alloc, err = sequential.NewIPAllocator(conf, s)
+				Expect(err).ToNot(HaveOccurred())
+				other, err = New(conf)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(other.Close()).To(Succeed())
+			})
+
+			It("passes over IPs reserved by other plugins since", func() {
+				res, err := alloc.Get("a")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.2"))
+
+				reserved, _, err := other.Reserve("b", net.ParseIP("10.0.0.3"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+
+				res, err = alloc.Get("c")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.4"))
+			})
+
+			It("finds IPs released by other plugins since", func() {
+				for _, id := range []string{"a", "b", "c", "d", "e"} {
+					_, err := alloc.Get(id)
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(other.ReleaseByID("b")).To(Succeed())
+
+				res, err := alloc.Get("f")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.IP.IP.String()).To(Equal("10.0.0.3"))
+			})
+		})
+	})
+
+	Describe("syncing writes", func() {
+		var synced []string
+
+		BeforeEach(func() {
+			synced = nil
+			syncFile = func(f *os.File) error {
+				synced = append(synced, f.Name())
+				return f.Sync()
+			}
+		})
+
+		AfterEach(func() {
+			syncFile = func(f *os.File) error {
+				return f.Sync()
+			}
+		})
+
+		It("fsyncs the reservation, the last reserved IP and the directory by default", func() {
+			// the first reservation also records the network
+			reserve("id1", "10.0.0.2")
+			synced = nil
+			reserve("id1", "10.0.0.3")
+
+			dir := filepath.Join(tmpDir, "net")
+			// the reservation file and the last reserved IP file are
+			// each written to a temporary file that is synced before
+			// it is moved into place, followed by the directory
+			Expect(synced).To(HaveLen(4))
+			Expect(filepath.Base(synced[0])).To(HavePrefix(".tmp-"))
+			Expect(synced[1]).To(Equal(dir))
+			Expect(filepath.Base(synced[2])).To(HavePrefix(".tmp-"))
+			Expect(synced[3]).To(Equal(dir))
+
+			synced = nil
+			Expect(s.Close()).To(Succeed())
+			Expect(synced).To(Equal([]string{dir}))
+			s, _ = New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+		})
+
+		It("syncs nothing with syncWrites off", func() {
+			off := false
+			store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir, SyncWrites: &off})
+			Expect(err).ToNot(HaveOccurred())
+			reserved, _, err := store.Reserve("id1", net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			Expect(store.Close()).To(Succeed())
+			Expect(synced).To(BeEmpty())
+		})
+	})
+
+	Describe("the network record", func() {
+		newConf := func(name string, subnets ...string) *sequential.IPAMConfig {
+			conf := &sequential.IPAMConfig{Name: name, DataDir: tmpDir}
+			for i, sub := range subnets {
+				n, err := types.ParseCIDR(sub)
+				Expect(err).ToNot(HaveOccurred())
+				if i == 0 {
+					conf.Subnet = types.IPNet(*n)
+				} else {
+					conf.Subnet6 = types.IPNet(*n)
+				}
+			}
+			return conf
+		}
+		open := func(conf *sequential.IPAMConfig) {
+			store, err := New(conf)
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+			reserved, _, err := store.Reserve("id", net.ParseIP("192.168.99.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			Expect(store.ReleaseByID("id")).To(Succeed())
+		}
+		recorded := func() string {
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, "net", networkFile))
+			Expect(err).ToNot(HaveOccurred())
+			return string(data)
+		}
+
+		It("is written by the first reservation", func() {
+			store, err := New(newConf("net", "10.0.0.0/24"))
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+			_, err = os.Stat(filepath.Join(tmpDir, "net", networkFile))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			open(newConf("net", "10.0.0.0/24"))
+			Expect(recorded()).To(Equal("net\n10.0.0.0/24\n"))
+		})
+
+		It("accepts a store opened again with the same subnet", func() {
+			open(newConf("net", "10.0.0.0/24"))
+			open(newConf("net", "10.0.0.0/24"))
+			Expect(recorded()).To(Equal("net\n10.0.0.0/24\n"))
+		})
+
+		It("adds subnets that do not overlap the recorded ones", func() {
+			open(newConf("net", "10.0.0.0/24"))
+			open(newConf("net", "10.0.0.0/24", "fd00::/64"))
+			Expect(recorded()).To(Equal("net\n10.0.0.0/24\nfd00::/64\n"))
+
+			// the IPv6 subnet stays recorded without subnet6
+			open(newConf("net", "10.0.0.0/24"))
+			_, err := New(newConf("net", "10.0.0.0/24", "fd00::/48"))
+			Expect(err).To(MatchError(ContainSubstring("with subnet fd00::/64, which conflicts with subnet fd00::/48 of network net")))
+		})
+
+		It("rejects a store opened with an overlapping subnet", func() {
+			open(newConf("net", "10.0.0.0/24"))
+			_, err := New(newConf("net", "10.0.0.0/16"))
+			var conflict *NetworkConflictError
+			Expect(errors.As(err, &conflict)).To(BeTrue())
+			Expect(err).To(MatchError(fmt.Sprintf("IPAM store directory %s belongs to network net with subnet 10.0.0.0/24, which conflicts with subnet 10.0.0.0/16 of network net", filepath.Join(tmpDir, "net"))))
+			Expect(recorded()).To(Equal("net\n10.0.0.0/24\n"))
+		})
+
+		It("rejects a store of another name with an overlapping subnet", func() {
+			open(newConf("net", "10.0.0.0/24"))
+			// the same directory reached through another data directory
+			conf := newConf("other", "10.0.0.0/24")
+			conf.DataDir = filepath.Join(tmpDir, "link")
+			Expect(os.MkdirAll(conf.DataDir, 0700)).To(Succeed())
+			Expect(os.Symlink(filepath.Join(tmpDir, "net"), filepath.Join(conf.DataDir, "other"))).To(Succeed())
+			_, err := New(conf)
+			Expect(err).To(MatchError(ContainSubstring("belongs to network net with subnet 10.0.0.0/24, which conflicts with subnet 10.0.0.0/24 of network other")))
+		})
+
+		It("rechecks the record before writing it", func() {
+			store, err := New(newConf("net", "10.0.0.0/16"))
+			Expect(err).ToNot(HaveOccurred())
+			defer store.Close()
+			open(newConf("net", "10.0.0.0/24"))
+
+			_, _, err = store.Reserve("id", net.ParseIP("10.0.5.1"))
+			Expect(err).To(MatchError(ContainSubstring("which conflicts with subnet 10.0.0.0/16 of network net")))
+		})
+	})
+
+	Describe("TakeToken", func() {
+		It("spaces out takes beyond the burst at the configured rate", func() {
+			now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			var waits []time.Duration
+			for i := 0; i < 4; i++ {
+				wait, ok, err := s.TakeToken(10, 2, 0, now)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+				waits = append(waits, wait)
+			}
+			Expect(waits).To(Equal([]time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}))
+
+			// the bucket refills up to the burst
+			wait, ok, err := s.TakeToken(10, 2, 0, now.Add(time.Second))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(wait).To(BeZero())
+		})
+
+		It("takes nothing if the wait would be too long", func() {
+			now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			_, ok, err := s.TakeToken(10, 1, 150*time.Millisecond, now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			wait, ok, err := s.TakeToken(10, 1, 150*time.Millisecond, now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(wait).To(Equal(100 * time.Millisecond))
+
+			wait, ok, err = s.TakeToken(10, 1, 150*time.Millisecond, now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(wait).To(Equal(200 * time.Millisecond))
+
+			// the refused take left the bucket alone
+			wait, ok, err = s.TakeToken(10, 1, 150*time.Millisecond, now.Add(100*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(wait).To(Equal(100 * time.Millisecond))
+		})
+	})
+
+	Describe("migrating to another store", func() {
+		It("transfers every reservation once and reports conflicts", func() {
+			reserve("id1", "10.0.0.2")
+			reserve("id1", "fd00::2")
+			reserve("id2", "10.0.0.3")
+			reserve("id3", "10.0.0.4")
+
+			target := memory.New()
+			reserved, _, err := target.Reserve("id2", net.ParseIP("10.0.0.3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			reserved, _, err = target.Reserve("other", net.ParseIP("10.0.0.4"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+
+			res, err := backend.Migrate(s, target)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Migrated).To(HaveLen(2))
+			Expect(res.Skipped).To(HaveLen(1))
+			Expect(res.Skipped[0].ID).To(Equal("id2"))
+			Expect(res.Conflicts).To(HaveLen(1))
+			Expect(res.Conflicts[0].IP.String()).To(Equal("10.0.0.4"))
+
+			ips, err := target.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(2))
+			Expect([]string{ips[0].String(), ips[1].String()}).To(ConsistOf("10.0.0.2", "fd00::2"))
+
+			// a second run finds everything in place
+			res, err = backend.Migrate(s, target)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Migrated).To(BeEmpty())
+			Expect(res.Skipped).To(HaveLen(3))
+			Expect(res.Conflicts).To(HaveLen(1))
+		})
+	})
+
+	Describe("ReleaseByID", func() {
+		It("succeeds when called twice and for an unknown container", func() {
+			reserve("id1", "10.0.0.2")
+			reserve("id2", "10.0.0.3")
+
+			Expect(s.ReleaseByID("id1")).To(Succeed())
+			Expect(s.ReleaseByID("id1")).To(Succeed())
+			Expect(s.ReleaseByID("never-seen")).To(Succeed())
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+			Expect(list[0].ID).To(Equal("id2"))
+		})
+
+		It("skips malformed files", func() {
+			reserve("id1", "10.0.0.2")
+			dir := filepath.Join(tmpDir, "net")
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.4"), []byte("id1\nyesterday"), 0644)).To(Succeed())
+
+			Expect(s.ReleaseByID("id1")).To(Succeed())
+			Expect(filepath.Join(dir, "10.0.0.2")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(dir, "10.0.0.4")).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("GetByID", func() {
+		It("returns only the container's reservations", func() {
+			reserve("id1", "10.0.0.2")
+			reserve("id2", "10.0.0.3")
+			reserve("id1", "10.0.0.4")
+
+			ips, err := s.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(2))
+			Expect(ips[0].String()).To(Equal("10.0.0.2"))
+			Expect(ips[1].String()).To(Equal("10.0.0.4"))
+		})
+
+		It("returns nothing for an unknown container", func() {
+			reserve("id1", "10.0.0.2")
+
+			ips, err := s.GetByID("id2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+		})
+
+		It("ignores files that are not reservations", func() {
+			reserve("id1", "10.0.0.2")
+			// last_reserved_ip holds an address and a stray lock file
+			// holds the ID; neither names an IP
+			err := ioutil.WriteFile(filepath.Join(tmpDir, "net", "lock"), []byte("id1"), 0644)
+			Expect(err).ToNot(HaveOccurred())
+
+			ips, err := s.GetByID("10.0.0.2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+
+			ips, err = s.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].String()).To(Equal("10.0.0.2"))
+		})
+	})
+
+	Describe("Clear", func() {
+		It("removes the reservations and the bookkeeping of the scans", func() {
+			reserve("id1", "10.0.0.2")
+			reserve("id2", "fd00::2")
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "net", "garbage"), []byte("a"), 0644)).To(Succeed())
+			Expect(s.SetLastReservedIP("range", net.ParseIP("10.0.0.2"))).To(Succeed())
+			Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.2"))).To(Succeed())
+			Expect(s.PushFreed(net.ParseIP("10.0.0.3"))).To(Succeed())
+			_, ok, err := s.TakeToken(1, 1, 0, time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			cleared, err := s.Clear()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(2))
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(BeEmpty())
+			last, err := s.LastReservedIP("range", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last).To(BeNil())
+
+			files, err := ioutil.ReadDir(filepath.Join(tmpDir, "net"))
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			// files that are not reservations are left for the
+			// consistency check
+			Expect(names).To(ConsistOf(networkFile, tokensFile, "garbage"))
+		})
+
+		It("removes the reservations of every shard", func() {
+			sharded, err := New(&sequential.IPAMConfig{Name: "sharded", DataDir: tmpDir, ShardPrefix: 24})
+			Expect(err).ToNot(HaveOccurred())
+			defer sharded.Close()
+			for _, addr := range []string{"10.0.1.2", "10.0.2.2", "10.0.2.3"} {
+				reserved, _, err := sharded.Reserve("id", net.ParseIP(addr))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+			}
+
+			cleared, err := sharded.Clear()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(3))
+			list, err := sharded.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(BeEmpty())
+		})
+	})
+
+	Describe("ChangeOwner", func() {
+		It("moves an IP held by the container", func() {
+			reserve("id1", "10.0.0.2")
+
+			moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "id1", "id2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(moved).To(BeTrue())
+			owner, err := s.Owner(net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(owner).To(Equal("id2"))
+		})
+
+		It("leaves another container's IP and a free IP alone", func() {
+			reserve("id1", "10.0.0.2")
+
+			moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "id2", "id3")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(moved).To(BeFalse())
+			moved, err = s.ChangeOwner(net.ParseIP("10.0.0.3"), "id1", "id3")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(moved).To(BeFalse())
+			_, err = os.Stat(filepath.Join(tmpDir, "net", "10.0.0.3"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("never lets a racing plugin reserve the IP", func() {
+			reserve("id0", "10.0.0.2")
+			other, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+			Expect(err).ToNot(HaveOccurred())
+			defer other.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					from, to := fmt.Sprintf("id%d", i), fmt.Sprintf("id%d", i+1)
+					moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), from, to)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(moved).To(BeTrue())
+				}
+			}()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				reserved, _, err := other.Reserve("racer", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeFalse())
+			}
+		})
+	})
+
+	Describe("ReleaseByIP", func() {
+		It("releases an IP held by the container", func() {
+			reserve("id1", "10.0.0.2")
+
+			Expect(s.ReleaseByIP("id1", net.ParseIP("10.0.0.2"))).To(Succeed())
+			_, err := os.Stat(filepath.Join(tmpDir, "net", "10.0.0.2"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("refuses to release another container's IP", func() {
+			reserve("id1", "10.0.0.2")
+
+			err := s.ReleaseByIP("id2", net.ParseIP("10.0.0.2"))
+			Expect(err).To(MatchError("10.0.0.2 is not reserved by container id2"))
+			ips, err := s.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("fails for an IP without a reservation file", func() {
+			err := s.ReleaseByIP("id1", net.ParseIP("10.0.0.2"))
+			Expect(err).To(MatchError("10.0.0.2 is not reserved"))
+		})
+	})
+
+	Describe("List", func() {
+		It("lists reservations without the lock", func() {
+			reserve("id1", "10.0.0.2")
+			reserve("id2", "10.0.0.3")
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(2))
+			Expect(list[0].IP.String()).To(Equal("10.0.0.2"))
+			Expect(list[0].ID).To(Equal("id1"))
+			Expect(list[1].IP.String()).To(Equal("10.0.0.3"))
+			Expect(list[1].ID).To(Equal("id2"))
+		})
+
+		It("skips malformed files", func() {
+			reserve("id1", "10.0.0.2")
+			dir := filepath.Join(tmpDir, "net")
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.3"), []byte(""), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.4"), []byte("id2\nyesterday"), 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(dir, "10.0.0.5"), 0700)).To(Succeed())
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+			Expect(list[0].ID).To(Equal("id1"))
+		})
+	})
+
+	Context("with a label", func() {
+		open := func(name string, hashed bool) *Store {
+			conf := &sequential.IPAMConfig{
+				Name:          name,
+				DataDir:       tmpDir,
+				HashFilenames: hashed,
+				Args:          &sequential.IPAMArgs{K8S_POD_NAMESPACE: "default", K8S_POD_NAME: "web-0"},
+			}
+			labeled, err := New(conf)
+			Expect(err).ToNot(HaveOccurred())
+			return labeled
+		}
+
+		It("round-trips the label through the reservation file", func() {
+			for _, hashed := range []bool{false, true} {
+				name := fmt.Sprintf("labeled-%t", hashed)
+				labeled := open(name, hashed)
+				defer labeled.Close()
+
+				reserved, _, err := labeled.Reserve("id1", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+
+				// the label is read back by a store opened without one
+				plain, err := New(&sequential.IPAMConfig{Name: name, DataDir: tmpDir, HashFilenames: hashed})
+				Expect(err).ToNot(HaveOccurred())
+				defer plain.Close()
+				list, err := plain.List()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].IP.String()).To(Equal("10.0.0.2"))
+				Expect(list[0].ID).To(Equal("id1"))
+				Expect(list[0].Label).To(Equal("default/web-0"))
+				Expect(list[0].ReservedAt).NotTo(BeZero())
+
+				ips, err := plain.GetByID("id1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ips).To(HaveLen(1))
+			}
+		})
+
+		It("still parses files written without a label", func() {
+			dir := filepath.Join(tmpDir, "net")
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.3"), []byte("id2"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.4"), []byte("id3\n2024-01-02T03:04:05Z"), 0644)).To(Succeed())
+
+			list, err := s.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(2))
+			for _, r := range list {
+				Expect(r.Label).To(BeEmpty())
+			}
+			Expect(list[1].ReservedAt).To(Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+		})
+	})
+
+	Context("with the json storeFormat", func() {
+		open := func(name string, hashed bool) *Store {
+			conf := &sequential.IPAMConfig{
+				Name:          name,
+				DataDir:       tmpDir,
+				HashFilenames: hashed,
+				StoreFormat:   sequential.StoreFormatJSON,
+				Args:          &sequential.IPAMArgs{K8S_POD_NAMESPACE: "default", K8S_POD_NAME: "web-0"},
+			}
+			js, err := New(conf)
+			Expect(err).ToNot(HaveOccurred())
+			return js
+		}
+
+		It("writes the reservation as JSON", func() {
+			js := open("json", false)
+			defer js.Close()
+			reserved, _, err := js.Reserve("id1", net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, "json", "10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			var f struct {
+				ID         string    `json:"id"`
+				ReservedAt time.Time `json:"reservedAt"`
+				IP         string    `json:"ip"`
+				Label      string    `json:"label"`
+			}
+			Expect(json.Unmarshal(data, &f)).To(Succeed())
+			Expect(f.ID).To(Equal("id1"))
+			Expect(f.IP).To(Equal("10.0.0.2"))
+			Expect(f.Label).To(Equal("default/web-0"))
+			Expect(f.ReservedAt).To(BeTemporally("~", time.Now(), time.Minute))
+		})
+
+		It("round-trips the reservation, read by a store in either format", func() {
+			for _, hashed := range []bool{false, true} {
+				name := fmt.Sprintf("json-%t", hashed)
+				js := open(name, hashed)
+				defer js.Close()
+				reserved, _, err := js.Reserve("id1", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+
+				legacy, err := New(&sequential.IPAMConfig{Name: name, DataDir: tmpDir, HashFilenames: hashed})
+				Expect(err).ToNot(HaveOccurred())
+				defer legacy.Close()
+				for _, st := range []*Store{js, legacy} {
+					list, err := st.List()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(list).To(HaveLen(1))
+					Expect(list[0].IP.String()).To(Equal("10.0.0.2"))
+					Expect(list[0].ID).To(Equal("id1"))
+					Expect(list[0].Label).To(Equal("default/web-0"))
+					Expect(list[0].ReservedAt).NotTo(BeZero())
+				}
+
+				// the same container reserves the IP again, another can't
+				reserved, _, err = legacy.Reserve("id1", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+				reserved, owner, err := legacy.Reserve("id2", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reserved).To(BeFalse())
+				Expect(owner).To(Equal("id1"))
+
+				Expect(legacy.ReleaseByID("id1")).To(Succeed())
+				list, err := js.List()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(BeEmpty())
+			}
+		})
+
+		It("reads legacy files", func() {
+			js := open("net", false)
+			defer js.Close()
+			dir := filepath.Join(tmpDir, "net")
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.3"), []byte("id2"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.4"), []byte("id3\n2024-01-02T03:04:05Z"), 0644)).To(Succeed())
+
+			list, err := js.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(2))
+			Expect(list[0].ID).To(Equal("id2"))
+			Expect(list[0].ReservedAt).To(BeZero())
+			Expect(list[1].ID).To(Equal("id3"))
+			Expect(list[1].ReservedAt).To(Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+		})
+
+		It("reports a malformed JSON file", func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "net", "10.0.0.3"), []byte(`{"id": `), 0644)).To(Succeed())
+			_, err := s.Owner(net.ParseIP("10.0.0.3"))
+			Expect(err).To(MatchError(HavePrefix("invalid reservation in " + filepath.Join(tmpDir, "net", "10.0.0.3"))))
+		})
+	})
+
+	Context("with a shardPrefix", func() {
+		var (
+			conf    *sequential.IPAMConfig
+			sharded *Store
+		)
+
+		BeforeEach(func() {
+			n, err := types.ParseCIDR("10.0.0.0/16")
+			Expect(err).ToNot(HaveOccurred())
+			conf = &sequential.IPAMConfig{Name: "sharded", DataDir: tmpDir, Subnet: types.IPNet(*n), ShardPrefix: 24}
+			sharded, err = New(conf)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(sharded.Close()).To(Succeed())
+		})
+
+		reserveSharded := func(id, addr string) {
+			reserved, _, err := sharded.Reserve(id, net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+
+		It("places reservation files in a directory per prefix", func() {
+			reserveSharded("id1", "10.0.1.2")
+			reserveSharded("id1", "fd00::1:2")
+			reserveSharded("id2", "10.0.2.2")
+
+			dir := filepath.Join(tmpDir, "sharded")
+			for _, path := range []string{"shard-10.0.1.0/10.0.1.2", "shard-fd00::1:0/fd00::1:2", "shard-10.0.2.0/10.0.2.2"} {
+				Expect(filepath.Join(dir, path)).To(BeAnExistingFile())
+			}
+			Expect(filepath.Join(dir, "10.0.1.2")).NotTo(BeAnExistingFile())
+
+			// the bookkeeping files stay at the top
+			last, err := sharded.LastReservedIP("", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last.String()).To(Equal("10.0.2.2"))
+			Expect(filepath.Join(dir, lastIPFile)).To(BeAnExistingFile())
+		})
+
+		It("looks up reservations across shards", func() {
+			reserveSharded("id1", "10.0.1.2")
+			reserveSharded("id2", "10.0.2.2")
+			reserveSharded("id1", "10.0.3.2")
+
+			reserved, owner, err := sharded.Reserve("id3", net.ParseIP("10.0.2.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeFalse())
+			Expect(owner).To(Equal("id2"))
+
+			list, err := sharded.List()
+			Expect(err).ToNot(HaveOccurred())
+			var ips []string
+			for _, r := range list {
+				ips = append(ips, r.IP.String())
+			}
+			Expect(ips).To(ConsistOf("10.0.1.2", "10.0.2.2", "10.0.3.2"))
+
+			held, err := sharded.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Fields(string(backend.FormatIPs(held)))).To(ConsistOf("10.0.1.2", "10.0.3.2"))
+
+			Expect(sharded.RefreshIndex()).To(Succeed())
+			taken, err := sharded.IsReserved(net.ParseIP("10.0.3.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(taken).To(BeTrue())
+			reservedIPs, err := sharded.ReservedIPs()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reservedIPs).To(HaveLen(3))
+
+			Expect(sharded.ReleaseByID("id1")).To(Succeed())
+			list, err = sharded.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+			Expect(list[0].ID).To(Equal("id2"))
+		})
+
+		It("allocates from every shard", func() {
+			alloc, err := sequential.NewIPAllocator(&sequential.IPAMConfig{
+				Name:       "sharded",
+				DataDir:    tmpDir,
+				Subnet:     conf.Subnet,
+				RangeStart: net.ParseIP("10.0.1.253"),
+				RangeEnd:   net.ParseIP("10.0.2.2"),
+			}, sharded)
+			Expect(err).ToNot(HaveOccurred())
+			var got []string
+			for i := 0; i < 5; i++ {
+				res, err := alloc.Get(fmt.Sprintf("id%d", i))
+				Expect(err).ToNot(HaveOccurred())
+				got = append(got, res.IP.IP.String())
+			}
+			Expect(got).To(Equal([]string{"10.0.1.253", "10.0.1.254", "10.0.1.255", "10.0.2.0", "10.0.2.1"}))
+			Expect(filepath.Join(tmpDir, "sharded", "shard-10.0.2.0", "10.0.2.0")).To(BeAnExistingFile())
+		})
+
+		It("reports reservations outside their shard without removing them", func() {
+			reserveSharded("id1", "10.0.1.2")
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "sharded", "10.0.1.3"), []byte("id2"), 0644)).To(Succeed())
+
+			report, err := sharded.Check(conf, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Invalid).To(Equal([]InvalidFile{{Name: "10.0.1.3", Reason: "reservation file is not in the directory shardPrefix places it in"}}))
+			Expect(filepath.Join(tmpDir, "sharded", "10.0.1.3")).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("ReleaseExpired", func() {
+		It("releases reservations made before the cutoff", func() {
+			reserve("id1", "10.0.0.2")
+			cutoff := time.Now().Add(time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+			reserve("id2", "10.0.0.3")
+
+			freed, err := s.ReleaseExpired(cutoff)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(HaveLen(1))
+			Expect(freed[0].String()).To(Equal("10.0.0.2"))
+
+			ips, err := s.GetByID("id2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("reads the reservation time from the file rather than its mtime", func() {
+			reserve("id1", "10.0.0.2")
+			future := time.Now().Add(time.Hour)
+			path := filepath.Join(tmpDir, "net", "10.0.0.2")
+			Expect(os.Chtimes(path, future, future)).To(Succeed())
+
+			freed, err := s.ReleaseExpired(time.Now().Add(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(HaveLen(1))
+		})
+
+		It("never expires reservations written without a timestamp", func() {
+			path := filepath.Join(tmpDir, "net", "10.0.0.2")
+			Expect(ioutil.WriteFile(path, []byte("id1"), 0644)).To(Succeed())
+
+			freed, err := s.ReleaseExpired(time.Now().Add(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(BeEmpty())
+
+			ips, err := s.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("never expires pre-reserved IPs", func() {
+			reserve(backend.PreReservedID, "10.0.0.2")
+
+			freed, err := s.ReleaseExpired(time.Now().Add(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(BeEmpty())
+
+			ips, err := s.GetByID(backend.PreReservedID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+		})
+
+		It("leaves the last reserved IP file alone", func() {
+			reserve("id1", "10.0.0.2")
+
+			_, err := s.ReleaseExpired(time.Now().Add(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			last, err := s.LastReservedIP("", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last.String()).To(Equal("10.0.0.2"))
+		})
+	})
+
+	Context("with hashed file names", func() {
+		var hashed *Store
+
+		BeforeEach(func() {
+			var err error
+			hashed, err = New(&sequential.IPAMConfig{Name: "hashed", DataDir: tmpDir, HashFilenames: true})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(hashed.Close()).To(Succeed())
+		})
+
+		reserveHashed := func(id, addr string) {
+			reserved, _, err := hashed.Reserve(id, net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+
+		It("round-trips reservations through fixed-length file names", func() {
+			long := "fd00:1234:5678:9abc:def0:1234:5678:9abc"
+			reserveHashed("id1", long)
+			reserveHashed("id1", "fd00::2")
+			reserveHashed("id2", "10.0.0.2")
+
+			files, err := ioutil.ReadDir(filepath.Join(tmpDir, "hashed"))
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, f := range files {
+				if strings.HasPrefix(f.Name(), "ip-") {
+					names = append(names, f.Name())
+					Expect(f.Name()).To(HaveLen(35))
+				}
+			}
+			Expect(names).To(HaveLen(3))
+
+			ips, err := hashed.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(ConsistOf(net.ParseIP(long), net.ParseIP("fd00::2")))
+
+			list, err := hashed.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(3))
+			for _, r := range list {
+				Expect(r.ReservedAt).ToNot(BeZero())
+			}
+
+			reserved, owner, err := hashed.Reserve("id3", net.ParseIP(long))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeFalse())
+			Expect(owner).To(Equal("id1"))
+		})
+
+		It("releases by IP, by ID and by age", func() {
+			reserveHashed("id1", "fd00::2")
+			reserveHashed("id1", "fd00::3")
+			reserveHashed("id2", "fd00::4")
+
+			Expect(hashed.ReleaseByIP("id2", net.ParseIP("fd00::2"))).To(MatchError("fd00::2 is not reserved by container id2"))
+			Expect(hashed.ReleaseByIP("id2", net.ParseIP("fd00::9"))).To(MatchError("fd00::9 is not reserved"))
+			Expect(hashed.ReleaseByIP("id1", net.ParseIP("fd00::2"))).To(Succeed())
+
+			Expect(hashed.ReleaseByID("id1")).To(Succeed())
+			ips, err := hashed.GetByID("id1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ips).To(BeEmpty())
+
+			freed, err := hashed.ReleaseExpired(time.Now().Add(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(freed).To(Equal([]net.IP{net.ParseIP("fd00::4")}))
+		})
+
+		It("keeps reservations made without hashed names when repairing", func() {
+			reserveHashed("id1", "fd00::2")
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "hashed", "fd00::3"), []byte("id2"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "hashed", "ip-0123"), []byte("id3\n"+time.Now().UTC().Format(time.RFC3339Nano)+"\nfd00::4"), 0644)).To(Succeed())
+
+			n, err := types.ParseCIDR("fd00::/64")
+			Expect(err).ToNot(HaveOccurred())
+			report, err := hashed.Check(&sequential.IPAMConfig{Subnet: types.IPNet(*n)}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Invalid).To(HaveLen(2))
+			Expect(report.Invalid[0].Name).To(Equal("fd00::3"))
+			Expect(report.Invalid[0].Removed).To(BeFalse())
+			Expect(report.Invalid[1]).To(Equal(InvalidFile{Name: "ip-0123", Reason: "file name does not match the hash of fd00::4", Removed: true}))
+
+			list, err := hashed.List()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+			Expect(list[0].IP.String()).To(Equal("fd00::2"))
+		})
+	})
+})
@@ -0,0 +1,168 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// unindexed hides the reservation index of a store, so that the scan
+// calls Reserve on every candidate as it does for other stores
+type unindexed struct {
+	backend.Store
+}
+
+// BenchmarkGetNearlyFull allocates the one free address of a /16 whose
+// other addresses are all reserved, starting the scan right after it so
+// that the whole range is walked. Run it with
+//
+//	go test -run '^$' -bench GetNearlyFull ./plugins/ipam/store/disk
+func BenchmarkGetNearlyFull(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "host-local-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	subnet, err := types.ParseCIDR("10.1.0.0/16")
+	if err != nil {
+		b.Fatal(err)
+	}
+	conf := &sequential.IPAMConfig{
+		Name:    "bench",
+		DataDir: tmpDir,
+		Subnet:  types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+	}
+	s, err := New(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	// reserve 10.1.0.2 - 10.1.255.254 but for the free one, writing the
+	// files directly as going through Reserve would take a while
+	free := net.ParseIP("10.1.128.0").To4()
+	dir := filepath.Join(tmpDir, "bench")
+	for cur := net.ParseIP("10.1.0.2").To4(); !cur.Equal(net.ParseIP("10.1.255.255").To4()); cur = ip.NextIP(cur) {
+		if cur.Equal(free) {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, cur.String()), []byte("other"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bc := range []struct {
+		name  string
+		store backend.Store
+	}{
+		{"indexed", s},
+		{"unindexed", unindexed{s}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			alloc, err := sequential.NewIPAllocator(conf, bc.store)
+			if err != nil {
+				b.Fatal(err)
+			}
+			get := func() {
+				// each plugin invocation builds the index anew
+				if err := s.RefreshIndex(); err != nil {
+					b.Fatal(err)
+				}
+				res, err := alloc.Get("bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !res.IP.IP.Equal(free) {
+					b.Fatalf("allocated %s, expected %s", res.IP.IP, free)
+				}
+				// releasing reads every reservation file, which is not
+				// what is measured
+				b.StopTimer()
+				if err := alloc.Release("bench"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			// once the free address was handed out, each scan resumes
+			// right after it
+			get()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				get()
+			}
+		})
+	}
+}
+
+// BenchmarkList lists a /18 whose addresses are all reserved, with the
+// reservation files in one directory and sharded per /24. Run it with
+//
+//	go test -run '^$' -bench List ./plugins/ipam/store/disk
+func BenchmarkList(b *testing.B) {
+	for _, bc := range []struct {
+		name        string
+		shardPrefix int
+	}{
+		{"flat", 0},
+		{"sharded", 24},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			tmpDir, err := ioutil.TempDir("", "host-local-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			s, err := New(&sequential.IPAMConfig{Name: "bench", DataDir: tmpDir, ShardPrefix: bc.shardPrefix})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+
+			// write the files directly, as going through Reserve would
+			// take a while
+			for cur := net.ParseIP("10.1.0.0").To4(); !cur.Equal(net.ParseIP("10.1.64.0").To4()); cur = ip.NextIP(cur) {
+				path := s.reservationPath(cur)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					b.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte("other"), 0644); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				list, err := s.List()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(list) != 1<<14 {
+					b.Fatalf("listed %d reservations, expected %d", len(list), 1<<14)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// CheckReport lists the problems Check found in the data directory
+type CheckReport struct {
+	// Invalid holds the files that are neither reservations nor
+	// bookkeeping files of the store, and reservation files that
+	// cannot be parsed
+	Invalid []InvalidFile
+	// OutOfNetwork holds the reservations of IPs outside the subnets
+	// of the network, as left behind when a network is renumbered
+	OutOfNetwork []backend.Reservation
+	// Duplicates holds the containers that reserve more than one IP of
+	// a family, which is only expected of block reservations
+	Duplicates []Duplicate
+}
+
+// InvalidFile is a file of the data directory Check could not make
+// sense of
+type InvalidFile struct {
+	Name    string
+	Reason  string
+	Removed bool
+}
+
+// Duplicate lists the IPs of one family reserved by a container
+type Duplicate struct {
+	ID  string
+	IPs []net.IP
+}
+
+// Check scans the data directory under the store lock and reports the
+// files that could make List and the allocators misbehave. With repair
+// set it also removes the invalid files. Reservations outside the
+// network and duplicate reservations are only reported: they may still
+// belong to running containers, whose DEL releases them.
+func (s *Store) Check(conf *sequential.IPAMConfig, repair bool) (*CheckReport, error) {
+	if err := s.lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	names, err := s.checkedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{}
+	held := map[string]map[bool][]net.IP{}
+	var ids []string
+	for _, name := range names {
+		path := filepath.Join(s.dataDir, name)
+		var r backend.Reservation
+		reason := ""
+		// a reservation made before hashFilenames or shardPrefix was
+		// changed is not corrupt, so it is kept even when repairing
+		keep := false
+		if base := filepath.Base(name); !s.isReservation(base) {
+			switch {
+			case !s.hashFilenames:
+				reason = "file name is not an IP address"
+			case net.ParseIP(base) != nil:
+				reason = "reservation file is not named after a hash, but hashFilenames is set"
+				keep = true
+			default:
+				reason = "file name is not a hashed reservation name"
+			}
+		} else if r, err = s.readReservation(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			reason = err.Error()
+		} else if r.ID == "" {
+			reason = "reservation has no container ID"
+		} else if s.hashFilenames && filepath.Base(s.reservationPath(r.IP)) != base {
+			reason = fmt.Sprintf("file name does not match the hash of %s", r.IP)
+		} else if s.reservationPath(r.IP) != path {
+			reason = "reservation file is not in the directory shardPrefix places it in"
+			keep = true
+		}
+
+		if reason != "" {
+			invalid := InvalidFile{Name: name, Reason: reason}
+			if repair && !keep {
+				if err := s.remove(path); err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+				invalid.Removed = true
+			}
+			report.Invalid = append(report.Invalid, invalid)
+			continue
+		}
+
+		if !conf.InNetwork(r.IP) {
+			report.OutOfNetwork = append(report.OutOfNetwork, r)
+		}
+		if held[r.ID] == nil {
+			held[r.ID] = map[bool][]net.IP{}
+			ids = append(ids, r.ID)
+		}
+		v6 := r.IP.To4() == nil
+		held[r.ID][v6] = append(held[r.ID][v6], r.IP)
+	}
+
+	for _, id := range ids {
+		for _, v6 := range []bool{false, true} {
+			if ips := held[id][v6]; len(ips) > 1 {
+				report.Duplicates = append(report.Duplicates, Duplicate{ID: id, IPs: ips})
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkedFiles returns the names of the files Check looks at, relative
+// to the data directory: those of the data directory but for the
+// bookkeeping files, followed by those of each shard directory
+func (s *Store) checkedFiles() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var names, shards []string
+	for _, info := range files {
+		switch {
+		case info.IsDir() && isShardDir(filepath.Join(s.dataDir, info.Name()), s.dataDir):
+			shards = append(shards, info.Name())
+		case !info.IsDir() && !isBookkeeping(info.Name()):
+			names = append(names, info.Name())
+		}
+	}
+	for _, shard := range shards {
+		files, err := ioutil.ReadDir(filepath.Join(s.dataDir, shard))
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range files {
+			if !info.IsDir() && !isBookkeeping(info.Name()) {
+				names = append(names, filepath.Join(shard, info.Name()))
+			}
+		}
+	}
+	return names, nil
+}
+
+// isBookkeeping reports whether name is one of the files the store
+// keeps besides reservations, or a temporary file that may be about to
+// become one
+func isBookkeeping(name string) bool {
+	switch name {
+	case lastIPFile, lastIP6File, highWaterMarkFile, highWaterMark6File, freedIPFile, freedIP6File, tokensFile, networkFile:
+		return true
+	}
+	return strings.HasPrefix(name, lastIPFile+"-") || strings.HasPrefix(name, ".tmp-")
+}
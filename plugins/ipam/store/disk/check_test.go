@@ -0,0 +1,119 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("disk store check", func() {
+	var (
+		tmpDir string
+		conf   *sequential.IPAMConfig
+		s      *Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host-local-check")
+		Expect(err).ToNot(HaveOccurred())
+
+		n, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		conf = &sequential.IPAMConfig{Name: "net", DataDir: tmpDir, Subnet: types.IPNet(*n)}
+		s, err = New(conf)
+		Expect(err).ToNot(HaveOccurred())
+
+		for addr, id := range map[string]string{"10.0.0.2": "a", "10.0.0.3": "b", "10.0.0.4": "b", "10.0.9.2": "c"} {
+			reserved, _, err := s.Reserve(id, net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+		Expect(s.SetLastReservedIP("10.0.0.2-10.0.0.254", net.ParseIP("10.0.0.4"))).To(Succeed())
+		Expect(s.PushFreed(net.ParseIP("10.0.0.9"))).To(Succeed())
+
+		plant := func(name, contents string) {
+			Expect(ioutil.WriteFile(filepath.Join(s.dataDir, name), []byte(contents), 0644)).To(Succeed())
+		}
+		plant("10.0.0.5", "d\nnot a time")
+		plant("10.0.0.6", "")
+		plant("garbage", "a")
+	})
+
+	AfterEach(func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(s.dataDir, name))
+		return err == nil
+	}
+
+	It("reports invalid files, reservations outside the network and duplicates", func() {
+		report, err := s.Check(conf, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(report.Invalid).To(HaveLen(3))
+		Expect(report.Invalid[0].Name).To(Equal("10.0.0.5"))
+		Expect(report.Invalid[0].Reason).To(ContainSubstring("invalid reservation time"))
+		Expect(report.Invalid[1]).To(Equal(InvalidFile{Name: "10.0.0.6", Reason: "reservation has no container ID"}))
+		Expect(report.Invalid[2]).To(Equal(InvalidFile{Name: "garbage", Reason: "file name is not an IP address"}))
+
+		Expect(report.OutOfNetwork).To(HaveLen(1))
+		Expect(report.OutOfNetwork[0].IP.String()).To(Equal("10.0.9.2"))
+		Expect(report.OutOfNetwork[0].ID).To(Equal("c"))
+
+		Expect(report.Duplicates).To(HaveLen(1))
+		Expect(report.Duplicates[0].ID).To(Equal("b"))
+		Expect(report.Duplicates[0].IPs).To(Equal([]net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")}))
+
+		for _, name := range []string{"10.0.0.5", "10.0.0.6", "garbage"} {
+			Expect(exists(name)).To(BeTrue(), name)
+		}
+	})
+
+	It("removes only the invalid files when repairing", func() {
+		report, err := s.Check(conf, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Invalid).To(HaveLen(3))
+		for _, invalid := range report.Invalid {
+			Expect(invalid.Removed).To(BeTrue())
+			Expect(exists(invalid.Name)).To(BeFalse(), invalid.Name)
+		}
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(4))
+		for _, name := range []string{lastIPFile, freedIPFile} {
+			Expect(exists(name)).To(BeTrue(), name)
+		}
+		last, err := s.LastReservedIP("10.0.0.2-10.0.0.254", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.4"))
+
+		report, err = s.Check(conf, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Invalid).To(BeEmpty())
+	})
+})
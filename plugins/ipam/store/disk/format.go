@@ -0,0 +1,79 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// reservationFile is the contents of a reservation file written with the
+// "json" storeFormat
+type reservationFile struct {
+	ID         string    `json:"id"`
+	ReservedAt time.Time `json:"reservedAt"`
+	IP         net.IP    `json:"ip"`
+	Label      string    `json:"label,omitempty"`
+}
+
+// encodeReservation returns the contents of the reservation file of ip
+// held by the container with given ID, in the format of the store
+func (s *Store) encodeReservation(id string, ip net.IP) (string, error) {
+	now := time.Now().UTC()
+	if s.jsonFormat {
+		data, err := json.Marshal(reservationFile{ID: id, ReservedAt: now, IP: ip, Label: s.label})
+		return string(data), err
+	}
+
+	// the reservation time follows the ID on a second line, and a hashed
+	// file name requires the IP on a third. A label goes on a fourth,
+	// after the IP.
+	data := id + "\n" + now.Format(time.RFC3339Nano)
+	if s.hashFilenames || s.label != "" {
+		data += "\n" + ip.String()
+	}
+	if s.label != "" {
+		data += "\n" + s.label
+	}
+	return data, nil
+}
+
+// isJSONReservation reports whether data was written in the "json"
+// storeFormat. Container IDs never start with a brace, so files of
+// either format can be told apart whatever the storeFormat.
+func isJSONReservation(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func (s *Store) parseJSONReservation(path string, data []byte) (backend.Reservation, error) {
+	var f reservationFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return backend.Reservation{}, fmt.Errorf("invalid reservation in %s: %v", path, err)
+	}
+	r := backend.Reservation{IP: f.IP, ID: f.ID, ReservedAt: f.ReservedAt, Label: f.Label}
+	if !s.hashFilenames {
+		r.IP = net.ParseIP(filepath.Base(path))
+	}
+	if r.IP == nil {
+		return backend.Reservation{}, fmt.Errorf("missing IP address in %s", path)
+	}
+	return r, nil
+}
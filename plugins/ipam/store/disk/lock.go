@@ -15,13 +15,38 @@
 package disk
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 )
 
-// FileLock wraps os.File to be used as a lock using flock
+// defaultLockRetryInterval is the first delay between attempts to take
+// a lock with a timeout
+const defaultLockRetryInterval = 10 * time.Millisecond
+
+// maxLockBackoff caps the delay between attempts
+const maxLockBackoff = time.Second
+
+// ErrLockTimeout is returned by Lock when the lock could not be taken
+// within the timeout
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// FileLock wraps os.File to be used as a lock using flock. It may be
+// taken again while held, and is only released by the matching number
+// of Unlock calls, so that an operation taking the lock on its own can
+// run under a caller that already holds it.
 type FileLock struct {
 	f *os.File
+
+	mu    sync.Mutex
+	depth int
+	// timeout bounds how long Lock waits; zero waits indefinitely
+	timeout       time.Duration
+	retryInterval time.Duration
 }
 
 // NewFileLock opens file/dir at path and returns unlocked FileLock object
@@ -31,7 +56,19 @@ func NewFileLock(path string) (*FileLock, error) {
 		return nil, err
 	}
 
-	return &FileLock{f}, nil
+	return &FileLock{f: f}, nil
+}
+
+// SetTimeout makes Lock give up with ErrLockTimeout once timeout has
+// passed, polling for the lock with a jittered backoff that starts at
+// retryInterval and doubles up to one second. A zero timeout waits
+// indefinitely and a zero retryInterval starts at 10ms.
+func (l *FileLock) SetTimeout(timeout, retryInterval time.Duration) {
+	if retryInterval <= 0 {
+		retryInterval = defaultLockRetryInterval
+	}
+	l.timeout = timeout
+	l.retryInterval = retryInterval
 }
 
 // Close closes underlying file
@@ -41,10 +78,61 @@ func (l *FileLock) Close() error {
 
 // Lock acquires an exclusive lock
 func (l *FileLock) Lock() error {
-	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.depth > 0 {
+		l.depth++
+		return nil
+	}
+	if err := l.flock(); err != nil {
+		return err
+	}
+	l.depth = 1
+	return nil
 }
 
-// Unlock releases the lock
+// flock takes the flock of the file, waiting up to the timeout
+func (l *FileLock) flock() error {
+	if l.timeout <= 0 {
+		return syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX)
+	}
+
+	deadline := time.Now().Add(l.timeout)
+	backoff := l.retryInterval
+	for {
+		err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%w on %s after %v", ErrLockTimeout, l.f.Name(), l.timeout)
+		}
+		// sleep between half and all of the backoff so that contending
+		// plugins spread out
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		if backoff *= 2; backoff > maxLockBackoff {
+			backoff = maxLockBackoff
+		}
+	}
+}
+
+// Unlock releases the lock once it has been unlocked as many times as
+// it was locked
 func (l *FileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.depth > 1 {
+		l.depth--
+		return nil
+	}
+	l.depth = 0
 	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
 }
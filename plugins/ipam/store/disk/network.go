@@ -0,0 +1,184 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+)
+
+// networkFile records the name of the network the store belongs to on
+// its first line, followed by one subnet of the network per line
+const networkFile = "network"
+
+// NetworkConflictError is returned by New when the store belongs to a
+// network whose subnet overlaps one of the incoming network without
+// being the same, or to a network of another name with an overlapping
+// subnet, so that an IP file would stand for addresses of both
+type NetworkConflictError struct {
+	Dir string
+	// Network and Subnet are recorded in the store, Other and
+	// OtherSubnet come with the incoming network
+	Network     string
+	Subnet      *net.IPNet
+	Other       string
+	OtherSubnet *net.IPNet
+}
+
+func (e *NetworkConflictError) Error() string {
+	return fmt.Sprintf("IPAM store directory %s belongs to network %s with subnet %s, which conflicts with subnet %s of network %s", e.Dir, e.Network, e.Subnet, e.OtherSubnet, e.Other)
+}
+
+// checkNetwork returns a NetworkConflictError if the store already
+// belongs to a network that conflicts with n. Otherwise the name and
+// subnets of n are recorded by the first Reserve, unless they already
+// are.
+func (s *Store) checkNetwork(n *sequential.IPAMConfig) error {
+	s.network = n.Name
+	s.subnets = networkSubnets(n)
+
+	name, recorded, err := readNetwork(s.networkPath())
+	if err != nil {
+		return err
+	}
+	if err := s.networkConflict(name, recorded); err != nil {
+		return err
+	}
+	s.recordPending = recorded == nil || !containsAll(recorded, s.subnets)
+	return nil
+}
+
+// recordNetwork records the network of the store, adding its subnets to
+// those recorded by other networks of the same name, such as an earlier
+// configuration without subnet6. It checks for a conflict again under
+// the store lock, as another network may have been recorded since New.
+func (s *Store) recordNetwork() error {
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	name, recorded, err := readNetwork(s.networkPath())
+	if err != nil {
+		return err
+	}
+	if err := s.networkConflict(name, recorded); err != nil {
+		return err
+	}
+	if recorded == nil {
+		name = s.network
+	}
+	for _, c := range s.subnets {
+		if !containsAll(recorded, []*net.IPNet{c}) {
+			recorded = append(recorded, c)
+		}
+	}
+	if err := s.replace(s.networkPath(), formatNetwork(name, recorded)); err != nil {
+		return err
+	}
+	s.recordPending = false
+	return nil
+}
+
+// networkConflict returns a NetworkConflictError if a recorded subnet
+// overlaps one of the store's network and either differs from it or was
+// recorded by a network of another name
+func (s *Store) networkConflict(name string, recorded []*net.IPNet) error {
+	for _, r := range recorded {
+		for _, c := range s.subnets {
+			if !r.Contains(c.IP) && !c.Contains(r.IP) {
+				continue
+			}
+			if name != s.network || r.String() != c.String() {
+				return &NetworkConflictError{s.dataDir, name, r, s.network, c}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) networkPath() string {
+	return filepath.Join(s.dataDir, networkFile)
+}
+
+// networkSubnets returns the subnet, subnet6 and the subnets under
+// "subnets" of n, masked to their network addresses
+func networkSubnets(n *sequential.IPAMConfig) []*net.IPNet {
+	all := []types.IPNet{n.Subnet, n.Subnet6}
+	for _, s := range n.Subnets {
+		all = append(all, s.Subnet)
+	}
+	var subnets []*net.IPNet
+	for _, s := range all {
+		if s.IP != nil {
+			subnets = append(subnets, &net.IPNet{IP: s.IP.Mask(s.Mask), Mask: s.Mask})
+		}
+	}
+	return subnets
+}
+
+// containsAll reports whether every subnet of subnets was recorded
+func containsAll(recorded, subnets []*net.IPNet) bool {
+	for _, c := range subnets {
+		found := false
+		for _, r := range recorded {
+			if r.String() == c.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// readNetwork returns the network name and subnets recorded at path,
+// or a nil list if nothing was recorded yet
+func readNetwork(path string) (string, []*net.IPNet, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	subnets := []*net.IPNet{}
+	for _, line := range lines[1:] {
+		_, subnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return "", nil, fmt.Errorf("malformed network file %s: %v", path, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return lines[0], subnets, nil
+}
+
+func formatNetwork(name string, subnets []*net.IPNet) string {
+	lines := []string{name}
+	for _, s := range subnets {
+		lines = append(lines, s.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net"
+	"time"
+)
+
+// dryRunStore answers reservations against a snapshot of the wrapped
+// store and keeps them in memory, so that an allocation can be worked
+// out without writing anything to the wrapped store
+type dryRunStore struct {
+	Store
+	// taken maps every reserved IP, real or pretend, to its holder;
+	// it is loaded from the wrapped store on first use
+	taken   map[string]string
+	pretend []Reservation
+}
+
+// NewDryRun wraps s so that reservations, releases and high-water marks
+// are never written through to it. Reads, locking and Close are passed
+// on, while the last reserved IP and the high-water mark stay at the
+// values of s. Expired reservations are not reclaimed, and freed IPs
+// are neither recorded nor reused.
+func NewDryRun(s Store) Store {
+	return &dryRunStore{Store: s}
+}
+
+func (s *dryRunStore) load() error {
+	if s.taken != nil {
+		return nil
+	}
+	reservations, err := s.Store.List()
+	if err != nil {
+		return err
+	}
+	s.taken = make(map[string]string, len(reservations))
+	for _, r := range reservations {
+		s.taken[r.IP.String()] = r.ID
+	}
+	return nil
+}
+
+func (s *dryRunStore) Reserve(id string, ip net.IP) (bool, string, error) {
+	if err := s.load(); err != nil {
+		return false, "", err
+	}
+	if owner, ok := s.taken[ip.String()]; ok {
+		return owner == id, owner, nil
+	}
+	s.taken[ip.String()] = id
+	s.pretend = append(s.pretend, Reservation{IP: ip, ID: id, ReservedAt: time.Now()})
+	return true, id, nil
+}
+
+func (s *dryRunStore) SetHighWaterMark(ip net.IP) error {
+	return nil
+}
+
+func (s *dryRunStore) SetLastReservedIP(rangeID string, ip net.IP) error {
+	return nil
+}
+
+func (s *dryRunStore) PushFreed(ip net.IP) error {
+	return nil
+}
+
+func (s *dryRunStore) PopFreed(v6 bool) (net.IP, error) {
+	return nil, nil
+}
+
+// release drops the pretend reservations that match
+func (s *dryRunStore) release(match func(Reservation) bool) {
+	kept := s.pretend[:0]
+	for _, r := range s.pretend {
+		if match(r) {
+			delete(s.taken, r.IP.String())
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.pretend = kept
+}
+
+func (s *dryRunStore) Release(ip net.IP) error {
+	s.release(func(r Reservation) bool { return r.IP.Equal(ip) })
+	return nil
+}
+
+func (s *dryRunStore) ReleaseByID(id string) error {
+	s.release(func(r Reservation) bool { return r.ID == id })
+	return nil
+}
+
+func (s *dryRunStore) ReleaseByIP(id string, ip net.IP) error {
+	s.release(func(r Reservation) bool { return r.ID == id && r.IP.Equal(ip) })
+	return nil
+}
+
+func (s *dryRunStore) GetByID(id string) ([]net.IP, error) {
+	ips, err := s.Store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range s.pretend {
+		if r.ID == id {
+			ips = append(ips, r.IP)
+		}
+	}
+	return ips, nil
+}
+
+func (s *dryRunStore) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if owner, ok := s.taken[ip.String()]; !ok || owner != from {
+		return false, nil
+	}
+	s.taken[ip.String()] = to
+	for i := range s.pretend {
+		if s.pretend[i].IP.Equal(ip) {
+			s.pretend[i].ID = to
+		}
+	}
+	return true, nil
+}
+
+func (s *dryRunStore) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (s *dryRunStore) List() ([]Reservation, error) {
+	reservations, err := s.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	return append(reservations, s.pretend...), nil
+}
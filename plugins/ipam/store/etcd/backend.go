@@ -0,0 +1,594 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcd stores reservations in etcd so that the nodes of a
+// cluster can allocate from a shared subnet without handing out the same
+// IP twice. It talks to the v3 JSON gateway that etcd serves next to its
+// gRPC API, so no etcd client library is needed.
+//
+// Consistency: an IP is reserved with a transaction that only creates
+// its key if the key does not exist yet, so two nodes can never both
+// reserve the same IP, even if they race or the store lock is lost.
+// Lock takes etcd's distributed lock on a lease of lockTTL; if a holder
+// stalls or is partitioned from the cluster for longer than that, its
+// lease expires and another node may enter while the first still
+// believes it holds the lock. Only the advisory state guarded by the
+// lock, the last reserved IP and the round-robin high-water mark, may
+// then be overwritten out of order, which at worst changes where the
+// next scan starts. A node that cannot reach a quorum fails Lock and
+// every other call with an error instead of allocating from stale
+// data, since reads are linearizable.
+package etcd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+const (
+	defaultPrefix = "/cni/ipam/"
+	// lockTTL bounds how long a crashed or partitioned plugin can keep
+	// other nodes out of the network's store
+	lockTTL = 30 * time.Second
+	// requestTimeout covers waiting for the lock, so it exceeds lockTTL
+	requestTimeout = 2 * lockTTL
+)
+
+type Store struct {
+	client    *http.Client
+	endpoints []string
+	// prefix is the key prefix of the network, ending in "/"
+	prefix string
+
+	lease   json.Number
+	lockKey []byte
+}
+
+// record is the value stored under the key of a reserved IP
+type record struct {
+	ID         string    `json:"id"`
+	ReservedAt time.Time `json:"reservedAt"`
+}
+
+// New connects to the etcd cluster configured in the "etcd" block
+func New(n *sequential.IPAMConfig) (*Store, error) {
+	c := n.Etcd
+	if c == nil || len(c.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd store requires at least one endpoint")
+	}
+
+	transport := &http.Transport{}
+	if c.CertFile != "" || c.TrustedCAFile != "" {
+		tlsConfig, err := newTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	endpoints := make([]string, len(c.Endpoints))
+	for i, e := range c.Endpoints {
+		endpoints[i] = strings.TrimSuffix(e, "/")
+	}
+
+	return &Store{
+		client:    &http.Client{Transport: transport, Timeout: requestTimeout},
+		endpoints: endpoints,
+		prefix:    prefix + n.Name + "/",
+	}, nil
+}
+
+func newTLSConfig(c *sequential.EtcdConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.TrustedCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TrustedCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TrustedCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Requests and responses of the v3 JSON gateway. Keys and values are
+// base64 encoded by encoding/json since they are []byte.
+
+type keyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type rangeResponse struct {
+	Kvs []keyValue `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type deleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type compare struct {
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+type requestOp struct {
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare"`
+	Success []requestOp `json:"success"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL"`
+}
+
+type leaseGrantResponse struct {
+	ID json.Number `json:"ID"`
+}
+
+type leaseRevokeRequest struct {
+	ID json.Number `json:"ID"`
+}
+
+type lockRequest struct {
+	Name  []byte      `json:"name"`
+	Lease json.Number `json:"lease"`
+}
+
+type lockResponse struct {
+	Key []byte `json:"key"`
+}
+
+type unlockRequest struct {
+	Key []byte `json:"key"`
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// call posts req to the gateway method, trying each endpoint in turn
+// until one answers
+func (s *Store) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		r, err := s.client.Post(endpoint+"/v3/"+method, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		if r.StatusCode != http.StatusOK {
+			var e errorResponse
+			if json.Unmarshal(data, &e) == nil && (e.Error != "" || e.Message != "") {
+				if e.Message == "" {
+					e.Message = e.Error
+				}
+				return fmt.Errorf("etcd %s: %s", method, e.Message)
+			}
+			return fmt.Errorf("etcd %s: %s", method, r.Status)
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(data, resp)
+	}
+	return fmt.Errorf("etcd %s: no endpoint reachable: %v", method, lastErr)
+}
+
+func (s *Store) get(key string) ([]byte, error) {
+	var resp rangeResponse
+	if err := s.call("kv/range", rangeRequest{Key: []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (s *Store) put(key string, value []byte) error {
+	return s.call("kv/put", putRequest{Key: []byte(key), Value: value}, nil)
+}
+
+func (s *Store) ipKey(ip net.IP) string {
+	return s.prefix + "ips/" + ip.String()
+}
+
+func (s *Store) lastReservedKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "last_reserved_ip6"
+	}
+	return s.prefix + "last_reserved_ip"
+}
+
+func (s *Store) lastInRangeKey(rangeID string) string {
+	return s.prefix + "last_reserved_range/" + rangeID
+}
+
+func (s *Store) highWaterMarkKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "high_water_mark6"
+	}
+	return s.prefix + "high_water_mark"
+}
+
+func (s *Store) freedKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "freed_ips6"
+	}
+	return s.prefix + "freed_ips"
+}
+
+func (s *Store) Lock() error {
+	var grant leaseGrantResponse
+	if err := s.call("lease/grant", leaseGrantRequest{TTL: int64(lockTTL / time.Second)}, &grant); err != nil {
+		return err
+	}
+
+	var lock lockResponse
+	err := s.call("lock/lock", lockRequest{Name: []byte(s.prefix + "lock"), Lease: grant.ID}, &lock)
+	if err != nil {
+		s.call("lease/revoke", leaseRevokeRequest{ID: grant.ID}, nil)
+		return err
+	}
+	s.lease = grant.ID
+	s.lockKey = lock.Key
+	return nil
+}
+
+func (s *Store) Unlock() error {
+	if s.lockKey == nil {
+		return nil
+	}
+	err := s.call("lock/unlock", unlockRequest{Key: s.lockKey}, nil)
+	// revoking the lease drops the lock even if the unlock failed
+	if rerr := s.call("lease/revoke", leaseRevokeRequest{ID: s.lease}, nil); err == nil {
+		err = rerr
+	}
+	s.lease = ""
+	s.lockKey = nil
+	return err
+}
+
+func (s *Store) Close() error {
+	if t, ok := s.client.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
+	value, err := json.Marshal(record{ID: id, ReservedAt: time.Now().UTC()})
+	if err != nil {
+		return false, "", err
+	}
+	key := []byte(s.ipKey(ip))
+
+	// only create the key if nobody else holds the IP
+	var resp txnResponse
+	err = s.call("kv/txn", txnRequest{
+		Compare: []compare{{Target: "CREATE", Key: key, CreateRevision: "0"}},
+		Success: []requestOp{
+			{RequestPut: &putRequest{Key: key, Value: value}},
+			{RequestPut: &putRequest{Key: []byte(s.lastReservedKey(ip.To4() == nil)), Value: []byte(ip.String())}},
+		},
+	}, &resp)
+	if err != nil {
+		return false, "", err
+	}
+	if resp.Succeeded {
+		return true, id, nil
+	}
+
+	// the IP is taken; a retried request from its owner still succeeds
+	value, err = s.get(string(key))
+	if err != nil || value == nil {
+		return false, "", err
+	}
+	var r record
+	if err := json.Unmarshal(value, &r); err != nil {
+		return false, "", err
+	}
+	return r.ID == id, r.ID, nil
+}
+
+// LastReservedIP returns the last reserved IP of the given range or,
+// failing that, of the given family if exists
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	ip, err := s.getIP(s.lastInRangeKey(rangeID))
+	if err != nil || ip != nil {
+		return ip, err
+	}
+	return s.getIP(s.lastReservedKey(v6))
+}
+
+// SetLastReservedIP records ip as the last reserved IP of the range
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	return s.put(s.lastInRangeKey(rangeID), []byte(ip.String()))
+}
+
+// HighWaterMark returns the high-water mark of the given family if
+// exists
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	return s.getIP(s.highWaterMarkKey(v6))
+}
+
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	return s.put(s.highWaterMarkKey(ip.To4() == nil), []byte(ip.String()))
+}
+
+// PushFreed records ip as the most recently freed IP of its family.
+// The caller must hold the store lock.
+func (s *Store) PushFreed(ip net.IP) error {
+	key := s.freedKey(ip.To4() == nil)
+	value, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	stack := append(backend.RemoveIP(backend.ParseIPs(value), ip), ip)
+	return s.put(key, backend.FormatIPs(stack))
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none. The caller must hold the store lock.
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	key := s.freedKey(v6)
+	value, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	stack := backend.ParseIPs(value)
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	if err := s.put(key, backend.FormatIPs(stack[:len(stack)-1])); err != nil {
+		return nil, err
+	}
+	return stack[len(stack)-1], nil
+}
+
+func (s *Store) getIP(key string) (net.IP, error) {
+	value, err := s.get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return net.ParseIP(string(value)), nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	return s.call("kv/deleterange", deleteRangeRequest{Key: []byte(s.ipKey(ip))}, nil)
+}
+
+// releaseIfUnchanged deletes the reservation of kv unless it was
+// changed since kv was read
+func (s *Store) releaseIfUnchanged(kv keyValue) error {
+	return s.call("kv/txn", txnRequest{
+		Compare: []compare{{Target: "VALUE", Key: kv.Key, Value: kv.Value}},
+		Success: []requestOp{{RequestDeleteRange: &deleteRangeRequest{Key: kv.Key}}},
+	}, nil)
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	kvs, err := s.reservations()
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if kv.rec.ID != id {
+			continue
+		}
+		if err := s.releaseIfUnchanged(kv.keyValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	key := s.ipKey(ip)
+	value, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	var rec record
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return err
+	}
+	if rec.ID != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	return s.releaseIfUnchanged(keyValue{Key: []byte(key), Value: value})
+}
+
+// ChangeOwner rewrites the reservation of ip for the container with ID
+// to, in a transaction that fails if it changed since it was read
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	key := s.ipKey(ip)
+	old, err := s.get(key)
+	if err != nil || old == nil {
+		return false, err
+	}
+	var rec record
+	if err := json.Unmarshal(old, &rec); err != nil {
+		return false, err
+	}
+	if rec.ID != from {
+		return false, nil
+	}
+	value, err := json.Marshal(record{ID: to, ReservedAt: time.Now().UTC()})
+	if err != nil {
+		return false, err
+	}
+
+	var resp txnResponse
+	err = s.call("kv/txn", txnRequest{
+		Compare: []compare{{Target: "VALUE", Key: []byte(key), Value: old}},
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(key), Value: value}}},
+	}, &resp)
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	kvs, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, kv := range kvs {
+		if kv.rec.ID == id {
+			ips = append(ips, kv.ip)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	kvs, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	var freed []net.IP
+	for _, kv := range kvs {
+		if kv.rec.ID == backend.PreReservedID || kv.rec.ReservedAt.IsZero() || !kv.rec.ReservedAt.Before(before) {
+			continue
+		}
+		if err := s.releaseIfUnchanged(kv.keyValue); err != nil {
+			return freed, err
+		}
+		freed = append(freed, kv.ip)
+	}
+	return freed, nil
+}
+
+// List returns every reservation in the store
+func (s *Store) List() ([]backend.Reservation, error) {
+	kvs, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]backend.Reservation, 0, len(kvs))
+	for _, kv := range kvs {
+		list = append(list, backend.Reservation{IP: kv.ip, ID: kv.rec.ID, ReservedAt: kv.rec.ReservedAt})
+	}
+	return list, nil
+}
+
+type reservation struct {
+	keyValue
+	ip  net.IP
+	rec record
+}
+
+// reservations reads every key under the ips/ prefix of the network
+func (s *Store) reservations() ([]reservation, error) {
+	prefix := []byte(s.prefix + "ips/")
+	var resp rangeResponse
+	if err := s.call("kv/range", rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)}, &resp); err != nil {
+		return nil, err
+	}
+
+	list := make([]reservation, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ip := net.ParseIP(string(kv.Key[len(prefix):]))
+		if ip == nil {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, fmt.Errorf("reservation of %s: %v", ip, err)
+		}
+		list = append(list, reservation{kv, ip, rec})
+	}
+	return list, nil
+}
+
+// prefixEnd returns the range end that selects every key starting with
+// prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every byte is 0xff: select to the end of the keyspace
+	return []byte{0}
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"net"
+	"net/http/httptest"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("etcd store", func() {
+	var (
+		gateway *fakeGateway
+		server  *httptest.Server
+		conf    *sequential.IPAMConfig
+	)
+
+	newStore := func() *Store {
+		s, err := New(conf)
+		Expect(err).ToNot(HaveOccurred())
+		return s
+	}
+
+	BeforeEach(func() {
+		gateway = newFakeGateway()
+		server = httptest.NewServer(gateway)
+		subnet, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		conf = &sequential.IPAMConfig{
+			Name:   "test",
+			Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			Etcd:   &sequential.EtcdConfig{Endpoints: []string{server.URL}},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("requires an endpoint", func() {
+		conf.Etcd = nil
+		_, err := New(conf)
+		Expect(err).To(MatchError("etcd store requires at least one endpoint"))
+	})
+
+	It("reserves, lists and releases IPs", func() {
+		s := newStore()
+		reserved, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, _, err = s.Reserve("ID", net.ParseIP("fd00::2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		Expect(gateway.kv).To(HaveKey("/cni/ipam/test/ips/10.0.0.2"))
+
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+		last, err = s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::2"))
+
+		ips, err := s.GetByID("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+
+		Expect(s.ReleaseByID("ID")).To(Succeed())
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+	})
+
+	It("never reserves an IP held by another node", func() {
+		node1, node2 := newStore(), newStore()
+		reserved, _, err := node1.Reserve("ID1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reserved, _, err = node2.Reserve("ID2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		ips, err := node2.GetByID("ID1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+
+		// the holder may reserve it again from any node
+		reserved, _, err = node2.Reserve("ID1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	})
+
+	It("only releases an IP for its holder", func() {
+		s := newStore()
+		_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.ReleaseByIP("other", net.ParseIP("10.0.0.2"))).To(MatchError("10.0.0.2 is not reserved by container other"))
+		Expect(s.ReleaseByIP("ID", net.ParseIP("10.0.0.3"))).To(MatchError("10.0.0.3 is not reserved"))
+		Expect(s.ReleaseByIP("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+		Expect(gateway.kv).ToNot(HaveKey("/cni/ipam/test/ips/10.0.0.2"))
+	})
+
+	It("only moves an IP from its holder", func() {
+		s := newStore()
+		_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "other", "new")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeFalse())
+		moved, err = s.ChangeOwner(net.ParseIP("10.0.0.2"), "ID", "new")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeTrue())
+		ips, err := s.GetByID("new")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].String()).To(Equal("10.0.0.2"))
+	})
+
+	It("releases reservations made before a given time", func() {
+		s := newStore()
+		_, _, err := s.Reserve("old", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		cutoff := time.Now()
+		time.Sleep(time.Millisecond)
+		_, _, err = s.Reserve("new", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+
+		freed, err := s.ReleaseExpired(cutoff)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(HaveLen(1))
+		Expect(freed[0].String()).To(Equal("10.0.0.2"))
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(1))
+		Expect(list[0].ID).To(Equal("new"))
+	})
+
+	It("keeps a high-water mark per family", func() {
+		s := newStore()
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.9"))).To(Succeed())
+		mark, err := s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("10.0.0.9"))
+		mark, err = s.HighWaterMark(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark).To(BeNil())
+	})
+
+	It("keeps a stack of freed IPs per family", func() {
+		s := newStore()
+		for _, addr := range []string{"10.0.0.2", "fd00::2", "10.0.0.3"} {
+			Expect(s.PushFreed(net.ParseIP(addr))).To(Succeed())
+		}
+		for _, expected := range []string{"10.0.0.3", "10.0.0.2"} {
+			ip, err := s.PopFreed(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal(expected))
+		}
+		ip, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+		ip, err = s.PopFreed(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::2"))
+	})
+
+	It("uses the configured key prefix", func() {
+		conf.Etcd.Prefix = "/site1"
+		_, _, err := newStore().Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gateway.kv).To(HaveKey("/site1/test/ips/10.0.0.2"))
+	})
+
+	It("fails over to the next endpoint", func() {
+		dead := httptest.NewServer(gateway)
+		dead.Close()
+		conf.Etcd.Endpoints = []string{dead.URL, server.URL}
+		reserved, _, err := newStore().Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		conf.Etcd.Endpoints = []string{dead.URL}
+		_, _, err = newStore().Reserve("ID", net.ParseIP("10.0.0.3"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("etcd kv/txn: no endpoint reachable"))
+	})
+
+	Context("when locking", func() {
+		// lockAsync locks s in the background, closing the returned
+		// channel once the lock is held
+		lockAsync := func(s *Store) chan struct{} {
+			locked := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				Expect(s.Lock()).To(Succeed())
+				close(locked)
+			}()
+			return locked
+		}
+
+		It("excludes other nodes until unlocked", func() {
+			node1, node2 := newStore(), newStore()
+			Expect(node1.Lock()).To(Succeed())
+
+			locked := lockAsync(node2)
+			Consistently(locked, "100ms").ShouldNot(BeClosed())
+
+			Expect(node1.Unlock()).To(Succeed())
+			Eventually(locked).Should(BeClosed())
+			Expect(node2.Unlock()).To(Succeed())
+			Expect(gateway.leases).To(BeEmpty())
+		})
+
+		It("lets another node in once the holder's lease expires", func() {
+			node1, node2 := newStore(), newStore()
+			Expect(node1.Lock()).To(Succeed())
+
+			locked := lockAsync(node2)
+			Consistently(locked, "100ms").ShouldNot(BeClosed())
+			gateway.expire(string(node1.lease))
+			Eventually(locked).Should(BeClosed())
+
+			// both nodes now believe they hold the lock, but only one
+			// of them can reserve a given IP
+			r1, _, err := node1.Reserve("ID1", net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			r2, _, err := node2.Reserve("ID2", net.ParseIP("10.0.0.2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect([]bool{r1, r2}).To(Equal([]bool{true, false}))
+		})
+	})
+
+	It("hands out distinct IPs to allocators on different nodes", func() {
+		seen := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			alloc, err := sequential.NewIPAllocator(conf, newStore())
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(seen).ToNot(HaveKey(res.IP.IP.String()))
+			seen[res.IP.IP.String()] = true
+		}
+	})
+})
@@ -0,0 +1,172 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// fakeGateway serves the subset of the etcd v3 JSON gateway used by the
+// store, keeping the keyspace in memory
+type fakeGateway struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	kv        map[string][]byte
+	nextLease int64
+	leases    map[string]bool
+	// locks maps a lock name to the lease holding it
+	locks map[string]string
+}
+
+func newFakeGateway() *fakeGateway {
+	g := &fakeGateway{
+		kv:     map[string][]byte{},
+		leases: map[string]bool{},
+		locks:  map[string]string{},
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// expire drops a lease as etcd does once its TTL runs out, releasing
+// the lock held on it
+func (g *fakeGateway) expire(lease string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.revoke(lease)
+}
+
+func (g *fakeGateway) revoke(lease string) {
+	delete(g.leases, lease)
+	for name, holder := range g.locks {
+		if holder == lease {
+			delete(g.locks, name)
+		}
+	}
+	g.cond.Broadcast()
+}
+
+func (g *fakeGateway) inRange(key string, r rangeRequest) bool {
+	if len(r.RangeEnd) == 0 {
+		return key == string(r.Key)
+	}
+	if key < string(r.Key) {
+		return false
+	}
+	return bytes.Equal(r.RangeEnd, []byte{0}) || key < string(r.RangeEnd)
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// lock/lock waits on cond, which releases mu while it blocks
+	var resp interface{} = struct{}{}
+	status := http.StatusOK
+	dec := json.NewDecoder(r.Body)
+
+	g.mu.Lock()
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req rangeRequest
+		dec.Decode(&req)
+		var keys []string
+		for k := range g.kv {
+			if g.inRange(k, req) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var out rangeResponse
+		for _, k := range keys {
+			out.Kvs = append(out.Kvs, keyValue{Key: []byte(k), Value: g.kv[k]})
+		}
+		resp = out
+	case "/v3/kv/put":
+		var req putRequest
+		dec.Decode(&req)
+		g.kv[string(req.Key)] = req.Value
+	case "/v3/kv/deleterange":
+		var req deleteRangeRequest
+		dec.Decode(&req)
+		delete(g.kv, string(req.Key))
+	case "/v3/kv/txn":
+		var req txnRequest
+		dec.Decode(&req)
+		succeeded := true
+		for _, c := range req.Compare {
+			v, ok := g.kv[string(c.Key)]
+			switch c.Target {
+			case "CREATE":
+				succeeded = succeeded && c.CreateRevision == "0" && !ok
+			case "VALUE":
+				succeeded = succeeded && ok && bytes.Equal(v, c.Value)
+			}
+		}
+		if succeeded {
+			for _, op := range req.Success {
+				if op.RequestPut != nil {
+					g.kv[string(op.RequestPut.Key)] = op.RequestPut.Value
+				}
+				if op.RequestDeleteRange != nil {
+					delete(g.kv, string(op.RequestDeleteRange.Key))
+				}
+			}
+		}
+		resp = txnResponse{Succeeded: succeeded}
+	case "/v3/lease/grant":
+		g.nextLease++
+		id := strconv.FormatInt(g.nextLease, 10)
+		g.leases[id] = true
+		resp = map[string]string{"ID": id, "TTL": "30"}
+	case "/v3/lease/revoke":
+		var req leaseRevokeRequest
+		dec.Decode(&req)
+		g.revoke(string(req.ID))
+	case "/v3/lock/lock":
+		var req lockRequest
+		dec.Decode(&req)
+		name := string(req.Name)
+		for g.locks[name] != "" && g.leases[string(req.Lease)] {
+			g.cond.Wait()
+		}
+		if !g.leases[string(req.Lease)] {
+			status = http.StatusNotFound
+			resp = errorResponse{Error: "etcdserver: requested lease not found"}
+			break
+		}
+		g.locks[name] = string(req.Lease)
+		resp = lockResponse{Key: []byte(name + "/" + string(req.Lease))}
+	case "/v3/lock/unlock":
+		var req unlockRequest
+		dec.Decode(&req)
+		for name, lease := range g.locks {
+			if string(req.Key) == name+"/"+lease {
+				delete(g.locks, name)
+			}
+		}
+		g.cond.Broadcast()
+	default:
+		status = http.StatusNotFound
+		resp = errorResponse{Error: "Not Found"}
+	}
+	g.mu.Unlock()
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
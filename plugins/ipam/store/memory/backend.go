@@ -0,0 +1,270 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+// Store keeps reservations in process memory. It mirrors the semantics
+// of the disk store and is meant for tests and ephemeral use.
+type Store struct {
+	// lock is the store-wide lock exposed through Lock/Unlock
+	lock sync.Mutex
+
+	// mu guards the fields below
+	mu             sync.Mutex
+	ipMap          map[string]string
+	reservedAt     map[string]time.Time
+	lastReservedIP map[bool]net.IP
+	// lastInRange holds the last reserved IP of each range ID
+	lastInRange   map[string]net.IP
+	highWaterMark map[bool]net.IP
+	// freed holds the stack of freed IPs of each family, most
+	// recently freed last
+	freed map[bool][]net.IP
+}
+
+func New() *Store {
+	s := &Store{}
+	s.reset()
+	return s
+}
+
+// reset empties the store; the caller must hold mu or own the store
+func (s *Store) reset() {
+	s.ipMap = map[string]string{}
+	s.reservedAt = map[string]time.Time{}
+	s.lastReservedIP = map[bool]net.IP{}
+	s.lastInRange = map[string]net.IP{}
+	s.highWaterMark = map[bool]net.IP{}
+	s.freed = map[bool][]net.IP{}
+}
+
+// Clear removes every reservation and the bookkeeping of the scans
+func (s *Store) Clear() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.ipMap)
+	s.reset()
+	return n, nil
+}
+
+// Lock acquires the store-wide lock
+func (s *Store) Lock() error {
+	s.lock.Lock()
+	return nil
+}
+
+// Unlock releases the store-wide lock
+func (s *Store) Unlock() error {
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if owner, ok := s.ipMap[key]; ok {
+		return owner == id, owner, nil
+	}
+	s.ipMap[key] = id
+	s.reservedAt[key] = time.Now()
+	s.lastReservedIP[ip.To4() == nil] = ip
+	return true, id, nil
+}
+
+// LastReservedIP returns the last reserved IP of the given range or,
+// failing that, of the given family if exists
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ip, ok := s.lastInRange[rangeID]; ok {
+		return ip, nil
+	}
+	return s.lastReservedIP[v6], nil
+}
+
+// SetLastReservedIP records ip as the last reserved IP of the range
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastInRange[rangeID] = ip
+	return nil
+}
+
+// HighWaterMark returns the high-water mark of the given family if
+// exists
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.highWaterMark[v6], nil
+}
+
+// SetHighWaterMark records ip as the high-water mark of its family
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.highWaterMark[ip.To4() == nil] = ip
+	return nil
+}
+
+// PushFreed records ip as the most recently freed IP of its family
+func (s *Store) PushFreed(ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v6 := ip.To4() == nil
+	s.freed[v6] = append(backend.RemoveIP(s.freed[v6], ip), ip)
+	return nil
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stack := s.freed[v6]
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	s.freed[v6] = stack[:len(stack)-1]
+	return stack[len(stack)-1], nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.ipMap, ip.String())
+	delete(s.reservedAt, ip.String())
+	return nil
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range s.ipMap {
+		if v == id {
+			delete(s.ipMap, k)
+			delete(s.reservedAt, k)
+		}
+	}
+	return nil
+}
+
+// ReleaseByIP releases ip if it is reserved by the container with given
+// ID and returns an error otherwise
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	owner, ok := s.ipMap[key]
+	if !ok {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	if owner != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	delete(s.ipMap, key)
+	delete(s.reservedAt, key)
+	return nil
+}
+
+// GetByID returns the IPs reserved for the container with given ID
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ips []net.IP
+	for k, v := range s.ipMap {
+		if v == id {
+			ips = append(ips, net.ParseIP(k))
+		}
+	}
+	return ips, nil
+}
+
+// ChangeOwner moves the reservation of ip from the container with ID
+// from to the one with ID to
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if owner, ok := s.ipMap[key]; !ok || owner != from {
+		return false, nil
+	}
+	s.ipMap[key] = to
+	s.reservedAt[key] = time.Now()
+	return true, nil
+}
+
+// ReleaseExpired releases all reservations made before the given time,
+// other than pre-reserved IPs, and returns the freed IPs
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed []net.IP
+	for k, t := range s.reservedAt {
+		if t.Before(before) && s.ipMap[k] != backend.PreReservedID {
+			delete(s.ipMap, k)
+			delete(s.reservedAt, k)
+			freed = append(freed, net.ParseIP(k))
+		}
+	}
+	return freed, nil
+}
+
+// Owner returns the ID of the container holding ip, or "" if ip is not
+// reserved
+func (s *Store) Owner(ip net.IP) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ipMap[ip.String()], nil
+}
+
+// List returns every reservation in the store
+func (s *Store) List() ([]backend.Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []backend.Reservation
+	for k, v := range s.ipMap {
+		list = append(list, backend.Reservation{IP: net.ParseIP(k), ID: v, ReservedAt: s.reservedAt[k]})
+	}
+	return list, nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("memory store", func() {
+	var s *Store
+
+	BeforeEach(func() {
+		s = New()
+	})
+
+	It("refuses to reserve a taken IP", func() {
+		reserved, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reserved, owner, err := s.Reserve("id2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		Expect(owner).To(Equal("id1"))
+	})
+
+	It("reserves an IP again for the container holding it", func() {
+		reserved, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reserved, _, err = s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	})
+
+	It("tracks the last reserved IP", func() {
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last).To(BeNil())
+
+		_, _, err = s.Reserve("id", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+		last, err = s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+	})
+
+	It("tracks the last reserved IP of each family separately", func() {
+		_, _, err := s.Reserve("id", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = s.Reserve("id", net.ParseIP("fd00::3"))
+		Expect(err).ToNot(HaveOccurred())
+
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+		last, err = s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::3"))
+	})
+
+	It("tracks the last reserved IP of each range separately", func() {
+		_, _, err := s.Reserve("id", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.SetLastReservedIP("a", net.ParseIP("10.0.1.7"))).To(Succeed())
+
+		last, err := s.LastReservedIP("a", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.1.7"))
+		last, err = s.LastReservedIP("b", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+	})
+
+	It("tracks the high-water mark of each family", func() {
+		mark, err := s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark).To(BeNil())
+
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.5"))).To(Succeed())
+		Expect(s.SetHighWaterMark(net.ParseIP("fd00::5"))).To(Succeed())
+		mark, err = s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("10.0.0.5"))
+		mark, err = s.HighWaterMark(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("fd00::5"))
+	})
+
+	It("keeps a stack of freed IPs per family", func() {
+		ip, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3", "fd00::2", "10.0.0.2"} {
+			Expect(s.PushFreed(net.ParseIP(addr))).To(Succeed())
+		}
+		// 10.0.0.2 was pushed twice and only moved to the top
+		for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+			ip, err := s.PopFreed(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal(expected))
+		}
+		ip, err = s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		ip, err = s.PopFreed(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::2"))
+	})
+
+	It("releases every reservation for a container", func() {
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3"} {
+			_, _, err := s.Reserve("id1", net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, _, err := s.Reserve("id2", net.ParseIP("10.0.0.4"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.ReleaseByID("id1")).To(Succeed())
+
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3"} {
+			reserved, _, err := s.Reserve("id3", net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+		reserved, _, err := s.Reserve("id3", net.ParseIP("10.0.0.4"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+	})
+
+	It("releases a single IP only for its owner", func() {
+		_, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		err = s.ReleaseByIP("id2", net.ParseIP("10.0.0.2"))
+		Expect(err).To(MatchError("10.0.0.2 is not reserved by container id2"))
+
+		Expect(s.ReleaseByIP("id1", net.ParseIP("10.0.0.2"))).To(Succeed())
+		err = s.ReleaseByIP("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).To(MatchError("10.0.0.2 is not reserved"))
+	})
+
+	It("moves a reservation only from its owner", func() {
+		_, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "id2", "id3")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeFalse())
+		moved, err = s.ChangeOwner(net.ParseIP("10.0.0.3"), "id1", "id3")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeFalse())
+
+		moved, err = s.ChangeOwner(net.ParseIP("10.0.0.2"), "id1", "id2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeTrue())
+		owner, err := s.Owner(net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(owner).To(Equal("id2"))
+	})
+
+	It("releases reservations made before a given time", func() {
+		_, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		cutoff := time.Now().Add(time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		_, _, err = s.Reserve("id2", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+
+		freed, err := s.ReleaseExpired(cutoff)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(HaveLen(1))
+		Expect(freed[0].String()).To(Equal("10.0.0.2"))
+
+		ips, err := s.GetByID("id2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("clears every reservation and the bookkeeping", func() {
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3", "fd00::2"} {
+			_, _, err := s.Reserve("id", net.ParseIP(addr))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(s.SetLastReservedIP("range", net.ParseIP("10.0.0.3"))).To(Succeed())
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.3"))).To(Succeed())
+		Expect(s.PushFreed(net.ParseIP("10.0.0.4"))).To(Succeed())
+
+		cleared, err := s.Clear()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cleared).To(Equal(3))
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+		last, err := s.LastReservedIP("range", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last).To(BeNil())
+		hwm, err := s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hwm).To(BeNil())
+		freed, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(BeNil())
+	})
+
+	It("lists every reservation", func() {
+		_, _, err := s.Reserve("id1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = s.Reserve("id2", net.ParseIP("fd00::2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		owners := map[string]string{}
+		for _, r := range list {
+			owners[r.IP.String()] = r.ID
+			Expect(r.ReservedAt).To(BeTemporally("~", time.Now(), time.Minute))
+		}
+		Expect(owners).To(Equal(map[string]string{"10.0.0.2": "id1", "fd00::2": "id2"}))
+	})
+
+	It("backs the sequential allocator", func() {
+		subnet, err := types.ParseCIDR("10.0.0.0/29")
+		Expect(err).ToNot(HaveOccurred())
+		conf := &sequential.IPAMConfig{
+			Name:   "test",
+			Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		}
+		alloc, err := sequential.NewIPAllocator(conf, s)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, expected := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.IP.IP.String()).To(Equal(expected))
+		}
+
+		Expect(alloc.Release("ID")).To(Succeed())
+		res, err := alloc.Get("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IP.IP.String()).To(Equal("10.0.0.5"))
+	})
+})
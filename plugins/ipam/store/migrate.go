@@ -0,0 +1,79 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+// MigrateResult sorts the reservations of the source store of a
+// migration by what became of them in the target
+type MigrateResult struct {
+	// Migrated are the reservations newly made in the target
+	Migrated []Reservation
+	// Skipped are the reservations the target already held for the
+	// same container
+	Skipped []Reservation
+	// Conflicts are the reservations whose IP the target holds for
+	// another container; they are left to be resolved by hand
+	Conflicts []Reservation
+}
+
+// Migrate copies every reservation of src into dst under the lock of
+// dst, keeping container IDs and IPs. Reservations dst already holds
+// are skipped, so an interrupted migration can simply be run again.
+// The reservation times are those of the migration, since stores
+// record the time a reservation is made.
+func Migrate(src, dst Store) (*MigrateResult, error) {
+	list, err := src.List()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dst.Lock(); err != nil {
+		return nil, err
+	}
+	defer dst.Unlock()
+
+	existing, err := dst.List()
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string, len(existing))
+	for _, r := range existing {
+		owners[r.IP.String()] = r.ID
+	}
+
+	res := &MigrateResult{}
+	for _, r := range list {
+		if owner, ok := owners[r.IP.String()]; ok {
+			if owner == r.ID {
+				res.Skipped = append(res.Skipped, r)
+			} else {
+				res.Conflicts = append(res.Conflicts, r)
+			}
+			continue
+		}
+		reserved, _, err := dst.Reserve(r.ID, r.IP)
+		if err != nil {
+			return res, err
+		}
+		if !reserved {
+			// taken concurrently, for instance by an ADD against a store
+			// that does not lock
+			res.Conflicts = append(res.Conflicts, r)
+			continue
+		}
+		owners[r.IP.String()] = r.ID
+		res.Migrated = append(res.Migrated, r)
+	}
+	return res, nil
+}
@@ -0,0 +1,543 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redis stores reservations in a Redis server so that the nodes
+// of a cluster can allocate from a shared subnet. It speaks the Redis
+// protocol directly, so no client library is needed.
+//
+// Consistency: an IP is reserved with SET NX, which only creates its
+// key if the key does not exist yet, so two nodes can never both
+// reserve the same IP, even if the store lock is lost. Lock is a single
+// instance RedLock: a key holding a random token that expires after
+// lockTTL and is only deleted by the holder of that token. If a holder
+// stalls for longer than lockTTL another node may enter while the first
+// still believes it holds the lock; the last reserved IPs are then kept
+// in sorted sets scored by time, so out of order writes cannot move
+// them backwards. A server that cannot be reached fails every call with
+// an error instead of blocking the plugin.
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+)
+
+const defaultPrefix = "cni/ipam/"
+
+// compareAndDelete deletes KEYS[1] only if it still holds ARGV[1]
+const compareAndDelete = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// compareAndSet sets KEYS[1] to ARGV[2] only if it still holds ARGV[1]
+const compareAndSet = `if redis.call("GET", KEYS[1]) == ARGV[1] then redis.call("SET", KEYS[1], ARGV[2]) return 1 else return 0 end`
+
+var (
+	// lockTTL bounds how long a crashed or partitioned plugin can keep
+	// other nodes out of the network's store
+	lockTTL = 30 * time.Second
+	// defaultLockRetry is the interval at which a waiting Lock tries
+	// again unless lockRetryInterval is set
+	defaultLockRetry = 50 * time.Millisecond
+)
+
+type Store struct {
+	conn *conn
+	// prefix is the key prefix of the network, ending in "/"
+	prefix  string
+	network string
+
+	lockWait  time.Duration
+	lockRetry time.Duration
+	lockToken string
+}
+
+// record is the value stored under the key of a reserved IP
+type record struct {
+	ID         string    `json:"id"`
+	ReservedAt time.Time `json:"reservedAt"`
+}
+
+// New connects to the Redis server configured in the "redis" block
+func New(n *sequential.IPAMConfig) (*Store, error) {
+	c := n.Redis
+	if c == nil || c.Address == "" {
+		return nil, fmt.Errorf("redis store requires an address")
+	}
+
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	lockWait := time.Duration(n.LockTimeout)
+	if lockWait <= 0 {
+		lockWait = 2 * lockTTL
+	}
+	lockRetry := time.Duration(n.LockRetryInterval)
+	if lockRetry <= 0 {
+		lockRetry = defaultLockRetry
+	}
+
+	s := &Store{
+		conn:      &conn{addr: c.Address, password: c.Password, db: c.DB},
+		prefix:    prefix + n.Name + "/",
+		network:   n.Name,
+		lockWait:  lockWait,
+		lockRetry: lockRetry,
+	}
+	// fail early with a clear error if the server cannot be reached
+	if _, err := s.conn.do("PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) get(key string) (string, bool, error) {
+	reply, err := s.conn.do("GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis GET: unexpected reply %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *Store) set(key, value string) error {
+	_, err := s.conn.do("SET", key, value)
+	return err
+}
+
+func (s *Store) ipKey(ip net.IP) string {
+	return s.prefix + "ips/" + ip.String()
+}
+
+func (s *Store) lockKey() string {
+	return s.prefix + "lock"
+}
+
+func (s *Store) lastReservedKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "last_reserved_ip6"
+	}
+	return s.prefix + "last_reserved_ip"
+}
+
+func (s *Store) lastInRangeKey(rangeID string) string {
+	return s.prefix + "last_reserved_range/" + rangeID
+}
+
+func (s *Store) highWaterMarkKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "high_water_mark6"
+	}
+	return s.prefix + "high_water_mark"
+}
+
+func (s *Store) freedKey(v6 bool) string {
+	if v6 {
+		return s.prefix + "freed_ips6"
+	}
+	return s.prefix + "freed_ips"
+}
+
+func (s *Store) Lock() error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	s.lockToken = hex.EncodeToString(token)
+
+	ttl := strconv.FormatInt(int64(lockTTL/time.Millisecond), 10)
+	deadline := time.Now().Add(s.lockWait)
+	for {
+		reply, err := s.conn.do("SET", s.lockKey(), s.lockToken, "NX", "PX", ttl)
+		if err != nil {
+			s.lockToken = ""
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			s.lockToken = ""
+			return fmt.Errorf("timed out waiting for lock of network %s after %v", s.network, s.lockWait)
+		}
+		time.Sleep(s.lockRetry)
+	}
+}
+
+func (s *Store) Unlock() error {
+	if s.lockToken == "" {
+		return nil
+	}
+	token := s.lockToken
+	s.lockToken = ""
+	// another node may hold the lock by now, which must stay in place
+	deleted, err := s.conn.do("EVAL", compareAndDelete, "1", s.lockKey(), token)
+	if err != nil {
+		return err
+	}
+	if deleted == int64(0) {
+		return fmt.Errorf("lock of network %s expired after %v before it was released", s.network, lockTTL)
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	return s.conn.close()
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
+	value, err := json.Marshal(record{ID: id, ReservedAt: time.Now().UTC()})
+	if err != nil {
+		return false, "", err
+	}
+	key := s.ipKey(ip)
+
+	// only create the key if nobody else holds the IP
+	reply, err := s.conn.do("SET", key, string(value), "NX")
+	if err != nil {
+		return false, "", err
+	}
+	if reply != nil {
+		if err := s.setLast(s.lastReservedKey(ip.To4() == nil), ip); err != nil {
+			return false, "", err
+		}
+		return true, id, nil
+	}
+
+	// the IP is taken; a retried request from its owner still succeeds
+	owner, err := s.Owner(ip)
+	if err != nil {
+		return false, "", err
+	}
+	return owner == id, owner, nil
+}
+
+// Owner returns the ID of the container holding ip, or "" if it is free
+func (s *Store) Owner(ip net.IP) (string, error) {
+	value, ok, err := s.get(s.ipKey(ip))
+	if err != nil || !ok {
+		return "", err
+	}
+	var r record
+	if err := json.Unmarshal([]byte(value), &r); err != nil {
+		return "", fmt.Errorf("reservation of %s: %v", ip, err)
+	}
+	return r.ID, nil
+}
+
+// setLast adds ip to the sorted set key, scored by the current time,
+// and trims the set to its newest member
+func (s *Store) setLast(key string, ip net.IP) error {
+	score := strconv.FormatInt(time.Now().UnixNano()/int64(time.Microsecond), 10)
+	if _, err := s.conn.do("ZADD", key, score, ip.String()); err != nil {
+		return err
+	}
+	_, err := s.conn.do("ZREMRANGEBYRANK", key, "0", "-2")
+	return err
+}
+
+// getLast returns the newest member of the sorted set key, if any
+func (s *Store) getLast(key string) (net.IP, error) {
+	reply, err := s.conn.do("ZREVRANGE", key, "0", "0")
+	if err != nil {
+		return nil, err
+	}
+	members, ok := reply.([]interface{})
+	if !ok || len(members) == 0 {
+		return nil, nil
+	}
+	member, _ := members[0].(string)
+	return net.ParseIP(member), nil
+}
+
+// LastReservedIP returns the last reserved IP of the given range or,
+// failing that, of the given family if exists
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	ip, err := s.getLast(s.lastInRangeKey(rangeID))
+	if err != nil || ip != nil {
+		return ip, err
+	}
+	return s.getLast(s.lastReservedKey(v6))
+}
+
+// SetLastReservedIP records ip as the last reserved IP of the range
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	return s.setLast(s.lastInRangeKey(rangeID), ip)
+}
+
+// HighWaterMark returns the high-water mark of the given family if
+// exists
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	return s.getIP(s.highWaterMarkKey(v6))
+}
+
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	return s.set(s.highWaterMarkKey(ip.To4() == nil), ip.String())
+}
+
+// PushFreed records ip as the most recently freed IP of its family.
+// The caller must hold the store lock.
+func (s *Store) PushFreed(ip net.IP) error {
+	key := s.freedKey(ip.To4() == nil)
+	value, _, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	stack := append(backend.RemoveIP(backend.ParseIPs([]byte(value)), ip), ip)
+	return s.set(key, string(backend.FormatIPs(stack)))
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none. The caller must hold the store lock.
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	key := s.freedKey(v6)
+	value, _, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	stack := backend.ParseIPs([]byte(value))
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	if err := s.set(key, string(backend.FormatIPs(stack[:len(stack)-1]))); err != nil {
+		return nil, err
+	}
+	return stack[len(stack)-1], nil
+}
+
+func (s *Store) getIP(key string) (net.IP, error) {
+	value, ok, err := s.get(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return net.ParseIP(value), nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	_, err := s.conn.do("DEL", s.ipKey(ip))
+	return err
+}
+
+// releaseIfUnchanged deletes the reservation of r unless it was
+// changed since r was read
+func (s *Store) releaseIfUnchanged(r reservation) error {
+	_, err := s.conn.do("EVAL", compareAndDelete, "1", r.key, r.value)
+	return err
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	list, err := s.reservations()
+	if err != nil {
+		return err
+	}
+	for _, r := range list {
+		if r.rec.ID != id {
+			continue
+		}
+		if err := s.releaseIfUnchanged(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	key := s.ipKey(ip)
+	value, ok, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	var rec record
+	if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		return err
+	}
+	if rec.ID != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	return s.releaseIfUnchanged(reservation{key: key, value: value})
+}
+
+// ChangeOwner rewrites the reservation of ip for the container with ID
+// to, in a script that fails if it changed since it was read
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	key := s.ipKey(ip)
+	old, ok, err := s.get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	var rec record
+	if err := json.Unmarshal([]byte(old), &rec); err != nil {
+		return false, err
+	}
+	if rec.ID != from {
+		return false, nil
+	}
+	value, err := json.Marshal(record{ID: to, ReservedAt: time.Now().UTC()})
+	if err != nil {
+		return false, err
+	}
+
+	set, err := s.conn.do("EVAL", compareAndSet, "1", key, old, string(value))
+	if err != nil {
+		return false, err
+	}
+	return set == int64(1), nil
+}
+
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	list, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, r := range list {
+		if r.rec.ID == id {
+			ips = append(ips, r.ip)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	list, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	var freed []net.IP
+	for _, r := range list {
+		if r.rec.ID == backend.PreReservedID || r.rec.ReservedAt.IsZero() || !r.rec.ReservedAt.Before(before) {
+			continue
+		}
+		if err := s.releaseIfUnchanged(r); err != nil {
+			return freed, err
+		}
+		freed = append(freed, r.ip)
+	}
+	return freed, nil
+}
+
+// List returns every reservation in the store
+func (s *Store) List() ([]backend.Reservation, error) {
+	list, err := s.reservations()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]backend.Reservation, 0, len(list))
+	for _, r := range list {
+		out = append(out, backend.Reservation{IP: r.ip, ID: r.rec.ID, ReservedAt: r.rec.ReservedAt})
+	}
+	return out, nil
+}
+
+type reservation struct {
+	key   string
+	value string
+	ip    net.IP
+	rec   record
+}
+
+// reservations reads every key under the ips/ prefix of the network
+func (s *Store) reservations() ([]reservation, error) {
+	prefix := s.prefix + "ips/"
+	keys, err := s.scan(globEscape(prefix) + "*")
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	reply, err := s.conn.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, fmt.Errorf("redis MGET: unexpected reply %v", reply)
+	}
+
+	list := make([]reservation, 0, len(keys))
+	for i, key := range keys {
+		ip := net.ParseIP(key[len(prefix):])
+		// the key may have been released since it was scanned
+		value, ok := values[i].(string)
+		if ip == nil || !ok {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal([]byte(value), &rec); err != nil {
+			return nil, fmt.Errorf("reservation of %s: %v", ip, err)
+		}
+		list = append(list, reservation{key, value, ip, rec})
+	}
+	return list, nil
+}
+
+// scan returns every key matching pattern, following the SCAN cursor
+// until the server reports the iteration complete
+func (s *Store) scan(pattern string) ([]string, error) {
+	seen := map[string]bool{}
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.conn.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis SCAN: unexpected reply %v", reply)
+		}
+		cursor, _ = page[0].(string)
+		batch, _ := page[1].([]interface{})
+		// SCAN may return a key more than once
+		for _, k := range batch {
+			if key, ok := k.(string); ok && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// globEscape quotes the characters that are special in a SCAN pattern
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("redis store", func() {
+	var (
+		server *fakeServer
+		conf   *sequential.IPAMConfig
+	)
+
+	newStore := func() *Store {
+		s, err := New(conf)
+		Expect(err).ToNot(HaveOccurred())
+		return s
+	}
+
+	BeforeEach(func() {
+		server = newFakeServer()
+		subnet, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		conf = &sequential.IPAMConfig{
+			Name:   "test",
+			Subnet: types.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+			Redis:  &sequential.RedisConfig{Address: server.Addr()},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("requires an address", func() {
+		conf.Redis = nil
+		_, err := New(conf)
+		Expect(err).To(MatchError("redis store requires an address"))
+	})
+
+	It("reserves, lists and releases IPs", func() {
+		s := newStore()
+		reserved, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, _, err = s.Reserve("ID", net.ParseIP("fd00::2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		Expect(server.keys()).To(ContainElement("cni/ipam/test/ips/10.0.0.2"))
+
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+		last, err = s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::2"))
+
+		ips, err := s.GetByID("ID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+
+		Expect(s.ReleaseByID("ID")).To(Succeed())
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+	})
+
+	It("never reserves an IP held by another node", func() {
+		node1, node2 := newStore(), newStore()
+		reserved, _, err := node1.Reserve("ID1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reserved, owner, err := node2.Reserve("ID2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		Expect(owner).To(Equal("ID1"))
+
+		// the holder may reserve it again from any node
+		reserved, _, err = node2.Reserve("ID1", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	})
+
+	It("only releases an IP for its holder", func() {
+		s := newStore()
+		_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.ReleaseByIP("other", net.ParseIP("10.0.0.2"))).To(MatchError("10.0.0.2 is not reserved by container other"))
+		Expect(s.ReleaseByIP("ID", net.ParseIP("10.0.0.3"))).To(MatchError("10.0.0.3 is not reserved"))
+		Expect(s.ReleaseByIP("ID", net.ParseIP("10.0.0.2"))).To(Succeed())
+		Expect(server.keys()).ToNot(ContainElement("cni/ipam/test/ips/10.0.0.2"))
+	})
+
+	It("only moves an IP from its holder", func() {
+		s := newStore()
+		_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "other", "new")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeFalse())
+		moved, err = s.ChangeOwner(net.ParseIP("10.0.0.2"), "ID", "new")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeTrue())
+		owner, err := s.Owner(net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(owner).To(Equal("new"))
+	})
+
+	It("releases reservations made before a given time", func() {
+		s := newStore()
+		_, _, err := s.Reserve("old", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		cutoff := time.Now()
+		time.Sleep(time.Millisecond)
+		_, _, err = s.Reserve("new", net.ParseIP("10.0.0.3"))
+		Expect(err).ToNot(HaveOccurred())
+
+		freed, err := s.ReleaseExpired(cutoff)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(HaveLen(1))
+		Expect(freed[0].String()).To(Equal("10.0.0.2"))
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(1))
+		Expect(list[0].ID).To(Equal("new"))
+	})
+
+	It("tracks the newest last reserved IP of a range", func() {
+		s := newStore()
+		Expect(s.SetLastReservedIP("r1", net.ParseIP("10.0.0.5"))).To(Succeed())
+		time.Sleep(time.Millisecond)
+		Expect(s.SetLastReservedIP("r1", net.ParseIP("10.0.0.3"))).To(Succeed())
+
+		last, err := s.LastReservedIP("r1", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+		Expect(server.zsets["cni/ipam/test/last_reserved_range/r1"]).To(HaveLen(1))
+	})
+
+	It("keeps a stack of freed IPs per family", func() {
+		s := newStore()
+		for _, addr := range []string{"10.0.0.2", "fd00::2", "10.0.0.3"} {
+			Expect(s.PushFreed(net.ParseIP(addr))).To(Succeed())
+		}
+		for _, expected := range []string{"10.0.0.3", "10.0.0.2"} {
+			ip, err := s.PopFreed(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal(expected))
+		}
+		ip, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+		ip, err = s.PopFreed(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::2"))
+	})
+
+	It("uses the configured key prefix", func() {
+		conf.Redis.Prefix = "site[1]"
+		s := newStore()
+		_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.keys()).To(ContainElement("site[1]/test/ips/10.0.0.2"))
+
+		// glob characters in the prefix match literally
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(1))
+	})
+
+	Context("when the server is unavailable", func() {
+		It("fails to connect with a clear error", func() {
+			server.Close()
+			_, err := New(conf)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("redis server " + server.Addr() + " is unavailable"))
+		})
+
+		It("fails every call once the server goes away", func() {
+			s := newStore()
+			server.Close()
+			// drop the connection the store already holds
+			s.Close()
+
+			_, _, err := s.Reserve("ID", net.ParseIP("10.0.0.2"))
+			Expect(err).To(MatchError(HavePrefix("redis server " + server.Addr() + " is unavailable")))
+			Expect(s.Lock()).To(HaveOccurred())
+			_, err = s.List()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when locking", func() {
+		// lockAsync locks s in the background, closing the returned
+		// channel once the lock is held
+		lockAsync := func(s *Store) chan struct{} {
+			locked := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				Expect(s.Lock()).To(Succeed())
+				close(locked)
+			}()
+			return locked
+		}
+
+		It("excludes other nodes until unlocked", func() {
+			node1, node2 := newStore(), newStore()
+			Expect(node1.Lock()).To(Succeed())
+
+			locked := lockAsync(node2)
+			Consistently(locked, "100ms").ShouldNot(BeClosed())
+
+			Expect(node1.Unlock()).To(Succeed())
+			Eventually(locked).Should(BeClosed())
+			Expect(node2.Unlock()).To(Succeed())
+			Expect(server.keys()).ToNot(ContainElement("cni/ipam/test/lock"))
+		})
+
+		Context("with a short lock TTL", func() {
+			var savedTTL time.Duration
+
+			BeforeEach(func() {
+				savedTTL = lockTTL
+				lockTTL = 200 * time.Millisecond
+			})
+
+			AfterEach(func() {
+				lockTTL = savedTTL
+			})
+
+			It("lets another node in once the holder's lock expires", func() {
+				node1, node2 := newStore(), newStore()
+				Expect(node1.Lock()).To(Succeed())
+
+				locked := lockAsync(node2)
+				Consistently(locked, "100ms").ShouldNot(BeClosed())
+				Eventually(locked).Should(BeClosed())
+
+				// both nodes now believe they hold the lock, but only one
+				// of them can reserve a given IP
+				r1, _, err := node1.Reserve("ID1", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				r2, _, err := node2.Reserve("ID2", net.ParseIP("10.0.0.2"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect([]bool{r1, r2}).To(Equal([]bool{true, false}))
+
+				// the stale holder cannot release the new holder's lock
+				Expect(node1.Unlock()).To(MatchError(ContainSubstring("lock of network test expired")))
+				Expect(server.keys()).To(ContainElement("cni/ipam/test/lock"))
+				Expect(node2.Unlock()).To(Succeed())
+			})
+
+			It("gives up waiting after the lock timeout", func() {
+				conf.LockTimeout = sequential.Duration(50 * time.Millisecond)
+				node1, node2 := newStore(), newStore()
+				Expect(node1.Lock()).To(Succeed())
+				Expect(node2.Lock()).To(MatchError("timed out waiting for lock of network test after 50ms"))
+			})
+		})
+	})
+
+	It("hands out distinct IPs to allocators on different nodes", func() {
+		seen := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			alloc, err := sequential.NewIPAllocator(conf, newStore())
+			Expect(err).ToNot(HaveOccurred())
+			res, err := alloc.Get("ID")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(seen).ToNot(HaveKey(res.IP.IP.String()))
+			seen[res.IP.IP.String()] = true
+		}
+	})
+})
@@ -0,0 +1,196 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// commandTimeout bounds a single round trip, so a hung server fails
+	// the call instead of blocking the plugin
+	commandTimeout = 10 * time.Second
+)
+
+// redisError is an error reply of the server, after which the
+// connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// conn is a minimal client of the Redis serialization protocol. It
+// dials lazily and drops the connection on any I/O error, so the next
+// command reconnects.
+type conn struct {
+	addr     string
+	password string
+	db       int
+
+	mu sync.Mutex
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func (c *conn) dial() error {
+	nc, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("redis server %s is unavailable: %v", c.addr, err)
+	}
+	c.nc = nc
+	c.r = bufio.NewReader(nc)
+	if c.password != "" {
+		if _, err := c.roundTrip("AUTH", c.password); err != nil {
+			c.drop()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) drop() {
+	if c.nc != nil {
+		c.nc.Close()
+	}
+	c.nc = nil
+	c.r = nil
+}
+
+func (c *conn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nc == nil {
+		return nil
+	}
+	err := c.nc.Close()
+	c.nc = nil
+	c.r = nil
+	return err
+}
+
+// do sends a command and returns its reply: a string for simple and
+// bulk strings, an int64 for integers, a []interface{} for arrays and
+// nil for null replies
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nc == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	return c.roundTrip(args...)
+}
+
+func (c *conn) roundTrip(args ...string) (interface{}, error) {
+	c.nc.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.nc.Write(encodeCommand(args)); err != nil {
+		c.drop()
+		return nil, fmt.Errorf("redis %s: %v", args[0], err)
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.drop()
+		}
+		return nil, fmt.Errorf("redis %s: %v", args[0], err)
+	}
+	return reply, nil
+}
+
+func encodeCommand(args []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return b.Bytes()
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	default:
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeServer serves the subset of Redis used by the store, keeping the
+// keyspace in memory and honouring key expiry
+type fakeServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	kv      map[string]string
+	expires map[string]time.Time
+	zsets   map[string]map[string]float64
+}
+
+func newFakeServer() *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &fakeServer{
+		listener: l,
+		kv:       map[string]string{},
+		expires:  map[string]time.Time{},
+		zsets:    map[string]map[string]float64{},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		elems, _ := reply.([]interface{})
+		args := make([]string, len(elems))
+		for i, e := range elems {
+			args[i], _ = e.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		if _, err := c.Write(s.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+// keys returns the live keys, for assertions
+func (s *fakeServer) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.kv {
+		if s.live(k) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range s.zsets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *fakeServer) live(key string) bool {
+	if t, ok := s.expires[key]; ok && !time.Now().Before(t) {
+		delete(s.kv, key)
+		delete(s.expires, key)
+	}
+	_, ok := s.kv[key]
+	return ok
+}
+
+func (s *fakeServer) exec(args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return simple("PONG")
+	case "GET":
+		if !s.live(args[1]) {
+			return null()
+		}
+		return bulk(s.kv[args[1]])
+	case "MGET":
+		replies := make([][]byte, 0, len(args)-1)
+		for _, k := range args[1:] {
+			if s.live(k) {
+				replies = append(replies, bulk(s.kv[k]))
+			} else {
+				replies = append(replies, null())
+			}
+		}
+		return array(replies...)
+	case "SET":
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				ttl = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if nx && s.live(key) {
+			return null()
+		}
+		s.kv[key] = value
+		delete(s.expires, key)
+		if ttl > 0 {
+			s.expires[key] = time.Now().Add(ttl)
+		}
+		return simple("OK")
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if s.live(k) {
+				n++
+			}
+			delete(s.kv, k)
+			delete(s.expires, k)
+			delete(s.zsets, k)
+		}
+		return integer(n)
+	case "EVAL":
+		if args[1] != compareAndDelete && args[1] != compareAndSet {
+			return errorReply("ERR unknown script")
+		}
+		key, value := args[3], args[4]
+		if !s.live(key) || s.kv[key] != value {
+			return integer(0)
+		}
+		if args[1] == compareAndSet {
+			s.kv[key] = args[5]
+			return integer(1)
+		}
+		delete(s.kv, key)
+		delete(s.expires, key)
+		return integer(1)
+	case "SCAN":
+		// every key fits in one page
+		var keys [][]byte
+		for k := range s.kv {
+			if ok, _ := path.Match(args[3], k); ok && s.live(k) {
+				keys = append(keys, bulk(k))
+			}
+		}
+		return array(bulk("0"), array(keys...))
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		if s.zsets[args[1]] == nil {
+			s.zsets[args[1]] = map[string]float64{}
+		}
+		s.zsets[args[1]][args[3]] = score
+		return integer(1)
+	case "ZREMRANGEBYRANK":
+		// only trimming to the newest member is supported
+		members := s.ranked(args[1])
+		for _, m := range members[:len(members)-1] {
+			delete(s.zsets[args[1]], m)
+		}
+		return integer(len(members) - 1)
+	case "ZREVRANGE":
+		members := s.ranked(args[1])
+		if len(members) == 0 {
+			return array()
+		}
+		return array(bulk(members[len(members)-1]))
+	default:
+		return errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// ranked returns the members of a sorted set by ascending score
+func (s *fakeServer) ranked(key string) []string {
+	set := s.zsets[key]
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return set[members[i]] < set[members[j]] })
+	return members
+}
+
+func simple(s string) []byte     { return []byte("+" + s + "\r\n") }
+func errorReply(s string) []byte { return []byte("-" + s + "\r\n") }
+func integer(n int) []byte       { return []byte(fmt.Sprintf(":%d\r\n", n)) }
+func null() []byte               { return []byte("$-1\r\n") }
+
+func bulk(s string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+func array(elems ...[]byte) []byte {
+	b := []byte(fmt.Sprintf("*%d\r\n", len(elems)))
+	for _, e := range elems {
+		b = append(b, e...)
+	}
+	return b
+}
@@ -0,0 +1,363 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite stores the reservations of a network in a single-file
+// SQLite database, which keeps them queryable, for example by age, and
+// makes each change transactional.
+//
+// The package only depends on database/sql; a binary that uses it must
+// register a driver under the name "sqlite3", as host-local does when
+// built with the sqlite build tag.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+	"github.com/containernetworking/cni/plugins/ipam/store/disk"
+)
+
+const driverName = "sqlite3"
+
+var defaultDataDir = "/var/lib/cni/networks"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS reservations (
+	ip           TEXT PRIMARY KEY,
+	container_id TEXT NOT NULL,
+	reserved_at  INTEGER NOT NULL,
+	v6           INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reservations_container_id ON reservations (container_id);
+CREATE TABLE IF NOT EXISTS marks (
+	name TEXT PRIMARY KEY,
+	ip   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS freed (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	ip  TEXT NOT NULL UNIQUE,
+	v6  INTEGER NOT NULL
+);
+`
+
+// Store keeps reservations in <dataDir>/<network>.db. Lock takes an
+// advisory lock on <network>.db.lock next to it; SQLite serializes the
+// statements themselves, so a reservation is atomic even without it.
+type Store struct {
+	*disk.FileLock
+	db *sql.DB
+}
+
+func New(n *sequential.IPAMConfig) (*Store, error) {
+	dataDir := n.DataDir
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dataDir, n.Name+".db")
+
+	if !driverRegistered() {
+		return nil, fmt.Errorf("sqlite store is not available: no %q database driver is registered", driverName)
+	}
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection keeps the busy timeout below in effect for
+	// every statement
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	f.Close()
+	lk, err := disk.NewFileLock(lockPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	lk.SetTimeout(time.Duration(n.LockTimeout), time.Duration(n.LockRetryInterval))
+
+	return &Store{lk, db}, nil
+}
+
+func driverRegistered() bool {
+	for _, d := range sql.Drivers() {
+		if d == driverName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) Close() error {
+	err := s.db.Close()
+	if lerr := s.FileLock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, string, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO reservations (ip, container_id, reserved_at, v6) VALUES (?, ?, ?, ?) ON CONFLICT (ip) DO NOTHING",
+		ip.String(), id, time.Now().UnixNano(), ip.To4() == nil)
+	if err != nil {
+		return false, "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, "", err
+	}
+	if n == 1 {
+		return true, id, nil
+	}
+
+	// the IP is taken; a retried request from its owner still succeeds
+	var owner string
+	err = s.db.QueryRow("SELECT container_id FROM reservations WHERE ip = ?", ip.String()).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return owner == id, owner, nil
+}
+
+// LastReservedIP returns the last reserved IP recorded for the given
+// range or, failing that, the most recently reserved IP of the given
+// family that is still reserved
+func (s *Store) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	ip, err := s.queryIP("SELECT ip FROM marks WHERE name = ?", lastInRangeName(rangeID))
+	if err != nil || ip != nil {
+		return ip, err
+	}
+	return s.queryIP("SELECT ip FROM reservations WHERE v6 = ? ORDER BY reserved_at DESC, rowid DESC LIMIT 1", v6)
+}
+
+// HighWaterMark returns the high-water mark of the given family if
+// exists
+func (s *Store) HighWaterMark(v6 bool) (net.IP, error) {
+	return s.queryIP("SELECT ip FROM marks WHERE name = ?", highWaterMarkName(v6))
+}
+
+func (s *Store) SetHighWaterMark(ip net.IP) error {
+	_, err := s.db.Exec(
+		"INSERT INTO marks (name, ip) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET ip = excluded.ip",
+		highWaterMarkName(ip.To4() == nil), ip.String())
+	return err
+}
+
+// SetLastReservedIP records ip as the last reserved IP of the range
+func (s *Store) SetLastReservedIP(rangeID string, ip net.IP) error {
+	_, err := s.db.Exec(
+		"INSERT INTO marks (name, ip) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET ip = excluded.ip",
+		lastInRangeName(rangeID), ip.String())
+	return err
+}
+
+func lastInRangeName(rangeID string) string {
+	return "last_reserved_ip:" + rangeID
+}
+
+func highWaterMarkName(v6 bool) string {
+	if v6 {
+		return "high_water_mark6"
+	}
+	return "high_water_mark"
+}
+
+// PushFreed records ip as the most recently freed IP of its family
+func (s *Store) PushFreed(ip net.IP) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a freed IP recorded before moves to the top
+	if _, err := tx.Exec("DELETE FROM freed WHERE ip = ?", ip.String()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO freed (ip, v6) VALUES (?, ?)", ip.String(), ip.To4() == nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PopFreed removes and returns the most recently freed IP of the given
+// family, or nil if there is none
+func (s *Store) PopFreed(v6 bool) (net.IP, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var seq int64
+	var ip string
+	err = tx.QueryRow("SELECT seq, ip FROM freed WHERE v6 = ? ORDER BY seq DESC LIMIT 1", v6).Scan(&seq, &ip)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM freed WHERE seq = ?", seq); err != nil {
+		return nil, err
+	}
+	return net.ParseIP(ip), tx.Commit()
+}
+
+func (s *Store) queryIP(query string, args ...interface{}) (net.IP, error) {
+	var ip string
+	err := s.db.QueryRow(query, args...).Scan(&ip)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(ip), nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	_, err := s.db.Exec("DELETE FROM reservations WHERE ip = ?", ip.String())
+	return err
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	_, err := s.db.Exec("DELETE FROM reservations WHERE container_id = ?", id)
+	return err
+}
+
+func (s *Store) ReleaseByIP(id string, ip net.IP) error {
+	var owner string
+	err := s.db.QueryRow("SELECT container_id FROM reservations WHERE ip = ?", ip.String()).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	if err != nil {
+		return err
+	}
+	if owner != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
+	}
+	_, err = s.db.Exec("DELETE FROM reservations WHERE ip = ? AND container_id = ?", ip.String(), id)
+	return err
+}
+
+// ChangeOwner moves the reservation of ip from the container with ID
+// from to the one with ID to
+func (s *Store) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	res, err := s.db.Exec(
+		"UPDATE reservations SET container_id = ?, reserved_at = ? WHERE ip = ? AND container_id = ?",
+		to, time.Now().UnixNano(), ip.String(), from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *Store) GetByID(id string) ([]net.IP, error) {
+	return s.queryIPs("SELECT ip FROM reservations WHERE container_id = ? ORDER BY rowid", id)
+}
+
+func (s *Store) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// pre-reserved IPs never expire
+	rows, err := tx.Query("SELECT ip FROM reservations WHERE reserved_at < ? AND container_id != ? ORDER BY rowid", before.UnixNano(), backend.PreReservedID)
+	if err != nil {
+		return nil, err
+	}
+	freed, err := scanIPs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM reservations WHERE reserved_at < ? AND container_id != ?", before.UnixNano(), backend.PreReservedID); err != nil {
+		return nil, err
+	}
+	return freed, tx.Commit()
+}
+
+// List returns every reservation in the store
+func (s *Store) List() ([]backend.Reservation, error) {
+	rows, err := s.db.Query("SELECT ip, container_id, reserved_at FROM reservations ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []backend.Reservation
+	for rows.Next() {
+		var ip, id string
+		var reservedAt int64
+		if err := rows.Scan(&ip, &id, &reservedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, backend.Reservation{IP: net.ParseIP(ip), ID: id, ReservedAt: time.Unix(0, reservedAt)})
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) queryIPs(query string, args ...interface{}) ([]net.IP, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanIPs(rows)
+}
+
+// scanIPs reads a single column of IPs and closes rows
+func scanIPs(rows *sql.Rows) ([]net.IP, error) {
+	defer rows.Close()
+	var ips []net.IP
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, rows.Err()
+}
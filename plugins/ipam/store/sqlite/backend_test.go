@@ -0,0 +1,240 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build sqlite
+// +build sqlite
+
+package sqlite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/allocator/sequential"
+	"github.com/containernetworking/cni/plugins/ipam/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sqlite store", func() {
+	var (
+		tmpDir string
+		s      *Store
+	)
+
+	open := func() *Store {
+		store, err := New(&sequential.IPAMConfig{Name: "net", DataDir: tmpDir})
+		Expect(err).ToNot(HaveOccurred())
+		return store
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host-local-sqlite")
+		Expect(err).ToNot(HaveOccurred())
+		s = open()
+	})
+
+	AfterEach(func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	reserve := func(id, addr string) {
+		reserved, _, err := s.Reserve(id, net.ParseIP(addr))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	}
+
+	It("reserves an IP only once", func() {
+		reserve("id1", "10.0.0.2")
+		reserved, _, err := s.Reserve("id2", net.ParseIP("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+	})
+
+	It("returns the latest reservation of each family", func() {
+		reserve("id1", "10.0.0.2")
+		reserve("id1", "fd00::2")
+		reserve("id2", "10.0.0.5")
+
+		last, err := s.LastReservedIP("", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.5"))
+		last, err = s.LastReservedIP("", true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("fd00::2"))
+	})
+
+	It("prefers the last reserved IP recorded for a range", func() {
+		reserve("id1", "10.0.0.5")
+		Expect(s.SetLastReservedIP("a", net.ParseIP("10.0.1.7"))).To(Succeed())
+		Expect(s.SetLastReservedIP("a", net.ParseIP("10.0.1.8"))).To(Succeed())
+
+		last, err := s.LastReservedIP("a", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.1.8"))
+		last, err = s.LastReservedIP("b", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.5"))
+	})
+
+	It("releases by ID and by IP", func() {
+		reserve("id1", "10.0.0.2")
+		reserve("id1", "10.0.0.3")
+		reserve("id2", "10.0.0.4")
+
+		Expect(s.ReleaseByIP("id2", net.ParseIP("10.0.0.2"))).To(MatchError("10.0.0.2 is not reserved by container id2"))
+		Expect(s.ReleaseByIP("id2", net.ParseIP("10.0.0.9"))).To(MatchError("10.0.0.9 is not reserved"))
+		Expect(s.ReleaseByIP("id2", net.ParseIP("10.0.0.4"))).To(Succeed())
+
+		ips, err := s.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+
+		Expect(s.ReleaseByID("id1")).To(Succeed())
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+	})
+
+	It("moves an IP only from its holder", func() {
+		reserve("id1", "10.0.0.2")
+
+		moved, err := s.ChangeOwner(net.ParseIP("10.0.0.2"), "id2", "id3")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeFalse())
+		moved, err = s.ChangeOwner(net.ParseIP("10.0.0.2"), "id1", "id2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(moved).To(BeTrue())
+
+		ips, err := s.GetByID("id2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("releases reservations made before the cutoff", func() {
+		reserve("id1", "10.0.0.2")
+		cutoff := time.Now()
+		time.Sleep(time.Millisecond)
+		reserve("id2", "10.0.0.3")
+
+		freed, err := s.ReleaseExpired(cutoff)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(HaveLen(1))
+		Expect(freed[0].String()).To(Equal("10.0.0.2"))
+
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(1))
+		Expect(list[0].ID).To(Equal("id2"))
+	})
+
+	It("never expires pre-reserved IPs", func() {
+		reserve(backend.PreReservedID, "10.0.0.2")
+
+		freed, err := s.ReleaseExpired(time.Now().Add(time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(freed).To(BeEmpty())
+		list, err := s.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(1))
+	})
+
+	It("keeps a high-water mark per family", func() {
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.5"))).To(Succeed())
+		Expect(s.SetHighWaterMark(net.ParseIP("10.0.0.9"))).To(Succeed())
+		mark, err := s.HighWaterMark(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark.String()).To(Equal("10.0.0.9"))
+		mark, err = s.HighWaterMark(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mark).To(BeNil())
+	})
+
+	It("keeps a stack of freed IPs per family", func() {
+		ip, err := s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		for _, addr := range []string{"10.0.0.2", "10.0.0.3", "fd00::2", "10.0.0.2"} {
+			Expect(s.PushFreed(net.ParseIP(addr))).To(Succeed())
+		}
+		// 10.0.0.2 was pushed twice and only moved to the top
+		for _, expected := range []string{"10.0.0.2", "10.0.0.3"} {
+			ip, err := s.PopFreed(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal(expected))
+		}
+		ip, err = s.PopFreed(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(BeNil())
+
+		ip, err = s.PopFreed(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.String()).To(Equal("fd00::2"))
+	})
+
+	It("keeps reservations across reopening", func() {
+		reserve("id1", "10.0.0.2")
+		other := open()
+		defer other.Close()
+		ips, err := other.GetByID("id1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("never lets concurrent reservers grab the same IP", func() {
+		const reservers = 4
+		const addrs = 50
+
+		var wg sync.WaitGroup
+		won := make([][]string, reservers)
+		for i := 0; i < reservers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				store := open()
+				defer store.Close()
+				id := fmt.Sprintf("id%d", i)
+				for j := 0; j < addrs; j++ {
+					ip := net.IPv4(10, 0, 0, byte(j+2))
+					reserved, _, err := store.Reserve(id, ip)
+					Expect(err).ToNot(HaveOccurred())
+					if reserved {
+						won[i] = append(won[i], ip.String())
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		owners := map[string]int{}
+		for _, ips := range won {
+			for _, ip := range ips {
+				owners[ip]++
+			}
+		}
+		Expect(owners).To(HaveLen(addrs))
+		for ip, n := range owners {
+			Expect(n).To(Equal(1), ip)
+		}
+	})
+})
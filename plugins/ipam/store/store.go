@@ -14,14 +14,246 @@
 
 package backend
 
-import "net"
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+)
 
 type Store interface {
 	Lock() error
 	Unlock() error
 	Close() error
-	Reserve(id string, ip net.IP) (bool, error)
-	LastReservedIP() (net.IP, error)
+	// Reserve reserves ip for the container with given ID. It returns
+	// true if the IP is newly reserved or already held by the same
+	// container, so that a retried request succeeds, and false along
+	// with the ID of the owner if it is held by another container. The
+	// owner is empty if the IP was released while being looked up.
+	Reserve(id string, ip net.IP) (bool, string, error)
+	// LastReservedIP returns the last IP recorded for the ranges with
+	// given ID through SetLastReservedIP, so that allocators scanning
+	// different ranges of one store each resume where they left off.
+	// If none was recorded it falls back to the last IP reserved from
+	// the given address family.
+	LastReservedIP(rangeID string, v6 bool) (net.IP, error)
+	// SetLastReservedIP records ip as the last IP handed out from the
+	// ranges with given ID
+	SetLastReservedIP(rangeID string, ip net.IP) error
+	// HighWaterMark returns the furthest IP of the given address family
+	// handed out in the current pass of the round-robin allocator, or
+	// nil if none was recorded
+	HighWaterMark(v6 bool) (net.IP, error)
+	// SetHighWaterMark records ip as the high-water mark of its family
+	SetHighWaterMark(ip net.IP) error
+	// PushFreed records ip as the most recently freed IP of its family
+	// for the "lifo" reuse mode, moving it to the top should it already
+	// be recorded
+	PushFreed(ip net.IP) error
+	// PopFreed removes and returns the most recently freed IP of the
+	// given address family, or nil if there is none
+	PopFreed(v6 bool) (net.IP, error)
 	Release(ip net.IP) error
 	ReleaseByID(id string) error
+	ReleaseByIP(id string, ip net.IP) error
+	GetByID(id string) ([]net.IP, error)
+	// ChangeOwner moves the reservation of ip from the container with
+	// ID from to the one with ID to in a single step, so that no other
+	// container can reserve ip in between, and stamps it with the
+	// current time. It returns false if ip is not reserved by from.
+	ChangeOwner(ip net.IP, from, to string) (bool, error)
+	// ReleaseExpired releases the reservations made before the given
+	// time and returns the freed IPs. Pre-reserved IPs never expire.
+	ReleaseExpired(before time.Time) ([]net.IP, error)
+	// List returns every reservation in the store. It does not require
+	// the store lock, so readers such as a metrics exporter may see a
+	// reservation that is being made or released concurrently.
+	List() ([]Reservation, error)
+}
+
+// Index is implemented by stores that keep the set of reserved IPs in
+// memory, so that a scan can pass over taken IPs without calling
+// Reserve on each of them. The set may lag behind reservations made
+// and released by other processes: an IP reported as free can still
+// fail to reserve, and one reported as reserved may have been released
+// since the set was last refreshed.
+type Index interface {
+	// IsReserved reports whether ip is reserved according to the set
+	IsReserved(ip net.IP) (bool, error)
+	// RefreshIndex rebuilds the set from the store
+	RefreshIndex() error
+	// ReservedIPs returns the IPs in the set
+	ReservedIPs() ([]net.IP, error)
+}
+
+// Lookup is implemented by stores that can look up the reservation of a
+// single IP without the store lock or a List of every reservation
+type Lookup interface {
+	// Owner returns the ID of the container holding ip, or "" if ip is
+	// not reserved
+	Owner(ip net.IP) (string, error)
+}
+
+// Clearer is implemented by stores that can be wiped, as done for a
+// network under test or being recovered from scratch
+type Clearer interface {
+	// Clear removes every reservation along with the last reserved IPs,
+	// high-water marks and freed IPs recorded for the scans, so that
+	// allocation starts over as in a new store. It returns the number
+	// of reservations removed and must be called under the store lock.
+	Clear() (int, error)
+}
+
+// Owner returns the ID of the container holding ip in s, or "" if ip is
+// not reserved. It does not take the store lock; stores that do not
+// implement Lookup are searched through List.
+func Owner(s Store, ip net.IP) (string, error) {
+	if l, ok := s.(Lookup); ok {
+		return l.Owner(ip)
+	}
+	list, err := s.List()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range list {
+		if r.IP.Equal(ip) {
+			return r.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// PreReservedID is the container ID that holds the IPs listed under
+// "preReserved", which are in use outside of CNI
+const PreReservedID = "__reserved__"
+
+// GraceID returns the ID that holds the IPs released by the container
+// with given ID during the "releaseGracePeriod", so that only that
+// container can reserve them again
+func GraceID(id string) string {
+	return gracePrefix + id
+}
+
+const gracePrefix = "__grace__/"
+
+// PendingID returns the ID that holds the IPs reserved for the container
+// with given ID until they are confirmed, as done when "confirmTTL" is
+// set
+func PendingID(id string) string {
+	return pendingPrefix + id
+}
+
+const pendingPrefix = "__pending__/"
+
+// Reservation is an IP held by the container with the given ID
+type Reservation struct {
+	IP net.IP
+	ID string
+	// ReservedAt is when the reservation was made, or the zero time if
+	// the store has no record of it
+	ReservedAt time.Time
+	// Label describes the workload the IP was reserved for, such as
+	// the namespace and name of a pod, if the store records one
+	Label string
+}
+
+// PreReserved reports whether r was made from the "preReserved" list
+// rather than for a container
+func (r Reservation) PreReserved() bool {
+	return r.ID == PreReservedID
+}
+
+// GraceOwner returns the ID of the container that released the IP of r
+// if r holds it during the grace period
+func (r Reservation) GraceOwner() (string, bool) {
+	if !strings.HasPrefix(r.ID, gracePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(r.ID, gracePrefix), true
+}
+
+// PendingOwner returns the ID of the container the IP of r is reserved
+// for if the reservation has not been confirmed yet
+func (r Reservation) PendingOwner() (string, bool) {
+	if !strings.HasPrefix(r.ID, pendingPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(r.ID, pendingPrefix), true
+}
+
+// ReleaseStale releases every reservation made before the given time
+// and returns them. Pre-reserved IPs and reservations without a
+// recorded time are kept. The caller must hold the store lock.
+func ReleaseStale(s Store, before time.Time) ([]Reservation, error) {
+	list, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var released []Reservation
+	for _, r := range list {
+		if r.PreReserved() || r.ReservedAt.IsZero() || !r.ReservedAt.Before(before) {
+			continue
+		}
+		if err := s.ReleaseByIP(r.ID, r.IP); err != nil {
+			return released, err
+		}
+		released = append(released, r)
+	}
+	return released, nil
+}
+
+// ReserveBlock reserves all of ips for the container with given ID, or
+// none of them: if any IP is taken or fails to reserve, the IPs reserved
+// so far are released again. None of ips may already be held by the
+// container, as they would be released too. The caller must hold the
+// store lock.
+func ReserveBlock(s Store, id string, ips []net.IP) (bool, error) {
+	for i, ip := range ips {
+		reserved, _, err := s.Reserve(id, ip)
+		if err == nil && reserved {
+			continue
+		}
+		for _, r := range ips[:i] {
+			if rerr := s.Release(r); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoveIP returns ips without any occurrence of ip, reusing the backing
+// array of ips. It helps stores keep their freed IPs free of duplicates.
+func RemoveIP(ips []net.IP, ip net.IP) []net.IP {
+	kept := ips[:0]
+	for _, cur := range ips {
+		if !cur.Equal(ip) {
+			kept = append(kept, cur)
+		}
+	}
+	return kept
+}
+
+// FormatIPs encodes ips one per line, for stores that keep a list of
+// IPs such as the freed IPs of the "lifo" reuse mode in a single value
+func FormatIPs(ips []net.IP) []byte {
+	var buf bytes.Buffer
+	for _, ip := range ips {
+		buf.WriteString(ip.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// ParseIPs decodes a list written by FormatIPs, skipping lines that do
+// not hold an IP
+func ParseIPs(data []byte) []net.IP {
+	var ips []net.IP
+	for _, line := range strings.Split(string(data), "\n") {
+		if ip := net.ParseIP(strings.TrimSpace(line)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
 }
@@ -15,16 +15,40 @@
 package testing
 
 import (
+	"fmt"
 	"net"
+	"time"
+
+	"github.com/containernetworking/cni/plugins/ipam/store"
 )
 
 type FakeStore struct {
 	ipMap          map[string]string
-	lastReservedIP net.IP
+	reservedAt     map[string]time.Time
+	lastReservedIP map[bool]net.IP
+	lastInRange    map[string]net.IP
+	highWaterMark  map[bool]net.IP
+	freed          map[bool][]net.IP
+	labels         map[string]string
 }
 
 func NewFakeStore(ipmap map[string]string, lastIP net.IP) *FakeStore {
-	return &FakeStore{ipmap, lastIP}
+	last := map[bool]net.IP{}
+	if lastIP != nil {
+		last[lastIP.To4() == nil] = lastIP
+	}
+	return &FakeStore{ipmap, map[string]time.Time{}, last, map[string]net.IP{}, map[bool]net.IP{}, map[bool][]net.IP{}, map[string]string{}}
+}
+
+// SetReservedAt overrides the reservation time of ip. Reservations
+// passed to NewFakeStore have no time and never expire.
+func (s *FakeStore) SetReservedAt(ip net.IP, t time.Time) {
+	s.reservedAt[ip.String()] = t
+}
+
+// SetLabel records label with the reservation of ip
+func (s *FakeStore) SetLabel(ip net.IP, label string) {
+	s.labels[ip.String()] = label
 }
 
 func (s *FakeStore) Lock() error {
@@ -39,22 +63,57 @@ func (s *FakeStore) Close() error {
 	return nil
 }
 
-func (s *FakeStore) Reserve(id string, ip net.IP) (bool, error) {
+func (s *FakeStore) Reserve(id string, ip net.IP) (bool, string, error) {
 	key := ip.String()
 	if _, ok := s.ipMap[key]; !ok {
 		s.ipMap[key] = id
-		s.lastReservedIP = ip
-		return true, nil
+		s.reservedAt[key] = time.Now()
+		s.lastReservedIP[ip.To4() == nil] = ip
+		return true, id, nil
 	}
-	return false, nil
+	return s.ipMap[key] == id, s.ipMap[key], nil
 }
 
-func (s *FakeStore) LastReservedIP() (net.IP, error) {
-	return s.lastReservedIP, nil
+func (s *FakeStore) LastReservedIP(rangeID string, v6 bool) (net.IP, error) {
+	if ip, ok := s.lastInRange[rangeID]; ok {
+		return ip, nil
+	}
+	return s.lastReservedIP[v6], nil
+}
+
+func (s *FakeStore) SetLastReservedIP(rangeID string, ip net.IP) error {
+	s.lastInRange[rangeID] = ip
+	return nil
+}
+
+func (s *FakeStore) HighWaterMark(v6 bool) (net.IP, error) {
+	return s.highWaterMark[v6], nil
+}
+
+func (s *FakeStore) SetHighWaterMark(ip net.IP) error {
+	s.highWaterMark[ip.To4() == nil] = ip
+	return nil
+}
+
+func (s *FakeStore) PushFreed(ip net.IP) error {
+	v6 := ip.To4() == nil
+	s.freed[v6] = append(backend.RemoveIP(s.freed[v6], ip), ip)
+	return nil
+}
+
+func (s *FakeStore) PopFreed(v6 bool) (net.IP, error) {
+	stack := s.freed[v6]
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	s.freed[v6] = stack[:len(stack)-1]
+	return stack[len(stack)-1], nil
 }
 
 func (s *FakeStore) Release(ip net.IP) error {
 	delete(s.ipMap, ip.String())
+	delete(s.reservedAt, ip.String())
+	delete(s.labels, ip.String())
 	return nil
 }
 
@@ -67,6 +126,83 @@ func (s *FakeStore) ReleaseByID(id string) error {
 	}
 	for _, ip := range toDelete {
 		delete(s.ipMap, ip)
+		delete(s.reservedAt, ip)
+		delete(s.labels, ip)
+	}
+	return nil
+}
+
+func (s *FakeStore) ReleaseByIP(id string, ip net.IP) error {
+	key := ip.String()
+	owner, ok := s.ipMap[key]
+	if !ok {
+		return fmt.Errorf("%s is not reserved", ip)
+	}
+	if owner != id {
+		return fmt.Errorf("%s is not reserved by container %s", ip, id)
 	}
+	delete(s.ipMap, key)
+	delete(s.reservedAt, key)
+	delete(s.labels, key)
 	return nil
 }
+
+func (s *FakeStore) GetByID(id string) ([]net.IP, error) {
+	var ips []net.IP
+	for k, v := range s.ipMap {
+		if v == id {
+			ips = append(ips, net.ParseIP(k))
+		}
+	}
+	return ips, nil
+}
+
+func (s *FakeStore) ChangeOwner(ip net.IP, from, to string) (bool, error) {
+	key := ip.String()
+	if owner, ok := s.ipMap[key]; !ok || owner != from {
+		return false, nil
+	}
+	s.ipMap[key] = to
+	s.reservedAt[key] = time.Now()
+	return true, nil
+}
+
+func (s *FakeStore) ReleaseExpired(before time.Time) ([]net.IP, error) {
+	var freed []net.IP
+	for k, t := range s.reservedAt {
+		if id, ok := s.ipMap[k]; ok && id != backend.PreReservedID && t.Before(before) {
+			delete(s.ipMap, k)
+			delete(s.reservedAt, k)
+			delete(s.labels, k)
+			freed = append(freed, net.ParseIP(k))
+		}
+	}
+	return freed, nil
+}
+
+func (s *FakeStore) Clear() (int, error) {
+	n := len(s.ipMap)
+	// tests hold on to the map passed to NewFakeStore
+	for k := range s.ipMap {
+		delete(s.ipMap, k)
+	}
+	s.reservedAt = map[string]time.Time{}
+	s.lastReservedIP = map[bool]net.IP{}
+	s.lastInRange = map[string]net.IP{}
+	s.highWaterMark = map[bool]net.IP{}
+	s.freed = map[bool][]net.IP{}
+	s.labels = map[string]string{}
+	return n, nil
+}
+
+func (s *FakeStore) Owner(ip net.IP) (string, error) {
+	return s.ipMap[ip.String()], nil
+}
+
+func (s *FakeStore) List() ([]backend.Reservation, error) {
+	var list []backend.Reservation
+	for k, v := range s.ipMap {
+		list = append(list, backend.Reservation{IP: net.ParseIP(k), ID: v, ReservedAt: s.reservedAt[k], Label: s.labels[k]})
+	}
+	return list, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"math"
+	"time"
+)
+
+// Throttler is implemented by stores that keep an allocation rate limit
+// shared by every plugin invocation on the store
+type Throttler interface {
+	// TakeToken takes a token from a bucket that refills at rate tokens
+	// per second up to burst tokens, and returns how long the caller
+	// must wait before allocating. If a positive maxWait would be
+	// exceeded, no token is taken and false is returned.
+	TakeToken(rate float64, burst int, maxWait time.Duration, now time.Time) (time.Duration, bool, error)
+}
+
+// TokenBucket is the state of a Throttler. Tokens drops below zero
+// while callers wait for tokens that have not been refilled yet, so
+// that each caller waits behind those that came before it.
+type TokenBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket up to now and takes a token from it. It
+// returns the new state of the bucket along with the time the caller
+// must wait; if that would exceed a positive maxWait, the bucket is
+// returned unchanged along with false. A zero bucket starts out full.
+func (b TokenBucket) Take(rate float64, burst int, maxWait time.Duration, now time.Time) (TokenBucket, time.Duration, bool) {
+	tokens := float64(burst)
+	if !b.Updated.IsZero() {
+		elapsed := now.Sub(b.Updated).Seconds()
+		if elapsed < 0 {
+			// the clock went backwards
+			elapsed = 0
+		}
+		tokens = math.Min(tokens, b.Tokens+elapsed*rate)
+	}
+	tokens--
+
+	var wait time.Duration
+	if tokens < 0 {
+		wait = time.Duration(-tokens / rate * float64(time.Second))
+	}
+	if maxWait > 0 && wait > maxWait {
+		return b, wait, false
+	}
+	return TokenBucket{tokens, now}, wait, true
+}